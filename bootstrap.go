@@ -0,0 +1,28 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"ipfs-identity/handler"
+	"ipfs-identity/logger"
+)
+
+// runBootstrapAdmin implements the `bootstrap-admin <username>` command: it
+// gives the admin role to username, creating the account with the password in
+// ADMIN_PASSWORD if it does not exist. It only works while there is no admin
+// yet. Run it while the server is stopped.
+func runBootstrapAdmin(log logger.Logger, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: bootstrap-admin <username>")
+	}
+	id, err := handler.Manager().BootstrapAdmin(context.Background(), args[0], os.Getenv("ADMIN_PASSWORD"))
+	if err != nil {
+		return fmt.Errorf("bootstrap failed: %w", err)
+	}
+	log.Info(fmt.Sprintf("User %s (%s) is now an admin", args[0], id))
+	fmt.Printf("%s is now an admin: %s\n", args[0], id)
+	return nil
+}
@@ -0,0 +1,185 @@
+// Package did builds and resolves W3C decentralized identifiers for the
+// did:key and did:web methods. It does not depend on the rest of the service,
+// so other Go programs can import it to resolve the DIDs this server issues.
+package did
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// JSON-LD contexts of the documents built by this package.
+const (
+	ContextDID      = "https://www.w3.org/ns/did/v1"
+	ContextMultikey = "https://w3id.org/security/multikey/v1"
+	ContextJWK      = "https://w3id.org/security/suites/jws-2020/v1"
+)
+
+// Document is a DID document.
+type Document struct {
+	Context            []string             `json:"@context"`
+	ID                 string               `json:"id"`
+	AlsoKnownAs        []string             `json:"alsoKnownAs,omitempty"`
+	Controller         string               `json:"controller,omitempty"`
+	VerificationMethod []VerificationMethod `json:"verificationMethod"`
+	Authentication     []string             `json:"authentication,omitempty"`
+	AssertionMethod    []string             `json:"assertionMethod,omitempty"`
+}
+
+// UnmarshalJSON accepts the forms documents of other methods use as well:
+// a single @context string, and verification methods embedded in
+// authentication and assertionMethod rather than referenced by ID. Embedded
+// methods are moved to VerificationMethod.
+func (d *Document) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		Context            json.RawMessage      `json:"@context"`
+		ID                 string               `json:"id"`
+		AlsoKnownAs        []string             `json:"alsoKnownAs"`
+		Controller         json.RawMessage      `json:"controller"`
+		VerificationMethod []VerificationMethod `json:"verificationMethod"`
+		Authentication     []json.RawMessage    `json:"authentication"`
+		AssertionMethod    []json.RawMessage    `json:"assertionMethod"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	*d = Document{ID: raw.ID, AlsoKnownAs: raw.AlsoKnownAs, VerificationMethod: raw.VerificationMethod}
+	if err := unmarshalStrings(raw.Context, &d.Context); err != nil {
+		return fmt.Errorf("did: malformed @context: %w", err)
+	}
+	var controllers []string
+	if err := unmarshalStrings(raw.Controller, &controllers); err != nil {
+		return fmt.Errorf("did: malformed controller: %w", err)
+	}
+	if len(controllers) > 0 {
+		d.Controller = controllers[0]
+	}
+	var err error
+	if d.Authentication, err = d.references(raw.Authentication); err != nil {
+		return err
+	}
+	d.AssertionMethod, err = d.references(raw.AssertionMethod)
+	return err
+}
+
+// references returns the IDs of a verification relationship, moving embedded
+// methods into d.VerificationMethod.
+func (d *Document) references(entries []json.RawMessage) ([]string, error) {
+	var refs []string
+	for _, entry := range entries {
+		var ref string
+		if json.Unmarshal(entry, &ref) == nil {
+			refs = append(refs, ref)
+			continue
+		}
+		var vm VerificationMethod
+		if err := json.Unmarshal(entry, &vm); err != nil || vm.ID == "" {
+			return nil, errors.New("did: malformed verification relationship")
+		}
+		d.VerificationMethod = append(d.VerificationMethod, vm)
+		refs = append(refs, vm.ID)
+	}
+	return refs, nil
+}
+
+// unmarshalStrings decodes a string or an array of strings; JSON-LD context
+// objects in the array are skipped.
+func unmarshalStrings(data json.RawMessage, list *[]string) error {
+	if len(data) == 0 || string(data) == "null" {
+		return nil
+	}
+	var one string
+	if json.Unmarshal(data, &one) == nil {
+		*list = []string{one}
+		return nil
+	}
+	var many []interface{}
+	if err := json.Unmarshal(data, &many); err != nil {
+		return err
+	}
+	for _, item := range many {
+		if s, ok := item.(string); ok {
+			*list = append(*list, s)
+		}
+	}
+	return nil
+}
+
+// VerificationMethod is a public key listed in a DID document. Keys are given
+// either as a Multikey or as a JSON Web Key.
+type VerificationMethod struct {
+	ID                 string            `json:"id"`
+	Type               string            `json:"type"` // Multikey or JsonWebKey2020
+	Controller         string            `json:"controller"`
+	PublicKeyMultibase string            `json:"publicKeyMultibase,omitempty"`
+	PublicKeyJWK       map[string]string `json:"publicKeyJwk,omitempty"`
+}
+
+// VerificationMethodByID returns the method with the given ID, which may be a
+// full DID URL or a fragment such as "#key-1".
+func (d *Document) VerificationMethodByID(id string) (VerificationMethod, bool) {
+	if strings.HasPrefix(id, "#") {
+		id = d.ID + id
+	}
+	for _, vm := range d.VerificationMethod {
+		if vm.ID == id || (strings.HasPrefix(vm.ID, "#") && d.ID+vm.ID == id) {
+			return vm, true
+		}
+	}
+	return VerificationMethod{}, false
+}
+
+// Authenticates reports whether the method with the given ID may be used to
+// authenticate as the DID subject.
+func (d *Document) Authenticates(id string) bool {
+	return d.hasReference(d.Authentication, id)
+}
+
+// Asserts reports whether the method with the given ID may be used to issue
+// assertions, such as verifiable credentials, for the DID subject.
+func (d *Document) Asserts(id string) bool {
+	return d.hasReference(d.AssertionMethod, id)
+}
+
+func (d *Document) hasReference(refs []string, id string) bool {
+	if strings.HasPrefix(id, "#") {
+		id = d.ID + id
+	}
+	for _, ref := range refs {
+		if ref == id || (strings.HasPrefix(ref, "#") && d.ID+ref == id) {
+			return true
+		}
+	}
+	return false
+}
+
+// Ed25519PublicKey returns the key of an Ed25519 verification method.
+func (vm VerificationMethod) Ed25519PublicKey() (ed25519.PublicKey, error) {
+	switch {
+	case vm.PublicKeyMultibase != "":
+		return DecodeMultikey(vm.PublicKeyMultibase)
+	case vm.PublicKeyJWK != nil:
+		return ParsePublicJWK(vm.PublicKeyJWK)
+	}
+	return nil, fmt.Errorf("did: verification method %s has no public key", vm.ID)
+}
+
+// Method returns the method name of a DID, such as "key" for did:key:z6Mk...
+func Method(id string) (string, error) {
+	parts := strings.SplitN(id, ":", 3)
+	if len(parts) != 3 || parts[0] != "did" || parts[1] == "" || parts[2] == "" {
+		return "", fmt.Errorf("did: %q is not a DID", id)
+	}
+	return parts[1], nil
+}
+
+// SplitURL splits a DID URL into the DID and its fragment, without the "#".
+func SplitURL(url string) (string, string) {
+	if i := strings.IndexByte(url, '#'); i >= 0 {
+		return url[:i], url[i+1:]
+	}
+	return url, ""
+}
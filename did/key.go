@@ -0,0 +1,120 @@
+package did
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/multiformats/go-multibase"
+)
+
+// ed25519PubCodec is the multicodec prefix of an Ed25519 public key, the
+// varint encoding of 0xed.
+var ed25519PubCodec = []byte{0xed, 0x01}
+
+// EncodeMultikey returns the base58btc Multikey form of an Ed25519 public key,
+// as used in publicKeyMultibase and did:key identifiers ("z6Mk...").
+func EncodeMultikey(pub ed25519.PublicKey) string {
+	s, _ := multibase.Encode(multibase.Base58BTC, append(append([]byte{}, ed25519PubCodec...), pub...))
+	return s
+}
+
+// DecodeMultikey parses a base58btc Ed25519 Multikey.
+func DecodeMultikey(s string) (ed25519.PublicKey, error) {
+	enc, data, err := multibase.Decode(s)
+	if err != nil || enc != multibase.Base58BTC {
+		return nil, errors.New("did: key is not base58btc multibase")
+	}
+	if !bytes.HasPrefix(data, ed25519PubCodec) || len(data) != len(ed25519PubCodec)+ed25519.PublicKeySize {
+		return nil, errors.New("did: only Ed25519 multikeys are supported")
+	}
+	return ed25519.PublicKey(data[len(ed25519PubCodec):]), nil
+}
+
+// KeyDID returns the did:key identifier of an Ed25519 public key.
+func KeyDID(pub ed25519.PublicKey) string {
+	return "did:key:" + EncodeMultikey(pub)
+}
+
+// KeyDocument expands a did:key identifier into its DID document. No network
+// access is needed: the document is derived from the key in the identifier.
+func KeyDocument(id string) (*Document, error) {
+	if !strings.HasPrefix(id, "did:key:") {
+		return nil, fmt.Errorf("did: %q is not a did:key", id)
+	}
+	multikey := strings.TrimPrefix(id, "did:key:")
+	if _, err := DecodeMultikey(multikey); err != nil {
+		return nil, err
+	}
+	vm := id + "#" + multikey
+	return &Document{
+		Context: []string{ContextDID, ContextMultikey},
+		ID:      id,
+		VerificationMethod: []VerificationMethod{{
+			ID:                 vm,
+			Type:               "Multikey",
+			Controller:         id,
+			PublicKeyMultibase: multikey,
+		}},
+		Authentication:  []string{vm},
+		AssertionMethod: []string{vm},
+	}, nil
+}
+
+// PrivateJWK returns an Ed25519 private key as a JSON Web Key, the form in
+// which keys are handed to their owners.
+func PrivateJWK(key ed25519.PrivateKey) map[string]string {
+	pub := key.Public().(ed25519.PublicKey)
+	return map[string]string{
+		"kty": "OKP",
+		"crv": "Ed25519",
+		"x":   base64.RawURLEncoding.EncodeToString(pub),
+		"d":   base64.RawURLEncoding.EncodeToString(key.Seed()),
+	}
+}
+
+// PublicJWK returns an Ed25519 public key as a JSON Web Key.
+func PublicJWK(pub ed25519.PublicKey) map[string]string {
+	return map[string]string{
+		"kty": "OKP",
+		"crv": "Ed25519",
+		"x":   base64.RawURLEncoding.EncodeToString(pub),
+	}
+}
+
+// ParsePublicJWK parses an Ed25519 public JSON Web Key.
+func ParsePublicJWK(jwk map[string]string) (ed25519.PublicKey, error) {
+	if jwk["kty"] != "OKP" || jwk["crv"] != "Ed25519" {
+		return nil, errors.New("did: JWK is not an Ed25519 key")
+	}
+	return decodeJWKEd25519(jwk["x"])
+}
+
+// ParsePrivateJWK parses an Ed25519 private JSON Web Key, as returned by
+// PrivateJWK.
+func ParsePrivateJWK(jwk map[string]string) (ed25519.PrivateKey, error) {
+	pub, err := ParsePublicJWK(jwk)
+	if err != nil {
+		return nil, err
+	}
+	seed, err := base64.RawURLEncoding.DecodeString(jwk["d"])
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, errors.New("did: malformed Ed25519 private JWK")
+	}
+	key := ed25519.NewKeyFromSeed(seed)
+	if !pub.Equal(key.Public()) {
+		return nil, errors.New("did: JWK private key does not match its public key")
+	}
+	return key, nil
+}
+
+func decodeJWKEd25519(x string) (ed25519.PublicKey, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(x)
+	if err != nil || len(raw) != ed25519.PublicKeySize {
+		return nil, errors.New("did: malformed Ed25519 JWK")
+	}
+	return ed25519.PublicKey(raw), nil
+}
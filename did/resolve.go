@@ -0,0 +1,185 @@
+package did
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Resolver resolves a DID to its document.
+type Resolver interface {
+	Resolve(ctx context.Context, id string) (*Document, error)
+}
+
+// KeyResolver resolves did:key identifiers offline.
+type KeyResolver struct{}
+
+// Resolve implements Resolver.
+func (KeyResolver) Resolve(ctx context.Context, id string) (*Document, error) {
+	return KeyDocument(id)
+}
+
+// WebResolver resolves did:web identifiers by fetching their documents over
+// HTTPS.
+type WebResolver struct {
+	Client *http.Client // http.DefaultClient if nil
+}
+
+// maxDocumentSize bounds the DID documents WebResolver reads.
+const maxDocumentSize = 1 << 20
+
+// Resolve implements Resolver.
+func (r WebResolver) Resolve(ctx context.Context, id string) (*Document, error) {
+	docURL, err := WebURL(id)
+	if err != nil {
+		return nil, err
+	}
+	client := r.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, docURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/did+json, application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("did: failed to fetch %s: %w", docURL, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("did: fetching %s returned %s", docURL, resp.Status)
+	}
+	var doc Document
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxDocumentSize)).Decode(&doc); err != nil {
+		return nil, fmt.Errorf("did: malformed document at %s: %w", docURL, err)
+	}
+	if doc.ID != id {
+		return nil, fmt.Errorf("did: document at %s is for %s", docURL, doc.ID)
+	}
+	return &doc, nil
+}
+
+// MethodResolver dispatches to a Resolver per DID method. The entry "*", if
+// present, handles every method without its own entry.
+type MethodResolver map[string]Resolver
+
+// Resolve implements Resolver.
+func (m MethodResolver) Resolve(ctx context.Context, id string) (*Document, error) {
+	method, err := Method(id)
+	if err != nil {
+		return nil, err
+	}
+	r, ok := m[method]
+	if !ok {
+		if r, ok = m["*"]; !ok {
+			return nil, fmt.Errorf("did: method %q is not supported", method)
+		}
+	}
+	return r.Resolve(ctx, id)
+}
+
+// UniversalResolver resolves DIDs of any method through a DIF Universal
+// Resolver, such as https://dev.uniresolver.io.
+type UniversalResolver struct {
+	URL    string       // Base URL; identifiers are fetched from URL/1.0/identifiers/<did>
+	Client *http.Client // http.DefaultClient if nil
+}
+
+// Resolve implements Resolver.
+func (r UniversalResolver) Resolve(ctx context.Context, id string) (*Document, error) {
+	if _, err := Method(id); err != nil {
+		return nil, err
+	}
+	client := r.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resolveURL := strings.TrimSuffix(r.URL, "/") + "/1.0/identifiers/" + url.PathEscape(id)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, resolveURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", `application/ld+json;profile="https://w3id.org/did-resolution", application/did+json`)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("did: failed to resolve %s: %w", id, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("did: resolving %s returned %s", id, resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxDocumentSize))
+	if err != nil {
+		return nil, err
+	}
+	// The resolver answers with either a resolution result wrapping the
+	// document or the bare document, depending on what it negotiated.
+	var result struct {
+		DIDDocument json.RawMessage `json:"didDocument"`
+	}
+	if json.Unmarshal(data, &result) == nil && len(result.DIDDocument) > 0 && string(result.DIDDocument) != "null" {
+		data = result.DIDDocument
+	}
+	var doc Document
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("did: malformed document for %s: %w", id, err)
+	}
+	if doc.ID != id {
+		return nil, fmt.Errorf("did: resolver returned the document of %s", doc.ID)
+	}
+	return &doc, nil
+}
+
+// DefaultResolver resolves did:key offline and did:web over HTTPS.
+var DefaultResolver Resolver = MethodResolver{
+	"key": KeyResolver{},
+	"web": WebResolver{Client: &http.Client{Timeout: 10 * time.Second}},
+}
+
+// Resolve resolves id with DefaultResolver.
+func Resolve(ctx context.Context, id string) (*Document, error) {
+	return DefaultResolver.Resolve(ctx, id)
+}
+
+// WebDID returns the did:web identifier for a domain, which may include a
+// port, and an optional path. WebDID("example.com", "users", "42") is
+// did:web:example.com:users:42.
+func WebDID(domain string, path ...string) string {
+	parts := []string{"did:web", strings.ReplaceAll(domain, ":", "%3A")}
+	for _, p := range path {
+		parts = append(parts, url.PathEscape(p))
+	}
+	return strings.Join(parts, ":")
+}
+
+// WebURL returns the URL the document of a did:web identifier is served at.
+func WebURL(id string) (string, error) {
+	if !strings.HasPrefix(id, "did:web:") {
+		return "", fmt.Errorf("did: %q is not a did:web", id)
+	}
+	parts := strings.Split(strings.TrimPrefix(id, "did:web:"), ":")
+	host, err := url.PathUnescape(parts[0])
+	if err != nil || host == "" || strings.ContainsAny(host, "/?#@") {
+		return "", fmt.Errorf("did: malformed did:web %q", id)
+	}
+	scheme := "https"
+	if h := strings.Split(host, ":")[0]; h == "localhost" || h == "127.0.0.1" {
+		scheme = "http" // Local development only
+	}
+	if len(parts) == 1 {
+		return scheme + "://" + host + "/.well-known/did.json", nil
+	}
+	for _, p := range parts[1:] {
+		if p == "" || p == "." || p == ".." {
+			return "", fmt.Errorf("did: malformed did:web %q", id)
+		}
+	}
+	return scheme + "://" + host + "/" + strings.Join(parts[1:], "/") + "/did.json", nil
+}
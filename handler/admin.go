@@ -0,0 +1,37 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// NetworkHandler handles GET /admin/network and lists the swarm peers and
+// bandwidth of every connected IPFS node.
+func NetworkHandler(w http.ResponseWriter, r *http.Request) {
+	network, err := im.Network(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"endpoints": network})
+}
+
+// MirrorCheckHandler handles GET /admin/mfs/check and compares the MFS mirror
+// with the canonical root CID.
+func MirrorCheckHandler(w http.ResponseWriter, r *http.Request) {
+	cid, problems, err := im.CheckMirror(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	response := map[string]interface{}{
+		"cid":        cid,
+		"consistent": len(problems) == 0,
+		"problems":   problems,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
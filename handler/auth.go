@@ -0,0 +1,120 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"ipfs-identity/logger"
+	"ipfs-identity/util"
+)
+
+// authLog records every authentication and authorization decision.
+var authLog = func() logger.Logger {
+	l, err := logger.NewLogger(logger.NewConfigFromEnv())
+	if err != nil {
+		log.Fatalf("Failed to initialize logger: %v", err)
+	}
+	return l
+}()
+
+type principalKey struct{}
+
+// PrincipalFrom returns the principal attached to ctx by Authenticate.
+func PrincipalFrom(ctx context.Context) (util.Principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(util.Principal)
+	return p, ok
+}
+
+// Authenticate is middleware that accepts a bearer access token in the
+// Authorization header or an API key in the X-API-Key header, and attaches the
+// caller's principal to the request context. Other requests get 401.
+func Authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var (
+			p   util.Principal
+			err error
+		)
+		if key := r.Header.Get("X-API-Key"); key != "" {
+			p, err = im.AuthenticateAPIKey(key)
+		} else if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+			p, err = im.AuthenticateToken(r.Context(), strings.TrimSpace(token))
+		} else {
+			authLog.Warn(fmt.Sprintf("Unauthenticated %s %s from %s: no credentials", r.Method, r.URL.Path, r.RemoteAddr))
+			w.Header().Set("WWW-Authenticate", `Bearer realm="ipfs-identity"`)
+			http.Error(w, "Authentication required", http.StatusUnauthorized)
+			return
+		}
+		if err != nil {
+			authLog.Warn(fmt.Sprintf("Unauthenticated %s %s from %s: %v", r.Method, r.URL.Path, r.RemoteAddr, err))
+			w.Header().Set("WWW-Authenticate", `Bearer realm="ipfs-identity", error="invalid_token"`)
+			http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+			return
+		}
+
+		authLog.Info(fmt.Sprintf("Authenticated %s for %s %s", p, r.Method, r.URL.Path))
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, p)))
+	})
+}
+
+// authorize lets the request through if allowed, and otherwise replies 403.
+// Both outcomes are logged.
+func authorize(w http.ResponseWriter, r *http.Request, p util.Principal, allowed bool, next http.Handler) {
+	if !allowed {
+		authLog.Warn(fmt.Sprintf("Denied %s %s to %s", r.Method, r.URL.Path, p))
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	authLog.Info(fmt.Sprintf("Allowed %s %s to %s", r.Method, r.URL.Path, p))
+	next.ServeHTTP(w, r)
+}
+
+func isSelf(r *http.Request, p util.Principal) bool {
+	return p.Kind == util.PrincipalUser && p.ID == mux.Vars(r)["id"]
+}
+
+// RequireSelfOr returns middleware for routes with an {id} variable. It lets
+// users act on their own account, and others only if they hold perm and every
+// permission of the account's user. It must run after Authenticate.
+func RequireSelfOr(perm string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			p, _ := PrincipalFrom(r.Context())
+			if isSelf(r, p) || !p.Can(perm) {
+				authorize(w, r, p, isSelf(r, p), next)
+				return
+			}
+			allowed, err := im.CanActOn(r.Context(), p, mux.Vars(r)["id"])
+			if err != nil {
+				writeError(w, err, http.StatusInternalServerError)
+				return
+			}
+			authorize(w, r, p, allowed, next)
+		})
+	}
+}
+
+// RequireSelf is middleware for routes with an {id} variable that bind
+// credentials to the account, such as second factors, passkeys and signing
+// keys. Only the user may use them, since anyone else who could would be able
+// to log in as the user. It must run after Authenticate.
+func RequireSelf(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, _ := PrincipalFrom(r.Context())
+		authorize(w, r, p, isSelf(r, p), next)
+	})
+}
+
+// RequirePermission returns middleware that only lets through principals
+// holding perm. It must run after Authenticate.
+func RequirePermission(perm string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			p, _ := PrincipalFrom(r.Context())
+			authorize(w, r, p, p.Can(perm), next)
+		})
+	}
+}
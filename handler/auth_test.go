@@ -0,0 +1,206 @@
+package handler
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"ipfs-identity/util"
+)
+
+// authFixture has a user for each built-in role and an access token for
+// each, plus API keys, behind a router that guards its routes the way
+// main.go does.
+type authFixture struct {
+	ids    map[string]string // User ID by username
+	tokens map[string]string // Access token by username
+	server *httptest.Server
+}
+
+func newAuthFixture(t *testing.T) *authFixture {
+	t.Setenv("API_KEYS", "ops:ops-key:*,helpdesk:helpdesk-key:users:write")
+	m := useTestManager(t)
+	ctx := context.Background()
+	root := util.Principal{ID: "test", Kind: "cli", Permissions: []string{util.PermAll}}
+	f := &authFixture{ids: make(map[string]string), tokens: make(map[string]string)}
+	for _, user := range []struct{ name, role string }{
+		{"alice", ""}, {"bob", ""}, {"sam", "support"}, {"ada", util.RoleAdmin}, {"audrey", "auditor"},
+	} {
+		id, _, err := m.AddUser(ctx, user.name, "secret", "")
+		if err != nil {
+			t.Fatalf("AddUser %s: %v", user.name, err)
+		}
+		if user.role != "" {
+			if err := m.AssignRole(ctx, root, id, user.role); err != nil {
+				t.Fatalf("AssignRole %s: %v", user.role, err)
+			}
+		}
+		tokens, err := m.IssueTokens(id, []string{"pwd", "otp", util.AMRMFA})
+		if err != nil {
+			t.Fatalf("IssueTokens: %v", err)
+		}
+		f.ids[user.name] = id
+		f.tokens[user.name] = tokens.AccessToken
+	}
+	// The admin role needs MFA by default, so this session has no
+	// permissions.
+	tokens, err := m.IssueTokens(f.ids["ada"], []string{"pwd"})
+	if err != nil {
+		t.Fatalf("IssueTokens: %v", err)
+	}
+	f.tokens["ada-pwd"] = tokens.AccessToken
+
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, _ := PrincipalFrom(r.Context())
+		w.Write([]byte(p.String()))
+	})
+	r := mux.NewRouter()
+	users := r.PathPrefix("/users/{id}").Subrouter()
+	users.Use(Authenticate, RequireSelfOr(util.PermUsersWrite))
+	users.Handle("", ok).Methods("PUT")
+	self := r.PathPrefix("/users/{id}").Subrouter()
+	self.Use(Authenticate, RequireSelf)
+	self.Handle("/mfa/totp", ok).Methods("POST")
+	audit := r.PathPrefix("/admin").Subrouter()
+	audit.Use(Authenticate, RequirePermission(util.PermAuditRead))
+	audit.Handle("/audit", ok).Methods("GET")
+	f.server = httptest.NewServer(r)
+	t.Cleanup(f.server.Close)
+	return f
+}
+
+// request calls method path with the token of the named user, an "api:<key>" API key, or
+// anonymously if as is empty, and returns the status, body and headers.
+func (f *authFixture) request(t *testing.T, method, path, as string) (int, string, http.Header) {
+	t.Helper()
+	req, _ := http.NewRequest(method, f.server.URL+path, nil)
+	if key, ok := strings.CutPrefix(as, "api:"); ok {
+		req.Header.Set("X-API-Key", key)
+	} else if token, ok := f.tokens[as]; ok {
+		req.Header.Set("Authorization", "Bearer "+token)
+	} else if as != "" {
+		req.Header.Set("Authorization", "Bearer "+as)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, strings.TrimSpace(string(body)), resp.Header
+}
+
+func TestAuthenticate(t *testing.T) {
+	f := newAuthFixture(t)
+	path := "/users/" + f.ids["alice"]
+	tests := []struct {
+		name      string
+		as        string
+		want      int
+		principal string
+		challenge string // Expected WWW-Authenticate header
+	}{
+		{"no credentials", "", http.StatusUnauthorized, "", `Bearer realm="ipfs-identity"`},
+		{"malformed token", "not-a-token", http.StatusUnauthorized, "", `Bearer realm="ipfs-identity", error="invalid_token"`},
+		{"unknown API key", "api:nope", http.StatusUnauthorized, "", `Bearer realm="ipfs-identity", error="invalid_token"`},
+		{"access token", "alice", http.StatusOK, "user:" + f.ids["alice"], ""},
+		{"API key", "api:ops-key", http.StatusOK, "api_key:ops", ""},
+	}
+	for _, tt := range tests {
+		status, body, header := f.request(t, "PUT", path, tt.as)
+		if status != tt.want {
+			t.Errorf("%s: status %d, want %d (%s)", tt.name, status, tt.want, body)
+			continue
+		}
+		if got := header.Get("WWW-Authenticate"); got != tt.challenge {
+			t.Errorf("%s: WWW-Authenticate %q, want %q", tt.name, got, tt.challenge)
+		}
+		if tt.principal != "" && body != tt.principal {
+			t.Errorf("%s: principal %q, want %q", tt.name, body, tt.principal)
+		}
+	}
+
+	// Tokens of deleted users stop working at once.
+	if err := im.DeleteUser(context.Background(), f.ids["bob"]); err != nil {
+		t.Fatalf("DeleteUser: %v", err)
+	}
+	if status, _, _ := f.request(t, "PUT", "/users/"+f.ids["bob"], "bob"); status != http.StatusUnauthorized {
+		t.Errorf("deleted user: status %d, want 401", status)
+	}
+}
+
+func TestRequireSelfOr(t *testing.T) {
+	f := newAuthFixture(t)
+	tests := []struct {
+		as, target string
+		want       int
+	}{
+		{"alice", "alice", http.StatusOK},
+		{"alice", "bob", http.StatusForbidden},
+		{"audrey", "alice", http.StatusForbidden}, // users:read is not enough
+		{"sam", "alice", http.StatusOK},
+		{"sam", "sam", http.StatusOK},
+		// support holds users:write but not everything an admin holds.
+		{"sam", "ada", http.StatusForbidden},
+		{"ada", "sam", http.StatusOK},
+		{"ada-pwd", "sam", http.StatusForbidden},
+		{"api:helpdesk-key", "alice", http.StatusOK},
+		{"api:helpdesk-key", "audrey", http.StatusForbidden},
+		{"api:ops-key", "ada", http.StatusOK},
+	}
+	for _, tt := range tests {
+		if status, body, _ := f.request(t, "PUT", "/users/"+f.ids[tt.target], tt.as); status != tt.want {
+			t.Errorf("%s on %s: status %d, want %d (%s)", tt.as, tt.target, status, tt.want, body)
+		}
+	}
+	if status, _, _ := f.request(t, "PUT", "/users/no-such-user", "alice"); status != http.StatusForbidden {
+		t.Errorf("alice on an unknown user: status %d, want 403", status)
+	}
+}
+
+func TestRequireSelf(t *testing.T) {
+	f := newAuthFixture(t)
+	tests := []struct {
+		as, target string
+		want       int
+	}{
+		{"alice", "alice", http.StatusOK},
+		{"ada", "ada", http.StatusOK},
+		{"alice", "bob", http.StatusForbidden},
+		{"sam", "alice", http.StatusForbidden},
+		{"ada", "alice", http.StatusForbidden},
+		{"api:ops-key", "alice", http.StatusForbidden},
+		{"", "alice", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		if status, body, _ := f.request(t, "POST", "/users/"+f.ids[tt.target]+"/mfa/totp", tt.as); status != tt.want {
+			t.Errorf("%q on %s: status %d, want %d (%s)", tt.as, tt.target, status, tt.want, body)
+		}
+	}
+}
+
+func TestRequirePermission(t *testing.T) {
+	f := newAuthFixture(t)
+	tests := []struct {
+		as   string
+		want int
+	}{
+		{"audrey", http.StatusOK},
+		{"ada", http.StatusOK},
+		{"api:ops-key", http.StatusOK},
+		{"ada-pwd", http.StatusForbidden},
+		{"alice", http.StatusForbidden},
+		{"sam", http.StatusForbidden},
+		{"api:helpdesk-key", http.StatusForbidden},
+		{"", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		if status, body, _ := f.request(t, "GET", "/admin/audit", tt.as); status != tt.want {
+			t.Errorf("%q: status %d, want %d (%s)", tt.as, status, tt.want, body)
+		}
+	}
+}
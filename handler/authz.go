@@ -0,0 +1,101 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"ipfs-identity/util"
+)
+
+type authzCheckRequest struct {
+	util.AuthzRequest
+	Explain bool `json:"explain"`
+}
+
+// AuthzCheckHandler handles POST /authz/check and returns the policy decision
+// for a subject, resource, action and environment. With "explain": true the
+// response also shows the attributes used and how each policy evaluated.
+func AuthzCheckHandler(w http.ResponseWriter, r *http.Request) {
+	var req authzCheckRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	decision, err := im.Authorize(r.Context(), req.AuthzRequest, req.Explain)
+	if err != nil {
+		writeError(w, err, http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(decision)
+}
+
+// PoliciesHandler handles GET /admin/policies and lists the stored policies.
+func PoliciesHandler(w http.ResponseWriter, r *http.Request) {
+	policies, err := im.Policies(r.Context())
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"policies": policies})
+}
+
+// PutPolicyHandler handles PUT /admin/policies/{id} and stores the policy in
+// the body as the next version of {id}.
+func PutPolicyHandler(w http.ResponseWriter, r *http.Request) {
+	var policy util.Policy
+	if err := json.NewDecoder(r.Body).Decode(&policy); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	policy.ID = mux.Vars(r)["id"]
+
+	actor, _ := PrincipalFrom(r.Context())
+	stored, err := im.PutPolicy(r.Context(), actor, policy)
+	if err != nil {
+		writeError(w, err, http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stored)
+}
+
+// DeletePolicyHandler handles DELETE /admin/policies/{id}.
+func DeletePolicyHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	actor, _ := PrincipalFrom(r.Context())
+	if err := im.DeletePolicy(r.Context(), actor, id); err != nil {
+		writeError(w, err, http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Policy deleted", "id": id})
+}
+
+// PolicyHistoryHandler handles GET /admin/policies/{id}/history and returns
+// the stored versions of a policy, newest first. The limit query parameter
+// defaults to 100; the next_cursor of the response, passed back as cursor,
+// continues the list.
+func PolicyHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	limit := 100
+	if value := r.URL.Query().Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	revisions, next, err := im.PolicyHistory(r.Context(), mux.Vars(r)["id"], limit, r.URL.Query().Get("cursor"))
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"revisions": revisions, "next_cursor": next})
+}
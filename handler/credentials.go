@@ -0,0 +1,127 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"ipfs-identity/util"
+)
+
+// CredentialsHandler handles GET and POST /admin/credentials. POST issues a
+// credential to a user's DID; GET lists issued credentials, limited to one
+// user with ?user=ID.
+func CredentialsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		var req util.CredentialRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.UserID == "" {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		baseURL, err := im.Issuer("Verifiable credentials")
+		if err != nil {
+			writeError(w, err, http.StatusInternalServerError)
+			return
+		}
+		actor, _ := PrincipalFrom(r.Context())
+		record, credential, err := im.IssueCredential(r.Context(), actor, baseURL, req)
+		if err != nil {
+			writeError(w, err, http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]interface{}{"record": record, "credential": credential})
+		return
+	}
+
+	records, err := im.IssuedCredentials(r.Context(), r.URL.Query().Get("user"))
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"credentials": records})
+}
+
+// RevokeCredentialHandler handles POST /admin/credentials/{id}/revoke. The
+// updated status list is published before it returns.
+func RevokeCredentialHandler(w http.ResponseWriter, r *http.Request) {
+	baseURL, err := im.Issuer("Verifiable credentials")
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	id := mux.Vars(r)["id"]
+	actor, _ := PrincipalFrom(r.Context())
+	if err := im.RevokeCredential(r.Context(), actor, baseURL, id); err != nil {
+		writeError(w, err, http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Credential revoked", "id": id})
+}
+
+// UserCredentialsHandler handles GET /users/{id}/credentials: the credentials
+// issued to the user, each with its signed document from IPFS.
+func UserCredentialsHandler(w http.ResponseWriter, r *http.Request) {
+	records, err := im.IssuedCredentials(r.Context(), mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	type entry struct {
+		Record     util.IssuedCredential `json:"record"`
+		Credential json.RawMessage       `json:"credential"`
+	}
+	entries := make([]entry, 0, len(records))
+	for _, record := range records {
+		credential, err := im.CredentialDocument(r.Context(), record)
+		if err != nil {
+			writeError(w, err, http.StatusBadGateway)
+			return
+		}
+		entries = append(entries, entry{record, credential})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"credentials": entries})
+}
+
+type verifyCredentialRequest struct {
+	Credential json.RawMessage `json:"credential"` // VC-JWT string or Data Integrity object
+}
+
+// VerifyCredentialHandler handles POST /credentials/verify. It answers 200
+// with verified set to false, and the reason, for credentials that fail.
+func VerifyCredentialHandler(w http.ResponseWriter, r *http.Request) {
+	var req verifyCredentialRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.Credential) == 0 {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	baseURL, err := im.Issuer("Verifiable credentials")
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	result := im.VerifyCredential(r.Context(), baseURL, req.Credential)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// StatusListHandler handles GET /credentials/status/{list}, the published
+// StatusList2021 credential. There is only list 1.
+func StatusListHandler(w http.ResponseWriter, r *http.Request) {
+	if mux.Vars(r)["list"] != "1" {
+		http.Error(w, "Status list not found", http.StatusNotFound)
+		return
+	}
+	list, err := im.StatusListCredential(r.Context())
+	if err != nil {
+		writeError(w, err, http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(list)
+}
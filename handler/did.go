@@ -0,0 +1,91 @@
+package handler
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"ipfs-identity/did"
+)
+
+// ServiceDIDHandler handles GET /.well-known/did.json, the did:web document of
+// the service.
+func ServiceDIDHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/did+json")
+	json.NewEncoder(w).Encode(im.ServiceDIDDocument())
+}
+
+// UserDIDDocumentHandler handles GET /users/{id}/did.json, the did:web
+// document of a user as stored on IPFS. ?versionId=N returns an earlier
+// version, counting from 1.
+func UserDIDDocumentHandler(w http.ResponseWriter, r *http.Request) {
+	version := 0
+	if v := r.URL.Query().Get("versionId"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			http.Error(w, "Invalid versionId", http.StatusBadRequest)
+			return
+		}
+		version = n
+	}
+	doc, err := im.UserDIDDocument(r.Context(), mux.Vars(r)["id"], version)
+	if err != nil {
+		writeError(w, err, http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/did+json")
+	w.Write(doc)
+}
+
+// UserDIDHandler handles GET /users/{id}/did: the user's DID, the CID of its
+// document and the history of its keys.
+func UserDIDHandler(w http.ResponseWriter, r *http.Request) {
+	userDID, err := im.UserDID(r.Context(), mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, err, http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(userDID)
+}
+
+type rotateDIDRequest struct {
+	PublicKeyMultibase string `json:"public_key_multibase"` // Optional Ed25519 Multikey to rotate to
+}
+
+// RotateDIDKeyHandler handles POST /users/{id}/did/rotate. The body may name
+// the new public key; otherwise a key pair is generated and the private key
+// returned once.
+func RotateDIDKeyHandler(w http.ResponseWriter, r *http.Request) {
+	var req rotateDIDRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+	}
+	var pub ed25519.PublicKey
+	if req.PublicKeyMultibase != "" {
+		var err error
+		if pub, err = did.DecodeMultikey(req.PublicKeyMultibase); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	actor, _ := PrincipalFrom(r.Context())
+	userDID, priv, err := im.RotateDIDKey(r.Context(), actor, mux.Vars(r)["id"], pub)
+	if err != nil {
+		writeError(w, err, http.StatusBadRequest)
+		return
+	}
+	response := map[string]interface{}{"did": userDID}
+	if priv != nil {
+		response["did_key"] = did.PrivateJWK(priv)
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
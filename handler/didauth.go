@@ -0,0 +1,108 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"ipfs-identity/util"
+)
+
+type didAuthRequest struct {
+	Response json.RawMessage `json:"response"` // JWS string or object with a Data Integrity proof
+}
+
+// DIDAuthNonceHandler handles GET /did/auth/nonce. The signed response must
+// carry the nonce and name the audience.
+func DIDAuthNonceHandler(w http.ResponseWriter, r *http.Request) {
+	nonce, audience, expires, err := im.DIDAuthNonce()
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"nonce":      nonce,
+		"audience":   audience,
+		"expires_at": expires.UTC().Format(time.RFC3339),
+	})
+}
+
+// DIDLoginHandler handles POST /did/login. It verifies the signed response
+// and issues session tokens for the user the DID belongs to.
+func DIDLoginHandler(w http.ResponseWriter, r *http.Request) {
+	var req didAuthRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.Response) == 0 {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	id, amr, err := im.DIDLogin(r.Context(), req.Response)
+	if err != nil {
+		authLog.Warn(fmt.Sprintf("Failed DID login from %s: %v", r.RemoteAddr, err))
+		writeError(w, err, http.StatusUnauthorized)
+		return
+	}
+	tokens, err := im.IssueTokens(id, amr)
+	if err != nil {
+		http.Error(w, "Failed to issue tokens", http.StatusInternalServerError)
+		return
+	}
+
+	response := struct {
+		ID string `json:"id"`
+		util.TokenPair
+	}{id, tokens}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// LinkedDIDsHandler handles GET, POST and DELETE /users/{id}/dids. GET lists
+// the linked DIDs; POST links the DID that signed the response in the body;
+// DELETE unlinks the DID given as ?did=.
+func LinkedDIDsHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	actor, _ := PrincipalFrom(r.Context())
+	switch r.Method {
+	case http.MethodPost:
+		var req didAuthRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.Response) == 0 {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		linked, err := im.LinkDID(r.Context(), actor, id, req.Response)
+		if err != nil {
+			writeError(w, err, http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]string{"message": "DID linked", "did": linked})
+		return
+	case http.MethodDelete:
+		linked := r.URL.Query().Get("did")
+		if linked == "" {
+			http.Error(w, "did is required", http.StatusBadRequest)
+			return
+		}
+		if err := im.UnlinkDID(r.Context(), actor, id, linked); err != nil {
+			writeError(w, err, http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"message": "DID unlinked", "did": linked})
+		return
+	}
+
+	linked, err := im.LinkedDIDs(r.Context(), id)
+	if err != nil {
+		writeError(w, err, http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(linked)
+}
@@ -0,0 +1,82 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+type emailRequest struct {
+	Email string `json:"email"`
+}
+
+// EmailHandler handles GET and PUT /users/{id}/email. PUT sets a new address
+// and sends a verification link to it; a verified address is only replaced
+// once the new one is verified.
+func EmailHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	status := http.StatusOK
+	if r.Method == http.MethodPut {
+		var req emailRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Email == "" {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		actor, _ := PrincipalFrom(r.Context())
+		if err := im.SetEmail(r.Context(), actor, id, req.Email); err != nil {
+			writeError(w, err, http.StatusBadRequest)
+			return
+		}
+		status = http.StatusAccepted
+	}
+	email, err := im.Email(r.Context(), id)
+	if err != nil {
+		writeError(w, err, http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(email)
+}
+
+// ResendEmailVerificationHandler handles POST /users/{id}/email/verify. It
+// sends a new link for the address awaiting verification.
+func ResendEmailVerificationHandler(w http.ResponseWriter, r *http.Request) {
+	if err := im.SendEmailVerification(r.Context(), mux.Vars(r)["id"]); err != nil {
+		writeError(w, err, http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Verification link sent"})
+}
+
+type verifyEmailRequest struct {
+	Token string `json:"token"`
+}
+
+// VerifyEmailHandler handles GET and POST /email/verify, where verification
+// links lead. The token comes from ?token= or the body.
+func VerifyEmailHandler(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+	if r.Method == http.MethodPost {
+		var req verifyEmailRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		token = req.Token
+	}
+	if token == "" {
+		http.Error(w, "token is required", http.StatusBadRequest)
+		return
+	}
+	id, err := im.VerifyEmail(r.Context(), token)
+	if err != nil {
+		writeError(w, err, http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Email address verified", "id": id})
+}
@@ -5,18 +5,20 @@ import (
 	"net/http"
 	"encoding/json"
 	"github.com/gorilla/mux"
+	"ipfs-identity/did"
 	"ipfs-identity/logger"
 	"ipfs-identity/util"
 )
 
 
-// Global identity manager instance.
-var im = util.NewIdentityManager()
+// Global identity manager instance, set by SetManager.
+var im *util.IdentityManager
 
 // HTTP request types.
 type userRequest struct {
 	Username string `json:"username"`
 	Password string `json:"password"`
+	Email    string `json:"email,omitempty"` // Optional at registration
 }
 
 // addUserHandler handles POST /users to add a new user.
@@ -36,18 +38,33 @@ func AddUserHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	id, err := im.AddUser(req.Username, req.Password)
+	id, didKey, err := im.AddUser(r.Context(), req.Username, req.Password, req.Email)
 	if err != nil {
 		logInstance.Error("Error adding user: %v", err)
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, err, http.StatusBadRequest)
 		return
 	}
 	logInstance.Info("User added with ID: %s", id)
+	if req.Email != "" {
+		if err := im.SendEmailVerification(r.Context(), id); err != nil {
+			logInstance.Error("Error sending email verification: %v", err)
+		}
+	}
 
-	response := map[string]string{
+	// The DID private key is only ever shown here.
+	userDID, err := im.UserDID(r.Context(), id)
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	response := map[string]interface{}{
 		"message": "User added successfully",
 		"id":      id,
+		"did":     userDID.ID,
+		"key_did": userDID.KeyDID,
+		"did_key": did.PrivateJWK(didKey),
 	}
+	w.Header().Set("Cache-Control", "no-store")
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 }
@@ -69,15 +86,39 @@ func LoginHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	id, err := im.Login(req.Username, req.Password)
+	id, err := im.Login(r.Context(), req.Username, req.Password)
 	if err != nil {
 		logInstance.Warn("Failed login attempt for username: %s", req.Username)
-		http.Error(w, err.Error(), http.StatusUnauthorized)
+		writeError(w, err, http.StatusUnauthorized)
 		return
 	}
 	logInstance.Info("User %s logged in successfully", req.Username)
 
-	response := map[string]string{"id": id}
+	// Users with a second factor get a challenge to redeem at /login/mfa.
+	challenge, err := im.BeginMFA(r.Context(), id)
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if challenge != nil {
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(challenge)
+		return
+	}
+
+	tokens, err := im.IssueTokens(id, []string{util.AMRPassword})
+	if err != nil {
+		logInstance.Error("Error issuing tokens: %v", err)
+		http.Error(w, "Failed to issue tokens", http.StatusInternalServerError)
+		return
+	}
+
+	response := struct {
+		ID string `json:"id"`
+		util.TokenPair
+	}{id, tokens}
+	w.Header().Set("Cache-Control", "no-store")
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 }
@@ -105,10 +146,10 @@ func UpdateUserHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = im.EditUser(id, req.Username, req.Password)
+	err = im.EditUser(r.Context(), id, req.Username, req.Password)
 	if err != nil {
 		logInstance.Error("Error updating user: %v", err)
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, err, http.StatusBadRequest)
 		return
 	}
 	logInstance.Info("User %s updated successfully", id)
@@ -136,10 +177,10 @@ func DeleteUserHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = im.DeleteUser(id)
+	err = im.DeleteUser(r.Context(), id)
 	if err != nil {
 		logInstance.Error("Error deleting user: %v", err)
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, err, http.StatusBadRequest)
 		return
 	}
 	logInstance.Info("User %s deleted successfully", id)
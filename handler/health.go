@@ -0,0 +1,26 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"ipfs-identity/util"
+)
+
+// HealthHandler handles GET /health and reports the storage backend state,
+// including the depth and age of the offline write queue.
+func HealthHandler(w http.ResponseWriter, r *http.Request) {
+	health := im.Health(r.Context())
+
+	status := "ok"
+	if !health.IPFSUp || health.WALDepth > 0 || health.Mode.Mode != util.ModeNormal {
+		status = "degraded"
+	}
+
+	response := map[string]interface{}{
+		"status":  status,
+		"storage": health,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
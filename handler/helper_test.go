@@ -0,0 +1,35 @@
+package handler
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"ipfs-identity/logger"
+	"ipfs-identity/util"
+)
+
+// useTestManager points the handlers at an IdentityManager backed by an
+// offline embedded node, with its state and logs in temporary directories.
+func useTestManager(t *testing.T) *util.IdentityManager {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	node, err := util.NewEmbeddedNode(ctx, util.EmbeddedConfig{RepoDir: t.TempDir(), Offline: true})
+	if err != nil {
+		t.Fatalf("NewEmbeddedNode: %v", err)
+	}
+	t.Cleanup(func() { node.Close() })
+	log, err := logger.NewLogger(logger.Config{Level: "error", Format: "console", BaseDir: t.TempDir(), RotateTime: time.Hour})
+	if err != nil {
+		t.Fatalf("NewLogger: %v", err)
+	}
+	m, err := util.NewIdentityManagerWithStore(node, t.TempDir(), log)
+	if err != nil {
+		t.Fatalf("NewIdentityManagerWithStore: %v", err)
+	}
+	previous := im
+	SetManager(m)
+	t.Cleanup(func() { SetManager(previous) })
+	return m
+}
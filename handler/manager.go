@@ -0,0 +1,15 @@
+package handler
+
+import "ipfs-identity/util"
+
+// Manager returns the identity manager shared by all handlers, for use by
+// offline commands that must not open a second write-ahead log.
+func Manager() *util.IdentityManager {
+	return im
+}
+
+// SetManager sets the identity manager shared by all handlers. Call it before
+// serving requests or running offline commands.
+func SetManager(m *util.IdentityManager) {
+	im = m
+}
@@ -0,0 +1,115 @@
+package handler
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"ipfs-identity/util"
+)
+
+// EnrollTOTPHandler handles POST /users/{id}/mfa/totp. It starts enrolling an
+// authenticator app and returns the secret, its otpauth:// URI and the URI as
+// a QR code PNG data URL.
+func EnrollTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	enrollment, err := im.EnrollTOTP(r.Context(), mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"secret":      enrollment.Secret,
+		"otpauth_uri": enrollment.URI,
+		"qr_code":     "data:image/png;base64," + base64.StdEncoding.EncodeToString(enrollment.QRCodePNG),
+	})
+}
+
+type totpCodeRequest struct {
+	Code string `json:"code"`
+}
+
+// ConfirmTOTPHandler handles POST /users/{id}/mfa/totp/confirm. A valid code
+// from the app enables the enrollment, and the response holds the recovery
+// codes.
+func ConfirmTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	var req totpCodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Code == "" {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	codes, err := im.ConfirmTOTP(r.Context(), mux.Vars(r)["id"], req.Code)
+	if err != nil {
+		writeError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"recovery_codes": codes})
+}
+
+// DisableTOTPHandler handles DELETE /users/{id}/mfa/totp. Sessions that did
+// not use MFA must send a TOTP or recovery code as {"code": "..."}.
+func DisableTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	var req totpCodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	id := mux.Vars(r)["id"]
+	actor, _ := PrincipalFrom(r.Context())
+	if err := im.DisableTOTP(r.Context(), actor, id, req.Code); err != nil {
+		if errors.Is(err, util.ErrMFARequired) {
+			writeError(w, err, http.StatusForbidden)
+			return
+		}
+		writeError(w, err, http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "TOTP disabled", "id": id})
+}
+
+type mfaLoginRequest struct {
+	Token        string `json:"mfa_token"`
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+// MFALoginHandler handles POST /login/mfa, the second step of a login for
+// users with TOTP enabled. It takes the challenge token from /login and a code
+// from the app or a recovery code, and issues the session tokens.
+func MFALoginHandler(w http.ResponseWriter, r *http.Request) {
+	var req mfaLoginRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token == "" || (req.Code == "") == (req.RecoveryCode == "") {
+		http.Error(w, "Invalid request: send mfa_token and either code or recovery_code", http.StatusBadRequest)
+		return
+	}
+
+	id, amr, err := im.CompleteMFA(r.Context(), req.Token, req.Code, req.RecoveryCode)
+	if err != nil {
+		authLog.Warn(fmt.Sprintf("Failed MFA login from %s: %v", r.RemoteAddr, err))
+		writeError(w, err, http.StatusUnauthorized)
+		return
+	}
+	tokens, err := im.IssueTokens(id, amr)
+	if err != nil {
+		http.Error(w, "Failed to issue tokens", http.StatusInternalServerError)
+		return
+	}
+
+	response := struct {
+		ID string `json:"id"`
+		util.TokenPair
+	}{id, tokens}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
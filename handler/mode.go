@@ -0,0 +1,69 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"ipfs-identity/util"
+)
+
+// writeError replies with err and status, or with 503 and a Retry-After header
+// if err was refused because of the service mode.
+func writeError(w http.ResponseWriter, err error, status int) {
+	var modeErr *util.ModeError
+	if errors.As(err, &modeErr) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(modeErr.RetryAfter.Seconds())))
+		status = http.StatusServiceUnavailable
+	}
+	if errors.Is(err, util.ErrForbidden) {
+		status = http.StatusForbidden
+	}
+	if errors.Is(err, util.ErrInvalidCursor) {
+		status = http.StatusBadRequest
+	}
+	http.Error(w, err.Error(), status)
+}
+
+// EnforceMode refuses every request except health checks and /admin ones
+// while the service is in maintenance mode. Read-only mode is enforced by the
+// operations that write.
+func EnforceMode(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health" && r.URL.Path != "/admin" && !strings.HasPrefix(r.URL.Path, "/admin/") {
+			if err := im.CheckRequest(); err != nil {
+				writeError(w, err, http.StatusServiceUnavailable)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+type modeRequest struct {
+	Mode   string `json:"mode"` // A util.Mode, or "auto" to resume automatic switching
+	Reason string `json:"reason"`
+}
+
+// ModeHandler handles GET and POST /admin/mode. GET reports the service mode;
+// POST sets it, and {"mode": "auto"} hands it back to the health checks.
+func ModeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		var req modeRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		if req.Mode == "auto" {
+			im.ReleaseMode()
+		} else if err := im.SetMode(util.Mode(req.Mode), req.Reason); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(im.Mode())
+}
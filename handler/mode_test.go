@@ -0,0 +1,48 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"ipfs-identity/util"
+)
+
+func TestEnforceMode(t *testing.T) {
+	m := useTestManager(t)
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	handler := EnforceMode(next)
+
+	paths := []string{"/health", "/admin", "/admin/mode", "/users", "/login", "/administrator", "/healthz"}
+	tests := []struct {
+		mode    util.Mode
+		allowed map[string]bool // Paths served; the others get 503
+	}{
+		{util.ModeNormal, map[string]bool{"/health": true, "/admin": true, "/admin/mode": true, "/users": true, "/login": true, "/administrator": true, "/healthz": true}},
+		{util.ModeReadOnly, map[string]bool{"/health": true, "/admin": true, "/admin/mode": true, "/users": true, "/login": true, "/administrator": true, "/healthz": true}},
+		{util.ModeMaintenance, map[string]bool{"/health": true, "/admin": true, "/admin/mode": true}},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.mode), func(t *testing.T) {
+			if err := m.SetMode(tt.mode, ""); err != nil {
+				t.Fatalf("SetMode: %v", err)
+			}
+			t.Cleanup(m.ReleaseMode)
+			for _, path := range paths {
+				rec := httptest.NewRecorder()
+				handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+				if tt.allowed[path] {
+					if rec.Code != http.StatusNoContent {
+						t.Errorf("%s: status %d, want it served", path, rec.Code)
+					}
+					continue
+				}
+				if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") == "" {
+					t.Errorf("%s: status %d, Retry-After %q, want 503 with Retry-After", path, rec.Code, rec.Header().Get("Retry-After"))
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,347 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"ipfs-identity/util"
+)
+
+// RegisterOIDC mounts the OpenID Connect provider endpoints on r: discovery,
+// the key set, /authorize, /token and /userinfo. They need nothing beyond
+// SetManager, so tests can serve r with httptest and act as the relying party.
+func RegisterOIDC(r *mux.Router) {
+	r.HandleFunc("/.well-known/openid-configuration", DiscoveryHandler).Methods("GET")
+	r.HandleFunc("/oauth/jwks", JWKSHandler).Methods("GET")
+	r.HandleFunc("/authorize", AuthorizeHandler).Methods("GET", "POST")
+	r.HandleFunc("/token", TokenHandler).Methods("POST")
+	r.HandleFunc("/userinfo", UserInfoHandler).Methods("GET", "POST")
+}
+
+// DiscoveryHandler handles GET /.well-known/openid-configuration.
+func DiscoveryHandler(w http.ResponseWriter, r *http.Request) {
+	iss, err := im.Issuer("OpenID Connect")
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"issuer":                                iss,
+		"authorization_endpoint":                iss + "/authorize",
+		"token_endpoint":                        iss + "/token",
+		"userinfo_endpoint":                     iss + "/userinfo",
+		"jwks_uri":                              iss + "/oauth/jwks",
+		"response_types_supported":              []string{"code"},
+		"grant_types_supported":                 []string{util.GrantAuthorizationCode, util.GrantRefreshToken, util.GrantClientCredentials},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{im.SigningAlg()},
+		"scopes_supported":                      []string{util.ScopeOpenID, util.ScopeProfile, util.ScopeOfflineAccess},
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post", "none"},
+		"code_challenge_methods_supported":      []string{"S256"},
+		"claims_supported":                      []string{"sub", "iss", "aud", "exp", "iat", "auth_time", "nonce", "preferred_username"},
+	})
+}
+
+// JWKSHandler handles GET /oauth/jwks and returns the token signing key.
+func JWKSHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(im.JWKS())
+}
+
+var authorizeForm = template.Must(template.New("authorize").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Sign in to {{.Client}}</title></head>
+<body>
+<h1>Sign in to {{.Client}}</h1>
+{{if .Error}}<p style="color: #b00">{{.Error}}</p>{{end}}
+<p>{{.Client}} is asking for access to:</p>
+<ul>{{range .Scopes}}<li>{{.}}</li>{{end}}</ul>
+<form method="post" action="authorize">
+{{range $name, $value := .Params}}<input type="hidden" name="{{$name}}" value="{{$value}}">
+{{end}}<label>Username <input name="username" autocomplete="username" value="{{.Username}}"></label><br>
+<label>Password <input type="password" name="password" autocomplete="current-password"></label><br>
+<label>Authentication code, if enabled <input name="otp" autocomplete="one-time-code" inputmode="numeric"></label><br>
+<button type="submit" name="decision" value="allow">Allow</button>
+<button type="submit" name="decision" value="deny">Deny</button>
+</form>
+</body>
+</html>
+`))
+
+type authorizePage struct {
+	Client   string
+	Scopes   []string
+	Params   map[string]string
+	Username string
+	Error    string
+}
+
+// AuthorizeHandler handles /authorize. GET shows a login and consent form for
+// the request; the form posts back here, and on success the browser is
+// redirected to the client with an authorization code.
+func AuthorizeHandler(w http.ResponseWriter, r *http.Request) {
+	iss, err := im.Issuer("OpenID Connect")
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	req := util.AuthorizationRequest{
+		ClientID:            r.Form.Get("client_id"),
+		RedirectURI:         r.Form.Get("redirect_uri"),
+		ResponseType:        r.Form.Get("response_type"),
+		Scope:               r.Form.Get("scope"),
+		State:               r.Form.Get("state"),
+		Nonce:               r.Form.Get("nonce"),
+		CodeChallenge:       r.Form.Get("code_challenge"),
+		CodeChallengeMethod: r.Form.Get("code_challenge_method"),
+	}
+
+	// Without a known client and redirect URI there is nowhere safe to send
+	// the error, so it is shown to the user instead.
+	client, err := im.AuthorizationClient(r.Context(), req.ClientID, req.RedirectURI)
+	if err != nil {
+		writeError(w, err, http.StatusBadRequest)
+		return
+	}
+	if err := im.ValidateAuthorization(client, req); err != nil {
+		code, description := oauthError(err)
+		redirectAuthorization(w, r, req, iss, url.Values{"error": {code}, "error_description": {description}})
+		return
+	}
+
+	page := authorizePage{
+		Client: client.Name,
+		Scopes: strings.Fields(req.Scope),
+		Params: map[string]string{
+			"client_id":             req.ClientID,
+			"redirect_uri":          req.RedirectURI,
+			"response_type":         req.ResponseType,
+			"scope":                 req.Scope,
+			"state":                 req.State,
+			"nonce":                 req.Nonce,
+			"code_challenge":        req.CodeChallenge,
+			"code_challenge_method": req.CodeChallengeMethod,
+		},
+	}
+	if r.Method == http.MethodGet {
+		showAuthorizeForm(w, page, http.StatusOK)
+		return
+	}
+
+	if r.PostForm.Get("decision") != "allow" {
+		authLog.Info(fmt.Sprintf("Authorization for client %s denied by the user", client.ID))
+		redirectAuthorization(w, r, req, iss, url.Values{"error": {"access_denied"}, "error_description": {"the user denied the request"}})
+		return
+	}
+	page.Username = r.PostForm.Get("username")
+	id, err := im.Login(r.Context(), page.Username, r.PostForm.Get("password"))
+	if err != nil {
+		authLog.Warn(fmt.Sprintf("Failed login at /authorize for client %s: %v", client.ID, err))
+		page.Error = "Invalid username or password."
+		showAuthorizeForm(w, page, http.StatusUnauthorized)
+		return
+	}
+	amr, err := im.VerifyMFA(r.Context(), id, r.PostForm.Get("otp"))
+	if err != nil {
+		authLog.Warn(fmt.Sprintf("Failed second factor at /authorize for client %s: %v", client.ID, err))
+		page.Error = "Invalid authentication code."
+		if errors.Is(err, util.ErrMFARequired) {
+			page.Error = "Enter the code from your authenticator app."
+		}
+		showAuthorizeForm(w, page, http.StatusUnauthorized)
+		return
+	}
+	code, err := im.GrantAuthorizationCode(req, id, amr)
+	if err != nil {
+		redirectAuthorization(w, r, req, iss, url.Values{"error": {"server_error"}})
+		return
+	}
+	redirectAuthorization(w, r, req, iss, url.Values{"code": {code}})
+}
+
+func showAuthorizeForm(w http.ResponseWriter, page authorizePage, status int) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.WriteHeader(status)
+	authorizeForm.Execute(w, page)
+}
+
+// redirectAuthorization sends the browser back to the client's redirect URI
+// with params, the state and the issuer iss added to its query.
+func redirectAuthorization(w http.ResponseWriter, r *http.Request, req util.AuthorizationRequest, iss string, params url.Values) {
+	target, _ := url.Parse(req.RedirectURI)
+	query := target.Query()
+	for name, values := range params {
+		query[name] = values
+	}
+	if req.State != "" {
+		query.Set("state", req.State)
+	}
+	query.Set("iss", iss)
+	target.RawQuery = query.Encode()
+	http.Redirect(w, r, target.String(), http.StatusFound)
+}
+
+// TokenHandler handles POST /token. Clients authenticate with HTTP Basic
+// (client_secret_basic) or form parameters (client_secret_post); public
+// clients send only their client_id.
+func TokenHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeOAuthError(w, &util.OAuthError{Code: "invalid_request", Description: "malformed form body"})
+		return
+	}
+	clientID, secret, basic := r.BasicAuth()
+	if basic {
+		// Credentials in the Authorization header are form-encoded first.
+		clientID, _ = url.QueryUnescape(clientID)
+		secret, _ = url.QueryUnescape(secret)
+	} else {
+		clientID, secret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+	client, err := im.AuthenticateClient(r.Context(), clientID, secret)
+	if err != nil {
+		authLog.Warn(fmt.Sprintf("Client authentication failed at /token for %q: %v", clientID, err))
+		if basic {
+			w.Header().Set("WWW-Authenticate", `Basic realm="ipfs-identity"`)
+		}
+		writeOAuthError(w, err)
+		return
+	}
+
+	iss, err := im.Issuer("OpenID Connect")
+	if err != nil {
+		writeOAuthError(w, err)
+		return
+	}
+	var tokens util.OAuthTokens
+	switch grant := r.PostForm.Get("grant_type"); grant {
+	case util.GrantAuthorizationCode:
+		tokens, err = im.ExchangeCode(r.Context(), client, r.PostForm.Get("code"), r.PostForm.Get("redirect_uri"), r.PostForm.Get("code_verifier"), iss)
+	case util.GrantRefreshToken:
+		tokens, err = im.RefreshClientTokens(r.Context(), client, r.PostForm.Get("refresh_token"), iss)
+	case util.GrantClientCredentials:
+		tokens, err = im.ClientCredentialsToken(client, r.PostForm.Get("scope"), iss)
+	default:
+		err = &util.OAuthError{Code: "unsupported_grant_type", Description: fmt.Sprintf("grant type %q is not supported", grant)}
+	}
+	if err != nil {
+		writeOAuthError(w, err)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tokens)
+}
+
+// UserInfoHandler handles GET and POST /userinfo for a bearer access token.
+func UserInfoHandler(w http.ResponseWriter, r *http.Request) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="ipfs-identity"`)
+		http.Error(w, "Authentication required", http.StatusUnauthorized)
+		return
+	}
+	info, err := im.UserInfo(r.Context(), strings.TrimSpace(token))
+	if err != nil {
+		var oauthErr *util.OAuthError
+		if errors.As(err, &oauthErr) {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="ipfs-identity", error=%q`, oauthErr.Code))
+		}
+		writeOAuthError(w, err)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
+}
+
+// oauthError returns the OAuth error code and description for err.
+func oauthError(err error) (string, string) {
+	var oauthErr *util.OAuthError
+	if errors.As(err, &oauthErr) {
+		return oauthErr.Code, oauthErr.Description
+	}
+	return "server_error", err.Error()
+}
+
+// writeOAuthError replies with an OAuth JSON error body. Errors without an
+// OAuth code are reported as server_error, or as 503 in a restricted mode.
+func writeOAuthError(w http.ResponseWriter, err error) {
+	var modeErr *util.ModeError
+	if errors.As(err, &modeErr) {
+		writeError(w, err, http.StatusServiceUnavailable)
+		return
+	}
+
+	code, description := oauthError(err)
+	status := http.StatusBadRequest
+	switch code {
+	case "invalid_client", "invalid_token":
+		status = http.StatusUnauthorized
+	case "insufficient_scope":
+		status = http.StatusForbidden
+	case "server_error":
+		status = http.StatusInternalServerError
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": code, "error_description": description})
+}
+
+// ClientsHandler handles GET and POST /admin/clients. GET lists the registered
+// OIDC clients; POST registers one and returns its secret, which is shown only
+// this once.
+func ClientsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		var reg util.ClientRegistration
+		if err := json.NewDecoder(r.Body).Decode(&reg); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		actor, _ := PrincipalFrom(r.Context())
+		client, secret, err := im.RegisterClient(r.Context(), actor, reg)
+		if err != nil {
+			writeError(w, err, http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]interface{}{"client": client, "client_secret": secret})
+		return
+	}
+
+	clients, err := im.Clients(r.Context())
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"clients": clients})
+}
+
+// DeleteClientHandler handles DELETE /admin/clients/{id}.
+func DeleteClientHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	actor, _ := PrincipalFrom(r.Context())
+	if err := im.DeleteClient(r.Context(), actor, id); err != nil {
+		writeError(w, err, http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Client deleted", "id": id})
+}
@@ -0,0 +1,457 @@
+package handler
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"ipfs-identity/util"
+)
+
+// oidcClient is a minimal OpenID Connect relying party: /login sends the browser
+// to the provider, and /callback redeems the code, checks the ID token
+// against the provider's key set and fetches the user info.
+type oidcClient struct {
+	t        *testing.T
+	provider string
+	clientID string
+	secret   string
+	server   *httptest.Server
+
+	mu       sync.Mutex
+	sessions map[string]rpSession // By state
+	lastCode string
+	refresh  string
+}
+
+type rpSession struct {
+	nonce    string
+	verifier string
+}
+
+// rpResult is what /callback reports to the browser.
+type rpResult struct {
+	Error             string `json:"error,omitempty"`
+	Subject           string `json:"sub,omitempty"`
+	PreferredUsername string `json:"preferred_username,omitempty"`
+	UserInfoSubject   string `json:"userinfo_sub,omitempty"`
+}
+
+func newOIDCClient(t *testing.T, provider string) *oidcClient {
+	rp := &oidcClient{t: t, provider: provider, sessions: make(map[string]rpSession)}
+	r := mux.NewRouter()
+	r.HandleFunc("/login", rp.login)
+	r.HandleFunc("/callback", rp.callback)
+	rp.server = httptest.NewServer(r)
+	t.Cleanup(rp.server.Close)
+	return rp
+}
+
+func (rp *oidcClient) redirectURI() string {
+	return rp.server.URL + "/callback"
+}
+
+func randomString(t *testing.T) string {
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		t.Fatal(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+func (rp *oidcClient) login(w http.ResponseWriter, r *http.Request) {
+	state, s := randomString(rp.t), rpSession{nonce: randomString(rp.t), verifier: randomString(rp.t) + randomString(rp.t)}
+	rp.mu.Lock()
+	rp.sessions[state] = s
+	rp.mu.Unlock()
+
+	redirectURI := rp.redirectURI()
+	if override := r.URL.Query().Get("redirect_uri"); override != "" {
+		redirectURI = override
+	}
+	challenge := sha256.Sum256([]byte(s.verifier))
+	query := url.Values{
+		"client_id":             {rp.clientID},
+		"redirect_uri":          {redirectURI},
+		"response_type":         {"code"},
+		"scope":                 {"openid profile"},
+		"state":                 {state},
+		"nonce":                 {s.nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	http.Redirect(w, r, rp.provider+"/authorize?"+query.Encode(), http.StatusFound)
+}
+
+func (rp *oidcClient) callback(w http.ResponseWriter, r *http.Request) {
+	result, err := rp.finish(r.URL.Query())
+	if err != nil {
+		result = rpResult{Error: err.Error()}
+	}
+	json.NewEncoder(w).Encode(result)
+}
+
+type rpError string
+
+func (e rpError) Error() string { return string(e) }
+
+func (rp *oidcClient) finish(query url.Values) (rpResult, error) {
+	rp.mu.Lock()
+	s, ok := rp.sessions[query.Get("state")]
+	delete(rp.sessions, query.Get("state"))
+	rp.mu.Unlock()
+	if !ok {
+		return rpResult{}, rpError("unknown state")
+	}
+	if query.Get("iss") != rp.provider {
+		return rpResult{}, rpError("unexpected iss " + query.Get("iss"))
+	}
+	if e := query.Get("error"); e != "" {
+		return rpResult{}, rpError(e)
+	}
+
+	code := query.Get("code")
+	rp.mu.Lock()
+	rp.lastCode = code
+	rp.mu.Unlock()
+	var tokens util.OAuthTokens
+	status := rp.token(url.Values{
+		"grant_type":    {util.GrantAuthorizationCode},
+		"code":          {code},
+		"redirect_uri":  {rp.redirectURI()},
+		"code_verifier": {s.verifier},
+	}, &tokens)
+	if status != http.StatusOK {
+		return rpResult{}, rpError("token endpoint returned " + http.StatusText(status))
+	}
+	rp.mu.Lock()
+	rp.refresh = tokens.RefreshToken
+	rp.mu.Unlock()
+
+	var claims struct {
+		Issuer            string `json:"iss"`
+		Subject           string `json:"sub"`
+		Audience          string `json:"aud"`
+		Nonce             string `json:"nonce"`
+		ExpiresAt         int64  `json:"exp"`
+		PreferredUsername string `json:"preferred_username"`
+	}
+	if err := rp.verifyIDToken(tokens.IDToken, &claims); err != nil {
+		return rpResult{}, err
+	}
+	switch {
+	case claims.Issuer != rp.provider:
+		return rpResult{}, rpError("ID token has iss " + claims.Issuer)
+	case claims.Audience != rp.clientID:
+		return rpResult{}, rpError("ID token has aud " + claims.Audience)
+	case claims.Nonce != s.nonce:
+		return rpResult{}, rpError("ID token nonce does not match")
+	case time.Now().Unix() > claims.ExpiresAt:
+		return rpResult{}, rpError("ID token expired")
+	}
+
+	var info map[string]interface{}
+	if status := rp.userInfo(tokens.AccessToken, &info); status != http.StatusOK {
+		return rpResult{}, rpError("userinfo returned " + http.StatusText(status))
+	}
+	sub, _ := info["sub"].(string)
+	return rpResult{Subject: claims.Subject, PreferredUsername: claims.PreferredUsername, UserInfoSubject: sub}, nil
+}
+
+// token posts form to the token endpoint with client_secret_basic and decodes
+// the response into v.
+func (rp *oidcClient) token(form url.Values, v interface{}) int {
+	req, _ := http.NewRequest(http.MethodPost, rp.provider+"/token", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(rp.clientID), url.QueryEscape(rp.secret))
+	return do(rp.t, req, v)
+}
+
+func (rp *oidcClient) userInfo(accessToken string, v interface{}) int {
+	req, _ := http.NewRequest(http.MethodGet, rp.provider+"/userinfo", nil)
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	return do(rp.t, req, v)
+}
+
+// verifyIDToken checks the signature of token with the key the discovery
+// document points to, and decodes its claims into v.
+func (rp *oidcClient) verifyIDToken(token string, v interface{}) error {
+	var discovery struct {
+		Issuer  string `json:"issuer"`
+		JWKSURI string `json:"jwks_uri"`
+	}
+	req, _ := http.NewRequest(http.MethodGet, rp.provider+"/.well-known/openid-configuration", nil)
+	if do(rp.t, req, &discovery) != http.StatusOK || discovery.Issuer != rp.provider {
+		return rpError("bad discovery document")
+	}
+	var jwks struct {
+		Keys []map[string]string `json:"keys"`
+	}
+	req, _ = http.NewRequest(http.MethodGet, discovery.JWKSURI, nil)
+	if do(rp.t, req, &jwks) != http.StatusOK || len(jwks.Keys) != 1 {
+		return rpError("bad key set")
+	}
+	key := jwks.Keys[0]
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return rpError("malformed ID token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return err
+	}
+	if header.Alg != "EdDSA" || key["crv"] != "Ed25519" || header.Kid != key["kid"] {
+		return rpError("ID token is not signed with the published key")
+	}
+	pub, err := base64.RawURLEncoding.DecodeString(key["x"])
+	if err != nil {
+		return err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(ed25519.PublicKey(pub), []byte(parts[0]+"."+parts[1]), sig) {
+		return rpError("invalid ID token signature")
+	}
+	return decodeSegment(parts[1], v)
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// do sends req and decodes a JSON response into v, returning the status.
+func do(t *testing.T, req *http.Request, v interface{}) int {
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Errorf("%s %s: %v", req.Method, req.URL, err)
+		return 0
+	}
+	defer resp.Body.Close()
+	if v != nil && strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
+		json.NewDecoder(resp.Body).Decode(v)
+	}
+	return resp.StatusCode
+}
+
+// signIn acts as the browser: it starts a login at the relying party, posts
+// the provider's form with username, password and decision, and follows the
+// redirect back. It returns the last response status and, if the browser
+// ended at the relying party, its result.
+func signIn(t *testing.T, rp *oidcClient, loginQuery, username, password, decision string) (int, rpResult) {
+	t.Helper()
+	jar, _ := cookiejar.New(nil)
+	browser := &http.Client{Jar: jar}
+	resp, err := browser.Get(rp.server.URL + "/login?" + loginQuery)
+	if err != nil {
+		t.Fatalf("GET /login: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return resp.StatusCode, rpResult{}
+	}
+
+	form := resp.Request.URL.Query()
+	form.Set("username", username)
+	form.Set("password", password)
+	form.Set("decision", decision)
+	resp, err = browser.PostForm(rp.provider+"/authorize", form)
+	if err != nil {
+		t.Fatalf("POST /authorize: %v", err)
+	}
+	defer resp.Body.Close()
+	var result rpResult
+	if strings.HasPrefix(resp.Request.URL.String(), rp.server.URL) {
+		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+			t.Fatalf("decoding relying party result: %v", err)
+		}
+	}
+	return resp.StatusCode, result
+}
+
+// newOIDCProvider serves the OIDC endpoints, with JWT_ISSUER set to their URL.
+func newOIDCProvider(t *testing.T) (*util.IdentityManager, *httptest.Server) {
+	t.Helper()
+	r := mux.NewRouter()
+	RegisterOIDC(r)
+	provider := httptest.NewServer(r)
+	t.Cleanup(provider.Close)
+	t.Setenv("JWT_ISSUER", provider.URL)
+	return useTestManager(t), provider
+}
+
+func TestOIDCRelyingParty(t *testing.T) {
+	m, provider := newOIDCProvider(t)
+	ctx := context.Background()
+	userID, _, err := m.AddUser(ctx, "alice", "correct horse", "")
+	if err != nil {
+		t.Fatalf("AddUser: %v", err)
+	}
+
+	rp := newOIDCClient(t, provider.URL)
+	admin := util.Principal{ID: "test", Kind: util.PrincipalUser}
+	client, secret, err := m.RegisterClient(ctx, admin, util.ClientRegistration{
+		Name:         "Relying party",
+		RedirectURIs: []string{rp.redirectURI()},
+	})
+	if err != nil {
+		t.Fatalf("RegisterClient: %v", err)
+	}
+	rp.clientID, rp.secret = client.ID, secret
+
+	t.Run("login", func(t *testing.T) {
+		status, result := signIn(t, rp, "", "alice", "correct horse", "allow")
+		if status != http.StatusOK || result.Error != "" {
+			t.Fatalf("sign-in ended with %d %+v", status, result)
+		}
+		if result.Subject != userID || result.UserInfoSubject != userID || result.PreferredUsername != "alice" {
+			t.Errorf("relying party got %+v, want subject %s and username alice", result, userID)
+		}
+	})
+
+	t.Run("code replay", func(t *testing.T) {
+		var body map[string]string
+		status := rp.token(url.Values{
+			"grant_type":    {util.GrantAuthorizationCode},
+			"code":          {rp.lastCode},
+			"redirect_uri":  {rp.redirectURI()},
+			"code_verifier": {"anything"},
+		}, &body)
+		if status != http.StatusBadRequest || body["error"] != "invalid_grant" {
+			t.Errorf("redeeming a used code: %d %v, want 400 invalid_grant", status, body)
+		}
+	})
+
+	t.Run("refresh rotation", func(t *testing.T) {
+		first := rp.refresh
+		var tokens util.OAuthTokens
+		if status := rp.token(url.Values{"grant_type": {util.GrantRefreshToken}, "refresh_token": {first}}, &tokens); status != http.StatusOK {
+			t.Fatalf("refresh: status %d", status)
+		}
+		if tokens.RefreshToken == "" || tokens.RefreshToken == first {
+			t.Fatalf("refresh token was not rotated")
+		}
+		var info map[string]interface{}
+		if status := rp.userInfo(tokens.AccessToken, &info); status != http.StatusOK || info["sub"] != userID {
+			t.Errorf("userinfo with refreshed token: %d %v", status, info)
+		}
+
+		// Reusing the old token revokes the family, including the new token.
+		var body map[string]string
+		if status := rp.token(url.Values{"grant_type": {util.GrantRefreshToken}, "refresh_token": {first}}, &body); status != http.StatusBadRequest {
+			t.Errorf("reusing a rotated refresh token: status %d, want 400", status)
+		}
+		if status := rp.token(url.Values{"grant_type": {util.GrantRefreshToken}, "refresh_token": {tokens.RefreshToken}}, &body); status != http.StatusBadRequest {
+			t.Errorf("refresh after reuse: status %d, want 400", status)
+		}
+	})
+
+	t.Run("wrong password", func(t *testing.T) {
+		status, result := signIn(t, rp, "", "alice", "wrong", "allow")
+		if status != http.StatusUnauthorized || result != (rpResult{}) {
+			t.Errorf("sign-in with a wrong password ended with %d %+v, want the form again", status, result)
+		}
+	})
+
+	t.Run("denied", func(t *testing.T) {
+		status, result := signIn(t, rp, "", "alice", "correct horse", "deny")
+		if status != http.StatusOK || result.Error != "access_denied" {
+			t.Errorf("denied sign-in ended with %d %+v, want access_denied", status, result)
+		}
+	})
+
+	t.Run("unregistered redirect URI", func(t *testing.T) {
+		query := url.Values{"redirect_uri": {"https://attacker.example/callback"}}.Encode()
+		if status, _ := signIn(t, rp, query, "alice", "correct horse", "allow"); status != http.StatusBadRequest {
+			t.Errorf("unregistered redirect URI: status %d, want 400", status)
+		}
+	})
+
+	t.Run("wrong client secret", func(t *testing.T) {
+		bad := &oidcClient{t: t, provider: rp.provider, clientID: rp.clientID, secret: "wrong"}
+		var body map[string]string
+		status := bad.token(url.Values{"grant_type": {util.GrantRefreshToken}, "refresh_token": {"x"}}, &body)
+		if status != http.StatusUnauthorized || body["error"] != "invalid_client" {
+			t.Errorf("wrong client secret: %d %v, want 401 invalid_client", status, body)
+		}
+	})
+}
+
+func TestOIDCClientCredentials(t *testing.T) {
+	m, provider := newOIDCProvider(t)
+	ctx := context.Background()
+
+	admin := util.Principal{ID: "test", Kind: util.PrincipalUser}
+	client, secret, err := m.RegisterClient(ctx, admin, util.ClientRegistration{
+		Name:       "Service",
+		GrantTypes: []string{util.GrantClientCredentials},
+		Scopes:     []string{util.ScopeProfile},
+	})
+	if err != nil {
+		t.Fatalf("RegisterClient: %v", err)
+	}
+	rp := &oidcClient{t: t, provider: provider.URL, clientID: client.ID, secret: secret}
+
+	var tokens util.OAuthTokens
+	if status := rp.token(url.Values{"grant_type": {util.GrantClientCredentials}, "scope": {util.ScopeProfile}}, &tokens); status != http.StatusOK {
+		t.Fatalf("client_credentials: status %d", status)
+	}
+	claims, err := m.VerifyAccessToken(tokens.AccessToken)
+	if err != nil {
+		t.Fatalf("VerifyAccessToken: %v", err)
+	}
+	if claims.Subject != client.ID || claims.ClientID != client.ID || claims.Issuer != provider.URL {
+		t.Errorf("client token claims %+v, want subject and client %s from %s", claims, client.ID, provider.URL)
+	}
+
+	// The token names no user, so there is no user info to return.
+	var body map[string]string
+	if status := rp.userInfo(tokens.AccessToken, &body); status != http.StatusForbidden || body["error"] != "insufficient_scope" {
+		t.Errorf("userinfo with a client token: %d %v, want 403 insufficient_scope", status, body)
+	}
+
+	if status := rp.token(url.Values{"grant_type": {util.GrantClientCredentials}, "scope": {util.ScopeOpenID}}, &body); status != http.StatusBadRequest || body["error"] != "invalid_scope" {
+		t.Errorf("client_credentials with a scope not allowed: %d %v, want 400 invalid_scope", status, body)
+	}
+}
+
+// TestOIDCIssuerRequired checks that without JWT_ISSUER the provider refuses
+// to work rather than name whatever host the request was sent to.
+func TestOIDCIssuerRequired(t *testing.T) {
+	t.Setenv("JWT_ISSUER", "")
+	useTestManager(t)
+	r := mux.NewRouter()
+	RegisterOIDC(r)
+
+	for _, target := range []string{"/.well-known/openid-configuration", "/authorize?client_id=c&redirect_uri=https://rp.example.com/cb"} {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.Host = "evil.example.com"
+		req.Header.Set("X-Forwarded-Proto", "https")
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		if rec.Code != http.StatusInternalServerError || strings.Contains(rec.Body.String(), "evil.example.com") {
+			t.Errorf("GET %s without JWT_ISSUER: %d %s", target, rec.Code, rec.Body)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"ipfs-identity/util"
+)
+
+type forgotPasswordRequest struct {
+	Username string `json:"username"`
+}
+
+// ForgotPasswordHandler handles POST /password/forgot. It answers 202 whether
+// or not the account exists; the reset link is delivered by the notifier.
+func ForgotPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	var req forgotPasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Username == "" {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if err := im.RequestPasswordReset(r.Context(), req.Username); err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{"message": "If the account exists, a reset link has been sent"})
+}
+
+type resetPasswordRequest struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+// ResetPasswordHandler handles POST /password/reset. It sets the new password
+// and ends every session of the user.
+func ResetPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	var req resetPasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token == "" || req.Password == "" {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if err := im.ResetPassword(r.Context(), req.Token, req.Password); err != nil {
+		if errors.Is(err, util.ErrInvalidResetToken) {
+			authLog.Warn(fmt.Sprintf("Invalid password reset token from %s", r.RemoteAddr))
+			writeError(w, err, http.StatusBadRequest)
+			return
+		}
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Password reset"})
+}
@@ -0,0 +1,78 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+type updateKeyRequest struct {
+	PublicKeyMultibase string `json:"public_key_multibase"`
+}
+
+// UpdateKeyHandler handles POST /users/{id}/update-key. It registers the first
+// key profile updates must be signed with; later keys are set by a signed
+// update.
+func UpdateKeyHandler(w http.ResponseWriter, r *http.Request) {
+	var req updateKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.PublicKeyMultibase == "" {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	actor, _ := PrincipalFrom(r.Context())
+	if err := im.RegisterUpdateKey(r.Context(), actor, mux.Vars(r)["id"], req.PublicKeyMultibase); err != nil {
+		writeError(w, err, http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Update key registered"})
+}
+
+type signedUpdateRequest struct {
+	Update json.RawMessage `json:"update"` // JWS string or object with a Data Integrity proof
+}
+
+// SignedUpdateHandler handles POST /users/{id}/updates. It applies a profile
+// update signed with the user's update key.
+func SignedUpdateHandler(w http.ResponseWriter, r *http.Request) {
+	var req signedUpdateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.Update) == 0 {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	actor, _ := PrincipalFrom(r.Context())
+	update, err := im.ApplySignedUpdate(r.Context(), actor, mux.Vars(r)["id"], req.Update)
+	if err != nil {
+		writeError(w, err, http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(update)
+}
+
+// ProfileUpdatesHandler handles GET /users/{id}/updates. It lists the user's
+// profile updates, newest first, with the documents as signed so anyone can
+// check them against the update keys. ?limit= caps the list (default 100),
+// and next_cursor, passed back as ?cursor=, continues it.
+func ProfileUpdatesHandler(w http.ResponseWriter, r *http.Request) {
+	limit := 100
+	if s := r.URL.Query().Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	updates, next, err := im.ProfileUpdates(r.Context(), mux.Vars(r)["id"], limit, r.URL.Query().Get("cursor"))
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"updates": updates, "next_cursor": next})
+}
@@ -0,0 +1,100 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+type roleRequest struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Permissions []string `json:"permissions"`
+}
+
+// RolesHandler handles GET and POST /admin/roles. GET lists the built-in and
+// custom roles; POST creates a custom role.
+func RolesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		var req roleRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		actor, _ := PrincipalFrom(r.Context())
+		if err := im.CreateRole(r.Context(), actor, req.Name, req.Description, req.Permissions); err != nil {
+			writeError(w, err, http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	}
+
+	roles, err := im.Roles(r.Context())
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"roles": roles})
+}
+
+type assignRoleRequest struct {
+	Role string `json:"role"`
+}
+
+// AssignRoleHandler handles POST /admin/users/{id}/roles and gives the user
+// the role named in the body.
+func AssignRoleHandler(w http.ResponseWriter, r *http.Request) {
+	var req assignRoleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Role == "" {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	id := mux.Vars(r)["id"]
+	actor, _ := PrincipalFrom(r.Context())
+	if err := im.AssignRole(r.Context(), actor, id, req.Role); err != nil {
+		writeError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Role assigned", "id": id, "role": req.Role})
+}
+
+// RevokeRoleHandler handles DELETE /admin/users/{id}/roles/{role}.
+func RevokeRoleHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	actor, _ := PrincipalFrom(r.Context())
+	if err := im.RevokeRole(r.Context(), actor, vars["id"], vars["role"]); err != nil {
+		writeError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Role revoked", "id": vars["id"], "role": vars["role"]})
+}
+
+// AuditHandler handles GET /admin/audit and returns the most recent role
+// changes, newest first. The limit query parameter defaults to 100; the
+// next_cursor of the response, passed back as cursor, continues the list.
+func AuditHandler(w http.ResponseWriter, r *http.Request) {
+	limit := 100
+	if value := r.URL.Query().Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	records, next, err := im.AuditTrail(r.Context(), limit, r.URL.Query().Get("cursor"))
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"records": records, "next_cursor": next})
+}
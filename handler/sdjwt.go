@@ -0,0 +1,137 @@
+package handler
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"ipfs-identity/did"
+	"ipfs-identity/sdjwt"
+)
+
+// AttributesHandler handles GET and PUT /admin/users/{id}/attributes. PUT
+// replaces every attribute of the user with the object in the body.
+func AttributesHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if r.Method == http.MethodPut {
+		var attributes map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&attributes); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		actor, _ := PrincipalFrom(r.Context())
+		if err := im.SetAttributes(r.Context(), actor, id, attributes); err != nil {
+			writeError(w, err, http.StatusBadRequest)
+			return
+		}
+	}
+	attributes, err := im.Attributes(r.Context(), id)
+	if err != nil {
+		writeError(w, err, http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"id": id, "attributes": attributes})
+}
+
+type issueSDJWTRequest struct {
+	HolderJWK map[string]string `json:"holder_jwk"` // Optional Ed25519 key to bind instead of the DID key
+}
+
+// IssueSDJWTHandler handles POST /users/{id}/sd-jwt. It returns an SD-JWT
+// with every disclosure, and the paths that can be disclosed.
+func IssueSDJWTHandler(w http.ResponseWriter, r *http.Request) {
+	var req issueSDJWTRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+	}
+	var holder ed25519.PublicKey
+	if req.HolderJWK != nil {
+		var err error
+		if holder, err = did.ParsePublicJWK(req.HolderJWK); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	actor, _ := PrincipalFrom(r.Context())
+	token, err := im.IssueSDJWT(r.Context(), actor, mux.Vars(r)["id"], holder)
+	if err != nil {
+		writeError(w, err, http.StatusBadRequest)
+		return
+	}
+	paths, _ := sdjwt.Disclosable(token)
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"sd_jwt": token, "disclosable": paths})
+}
+
+type presentSDJWTRequest struct {
+	SDJWT    string   `json:"sd_jwt"`
+	Disclose []string `json:"disclose"` // Paths as listed at issuance
+	Audience string   `json:"audience"` // With nonce, asks for a Key Binding JWT to sign
+	Nonce    string   `json:"nonce"`
+}
+
+// PresentSDJWTHandler handles POST /sd-jwt/present. It builds a presentation
+// for clients that cannot do it themselves, and nothing is stored. The holder
+// key never travels: given an audience and a nonce, the response carries the
+// signing input of the Key Binding JWT as key_binding_input, which the holder
+// signs and appends, as "<input>.<signature>", to the presentation.
+func PresentSDJWTHandler(w http.ResponseWriter, r *http.Request) {
+	var req presentSDJWTRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.SDJWT == "" {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	presentation, err := sdjwt.Present(req.SDJWT, req.Disclose, nil, "", "")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	response := map[string]string{"presentation": presentation}
+	if req.Audience != "" || req.Nonce != "" {
+		input, err := sdjwt.KeyBindingInput(presentation, req.Audience, req.Nonce)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		response["key_binding_input"] = input
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+type verifySDJWTRequest struct {
+	Presentation      string `json:"presentation"`
+	Audience          string `json:"audience"`
+	Nonce             string `json:"nonce"`
+	RequireKeyBinding bool   `json:"require_key_binding"`
+}
+
+// VerifySDJWTHandler handles POST /sd-jwt/verify. Like /credentials/verify, a
+// presentation that fails is answered with 200, verified false and the
+// reason.
+func VerifySDJWTHandler(w http.ResponseWriter, r *http.Request) {
+	var req verifySDJWTRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Presentation == "" {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	result, err := im.VerifySDJWT(r.Context(), req.Presentation, req.Audience, req.Nonce, req.RequireKeyBinding)
+	response := struct {
+		Verified bool `json:"verified"`
+		*sdjwt.Result
+		Error string `json:"error,omitempty"`
+	}{Verified: err == nil, Result: result}
+	if err != nil {
+		response.Error = err.Error()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,106 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"ipfs-identity/util"
+)
+
+type siweRequest struct {
+	Message   string `json:"message"`   // EIP-4361 message text
+	Signature string `json:"signature"` // 0x-prefixed personal_sign signature
+}
+
+// SIWENonceHandler handles GET /siwe/nonce. The nonce goes into the Nonce
+// field of the next message the wallet signs.
+func SIWENonceHandler(w http.ResponseWriter, r *http.Request) {
+	nonce, expires, err := im.SIWENonce()
+	if err != nil {
+		http.Error(w, "Failed to generate nonce", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"nonce":      nonce,
+		"expires_at": expires.UTC().Format(time.RFC3339),
+	})
+}
+
+// SIWELoginHandler handles POST /siwe/login. It verifies the signed message
+// and issues session tokens for the user the wallet is linked to.
+func SIWELoginHandler(w http.ResponseWriter, r *http.Request) {
+	var req siweRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Message == "" || req.Signature == "" {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	id, amr, err := im.SIWELogin(r.Context(), req.Message, req.Signature)
+	if err != nil {
+		authLog.Warn(fmt.Sprintf("Failed wallet login from %s: %v", r.RemoteAddr, err))
+		writeError(w, err, http.StatusUnauthorized)
+		return
+	}
+	tokens, err := im.IssueTokens(id, amr)
+	if err != nil {
+		http.Error(w, "Failed to issue tokens", http.StatusInternalServerError)
+		return
+	}
+
+	response := struct {
+		ID string `json:"id"`
+		util.TokenPair
+	}{id, tokens}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// WalletsHandler handles GET and POST /users/{id}/wallets. GET lists the
+// linked addresses; POST links the wallet that signed the message in the
+// body.
+func WalletsHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if r.Method == http.MethodGet {
+		wallets, err := im.Wallets(r.Context(), id)
+		if err != nil {
+			writeError(w, err, http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(wallets)
+		return
+	}
+
+	var req siweRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Message == "" || req.Signature == "" {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	actor, _ := PrincipalFrom(r.Context())
+	address, err := im.LinkWallet(r.Context(), actor, id, req.Message, req.Signature)
+	if err != nil {
+		writeError(w, err, http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Wallet linked", "address": address})
+}
+
+// UnlinkWalletHandler handles DELETE /users/{id}/wallets/{address}.
+func UnlinkWalletHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	actor, _ := PrincipalFrom(r.Context())
+	if err := im.UnlinkWallet(r.Context(), actor, vars["id"], vars["address"]); err != nil {
+		writeError(w, err, http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Wallet unlinked", "address": vars["address"]})
+}
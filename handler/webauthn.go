@@ -0,0 +1,126 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"ipfs-identity/util"
+)
+
+// WebAuthnRegisterOptionsHandler handles POST
+// /users/{id}/webauthn/register/options. It returns the options to pass to
+// navigator.credentials.create.
+func WebAuthnRegisterOptionsHandler(w http.ResponseWriter, r *http.Request) {
+	opts, err := im.BeginWebAuthnRegistration(r.Context(), mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, err, http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"publicKey": opts})
+}
+
+type webauthnRegisterRequest struct {
+	Name       string                  `json:"name"`
+	Credential util.CredentialResponse `json:"credential"`
+}
+
+// WebAuthnRegisterHandler handles POST /users/{id}/webauthn/register. It takes
+// the credential created by the authenticator, with an optional name, and
+// stores it.
+func WebAuthnRegisterHandler(w http.ResponseWriter, r *http.Request) {
+	var req webauthnRegisterRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Credential.Response.AttestationObject == "" {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	cred, err := im.FinishWebAuthnRegistration(r.Context(), mux.Vars(r)["id"], req.Name, req.Credential)
+	if err != nil {
+		writeError(w, err, http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(cred)
+}
+
+// WebAuthnCredentialsHandler handles GET /users/{id}/webauthn/credentials.
+func WebAuthnCredentialsHandler(w http.ResponseWriter, r *http.Request) {
+	creds, err := im.WebAuthnCredentials(r.Context(), mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, err, http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(creds)
+}
+
+// DeleteWebAuthnCredentialHandler handles DELETE
+// /users/{id}/webauthn/credentials/{credId}.
+func DeleteWebAuthnCredentialHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	actor, _ := PrincipalFrom(r.Context())
+	if err := im.RemoveWebAuthnCredential(r.Context(), actor, vars["id"], vars["credId"]); err != nil {
+		writeError(w, err, http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Credential removed", "id": vars["credId"]})
+}
+
+// WebAuthnLoginOptionsHandler handles POST /webauthn/login/options. The body
+// may name a username to restrict the login to that user's credentials; an
+// empty body asks for a passkey.
+func WebAuthnLoginOptionsHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Username string `json:"username"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+	}
+	opts, err := im.BeginWebAuthnLogin(r.Context(), req.Username)
+	if err != nil {
+		writeError(w, err, http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"publicKey": opts})
+}
+
+// WebAuthnLoginHandler handles POST /webauthn/login. It verifies the
+// assertion and issues the session tokens. A credential that verified the
+// user satisfies MFA_REQUIRED_ROLES on its own.
+func WebAuthnLoginHandler(w http.ResponseWriter, r *http.Request) {
+	var req util.CredentialResponse
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ID == "" || req.Response.Signature == "" {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	id, amr, err := im.FinishWebAuthnLogin(r.Context(), req)
+	if err != nil {
+		authLog.Warn(fmt.Sprintf("Failed WebAuthn login from %s: %v", r.RemoteAddr, err))
+		writeError(w, err, http.StatusUnauthorized)
+		return
+	}
+	tokens, err := im.IssueTokens(id, amr)
+	if err != nil {
+		http.Error(w, "Failed to issue tokens", http.StatusInternalServerError)
+		return
+	}
+
+	response := struct {
+		ID string `json:"id"`
+		util.TokenPair
+	}{id, tokens}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
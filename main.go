@@ -11,6 +11,7 @@ import (
 	"github.com/gorilla/mux"
 	"ipfs-identity/handler" 
 	"ipfs-identity/logger"
+	"ipfs-identity/util"
 )
 
 
@@ -28,11 +29,120 @@ func main() {
 	}
 	defer log.Sync()
 
+	handler.SetManager(util.NewIdentityManager())
+
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := runMigrate(log); err != nil {
+			log.Error(err.Error())
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "bootstrap-admin" {
+		if err := runBootstrapAdmin(log, os.Args[2:]); err != nil {
+			log.Error(err.Error())
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// In maintenance mode only /health and /admin are served.
+	r.Use(handler.EnforceMode)
+
 	// Define API endpoints.
 	r.HandleFunc("/addusers", handler.AddUserHandler).Methods("POST")
-	r.HandleFunc("/users/{id}", handler.UpdateUserHandler).Methods("PUT")
-	r.HandleFunc("/users/{id}", handler.DeleteUserHandler).Methods("DELETE")
 	r.HandleFunc("/login", handler.LoginHandler).Methods("POST")
+	r.HandleFunc("/login/mfa", handler.MFALoginHandler).Methods("POST")
+	r.HandleFunc("/webauthn/login/options", handler.WebAuthnLoginOptionsHandler).Methods("POST")
+	r.HandleFunc("/webauthn/login", handler.WebAuthnLoginHandler).Methods("POST")
+	r.HandleFunc("/siwe/nonce", handler.SIWENonceHandler).Methods("GET")
+	r.HandleFunc("/siwe/login", handler.SIWELoginHandler).Methods("POST")
+	r.HandleFunc("/did/auth/nonce", handler.DIDAuthNonceHandler).Methods("GET")
+	r.HandleFunc("/did/login", handler.DIDLoginHandler).Methods("POST")
+	r.HandleFunc("/.well-known/did.json", handler.ServiceDIDHandler).Methods("GET")
+	r.HandleFunc("/users/{id}/did.json", handler.UserDIDDocumentHandler).Methods("GET")
+	r.HandleFunc("/users/{id}/did", handler.UserDIDHandler).Methods("GET")
+	r.HandleFunc("/users/{id}/updates", handler.ProfileUpdatesHandler).Methods("GET")
+	r.HandleFunc("/credentials/verify", handler.VerifyCredentialHandler).Methods("POST")
+	r.HandleFunc("/credentials/status/{list}", handler.StatusListHandler).Methods("GET")
+	r.HandleFunc("/sd-jwt/present", handler.PresentSDJWTHandler).Methods("POST")
+	r.HandleFunc("/sd-jwt/verify", handler.VerifySDJWTHandler).Methods("POST")
+	r.HandleFunc("/password/forgot", handler.ForgotPasswordHandler).Methods("POST")
+	r.HandleFunc("/password/reset", handler.ResetPasswordHandler).Methods("POST")
+	r.HandleFunc("/email/verify", handler.VerifyEmailHandler).Methods("GET", "POST")
+	r.HandleFunc("/token/refresh", handler.RefreshHandler).Methods("POST")
+	r.HandleFunc("/health", handler.HealthHandler).Methods("GET")
+
+	// Users may only modify their own account unless they are admins, and
+	// admins only accounts with no permissions they lack.
+	users := r.PathPrefix("/users/{id}").Subrouter()
+	users.Use(handler.Authenticate, handler.RequireSelfOr(util.PermUsersWrite))
+	users.HandleFunc("", handler.UpdateUserHandler).Methods("PUT")
+	users.HandleFunc("", handler.DeleteUserHandler).Methods("DELETE")
+	users.HandleFunc("/credentials", handler.UserCredentialsHandler).Methods("GET")
+	users.HandleFunc("/sd-jwt", handler.IssueSDJWTHandler).Methods("POST")
+	users.HandleFunc("/updates", handler.SignedUpdateHandler).Methods("POST")
+	users.HandleFunc("/email", handler.EmailHandler).Methods("GET", "PUT")
+	users.HandleFunc("/email/verify", handler.ResendEmailVerificationHandler).Methods("POST")
+
+	// Login credentials can only be bound by the user.
+	self := r.PathPrefix("/users/{id}").Subrouter()
+	self.Use(handler.Authenticate, handler.RequireSelf)
+	self.HandleFunc("/mfa/totp", handler.EnrollTOTPHandler).Methods("POST")
+	self.HandleFunc("/mfa/totp", handler.DisableTOTPHandler).Methods("DELETE")
+	self.HandleFunc("/mfa/totp/confirm", handler.ConfirmTOTPHandler).Methods("POST")
+	self.HandleFunc("/webauthn/register/options", handler.WebAuthnRegisterOptionsHandler).Methods("POST")
+	self.HandleFunc("/webauthn/register", handler.WebAuthnRegisterHandler).Methods("POST")
+	self.HandleFunc("/webauthn/credentials", handler.WebAuthnCredentialsHandler).Methods("GET")
+	self.HandleFunc("/webauthn/credentials/{credId}", handler.DeleteWebAuthnCredentialHandler).Methods("DELETE")
+	self.HandleFunc("/wallets", handler.WalletsHandler).Methods("GET", "POST")
+	self.HandleFunc("/wallets/{address}", handler.UnlinkWalletHandler).Methods("DELETE")
+	self.HandleFunc("/did/rotate", handler.RotateDIDKeyHandler).Methods("POST")
+	self.HandleFunc("/dids", handler.LinkedDIDsHandler).Methods("GET", "POST", "DELETE")
+	self.HandleFunc("/update-key", handler.UpdateKeyHandler).Methods("POST")
+
+	admin := r.PathPrefix("/admin").Subrouter()
+	admin.Use(handler.Authenticate)
+	system := admin.NewRoute().Subrouter()
+	system.Use(handler.RequirePermission(util.PermSystem))
+	system.HandleFunc("/network", handler.NetworkHandler).Methods("GET")
+	system.HandleFunc("/mfs/check", handler.MirrorCheckHandler).Methods("GET")
+	system.HandleFunc("/mode", handler.ModeHandler).Methods("GET", "POST")
+	roles := admin.NewRoute().Subrouter()
+	roles.Use(handler.RequirePermission(util.PermRolesManage))
+	roles.HandleFunc("/roles", handler.RolesHandler).Methods("GET", "POST")
+	roles.HandleFunc("/users/{id}/roles", handler.AssignRoleHandler).Methods("POST")
+	roles.HandleFunc("/users/{id}/roles/{role}", handler.RevokeRoleHandler).Methods("DELETE")
+	audit := admin.NewRoute().Subrouter()
+	audit.Use(handler.RequirePermission(util.PermAuditRead))
+	audit.HandleFunc("/audit", handler.AuditHandler).Methods("GET")
+	policies := admin.NewRoute().Subrouter()
+	policies.Use(handler.RequirePermission(util.PermPoliciesManage))
+	policies.HandleFunc("/policies", handler.PoliciesHandler).Methods("GET")
+	policies.HandleFunc("/policies/{id}", handler.PutPolicyHandler).Methods("PUT")
+	policies.HandleFunc("/policies/{id}", handler.DeletePolicyHandler).Methods("DELETE")
+	policies.HandleFunc("/policies/{id}/history", handler.PolicyHistoryHandler).Methods("GET")
+	clients := admin.NewRoute().Subrouter()
+	clients.Use(handler.RequirePermission(util.PermClientsManage))
+	clients.HandleFunc("/clients", handler.ClientsHandler).Methods("GET", "POST")
+	clients.HandleFunc("/clients/{id}", handler.DeleteClientHandler).Methods("DELETE")
+	credentials := admin.NewRoute().Subrouter()
+	credentials.Use(handler.RequirePermission(util.PermCredentialsIssue))
+	credentials.HandleFunc("/credentials", handler.CredentialsHandler).Methods("GET", "POST")
+	credentials.HandleFunc("/credentials/{id}/revoke", handler.RevokeCredentialHandler).Methods("POST")
+	attributes := admin.NewRoute().Subrouter()
+	attributes.Use(handler.RequirePermission(util.PermUsersWrite))
+	attributes.HandleFunc("/users/{id}/attributes", handler.AttributesHandler).Methods("GET", "PUT")
+
+	// Policy decisions for other services.
+	authz := r.PathPrefix("/authz").Subrouter()
+	authz.Use(handler.Authenticate, handler.RequirePermission(util.PermAuthzCheck))
+	authz.HandleFunc("/check", handler.AuthzCheckHandler).Methods("POST")
+
+	// OpenID Connect provider.
+	handler.RegisterOIDC(r)
 
 	// Optional: You can add a root handler.
 	r.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"ipfs-identity/handler"
+	"ipfs-identity/logger"
+	"ipfs-identity/util"
+)
+
+// runMigrate implements the `migrate` command: it rewrites the stored user
+// database at the current schema version and records the upgrade in the
+// ledger. Run it while the server is stopped.
+func runMigrate(log logger.Logger) error {
+	from, cid, err := handler.Manager().Migrate(context.Background())
+	if err != nil {
+		return fmt.Errorf("migration failed: %w", err)
+	}
+	if from == util.CurrentSchemaVersion {
+		log.Info(fmt.Sprintf("Schema is already at version %d (root %s)", from, cid))
+		fmt.Printf("already at schema %d: %s\n", from, cid)
+		return nil
+	}
+	log.Info(fmt.Sprintf("Migrated schema %d -> %d, new root %s", from, util.CurrentSchemaVersion, cid))
+	fmt.Printf("migrated schema %d -> %d: %s\n", from, util.CurrentSchemaVersion, cid)
+	return nil
+}
@@ -0,0 +1,699 @@
+// Package sdjwt issues, presents and verifies Selective Disclosure JWTs (RFC
+// 9901) signed with Ed25519. Like package did, it does not depend on the rest
+// of the service, so holders and verifiers can import it directly.
+package sdjwt
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"ipfs-identity/did"
+)
+
+// Header and claim values defined by the specification.
+const (
+	AlgSHA256     = "sha-256" // The only _sd_alg supported
+	TypKeyBinding = "kb+jwt"
+
+	algEdDSA = "EdDSA"
+)
+
+// Disclosure reveals one selectively disclosable claim or array element.
+type Disclosure struct {
+	Salt    string
+	Name    string // Claim name; empty for an array element
+	Value   interface{}
+	Encoded string // base64url of the JSON array, exactly as it was sent
+}
+
+// NewDisclosure returns a disclosure of the claim name with a random salt.
+func NewDisclosure(name string, value interface{}) (Disclosure, error) {
+	if name == "" || name == "_sd" || name == "..." {
+		return Disclosure{}, fmt.Errorf("sdjwt: %q cannot be a disclosed claim name", name)
+	}
+	return newDisclosure(name, value)
+}
+
+// NewElementDisclosure returns a disclosure of an array element with a random
+// salt.
+func NewElementDisclosure(value interface{}) (Disclosure, error) {
+	return newDisclosure("", value)
+}
+
+func newDisclosure(name string, value interface{}) (Disclosure, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return Disclosure{}, err
+	}
+	d := Disclosure{Salt: base64.RawURLEncoding.EncodeToString(salt), Name: name, Value: value}
+	array := []interface{}{d.Salt, name, value}
+	if name == "" {
+		array = []interface{}{d.Salt, value}
+	}
+	data, err := json.Marshal(array)
+	if err != nil {
+		return Disclosure{}, err
+	}
+	d.Encoded = base64.RawURLEncoding.EncodeToString(data)
+	return d, nil
+}
+
+// ParseDisclosure decodes a disclosure. The examples from RFC 9901 decode as
+//
+//	WyI2cU1RdlJMNWhhaiIsICJmYW1pbHlfbmFtZSIsICJNw7ZiaXVzIl0  family_name "Möbius"
+//	WyJsa2x4RjVqTVlsR1RQVW92TU5JdkNBIiwgIkZSIl0              array element "FR"
+func ParseDisclosure(encoded string) (Disclosure, error) {
+	data, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return Disclosure{}, errors.New("sdjwt: disclosure is not base64url")
+	}
+	var array []interface{}
+	if err := json.Unmarshal(data, &array); err != nil {
+		return Disclosure{}, errors.New("sdjwt: disclosure is not a JSON array")
+	}
+	d := Disclosure{Encoded: encoded}
+	switch len(array) {
+	case 2:
+		d.Value = array[1]
+	case 3:
+		name, ok := array[1].(string)
+		if !ok || name == "_sd" || name == "..." {
+			return Disclosure{}, errors.New("sdjwt: disclosure has an invalid claim name")
+		}
+		d.Name, d.Value = name, array[2]
+	default:
+		return Disclosure{}, errors.New("sdjwt: disclosure must have two or three elements")
+	}
+	salt, ok := array[0].(string)
+	if !ok {
+		return Disclosure{}, errors.New("sdjwt: disclosure salt must be a string")
+	}
+	d.Salt = salt
+	return d, nil
+}
+
+// Digest returns the SHA-256 digest by which the signed payload refers to the
+// disclosure. For the examples above they are
+// uutlBuYeMDyjLLTpf6Jxi7yNkEF35jdyWMn9U7b_RYY and
+// w0I8EKcdCtUPkGCNUrfwVp2xEgNjtoIDlOxc9-PlOhs.
+func (d Disclosure) Digest() string {
+	sum := sha256.Sum256([]byte(d.Encoded))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// Token is an SD-JWT or a presentation of one, split into its parts.
+type Token struct {
+	JWT         string // Issuer-signed JWT
+	Disclosures []Disclosure
+	KeyBinding  string // Key Binding JWT, empty if there is none
+}
+
+// Parse splits the compact form <JWT>~<disclosure>~...~[<KB-JWT>].
+func Parse(s string) (*Token, error) {
+	parts := strings.Split(s, "~")
+	if len(parts) < 2 || parts[0] == "" {
+		return nil, errors.New("sdjwt: not an SD-JWT")
+	}
+	t := &Token{JWT: parts[0], KeyBinding: parts[len(parts)-1]}
+	for _, encoded := range parts[1 : len(parts)-1] {
+		d, err := ParseDisclosure(encoded)
+		if err != nil {
+			return nil, err
+		}
+		t.Disclosures = append(t.Disclosures, d)
+	}
+	return t, nil
+}
+
+// String returns the compact form of t.
+func (t *Token) String() string {
+	return t.unbound() + t.KeyBinding
+}
+
+// unbound returns the compact form without the Key Binding JWT, the input of
+// its sd_hash.
+func (t *Token) unbound() string {
+	var b strings.Builder
+	b.WriteString(t.JWT)
+	b.WriteByte('~')
+	for _, d := range t.Disclosures {
+		b.WriteString(d.Encoded)
+		b.WriteByte('~')
+	}
+	return b.String()
+}
+
+// IssueOptions control how Issue signs an SD-JWT.
+type IssueOptions struct {
+	Key    ed25519.PrivateKey
+	KeyID  string            // kid header, e.g. a DID URL
+	Type   string            // typ header, e.g. "example+sd-jwt"
+	Holder ed25519.PublicKey // Bound as cnf.jwk if set; presentations must then be signed with it
+
+	// Disclosable names top-level claims the holder may choose to reveal.
+	// When such a claim is an array, each element is disclosable too, so one
+	// entry of a list can be shown without the others.
+	Disclosable []string
+}
+
+// Issue signs claims as an SD-JWT and returns it with every disclosure
+// attached. The holder then chooses which to pass on with Present.
+func Issue(claims map[string]interface{}, opts IssueOptions) (string, error) {
+	payload := make(map[string]interface{}, len(claims)+3)
+	for k, v := range claims {
+		payload[k] = v
+	}
+	var disclosures []Disclosure
+	var digests []string
+	for _, name := range opts.Disclosable {
+		value, ok := payload[name]
+		if !ok {
+			continue
+		}
+		delete(payload, name)
+		if list, ok := value.([]interface{}); ok {
+			elements := make([]interface{}, 0, len(list))
+			for _, item := range list {
+				d, err := NewElementDisclosure(item)
+				if err != nil {
+					return "", err
+				}
+				disclosures = append(disclosures, d)
+				elements = append(elements, map[string]interface{}{"...": d.Digest()})
+			}
+			value = elements
+		}
+		d, err := NewDisclosure(name, value)
+		if err != nil {
+			return "", err
+		}
+		disclosures = append(disclosures, d)
+		digests = append(digests, d.Digest())
+	}
+	// Sorted digests say nothing about the order claims were listed in.
+	sort.Strings(digests)
+	if len(digests) > 0 {
+		payload["_sd"] = digests
+		payload["_sd_alg"] = AlgSHA256
+	}
+	if opts.Holder != nil {
+		payload["cnf"] = map[string]interface{}{"jwk": did.PublicJWK(opts.Holder)}
+	}
+
+	header := map[string]string{"alg": algEdDSA}
+	if opts.Type != "" {
+		header["typ"] = opts.Type
+	}
+	if opts.KeyID != "" {
+		header["kid"] = opts.KeyID
+	}
+	jwt, err := signJWT(header, payload, opts.Key)
+	if err != nil {
+		return "", err
+	}
+	return (&Token{JWT: jwt, Disclosures: disclosures}).String(), nil
+}
+
+// Disclosable lists the paths of the claims in an SD-JWT that can be
+// disclosed, such as "birthdate" or "roles/admin" for one element of the
+// roles array. The issuer's signature is not checked.
+func Disclosable(sdjwt string) ([]string, error) {
+	t, err := Parse(sdjwt)
+	if err != nil {
+		return nil, err
+	}
+	payload, err := decodePayload(t.JWT)
+	if err != nil {
+		return nil, err
+	}
+	p, err := newProcessor(t.Disclosures)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := p.object(payload, ""); err != nil {
+		return nil, err
+	}
+	paths := make([]string, 0, len(p.paths))
+	for _, path := range p.paths {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// Present returns a presentation of sdjwt revealing only the claims at the
+// given paths, as listed by Disclosable. With a
+// holder key it appends a Key Binding JWT for the audience and nonce of the
+// verifier.
+func Present(sdjwt string, paths []string, holder ed25519.PrivateKey, audience, nonce string) (string, error) {
+	t, err := Parse(sdjwt)
+	if err != nil {
+		return "", err
+	}
+	payload, err := decodePayload(t.JWT)
+	if err != nil {
+		return "", err
+	}
+	p, err := newProcessor(t.Disclosures)
+	if err != nil {
+		return "", err
+	}
+	if _, err := p.object(payload, ""); err != nil {
+		return "", err
+	}
+	wanted := make(map[string]bool, len(paths))
+	for _, path := range paths {
+		wanted[path] = true
+	}
+	found := make(map[string]bool, len(paths))
+	presentation := &Token{JWT: t.JWT}
+	for _, d := range t.Disclosures {
+		path := p.paths[d.Digest()]
+		// A claim comes with what contains it and everything inside it.
+		include := wanted[path]
+		for w := range wanted {
+			if strings.HasPrefix(w, path+"/") || strings.HasPrefix(path, w+"/") {
+				include = true
+			}
+		}
+		if include {
+			presentation.Disclosures = append(presentation.Disclosures, d)
+			found[path] = true
+		}
+	}
+	for _, path := range paths {
+		if !found[path] {
+			return "", fmt.Errorf("sdjwt: %s is not disclosable", path)
+		}
+	}
+	if holder == nil {
+		return presentation.String(), nil
+	}
+
+	if cnf, err := confirmationKey(payload); err != nil {
+		return "", err
+	} else if cnf != nil && !cnf.Equal(holder.Public()) {
+		return "", errors.New("sdjwt: holder key does not match the key the SD-JWT is bound to")
+	}
+	input, err := keyBindingInput(presentation.unbound(), audience, nonce)
+	if err != nil {
+		return "", err
+	}
+	presentation.KeyBinding = input + "." + base64.RawURLEncoding.EncodeToString(ed25519.Sign(holder, []byte(input)))
+	return presentation.String(), nil
+}
+
+// KeyBindingInput returns the signing input of a Key Binding JWT for a
+// presentation made by Present without a holder key, for holders whose key
+// cannot leave their device. Signing it with Ed25519 gives sig, and
+// presentation + input + "." + base64url(sig) is the bound presentation.
+func KeyBindingInput(presentation, audience, nonce string) (string, error) {
+	t, err := Parse(presentation)
+	if err != nil {
+		return "", err
+	}
+	if t.KeyBinding != "" {
+		return "", errors.New("sdjwt: presentation already has a Key Binding JWT")
+	}
+	return keyBindingInput(t.unbound(), audience, nonce)
+}
+
+// keyBindingInput returns the signing input of a Key Binding JWT over
+// unbound for the audience and nonce of the verifier.
+func keyBindingInput(unbound, audience, nonce string) (string, error) {
+	if audience == "" || nonce == "" {
+		return "", errors.New("sdjwt: key binding needs an audience and a nonce")
+	}
+	return jwtSigningInput(map[string]string{"alg": algEdDSA, "typ": TypKeyBinding}, map[string]interface{}{
+		"iat":     time.Now().Unix(),
+		"aud":     audience,
+		"nonce":   nonce,
+		"sd_hash": sdHash(unbound),
+	})
+}
+
+// VerifyOptions control what Verify accepts.
+type VerifyOptions struct {
+	// IssuerKey returns the key the issuer named by iss signs with, given
+	// the kid header of the issuer-signed JWT.
+	IssuerKey func(ctx context.Context, iss, kid string) (ed25519.PublicKey, error)
+
+	Audience          string        // Expected aud of the Key Binding JWT; any if empty
+	Nonce             string        // Expected nonce of the Key Binding JWT; any if empty
+	RequireKeyBinding bool          // Reject presentations without a Key Binding JWT
+	MaxKeyBindingAge  time.Duration // How old the Key Binding JWT may be; 5 minutes if zero
+}
+
+// Result is a verified presentation.
+type Result struct {
+	Issuer     string                 `json:"issuer"`
+	Claims     map[string]interface{} `json:"claims"`    // Signed claims with the disclosed ones filled in
+	Disclosed  []string               `json:"disclosed"` // Paths of the disclosed claims
+	KeyBinding bool                   `json:"key_binding"`
+}
+
+// Verify checks the issuer's signature and validity period, every disclosure
+// and, if present, the Key Binding JWT, and returns the disclosed claims.
+func Verify(ctx context.Context, presentation string, opts VerifyOptions) (*Result, error) {
+	t, err := Parse(presentation)
+	if err != nil {
+		return nil, err
+	}
+	header, payload, err := verifyJWT(t.JWT, func(header map[string]interface{}, payload map[string]interface{}) (ed25519.PublicKey, error) {
+		iss, _ := payload["iss"].(string)
+		kid, _ := header["kid"].(string)
+		if iss == "" {
+			return nil, errors.New("sdjwt: SD-JWT has no issuer")
+		}
+		return opts.IssuerKey(ctx, iss, kid)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if typ, _ := header["typ"].(string); typ == TypKeyBinding {
+		return nil, errors.New("sdjwt: a Key Binding JWT is not an SD-JWT")
+	}
+	now := time.Now().Unix()
+	if exp, ok := payload["exp"].(float64); ok && now >= int64(exp) {
+		return nil, errors.New("sdjwt: SD-JWT has expired")
+	}
+	if nbf, ok := payload["nbf"].(float64); ok && now < int64(nbf) {
+		return nil, errors.New("sdjwt: SD-JWT is not valid yet")
+	}
+	if alg, ok := payload["_sd_alg"]; ok && alg != AlgSHA256 {
+		return nil, fmt.Errorf("sdjwt: unsupported _sd_alg %v", alg)
+	}
+
+	p, err := newProcessor(t.Disclosures)
+	if err != nil {
+		return nil, err
+	}
+	claims, err := p.object(payload, "")
+	if err != nil {
+		return nil, err
+	}
+	if len(p.paths) != len(t.Disclosures) {
+		return nil, errors.New("sdjwt: a disclosure is not referenced by the SD-JWT")
+	}
+	delete(claims, "_sd_alg")
+	result := &Result{Claims: claims, Disclosed: make([]string, 0, len(p.paths))}
+	result.Issuer, _ = payload["iss"].(string)
+	for _, path := range p.paths {
+		result.Disclosed = append(result.Disclosed, path)
+	}
+	sort.Strings(result.Disclosed)
+
+	if t.KeyBinding == "" {
+		if opts.RequireKeyBinding {
+			return nil, errors.New("sdjwt: presentation has no Key Binding JWT")
+		}
+		return result, nil
+	}
+	holder, err := confirmationKey(payload)
+	if err != nil {
+		return nil, err
+	}
+	if holder == nil {
+		return nil, errors.New("sdjwt: Key Binding JWT given but the SD-JWT has no cnf key")
+	}
+	kbHeader, kb, err := verifyJWT(t.KeyBinding, func(map[string]interface{}, map[string]interface{}) (ed25519.PublicKey, error) {
+		return holder, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%w (Key Binding JWT)", err)
+	}
+	if kbHeader["typ"] != TypKeyBinding {
+		return nil, errors.New("sdjwt: Key Binding JWT must have typ kb+jwt")
+	}
+	maxAge := opts.MaxKeyBindingAge
+	if maxAge == 0 {
+		maxAge = 5 * time.Minute
+	}
+	iat, ok := kb["iat"].(float64)
+	if !ok {
+		return nil, errors.New("sdjwt: Key Binding JWT has no iat")
+	}
+	if issued := time.Unix(int64(iat), 0); time.Since(issued) > maxAge || time.Until(issued) > time.Minute {
+		return nil, errors.New("sdjwt: Key Binding JWT is too old or from the future")
+	}
+	aud, _ := kb["aud"].(string)
+	nonce, _ := kb["nonce"].(string)
+	if aud == "" || nonce == "" {
+		return nil, errors.New("sdjwt: Key Binding JWT needs aud and nonce")
+	}
+	if opts.Audience != "" && aud != opts.Audience {
+		return nil, errors.New("sdjwt: Key Binding JWT is for another audience")
+	}
+	if opts.Nonce != "" && nonce != opts.Nonce {
+		return nil, errors.New("sdjwt: Key Binding JWT nonce does not match")
+	}
+	if kb["sd_hash"] != sdHash(t.unbound()) {
+		return nil, errors.New("sdjwt: Key Binding JWT sd_hash does not match the presentation")
+	}
+	result.KeyBinding = true
+	return result, nil
+}
+
+// processor replaces digests with the claims they refer to, recording the
+// path of each disclosure used.
+type processor struct {
+	byDigest map[string]Disclosure
+	paths    map[string]string // Digest to path, for disclosures in use
+}
+
+func newProcessor(disclosures []Disclosure) (*processor, error) {
+	p := &processor{byDigest: make(map[string]Disclosure, len(disclosures)), paths: make(map[string]string)}
+	for _, d := range disclosures {
+		digest := d.Digest()
+		if _, dup := p.byDigest[digest]; dup {
+			return nil, errors.New("sdjwt: disclosure repeated")
+		}
+		p.byDigest[digest] = d
+	}
+	return p, nil
+}
+
+func (p *processor) object(obj map[string]interface{}, path string) (map[string]interface{}, error) {
+	out := make(map[string]interface{}, len(obj))
+	for k, v := range obj {
+		if k == "_sd" {
+			continue
+		}
+		value, err := p.value(v, joinPath(path, k))
+		if err != nil {
+			return nil, err
+		}
+		out[k] = value
+	}
+	sd, ok := obj["_sd"]
+	if !ok {
+		return out, nil
+	}
+	digests, ok := sd.([]interface{})
+	if !ok {
+		return nil, errors.New("sdjwt: _sd must be an array")
+	}
+	for _, item := range digests {
+		digest, ok := item.(string)
+		if !ok {
+			return nil, errors.New("sdjwt: _sd must hold strings")
+		}
+		d, disclosed := p.byDigest[digest]
+		if !disclosed {
+			continue // Withheld, or a decoy
+		}
+		if _, used := p.paths[digest]; used {
+			return nil, errors.New("sdjwt: digest referenced twice")
+		}
+		if d.Name == "" {
+			return nil, errors.New("sdjwt: array element disclosure used for an object property")
+		}
+		if _, exists := out[d.Name]; exists {
+			return nil, fmt.Errorf("sdjwt: claim %s disclosed twice", d.Name)
+		}
+		claimPath := joinPath(path, d.Name)
+		p.paths[digest] = claimPath
+		value, err := p.value(d.Value, claimPath)
+		if err != nil {
+			return nil, err
+		}
+		out[d.Name] = value
+	}
+	return out, nil
+}
+
+func (p *processor) value(v interface{}, path string) (interface{}, error) {
+	switch x := v.(type) {
+	case map[string]interface{}:
+		return p.object(x, path)
+	case []interface{}:
+		out := make([]interface{}, 0, len(x))
+		for _, item := range x {
+			if ref, ok := item.(map[string]interface{}); ok && len(ref) == 1 {
+				if digestValue, ok := ref["..."]; ok {
+					digest, ok := digestValue.(string)
+					if !ok {
+						return nil, errors.New("sdjwt: array digest must be a string")
+					}
+					d, disclosed := p.byDigest[digest]
+					if !disclosed {
+						continue
+					}
+					if _, used := p.paths[digest]; used {
+						return nil, errors.New("sdjwt: digest referenced twice")
+					}
+					if d.Name != "" {
+						return nil, errors.New("sdjwt: object property disclosure used for an array element")
+					}
+					elementPath := joinPath(path, elementName(d.Value))
+					p.paths[digest] = elementPath
+					value, err := p.value(d.Value, elementPath)
+					if err != nil {
+						return nil, err
+					}
+					out = append(out, value)
+					continue
+				}
+			}
+			value, err := p.value(item, path)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, value)
+		}
+		return out, nil
+	}
+	return v, nil
+}
+
+func joinPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "/" + name
+}
+
+// elementName names an array element in a path: strings by themselves,
+// other values by their JSON.
+func elementName(v interface{}) string {
+	if s, ok := v.(string); ok {
+		return s
+	}
+	data, _ := json.Marshal(v)
+	return string(data)
+}
+
+// confirmationKey returns the holder key in the cnf claim, nil if there is
+// none.
+func confirmationKey(payload map[string]interface{}) (ed25519.PublicKey, error) {
+	cnf, ok := payload["cnf"].(map[string]interface{})
+	if !ok {
+		return nil, nil
+	}
+	raw, ok := cnf["jwk"].(map[string]interface{})
+	if !ok {
+		return nil, errors.New("sdjwt: cnf must hold a jwk")
+	}
+	jwk := make(map[string]string, len(raw))
+	for k, v := range raw {
+		if s, ok := v.(string); ok {
+			jwk[k] = s
+		}
+	}
+	key, err := did.ParsePublicJWK(jwk)
+	if err != nil {
+		return nil, fmt.Errorf("sdjwt: unsupported cnf key: %w", err)
+	}
+	return key, nil
+}
+
+func sdHash(unbound string) string {
+	sum := sha256.Sum256([]byte(unbound))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func signJWT(header map[string]string, payload map[string]interface{}, key ed25519.PrivateKey) (string, error) {
+	if key == nil {
+		return "", errors.New("sdjwt: no signing key")
+	}
+	input, err := jwtSigningInput(header, payload)
+	if err != nil {
+		return "", err
+	}
+	return input + "." + base64.RawURLEncoding.EncodeToString(ed25519.Sign(key, []byte(input))), nil
+}
+
+// jwtSigningInput returns the encoded header and payload of a JWS, joined by
+// a dot.
+func jwtSigningInput(header map[string]string, payload map[string]interface{}) (string, error) {
+	h, err := json.Marshal(header)
+	if err != nil {
+		return "", err
+	}
+	p, err := json.Marshal(payload)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(p), nil
+}
+
+func decodePayload(jwt string) (map[string]interface{}, error) {
+	parts := strings.Split(jwt, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("sdjwt: malformed JWT")
+	}
+	data, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errors.New("sdjwt: malformed JWT payload")
+	}
+	var payload map[string]interface{}
+	if err := json.Unmarshal(data, &payload); err != nil {
+		return nil, errors.New("sdjwt: malformed JWT payload")
+	}
+	return payload, nil
+}
+
+// verifyJWT checks an EdDSA JWT with the key returned by keyFor and returns
+// its header and payload.
+func verifyJWT(jwt string, keyFor func(header, payload map[string]interface{}) (ed25519.PublicKey, error)) (map[string]interface{}, map[string]interface{}, error) {
+	parts := strings.Split(jwt, ".")
+	if len(parts) != 3 {
+		return nil, nil, errors.New("sdjwt: malformed JWT")
+	}
+	data, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, nil, errors.New("sdjwt: malformed JWT header")
+	}
+	var header map[string]interface{}
+	if err := json.Unmarshal(data, &header); err != nil {
+		return nil, nil, errors.New("sdjwt: malformed JWT header")
+	}
+	if header["alg"] != algEdDSA {
+		return nil, nil, fmt.Errorf("sdjwt: unsupported algorithm %v", header["alg"])
+	}
+	payload, err := decodePayload(jwt)
+	if err != nil {
+		return nil, nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, nil, errors.New("sdjwt: malformed JWT signature")
+	}
+	key, err := keyFor(header, payload)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !ed25519.Verify(key, []byte(parts[0]+"."+parts[1]), sig) {
+		return nil, nil, errors.New("sdjwt: invalid signature")
+	}
+	return header, payload, nil
+}
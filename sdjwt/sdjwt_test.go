@@ -0,0 +1,354 @@
+package sdjwt
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Disclosures from sections 4.2.1 and 4.2.2 of RFC 9901.
+const (
+	rfcFamilyName        = "WyI2cU1RdlJMNWhhaiIsICJmYW1pbHlfbmFtZSIsICJNw7ZiaXVzIl0"
+	rfcFamilyNameDigest  = "uutlBuYeMDyjLLTpf6Jxi7yNkEF35jdyWMn9U7b_RYY"
+	rfcNationality       = "WyJsa2x4RjVqTVlsR1RQVW92TU5JdkNBIiwgIkZSIl0"
+	rfcNationalityDigest = "w0I8EKcdCtUPkGCNUrfwVp2xEgNjtoIDlOxc9-PlOhs"
+)
+
+func TestDisclosureVectors(t *testing.T) {
+	tests := []struct {
+		encoded string
+		want    Disclosure
+		digest  string
+	}{
+		{rfcFamilyName, Disclosure{Salt: "6qMQvRL5haj", Name: "family_name", Value: "Möbius"}, rfcFamilyNameDigest},
+		{rfcNationality, Disclosure{Salt: "lklxF5jMYlGTPUovMNIvCA", Value: "FR"}, rfcNationalityDigest},
+	}
+	for _, tt := range tests {
+		d, err := ParseDisclosure(tt.encoded)
+		if err != nil {
+			t.Fatalf("ParseDisclosure(%s): %v", tt.encoded, err)
+		}
+		tt.want.Encoded = tt.encoded
+		if !reflect.DeepEqual(d, tt.want) {
+			t.Errorf("ParseDisclosure(%s) = %+v, want %+v", tt.encoded, d, tt.want)
+		}
+		if got := d.Digest(); got != tt.digest {
+			t.Errorf("digest of %s = %s, want %s", tt.encoded, got, tt.digest)
+		}
+	}
+}
+
+func TestParseDisclosureErrors(t *testing.T) {
+	tests := map[string]string{
+		"not base64url":   "not base64!",
+		"not an array":    "eyJhIjogMX0",                 // {"a": 1}
+		"one element":     "WyJzYWx0Il0",                 // ["salt"]
+		"four elements":   "WyJzYWx0IiwgImEiLCAxLCAyXQ",  // ["salt", "a", 1, 2]
+		"numeric salt":    "WzEsICJhIiwgMV0",             // [1, "a", 1]
+		"numeric name":    "WyJzYWx0IiwgMSwgMV0",         // ["salt", 1, 1]
+		"_sd as the name": "WyJzYWx0IiwgIl9zZCIsIFtdXQ",  // ["salt", "_sd", []]
+		"... as the name": "WyJzYWx0IiwgIi4uLiIsICJ4Il0", // ["salt", "...", "x"]
+	}
+	for name, encoded := range tests {
+		if d, err := ParseDisclosure(encoded); err == nil {
+			t.Errorf("%s: ParseDisclosure(%s) = %+v, want an error", name, encoded, d)
+		}
+	}
+	for _, name := range []string{"", "_sd", "..."} {
+		if _, err := NewDisclosure(name, 1); err == nil {
+			t.Errorf("NewDisclosure(%q) succeeded", name)
+		}
+	}
+}
+
+type testKeys struct {
+	issuerPub  ed25519.PublicKey
+	issuer     ed25519.PrivateKey
+	holderPub  ed25519.PublicKey
+	holder     ed25519.PrivateKey
+	verifyOpts VerifyOptions
+}
+
+func newTestKeys(t *testing.T) *testKeys {
+	k := &testKeys{}
+	var err error
+	if k.issuerPub, k.issuer, err = ed25519.GenerateKey(rand.Reader); err != nil {
+		t.Fatal(err)
+	}
+	if k.holderPub, k.holder, err = ed25519.GenerateKey(rand.Reader); err != nil {
+		t.Fatal(err)
+	}
+	k.verifyOpts = VerifyOptions{
+		IssuerKey: func(ctx context.Context, iss, kid string) (ed25519.PublicKey, error) {
+			if iss != "https://issuer.example" || kid != "key-1" {
+				return nil, errors.New("unknown issuer key")
+			}
+			return k.issuerPub, nil
+		},
+		Audience: "https://verifier.example",
+		Nonce:    "n-0S6_WzA2Mj",
+	}
+	return k
+}
+
+// TestVerifyVectors verifies an SD-JWT that refers to the RFC 9901
+// disclosures by their digests, next to decoys.
+func TestVerifyVectors(t *testing.T) {
+	k := newTestKeys(t)
+	jwt, err := signJWT(map[string]string{"alg": algEdDSA, "kid": "key-1"}, map[string]interface{}{
+		"iss":           "https://issuer.example",
+		"given_name":    "Erika",
+		"_sd":           []string{"4CZ9ln2e_HrxZ9mp5kxj16NH3TaD2SVdzu7s7xPtbJY", rfcFamilyNameDigest},
+		"nationalities": []interface{}{map[string]string{"...": rfcNationalityDigest}, map[string]string{"...": "Pc33JM2LchcU_lHggv_ufQjn2jTcDyolsWDCN2sh-A0"}},
+		"_sd_alg":       AlgSHA256,
+	}, k.issuer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sdjwt := jwt + "~" + rfcFamilyName + "~" + rfcNationality + "~"
+
+	paths, err := Disclosable(sdjwt)
+	if err != nil {
+		t.Fatalf("Disclosable: %v", err)
+	}
+	if want := []string{"family_name", "nationalities/FR"}; !reflect.DeepEqual(paths, want) {
+		t.Errorf("Disclosable = %v, want %v", paths, want)
+	}
+
+	result, err := Verify(context.Background(), sdjwt, k.verifyOpts)
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	want := map[string]interface{}{
+		"iss":           "https://issuer.example",
+		"given_name":    "Erika",
+		"family_name":   "Möbius",
+		"nationalities": []interface{}{"FR"},
+	}
+	if !reflect.DeepEqual(result.Claims, want) {
+		t.Errorf("claims = %v, want %v", result.Claims, want)
+	}
+
+	// Withholding a disclosure drops the claim; the decoys never appear.
+	result, err = Verify(context.Background(), jwt+"~"+rfcNationality+"~", k.verifyOpts)
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if _, ok := result.Claims["family_name"]; ok || !reflect.DeepEqual(result.Disclosed, []string{"nationalities/FR"}) {
+		t.Errorf("presentation without family_name: claims %v, disclosed %v", result.Claims, result.Disclosed)
+	}
+}
+
+func issueTestSDJWT(t *testing.T, k *testKeys, exp time.Time) string {
+	t.Helper()
+	sdjwt, err := Issue(map[string]interface{}{
+		"iss":        "https://issuer.example",
+		"sub":        "did:example:alice",
+		"exp":        exp.Unix(),
+		"birthdate":  "1940-01-01",
+		"email":      "alice@example.com",
+		"roles":      []interface{}{"admin", "auditor"},
+		"given_name": "Alice",
+	}, IssueOptions{
+		Key:         k.issuer,
+		KeyID:       "key-1",
+		Type:        "example+sd-jwt",
+		Holder:      k.holderPub,
+		Disclosable: []string{"birthdate", "email", "roles"},
+	})
+	if err != nil {
+		t.Fatalf("Issue: %v", err)
+	}
+	return sdjwt
+}
+
+func TestIssuePresentVerify(t *testing.T) {
+	k := newTestKeys(t)
+	sdjwt := issueTestSDJWT(t, k, time.Now().Add(time.Hour))
+
+	paths, err := Disclosable(sdjwt)
+	if err != nil {
+		t.Fatalf("Disclosable: %v", err)
+	}
+	if want := []string{"birthdate", "email", "roles", "roles/admin", "roles/auditor"}; !reflect.DeepEqual(paths, want) {
+		t.Fatalf("Disclosable = %v, want %v", paths, want)
+	}
+
+	tests := []struct {
+		paths     []string
+		disclosed []string
+		claims    map[string]interface{} // Disclosed claims expected
+	}{
+		{nil, []string{}, map[string]interface{}{}},
+		{[]string{"email"}, []string{"email"}, map[string]interface{}{"email": "alice@example.com"}},
+		// An element comes with the array that holds it.
+		{[]string{"roles/auditor"}, []string{"roles", "roles/auditor"}, map[string]interface{}{"roles": []interface{}{"auditor"}}},
+		{[]string{"roles"}, []string{"roles", "roles/admin", "roles/auditor"}, map[string]interface{}{"roles": []interface{}{"admin", "auditor"}}},
+	}
+	for _, tt := range tests {
+		presentation, err := Present(sdjwt, tt.paths, k.holder, k.verifyOpts.Audience, k.verifyOpts.Nonce)
+		if err != nil {
+			t.Fatalf("Present(%v): %v", tt.paths, err)
+		}
+		opts := k.verifyOpts
+		opts.RequireKeyBinding = true
+		result, err := Verify(context.Background(), presentation, opts)
+		if err != nil {
+			t.Fatalf("Verify(%v): %v", tt.paths, err)
+		}
+		if !result.KeyBinding || result.Issuer != "https://issuer.example" || !reflect.DeepEqual(result.Disclosed, tt.disclosed) {
+			t.Errorf("Verify(%v) = %+v, want disclosed %v with key binding", tt.paths, result, tt.disclosed)
+		}
+		for _, name := range []string{"birthdate", "email", "roles"} {
+			if got, want := result.Claims[name], tt.claims[name]; !reflect.DeepEqual(got, want) {
+				t.Errorf("Verify(%v): %s = %v, want %v", tt.paths, name, got, want)
+			}
+		}
+		if result.Claims["given_name"] != "Alice" {
+			t.Errorf("Verify(%v) lost the always-disclosed claims: %v", tt.paths, result.Claims)
+		}
+	}
+
+	if _, err := Present(sdjwt, []string{"given_name"}, k.holder, "aud", "nonce"); err == nil {
+		t.Error("Present of a claim that is not disclosable succeeded")
+	}
+	_, otherKey, _ := ed25519.GenerateKey(rand.Reader)
+	if _, err := Present(sdjwt, []string{"email"}, otherKey, "aud", "nonce"); err == nil {
+		t.Error("Present with a key other than the cnf key succeeded")
+	}
+}
+
+// TestKeyBindingInput binds a presentation with a key that never reaches
+// the code building it, as /sd-jwt/present does.
+func TestKeyBindingInput(t *testing.T) {
+	k := newTestKeys(t)
+	sdjwt := issueTestSDJWT(t, k, time.Now().Add(time.Hour))
+	unbound, err := Present(sdjwt, []string{"email"}, nil, "", "")
+	if err != nil {
+		t.Fatalf("Present: %v", err)
+	}
+	input, err := KeyBindingInput(unbound, k.verifyOpts.Audience, k.verifyOpts.Nonce)
+	if err != nil {
+		t.Fatalf("KeyBindingInput: %v", err)
+	}
+	sign := func(key ed25519.PrivateKey) string {
+		return unbound + input + "." + base64.RawURLEncoding.EncodeToString(ed25519.Sign(key, []byte(input)))
+	}
+
+	opts := k.verifyOpts
+	opts.RequireKeyBinding = true
+	result, err := Verify(context.Background(), sign(k.holder), opts)
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if !result.KeyBinding || result.Claims["email"] != "alice@example.com" {
+		t.Errorf("Verify = %+v, want email with key binding", result)
+	}
+	_, otherKey, _ := ed25519.GenerateKey(rand.Reader)
+	if _, err := Verify(context.Background(), sign(otherKey), opts); err == nil {
+		t.Error("Verify accepted a Key Binding JWT signed with another key")
+	}
+	other := opts
+	other.Nonce = "other"
+	if _, err := Verify(context.Background(), sign(k.holder), other); err == nil {
+		t.Error("Verify accepted a Key Binding JWT for another nonce")
+	}
+
+	if _, err := KeyBindingInput(sign(k.holder), k.verifyOpts.Audience, k.verifyOpts.Nonce); err == nil {
+		t.Error("KeyBindingInput accepted a bound presentation")
+	}
+	if _, err := KeyBindingInput(unbound, k.verifyOpts.Audience, ""); err == nil {
+		t.Error("KeyBindingInput accepted a missing nonce")
+	}
+}
+
+func TestVerifyRejects(t *testing.T) {
+	k := newTestKeys(t)
+	sdjwt := issueTestSDJWT(t, k, time.Now().Add(time.Hour))
+	present := func(paths ...string) string {
+		p, err := Present(sdjwt, paths, k.holder, k.verifyOpts.Audience, k.verifyOpts.Nonce)
+		if err != nil {
+			t.Fatalf("Present: %v", err)
+		}
+		return p
+	}
+	token, _ := Parse(present("email", "birthdate"))
+	withoutKB := present("email")
+	withoutKB = withoutKB[:strings.LastIndex(withoutKB, "~")+1]
+	otherIssuer := newTestKeys(t)
+
+	tests := []struct {
+		name         string
+		presentation string
+		opts         func(*VerifyOptions)
+		want         string
+	}{
+		{
+			// Dropping a disclosure after key binding breaks sd_hash.
+			name:         "disclosure removed",
+			presentation: token.JWT + "~" + token.Disclosures[0].Encoded + "~" + token.KeyBinding,
+			want:         "sd_hash",
+		},
+		{
+			name:         "disclosure not in the SD-JWT",
+			presentation: token.JWT + "~" + token.Disclosures[0].Encoded + "~" + token.Disclosures[1].Encoded + "~" + rfcFamilyName + "~",
+			want:         "not referenced",
+		},
+		{
+			name:         "disclosure repeated",
+			presentation: token.JWT + "~" + token.Disclosures[0].Encoded + "~" + token.Disclosures[0].Encoded + "~",
+			want:         "repeated",
+		},
+		{
+			name:         "wrong nonce",
+			presentation: present("email"),
+			opts:         func(o *VerifyOptions) { o.Nonce = "other" },
+			want:         "nonce",
+		},
+		{
+			name:         "wrong audience",
+			presentation: present("email"),
+			opts:         func(o *VerifyOptions) { o.Audience = "https://other.example" },
+			want:         "audience",
+		},
+		{
+			name:         "key binding required",
+			presentation: withoutKB,
+			opts:         func(o *VerifyOptions) { o.RequireKeyBinding = true },
+			want:         "no Key Binding JWT",
+		},
+		{
+			name:         "old key binding",
+			presentation: present("email"),
+			opts:         func(o *VerifyOptions) { o.MaxKeyBindingAge = -time.Second },
+			want:         "too old",
+		},
+		{
+			name:         "issuer key",
+			presentation: present("email"),
+			opts:         func(o *VerifyOptions) { o.IssuerKey = otherIssuer.verifyOpts.IssuerKey },
+			want:         "invalid signature",
+		},
+		{
+			name:         "expired",
+			presentation: issueTestSDJWT(t, k, time.Now().Add(-time.Minute)),
+			want:         "expired",
+		},
+	}
+	for _, tt := range tests {
+		opts := k.verifyOpts
+		if tt.opts != nil {
+			tt.opts(&opts)
+		}
+		_, err := Verify(context.Background(), tt.presentation, opts)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: Verify error = %v, want one containing %q", tt.name, err, tt.want)
+		}
+	}
+}
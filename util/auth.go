@@ -0,0 +1,136 @@
+package util
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Principal kinds.
+const (
+	PrincipalUser   = "user"    // Authenticated with an access token
+	PrincipalAPIKey = "api_key" // Authenticated with a configured API key
+)
+
+// Principal is the authenticated caller of a request.
+type Principal struct {
+	ID          string   `json:"id"` // User ID, or the name of the API key
+	Kind        string   `json:"kind"`
+	Permissions []string `json:"permissions,omitempty"`
+	AMR         []string `json:"amr,omitempty"` // Authentication methods of the session; none for API keys
+}
+
+// Can reports whether p holds perm. This is the permission check used for
+// every authorization decision.
+func (p Principal) Can(perm string) bool {
+	for _, held := range p.Permissions {
+		if held == perm || held == PermAll {
+			return true
+		}
+	}
+	return false
+}
+
+// CanGrant reports whether p holds every permission in perms. Principals may
+// only hand out what they hold themselves, or roles:manage would lead to
+// admin.
+func (p Principal) CanGrant(perms []string) bool {
+	for _, perm := range perms {
+		if !p.Can(perm) {
+			return false
+		}
+	}
+	return true
+}
+
+func (p Principal) String() string {
+	return p.Kind + ":" + p.ID
+}
+
+// ErrForbidden is returned when the actor lacks a permission that the
+// operation grants or would let it use.
+var ErrForbidden = errors.New("permission denied")
+
+// apiKey is a static credential for services and operators.
+type apiKey struct {
+	name        string
+	key         string
+	permissions []string
+}
+
+// parseAPIKeys parses a comma-separated list of name:key[:perm|perm...]
+// entries.
+func parseAPIKeys(spec string) ([]apiKey, error) {
+	var keys []apiKey
+	for _, entry := range splitList(spec) {
+		parts := strings.SplitN(entry, ":", 3)
+		if len(parts) < 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid API key entry %q, want name:key[:permissions]", entry)
+		}
+		key := apiKey{name: parts[0], key: parts[1]}
+		if len(parts) == 3 && parts[2] != "" {
+			key.permissions = strings.Split(parts[2], "|")
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// AuthenticateToken returns the principal of a valid access token, with the
+// permissions currently granted by the user's roles. Roles that require MFA
+// only count if the token's session used it.
+func (im *IdentityManager) AuthenticateToken(ctx context.Context, token string) (Principal, error) {
+	claims, err := im.VerifyAccessToken(token)
+	if err != nil {
+		return Principal{}, err
+	}
+	// Tokens issued to OIDC clients carry only their scopes, not the user's
+	// permissions.
+	if claims.ClientID != "" {
+		return Principal{}, ErrInvalidToken
+	}
+	db, err := im.loadDatabase(ctx)
+	if err != nil {
+		return Principal{}, err
+	}
+	user, exists := db.Users[claims.Subject]
+	if !exists || user.Status != StatusActive {
+		return Principal{}, ErrInvalidToken
+	}
+	user.Roles = im.mfa.effectiveRoles(user.Roles, claims.AMR)
+	if now := time.Now(); im.email.blocked(user, now) {
+		return Principal{}, ErrEmailUnverified
+	} else if im.email.restricted(user, now) {
+		user.Roles = nil
+	}
+	return Principal{ID: user.ID, Kind: PrincipalUser, Permissions: permissionsOf(db, user), AMR: claims.AMR}, nil
+}
+
+// CanActOn reports whether actor holds every permission granted by the roles
+// of the user with ID userID. Whoever can change an account can log in as its
+// user, so acting on it must not give actor more than it already has. Unknown
+// users are left for the operation itself to reject.
+func (im *IdentityManager) CanActOn(ctx context.Context, actor Principal, userID string) (bool, error) {
+	db, err := im.loadDatabase(ctx)
+	if err != nil {
+		return false, err
+	}
+	user, exists := db.Users[userID]
+	if !exists {
+		return true, nil
+	}
+	return actor.CanGrant(permissionsOf(db, user)), nil
+}
+
+// AuthenticateAPIKey returns the principal of a configured API key.
+func (im *IdentityManager) AuthenticateAPIKey(key string) (Principal, error) {
+	for _, k := range im.apiKeys {
+		if subtle.ConstantTimeCompare([]byte(k.key), []byte(key)) == 1 {
+			return Principal{ID: k.name, Kind: PrincipalAPIKey, Permissions: k.permissions}, nil
+		}
+	}
+	return Principal{}, errors.New("unknown API key")
+}
@@ -0,0 +1,669 @@
+package util
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// mutationOp identifies the kind of change a mutation makes to the user set.
+type mutationOp string
+
+const (
+	opAddUser    mutationOp = "add_user"
+	opEditUser   mutationOp = "edit_user"
+	opDeleteUser mutationOp = "delete_user"
+	opCreateRole mutationOp = "create_role"
+	opAssignRole mutationOp = "assign_role"
+	opRevokeRole mutationOp = "revoke_role"
+
+	opPutPolicy    mutationOp = "put_policy"
+	opDeletePolicy mutationOp = "delete_policy"
+
+	opRegisterClient mutationOp = "register_client"
+	opDeleteClient   mutationOp = "delete_client"
+
+	opEnrollTOTP  mutationOp = "enroll_totp"
+	opConfirmTOTP mutationOp = "confirm_totp"
+	opUseTOTP     mutationOp = "use_totp"
+	opDisableTOTP mutationOp = "disable_totp"
+
+	opAddCredential    mutationOp = "add_credential"
+	opUseCredential    mutationOp = "use_credential"
+	opRemoveCredential mutationOp = "remove_credential"
+
+	opLinkWallet   mutationOp = "link_wallet"
+	opUnlinkWallet mutationOp = "unlink_wallet"
+
+	opRotateDIDKey mutationOp = "rotate_did_key"
+
+	opIssueCredential   mutationOp = "issue_credential"
+	opRevokeCredential  mutationOp = "revoke_credential"
+	opPublishStatusList mutationOp = "publish_status_list"
+
+	opSetAttributes mutationOp = "set_attributes"
+
+	opLinkDID   mutationOp = "link_did"
+	opUnlinkDID mutationOp = "unlink_did"
+
+	opSetUpdateKey mutationOp = "set_update_key"
+	opSignedUpdate mutationOp = "signed_update"
+
+	opSetEmail    mutationOp = "set_email"
+	opVerifyEmail mutationOp = "verify_email"
+)
+
+// mutation is a single change to the user set. Mutations are plain data so the
+// write batcher can apply many of them, in order, to one state.
+type mutation struct {
+	Op       mutationOp `json:"op"`
+	ID       string     `json:"id"`
+	Username string     `json:"username,omitempty"`
+	Password string     `json:"password,omitempty"` // Hashed password
+	// Hash of the password hash a reset token was issued for; the password
+	// is only changed if it is still the current one.
+	ExpectPassword string    `json:"expect_password,omitempty"`
+	At             time.Time `json:"at"`
+
+	Actor       string   `json:"actor,omitempty"`       // Principal that made an admin change
+	Role        string   `json:"role,omitempty"`        // Role created, assigned or revoked
+	Permissions []string `json:"permissions,omitempty"` // Permissions of a created role
+	Description string   `json:"description,omitempty"` // Description of a created role
+	Policy      *Policy  `json:"policy,omitempty"`      // Policy version to store
+	Client      *Client  `json:"client,omitempty"`      // OIDC client to register
+
+	TOTP          *TOTP    `json:"totp,omitempty"`           // New, unconfirmed enrollment
+	Step          int64    `json:"step,omitempty"`           // TOTP time step used
+	RecoveryCodes []string `json:"recovery_codes,omitempty"` // Hashes of new recovery codes, or of the one used
+
+	Credential   *WebAuthnCredential `json:"credential,omitempty"`    // WebAuthn credential to add
+	CredentialID string              `json:"credential_id,omitempty"` // WebAuthn credential used or removed
+	SignCount    uint32              `json:"sign_count,omitempty"`    // Signature counter of an assertion
+
+	Wallet string   `json:"wallet,omitempty"` // Ethereum address linked or unlinked
+	DID    *UserDID `json:"did,omitempty"`    // DID of a new user, or after a key rotation
+
+	IssuedCredential *IssuedCredential `json:"issued_credential,omitempty"` // Verifiable credential issued
+	StatusList       *StatusList       `json:"status_list,omitempty"`       // Status list published
+
+	Attributes map[string]string `json:"attributes,omitempty"` // Replacement attributes of a user
+	LinkedDID  string            `json:"linked_did,omitempty"` // DID linked or unlinked
+
+	UpdateKey    *string         `json:"update_key,omitempty"`    // New profile update key; empty to remove it
+	Sequence     int             `json:"sequence,omitempty"`      // Sequence number of a signed update
+	SignedUpdate json.RawMessage `json:"signed_update,omitempty"` // The update document exactly as the user signed it
+
+	Email string `json:"email,omitempty"` // Normalized email address set or verified
+}
+
+// apply validates the mutation against db and applies it.
+// A mutation that returns an error must leave db untouched.
+func (m mutation) apply(db *database) error {
+	users := db.Users
+	switch m.Op {
+	case opAddUser:
+		for _, user := range users {
+			if user.Username == m.Username {
+				return errors.New("username already exists")
+			}
+		}
+		if usernameIsEmail(users, m.ID, m.Username) {
+			return errors.New("username is another user's email address")
+		}
+		if m.Email != "" && emailTaken(users, m.ID, m.Email) {
+			return errors.New("email address already in use")
+		}
+		users[m.ID] = User{
+			ID:        m.ID,
+			Username:  m.Username,
+			Password:  m.Password,
+			CreatedAt: m.At,
+			UpdatedAt: m.At,
+			Status:    StatusActive,
+			DID:       m.DID,
+			Email:     m.Email,
+		}
+	case opEditUser:
+		user, exists := users[m.ID]
+		if !exists {
+			return errors.New("user not found")
+		}
+		if m.Username != "" && m.Username != user.Username && user.UpdateKey != "" {
+			return errors.New("this user's profile can only be changed by a signed update")
+		}
+		if m.Username != "" && usernameIsEmail(users, m.ID, m.Username) {
+			return errors.New("username is another user's email address")
+		}
+		if m.Username != "" {
+			user.Username = m.Username
+		}
+		if m.ExpectPassword != "" && hashToken(user.Password) != m.ExpectPassword {
+			return ErrInvalidResetToken
+		}
+		if m.Password != "" {
+			user.Password = m.Password
+		}
+		user.UpdatedAt = m.At
+		users[m.ID] = user
+	case opDeleteUser:
+		if _, exists := users[m.ID]; !exists {
+			return errors.New("user not found")
+		}
+		delete(users, m.ID)
+	case opCreateRole:
+		if _, exists := lookupRole(db, m.Role); exists {
+			return fmt.Errorf("role %q already exists", m.Role)
+		}
+		db.Roles[m.Role] = Role{
+			Name:        m.Role,
+			Permissions: m.Permissions,
+			Description: m.Description,
+			CreatedAt:   m.At,
+		}
+	case opAssignRole, opRevokeRole:
+		user, exists := users[m.ID]
+		if !exists {
+			return errors.New("user not found")
+		}
+		if _, exists := lookupRole(db, m.Role); !exists {
+			return fmt.Errorf("role %q does not exist", m.Role)
+		}
+		held := hasRole(user, m.Role)
+		if m.Op == opAssignRole && held {
+			return fmt.Errorf("user already has role %q", m.Role)
+		}
+		if m.Op == opRevokeRole && !held {
+			return fmt.Errorf("user does not have role %q", m.Role)
+		}
+		user.Roles = toggleRole(user.Roles, m.Role, m.Op == opAssignRole)
+		user.UpdatedAt = m.At
+		users[m.ID] = user
+	case opPutPolicy:
+		if m.Policy == nil || m.Policy.ID != m.ID {
+			return errors.New("malformed policy mutation")
+		}
+		if current := db.Policies[m.ID].Version; m.Policy.Version != current+1 {
+			return fmt.Errorf("policy %s was modified concurrently (now at version %d)", m.ID, current)
+		}
+		db.Policies[m.ID] = *m.Policy
+	case opDeletePolicy:
+		if _, exists := db.Policies[m.ID]; !exists {
+			return errors.New("policy not found")
+		}
+		delete(db.Policies, m.ID)
+	case opRegisterClient:
+		if m.Client == nil || m.Client.ID != m.ID {
+			return errors.New("malformed client mutation")
+		}
+		if _, exists := db.Clients[m.ID]; exists {
+			return fmt.Errorf("client %s already exists", m.ID)
+		}
+		db.Clients[m.ID] = *m.Client
+	case opDeleteClient:
+		if _, exists := db.Clients[m.ID]; !exists {
+			return errors.New("client not found")
+		}
+		delete(db.Clients, m.ID)
+	case opEnrollTOTP, opConfirmTOTP, opUseTOTP, opDisableTOTP:
+		user, exists := users[m.ID]
+		if !exists {
+			return errors.New("user not found")
+		}
+		totp, err := m.applyTOTP(user.TOTP)
+		if err != nil {
+			return err
+		}
+		user.TOTP = totp
+		users[m.ID] = user
+	case opAddCredential:
+		user, exists := users[m.ID]
+		if !exists {
+			return errors.New("user not found")
+		}
+		if m.Credential == nil {
+			return errors.New("malformed credential mutation")
+		}
+		if _, _, taken := findCredential(db, m.Credential.ID); taken {
+			return errors.New("credential is already registered")
+		}
+		user.Credentials = append(append([]WebAuthnCredential{}, user.Credentials...), *m.Credential)
+		user.UpdatedAt = m.At
+		users[m.ID] = user
+	case opUseCredential, opRemoveCredential:
+		user, exists := users[m.ID]
+		if !exists {
+			return errors.New("user not found")
+		}
+		creds, err := m.applyCredential(user.Credentials)
+		if err != nil {
+			return err
+		}
+		user.Credentials = creds
+		users[m.ID] = user
+	case opLinkWallet:
+		user, exists := users[m.ID]
+		if !exists {
+			return errors.New("user not found")
+		}
+		if owner, linked := findWallet(db, m.Wallet); linked {
+			if owner.ID == m.ID {
+				return errors.New("wallet is already linked to this user")
+			}
+			return errors.New("wallet is linked to another user")
+		}
+		user.Wallets = append(append([]string{}, user.Wallets...), m.Wallet)
+		user.UpdatedAt = m.At
+		users[m.ID] = user
+	case opUnlinkWallet:
+		user, exists := users[m.ID]
+		if !exists {
+			return errors.New("user not found")
+		}
+		var wallets []string
+		for _, wallet := range user.Wallets {
+			if wallet != m.Wallet {
+				wallets = append(wallets, wallet)
+			}
+		}
+		if len(wallets) == len(user.Wallets) {
+			return errors.New("wallet is not linked")
+		}
+		user.Wallets = wallets
+		user.UpdatedAt = m.At
+		users[m.ID] = user
+	case opRotateDIDKey:
+		user, exists := users[m.ID]
+		if !exists {
+			return errors.New("user not found")
+		}
+		if m.DID == nil || len(m.DID.Keys) == 0 {
+			return errors.New("malformed DID mutation")
+		}
+		// The new DID extends the current key history by one key, so two
+		// concurrent rotations cannot both succeed.
+		held := 0
+		if user.DID != nil {
+			held = len(user.DID.Keys)
+			if m.DID.ID != user.DID.ID {
+				return errors.New("malformed DID mutation")
+			}
+		}
+		if len(m.DID.Keys) != held+1 {
+			return errors.New("DID was rotated concurrently")
+		}
+		user.DID = m.DID
+		user.UpdatedAt = m.At
+		users[m.ID] = user
+	case opIssueCredential:
+		c := m.IssuedCredential
+		if c == nil {
+			return errors.New("malformed credential mutation")
+		}
+		if _, exists := users[c.UserID]; !exists {
+			return errors.New("user not found")
+		}
+		if _, exists := db.Credentials[c.ID]; exists {
+			return errors.New("credential already exists")
+		}
+		for _, other := range db.Credentials {
+			if other.StatusIndex == c.StatusIndex {
+				return errors.New("status list index is already in use")
+			}
+		}
+		db.Credentials[c.ID] = *c
+	case opRevokeCredential:
+		c, exists := db.Credentials[m.ID]
+		if !exists {
+			return errors.New("credential not found")
+		}
+		if c.RevokedAt != nil {
+			return errors.New("credential is already revoked")
+		}
+		at := m.At
+		c.RevokedAt = &at
+		c.RevokedBy = m.Actor
+		db.Credentials[m.ID] = c
+	case opPublishStatusList:
+		if m.StatusList == nil {
+			return errors.New("malformed status list mutation")
+		}
+		if db.StatusList != nil && m.StatusList.Revision < db.StatusList.Revision {
+			return errStaleStatusList
+		}
+		list := *m.StatusList
+		db.StatusList = &list
+	case opSetAttributes:
+		user, exists := users[m.ID]
+		if !exists {
+			return errors.New("user not found")
+		}
+		user.Attributes = m.Attributes
+		if len(user.Attributes) == 0 {
+			user.Attributes = nil
+		}
+		user.UpdatedAt = m.At
+		users[m.ID] = user
+	case opLinkDID:
+		user, exists := users[m.ID]
+		if !exists {
+			return errors.New("user not found")
+		}
+		if owner, found := findDID(db, m.LinkedDID); found {
+			if owner.ID == m.ID {
+				return errors.New("DID is already linked")
+			}
+			return errors.New("DID is linked to another account")
+		}
+		user.LinkedDIDs = append(append([]string{}, user.LinkedDIDs...), m.LinkedDID)
+		user.UpdatedAt = m.At
+		users[m.ID] = user
+	case opUnlinkDID:
+		user, exists := users[m.ID]
+		if !exists {
+			return errors.New("user not found")
+		}
+		var linked []string
+		for _, d := range user.LinkedDIDs {
+			if d != m.LinkedDID {
+				linked = append(linked, d)
+			}
+		}
+		if len(linked) == len(user.LinkedDIDs) {
+			return errors.New("DID is not linked")
+		}
+		user.LinkedDIDs = linked
+		user.UpdatedAt = m.At
+		users[m.ID] = user
+	case opSetUpdateKey:
+		user, exists := users[m.ID]
+		if !exists {
+			return errors.New("user not found")
+		}
+		if m.UpdateKey == nil || *m.UpdateKey == "" {
+			return errors.New("malformed update key mutation")
+		}
+		if user.UpdateKey != "" {
+			return errors.New("an update key is already registered; replace it with a signed update")
+		}
+		user.UpdateKey = *m.UpdateKey
+		user.UpdatedAt = m.At
+		users[m.ID] = user
+	case opSignedUpdate:
+		user, exists := users[m.ID]
+		if !exists {
+			return errors.New("user not found")
+		}
+		// Two updates signed with the same sequence cannot both apply.
+		if m.Sequence != user.UpdateSequence+1 {
+			return errors.New("signed update is out of sequence")
+		}
+		if m.Username != "" && m.Username != user.Username {
+			for _, other := range users {
+				if other.Username == m.Username {
+					return errors.New("username already exists")
+				}
+			}
+			if usernameIsEmail(users, m.ID, m.Username) {
+				return errors.New("username is another user's email address")
+			}
+			user.Username = m.Username
+		}
+		if m.UpdateKey != nil {
+			user.UpdateKey = *m.UpdateKey
+		}
+		user.UpdateSequence = m.Sequence
+		user.UpdatedAt = m.At
+		users[m.ID] = user
+	case opSetEmail:
+		user, exists := users[m.ID]
+		if !exists {
+			return errors.New("user not found")
+		}
+		if m.Email == "" {
+			return errors.New("malformed email mutation")
+		}
+		if emailTaken(users, m.ID, m.Email) {
+			return errors.New("email address already in use")
+		}
+		switch {
+		case m.Email == user.Email:
+			user.PendingEmail = ""
+		case user.EmailVerified:
+			// A verified address stays until the new one is verified too.
+			user.PendingEmail = m.Email
+		default:
+			user.Email = m.Email
+			user.PendingEmail = ""
+		}
+		user.UpdatedAt = m.At
+		users[m.ID] = user
+	case opVerifyEmail:
+		user, exists := users[m.ID]
+		if !exists {
+			return errors.New("user not found")
+		}
+		pending := m.Email != "" && m.Email == user.PendingEmail
+		if !pending && (m.Email != user.Email || user.EmailVerified) {
+			return errors.New("email address is not awaiting verification")
+		}
+		if emailTaken(users, m.ID, m.Email) {
+			return errors.New("email address already in use")
+		}
+		user.Email = m.Email
+		user.EmailVerified = true
+		user.PendingEmail = ""
+		user.UpdatedAt = m.At
+		users[m.ID] = user
+		releaseEmailClaims(users, m.ID, m.Email, m.At)
+	default:
+		return fmt.Errorf("unknown mutation %q", m.Op)
+	}
+	return nil
+}
+
+// applyTOTP returns the enrollment that results from applying m to current.
+// The stored enrollment is shared with older states, so it is copied rather
+// than modified.
+func (m mutation) applyTOTP(current *TOTP) (*TOTP, error) {
+	if m.Op == opEnrollTOTP {
+		if m.TOTP == nil {
+			return nil, errors.New("malformed TOTP mutation")
+		}
+		if current != nil && current.Confirmed {
+			return nil, errors.New("TOTP is already enabled")
+		}
+		return m.TOTP, nil
+	}
+	if m.Op == opDisableTOTP {
+		if current == nil {
+			return nil, errors.New("TOTP is not enabled")
+		}
+		return nil, nil
+	}
+	if current == nil {
+		return nil, errors.New("TOTP is not enabled")
+	}
+
+	totp := *current
+	switch {
+	case m.Op == opConfirmTOTP:
+		if totp.Confirmed {
+			return nil, errors.New("TOTP is already enabled")
+		}
+		totp.Confirmed = true
+		totp.LastStep = m.Step
+		totp.RecoveryCodes = m.RecoveryCodes
+	case !totp.Confirmed:
+		return nil, errors.New("TOTP is not enabled")
+	case m.Step > 0:
+		if m.Step <= totp.LastStep {
+			return nil, errInvalidCode
+		}
+		totp.LastStep = m.Step
+	case len(m.RecoveryCodes) == 1:
+		var remaining []string
+		for _, hash := range totp.RecoveryCodes {
+			if hash != m.RecoveryCodes[0] {
+				remaining = append(remaining, hash)
+			}
+		}
+		if len(remaining) == len(totp.RecoveryCodes) {
+			return nil, errInvalidCode
+		}
+		totp.RecoveryCodes = remaining
+	default:
+		return nil, errors.New("malformed TOTP mutation")
+	}
+	return &totp, nil
+}
+
+// applyCredential returns the credentials that result from applying m to
+// current, which is shared with older states and so is copied.
+func (m mutation) applyCredential(current []WebAuthnCredential) ([]WebAuthnCredential, error) {
+	var creds []WebAuthnCredential
+	found := false
+	for _, c := range current {
+		if c.ID != m.CredentialID {
+			creds = append(creds, c)
+			continue
+		}
+		found = true
+		if m.Op == opRemoveCredential {
+			continue
+		}
+		if (m.SignCount != 0 || c.SignCount != 0) && m.SignCount <= c.SignCount {
+			return nil, errors.New("signature counter did not increase")
+		}
+		c.SignCount = m.SignCount
+		c.LastUsedAt = m.At
+		creds = append(creds, c)
+	}
+	if !found {
+		return nil, errors.New("credential not found")
+	}
+	return creds, nil
+}
+
+// pendingWrite is a mutation waiting in the batcher queue together with the
+// channel its caller is blocked on.
+type pendingWrite struct {
+	m    mutation
+	done chan error
+}
+
+// writeBatcher coalesces mutations that arrive within a short window into a
+// single IPFS upload. It owns all writes, including WAL replay, so mutations
+// are applied strictly in the order they were submitted.
+type writeBatcher struct {
+	im           *IdentityManager
+	window       time.Duration
+	maxSize      int
+	syncInterval time.Duration
+	queue        chan pendingWrite
+}
+
+// newWriteBatcher creates a batcher for im and starts its worker goroutine.
+// Every syncInterval the worker replays pending WAL entries to IPFS.
+func newWriteBatcher(im *IdentityManager, window time.Duration, maxSize int, syncInterval time.Duration) *writeBatcher {
+	b := &writeBatcher{
+		im:           im,
+		window:       window,
+		maxSize:      maxSize,
+		syncInterval: syncInterval,
+		queue:        make(chan pendingWrite, maxSize),
+	}
+	go b.run()
+	return b
+}
+
+// submit queues m and blocks until the batch containing it has been stored.
+// The returned error is specific to m: a validation failure of another
+// mutation in the same batch does not affect it. If ctx ends after m was
+// queued, m may still be applied even though ctx.Err() is returned.
+func (b *writeBatcher) submit(ctx context.Context, m mutation) error {
+	done := make(chan error, 1)
+	select {
+	case b.queue <- pendingWrite{m: m, done: done}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (b *writeBatcher) run() {
+	ticker := time.NewTicker(b.syncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case first := <-b.queue:
+			b.flush(b.collect(first))
+		case <-ticker.C:
+			b.im.syncWAL(context.Background())
+		}
+	}
+}
+
+// collect gathers mutations arriving within the batch window after first.
+func (b *writeBatcher) collect(first pendingWrite) []pendingWrite {
+	batch := []pendingWrite{first}
+	timer := time.NewTimer(b.window)
+	defer timer.Stop()
+
+	for len(batch) < b.maxSize {
+		select {
+		case w := <-b.queue:
+			batch = append(batch, w)
+		case <-timer.C:
+			return batch
+		}
+	}
+	return batch
+}
+
+// flush applies batch to the current state, uploads the result once and
+// acknowledges every caller individually. The batch is shared by several
+// callers, so it runs under the store's own deadlines rather than any
+// caller's context.
+func (b *writeBatcher) flush(batch []pendingWrite) {
+	ctx := context.Background()
+	db, err := b.im.loadDatabase(ctx)
+	if err != nil {
+		for _, w := range batch {
+			w.done <- err
+		}
+		return
+	}
+
+	results := make([]error, len(batch))
+	var applied []mutation
+	for i, w := range batch {
+		results[i] = w.m.apply(db)
+		if results[i] == nil {
+			applied = append(applied, w.m)
+		}
+	}
+
+	if len(applied) > 0 {
+		if err := b.im.commit(ctx, applied, db); err != nil {
+			for i := range results {
+				if results[i] == nil {
+					results[i] = err
+				}
+			}
+		}
+	}
+
+	for i, w := range batch {
+		w.done <- results[i]
+	}
+	b.im.log.Debug(fmt.Sprintf("Flushed write batch: %d mutations, %d applied", len(batch), len(applied)))
+}
@@ -0,0 +1,99 @@
+package util
+
+import (
+	"context"
+	"io"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// latencyStore adds a fixed delay to every upload, like the round-trip to an
+// IPFS daemon.
+type latencyStore struct {
+	Store
+	delay time.Duration
+	adds  atomic.Int64
+}
+
+func (s *latencyStore) Add(ctx context.Context, r io.Reader) (string, error) {
+	s.adds.Add(1)
+	time.Sleep(s.delay)
+	return s.Store.Add(ctx, r)
+}
+
+// TestBatchIsolatesFailures flushes one batch, in submission order, in which
+// one mutation fails validation, and checks that only that one is refused.
+func TestBatchIsolatesFailures(t *testing.T) {
+	t.Setenv("WAL_SYNC_INTERVAL", "1h")
+	im := newTestManager(t, newTestNode(t))
+	ctx := context.Background()
+
+	tests := []struct {
+		id, username string
+		wantErr      bool
+	}{
+		{"1", "alice", false},
+		{"2", "bob", false},
+		{"3", "alice", true}, // Duplicate of the first
+		{"4", "carol", false},
+	}
+	batch := make([]pendingWrite, len(tests))
+	for i, tt := range tests {
+		batch[i] = pendingWrite{m: mutation{Op: opAddUser, ID: tt.id, Username: tt.username, At: time.Now()}, done: make(chan error, 1)}
+	}
+	im.batch.flush(batch)
+
+	for i, tt := range tests {
+		if err := <-batch[i].done; (err != nil) != tt.wantErr {
+			t.Errorf("submit %s (%s) = %v, want error %v", tt.id, tt.username, err, tt.wantErr)
+		}
+	}
+	db, err := im.loadDatabase(ctx)
+	if err != nil {
+		t.Fatalf("loadDatabase: %v", err)
+	}
+	if len(db.Users) != 3 {
+		t.Errorf("stored %d users, want 3", len(db.Users))
+	}
+	if db.Users["1"].Username != "alice" {
+		t.Errorf("user 1 is %q, want alice", db.Users["1"].Username)
+	}
+}
+
+// BenchmarkConcurrentWrites compares storing every write on its own, as
+// before batching, with coalescing concurrent writes into one upload, against
+// a store with a 2ms upload round-trip.
+func BenchmarkConcurrentWrites(b *testing.B) {
+	for _, bc := range []struct {
+		name string
+		size string
+	}{
+		{"unbatched", "1"},
+		{"batched", "64"},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			b.Setenv("WRITE_BATCH_SIZE", bc.size)
+			store := &latencyStore{Store: newTestNode(b), delay: 2 * time.Millisecond}
+			im := newTestManager(b, store)
+			ctx := context.Background()
+			var next atomic.Int64
+
+			b.SetParallelism(16)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					id := strconv.FormatInt(next.Add(1), 10)
+					err := im.batch.submit(ctx, mutation{Op: opAddUser, ID: id, Username: "user-" + id, At: time.Now()})
+					if err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+			b.StopTimer()
+			b.ReportMetric(float64(store.adds.Load())/float64(b.N), "uploads/op")
+		})
+	}
+}
@@ -0,0 +1,171 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// This file is a small CBOR (RFC 8949) decoder covering what WebAuthn
+// attestation objects and COSE keys use. Items decode to int64, []byte,
+// string, []interface{}, map[interface{}]interface{} (with int64 or string
+// keys), bool, float64 or nil. Tags are skipped, and indefinite lengths are
+// rejected; authenticators must use canonical encoding.
+
+const cborMaxDepth = 16
+
+var errCBORTruncated = errors.New("cbor: unexpected end of data")
+
+// cborDecode decodes the first data item in data and returns it with the
+// number of bytes it used.
+func cborDecode(data []byte) (interface{}, int, error) {
+	d := cborDecoder{data: data}
+	v, err := d.item(0)
+	return v, d.pos, err
+}
+
+type cborDecoder struct {
+	data []byte
+	pos  int
+}
+
+// head reads an item's initial byte and argument.
+func (d *cborDecoder) head() (byte, uint64, error) {
+	if d.pos >= len(d.data) {
+		return 0, 0, errCBORTruncated
+	}
+	major, info := d.data[d.pos]>>5, d.data[d.pos]&0x1f
+	d.pos++
+	if info < 24 {
+		return major, uint64(info), nil
+	}
+	size := 0
+	switch info {
+	case 24:
+		size = 1
+	case 25:
+		size = 2
+	case 26:
+		size = 4
+	case 27:
+		size = 8
+	default:
+		return 0, 0, fmt.Errorf("cbor: unsupported additional information %d", info)
+	}
+	if len(d.data)-d.pos < size {
+		return 0, 0, errCBORTruncated
+	}
+	var arg uint64
+	for _, b := range d.data[d.pos : d.pos+size] {
+		arg = arg<<8 | uint64(b)
+	}
+	d.pos += size
+	return major, arg, nil
+}
+
+func (d *cborDecoder) item(depth int) (interface{}, error) {
+	if depth > cborMaxDepth {
+		return nil, errors.New("cbor: nesting too deep")
+	}
+	start := d.pos
+	major, arg, err := d.head()
+	if err != nil {
+		return nil, err
+	}
+	switch major {
+	case 0:
+		if arg > math.MaxInt64 {
+			return nil, errors.New("cbor: integer overflow")
+		}
+		return int64(arg), nil
+	case 1:
+		if arg > math.MaxInt64 {
+			return nil, errors.New("cbor: integer overflow")
+		}
+		return -1 - int64(arg), nil
+	case 2, 3:
+		if arg > uint64(len(d.data)-d.pos) {
+			return nil, errCBORTruncated
+		}
+		b := d.data[d.pos : d.pos+int(arg)]
+		d.pos += int(arg)
+		if major == 3 {
+			return string(b), nil
+		}
+		return append([]byte{}, b...), nil
+	case 4:
+		if arg > uint64(len(d.data)-d.pos) {
+			return nil, errCBORTruncated // Every element takes at least a byte
+		}
+		list := make([]interface{}, 0, arg)
+		for i := uint64(0); i < arg; i++ {
+			v, err := d.item(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+		return list, nil
+	case 5:
+		if arg > uint64(len(d.data)-d.pos)/2 {
+			return nil, errCBORTruncated
+		}
+		m := make(map[interface{}]interface{}, arg)
+		for i := uint64(0); i < arg; i++ {
+			k, err := d.item(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			switch k.(type) {
+			case int64, string:
+			default:
+				return nil, fmt.Errorf("cbor: unsupported map key type %T", k)
+			}
+			if _, dup := m[k]; dup {
+				return nil, fmt.Errorf("cbor: duplicate map key %v", k)
+			}
+			if m[k], err = d.item(depth + 1); err != nil {
+				return nil, err
+			}
+		}
+		return m, nil
+	case 6:
+		return d.item(depth + 1)
+	default: // 7
+		info := d.data[start] & 0x1f
+		switch {
+		case info == 20:
+			return false, nil
+		case info == 21:
+			return true, nil
+		case info == 22 || info == 23:
+			return nil, nil
+		case info == 25:
+			return float64(halfToFloat(uint16(arg))), nil
+		case info == 26:
+			return float64(math.Float32frombits(uint32(arg))), nil
+		case info == 27:
+			return math.Float64frombits(arg), nil
+		}
+		return nil, fmt.Errorf("cbor: unsupported simple value %d", arg)
+	}
+}
+
+// halfToFloat converts an IEEE 754 half-precision float.
+func halfToFloat(h uint16) float32 {
+	sign := float32(1)
+	if h&0x8000 != 0 {
+		sign = -1
+	}
+	exp, frac := int(h>>10&0x1f), float64(h&0x3ff)
+	switch exp {
+	case 0:
+		return sign * float32(math.Ldexp(frac, -24))
+	case 31:
+		if frac == 0 {
+			return sign * float32(math.Inf(1))
+		}
+		return float32(math.NaN())
+	}
+	return sign * float32(math.Ldexp(frac+1024, exp-25))
+}
@@ -0,0 +1,155 @@
+package util
+
+import (
+	"encoding/hex"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestCBORDecode checks the examples of appendix A of RFC 8949 that the
+// decoder supports.
+func TestCBORDecode(t *testing.T) {
+	tests := []struct {
+		hex  string
+		want interface{}
+	}{
+		{"00", int64(0)},
+		{"01", int64(1)},
+		{"0a", int64(10)},
+		{"17", int64(23)},
+		{"1818", int64(24)},
+		{"1819", int64(25)},
+		{"1864", int64(100)},
+		{"1903e8", int64(1000)},
+		{"1a000f4240", int64(1000000)},
+		{"1b000000e8d4a51000", int64(1000000000000)},
+		{"1b7fffffffffffffff", int64(math.MaxInt64)},
+		{"20", int64(-1)},
+		{"29", int64(-10)},
+		{"3863", int64(-100)},
+		{"3903e7", int64(-1000)},
+		{"3b7fffffffffffffff", int64(math.MinInt64)},
+
+		{"f90000", 0.0},
+		{"f93c00", 1.0},
+		{"fb3ff199999999999a", 1.1},
+		{"f93e00", 1.5},
+		{"f97bff", 65504.0},
+		{"fa47c35000", 100000.0},
+		{"fa7f7fffff", 3.4028234663852886e+38},
+		{"fb7e37e43c8800759c", 1.0e+300},
+		{"f90001", 5.960464477539063e-8},
+		{"f90400", 0.00006103515625},
+		{"f9c400", -4.0},
+		{"fbc010666666666666", -4.1},
+		{"f97c00", math.Inf(1)},
+		{"f9fc00", math.Inf(-1)},
+		{"fa7f800000", math.Inf(1)},
+		{"fb7ff0000000000000", math.Inf(1)},
+
+		{"f4", false},
+		{"f5", true},
+		{"f6", nil},
+		{"f7", nil},
+
+		{"40", []byte{}},
+		{"4401020304", []byte{1, 2, 3, 4}},
+		{"60", ""},
+		{"6161", "a"},
+		{"6449455446", "IETF"},
+		{"62225c", "\"\\"},
+		{"62c3bc", "ü"},
+		{"63e6b0b4", "水"},
+		{"64f0908591", "\U00010151"},
+
+		{"80", []interface{}{}},
+		{"83010203", []interface{}{int64(1), int64(2), int64(3)}},
+		{"8301820203820405", []interface{}{int64(1), []interface{}{int64(2), int64(3)}, []interface{}{int64(4), int64(5)}}},
+		{"a0", map[interface{}]interface{}{}},
+		{"a201020304", map[interface{}]interface{}{int64(1): int64(2), int64(3): int64(4)}},
+		{"a26161016162820203", map[interface{}]interface{}{"a": int64(1), "b": []interface{}{int64(2), int64(3)}}},
+		{"826161a161626163", []interface{}{"a", map[interface{}]interface{}{"b": "c"}}},
+
+		// Tags are skipped.
+		{"c074323031332d30332d32315432303a30343a30305a", "2013-03-21T20:04:00Z"},
+		{"c11a514b67b0", int64(1363896240)},
+		{"d74401020304", []byte{1, 2, 3, 4}},
+		{"d818456449455446", []byte("dIETF")},
+	}
+	for _, tt := range tests {
+		data, _ := hex.DecodeString(tt.hex)
+		got, n, err := cborDecode(data)
+		if err != nil {
+			t.Errorf("cborDecode(%s): %v", tt.hex, err)
+			continue
+		}
+		if n != len(data) {
+			t.Errorf("cborDecode(%s) used %d of %d bytes", tt.hex, n, len(data))
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("cborDecode(%s) = %#v, want %#v", tt.hex, got, tt.want)
+		}
+	}
+
+	// Negative zero and NaN do not compare equal to themselves.
+	if v, _, _ := cborDecode([]byte{0xf9, 0x80, 0x00}); !math.Signbit(v.(float64)) {
+		t.Error("cborDecode(f98000) is not negative zero")
+	}
+	for _, h := range []string{"f97e00", "fa7fc00000", "fb7ff8000000000000"} {
+		data, _ := hex.DecodeString(h)
+		if v, _, err := cborDecode(data); err != nil || !math.IsNaN(v.(float64)) {
+			t.Errorf("cborDecode(%s) = %v, %v, want NaN", h, v, err)
+		}
+	}
+}
+
+// TestCBORDecodeFirstItem checks that only the first item is decoded, as when
+// a COSE key is followed by extensions in authenticator data.
+func TestCBORDecodeFirstItem(t *testing.T) {
+	v, n, err := cborDecode([]byte{0x82, 0x01, 0x02, 0xa0, 0xff})
+	if err != nil || n != 3 || !reflect.DeepEqual(v, []interface{}{int64(1), int64(2)}) {
+		t.Errorf("cborDecode = %v, %d, %v, want [1 2], 3", v, n, err)
+	}
+}
+
+func TestCBORDecodeErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		hex  string
+		want string // Substring of the error
+	}{
+		{"empty", "", "unexpected end"},
+		{"truncated argument", "1903", "unexpected end"},
+		{"truncated string", "6261", "unexpected end"},
+		{"truncated array", "8201", "unexpected end"},
+		{"truncated map value", "a101", "unexpected end"},
+		{"huge array length", "9b0000000100000000", "unexpected end"},
+		{"huge map length", "bb0000000100000000", "unexpected end"},
+		{"huge string length", "5bffffffffffffffff", "unexpected end"},
+		{"unsigned overflow", "1bffffffffffffffff", "overflow"},
+		{"negative overflow", "3b8000000000000000", "overflow"},
+		{"indefinite string", "5f42010243030405ff", "additional information 31"},
+		{"indefinite array", "9f018202039f0405ffff", "additional information 31"},
+		{"indefinite map", "bf61610161629f0203ffff", "additional information 31"},
+		{"reserved additional information", "1c", "additional information 28"},
+		{"duplicate key", "a2010201 03", "duplicate map key"},
+		{"array key", "a1800102", "unsupported map key"},
+		{"byte string key", "a1400102", "unsupported map key"},
+		{"unassigned simple value", "f0", "unsupported simple value"},
+		{"one-byte simple value", "f8ff", "unsupported simple value"},
+		{"nesting", strings.Repeat("81", 20) + "00", "too deep"},
+		{"tag nesting", strings.Repeat("c1", 20) + "00", "too deep"},
+	}
+	for _, tt := range tests {
+		data, err := hex.DecodeString(strings.ReplaceAll(tt.hex, " ", ""))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		_, _, err = cborDecode(data)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: cborDecode(%s) error = %v, want one containing %q", tt.name, tt.hex, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package util
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// PermClientsManage allows registering and removing OIDC clients.
+const PermClientsManage = "clients:manage"
+
+// OAuth grant types a client may be allowed to use.
+const (
+	GrantAuthorizationCode = "authorization_code"
+	GrantRefreshToken      = "refresh_token"
+	GrantClientCredentials = "client_credentials"
+)
+
+// Client is an application registered to use the OpenID Connect provider.
+// Public clients, such as single-page and mobile apps, have no secret and
+// must use PKCE.
+type Client struct {
+	ID           string    `json:"id"`
+	Name         string    `json:"name"`
+	SecretHash   string    `json:"secret_hash,omitempty"` // SHA-256 of the secret; empty for public clients
+	RedirectURIs []string  `json:"redirect_uris,omitempty"`
+	GrantTypes   []string  `json:"grant_types"`
+	Scopes       []string  `json:"scopes"` // Scopes the client may request
+	CreatedAt    time.Time `json:"created_at"`
+	CreatedBy    string    `json:"created_by,omitempty"`
+}
+
+func (c Client) canonical() Client {
+	c.CreatedAt = c.CreatedAt.UTC()
+	return c
+}
+
+// Public reports whether the client has no secret.
+func (c Client) Public() bool {
+	return c.SecretHash == ""
+}
+
+func (c Client) allows(grant string) bool {
+	for _, g := range c.GrantTypes {
+		if g == grant {
+			return true
+		}
+	}
+	return false
+}
+
+func (c Client) allowsRedirect(uri string) bool {
+	for _, registered := range c.RedirectURIs {
+		if registered == uri {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientRegistration is the input to RegisterClient.
+type ClientRegistration struct {
+	Name         string   `json:"name"`
+	RedirectURIs []string `json:"redirect_uris"`
+	GrantTypes   []string `json:"grant_types"`
+	Scopes       []string `json:"scopes"`
+	Public       bool     `json:"public"`
+}
+
+// RegisterClient stores a new client and returns it together with its secret,
+// which is not stored and cannot be retrieved again. Public clients get no
+// secret.
+func (im *IdentityManager) RegisterClient(ctx context.Context, actor Principal, reg ClientRegistration) (Client, string, error) {
+	if err := im.mode.checkWrite(); err != nil {
+		return Client{}, "", err
+	}
+	if reg.Name == "" {
+		return Client{}, "", errors.New("client name is required")
+	}
+	if len(reg.GrantTypes) == 0 {
+		reg.GrantTypes = []string{GrantAuthorizationCode, GrantRefreshToken}
+	}
+	if len(reg.Scopes) == 0 {
+		reg.Scopes = []string{ScopeOpenID, ScopeProfile}
+	}
+	for _, grant := range reg.GrantTypes {
+		switch grant {
+		case GrantAuthorizationCode, GrantRefreshToken:
+		case GrantClientCredentials:
+			if reg.Public {
+				return Client{}, "", errors.New("public clients cannot use client_credentials")
+			}
+		default:
+			return Client{}, "", fmt.Errorf("unsupported grant type %q", grant)
+		}
+	}
+	for _, scope := range reg.Scopes {
+		if !supportedScopes[scope] {
+			return Client{}, "", fmt.Errorf("unsupported scope %q", scope)
+		}
+	}
+	for _, uri := range reg.RedirectURIs {
+		u, err := url.Parse(uri)
+		if err != nil || !u.IsAbs() || u.Fragment != "" {
+			return Client{}, "", fmt.Errorf("redirect URI %q must be absolute and without a fragment", uri)
+		}
+	}
+	client := Client{
+		ID:           uuid.New().String(),
+		Name:         reg.Name,
+		RedirectURIs: reg.RedirectURIs,
+		GrantTypes:   reg.GrantTypes,
+		Scopes:       reg.Scopes,
+		CreatedAt:    time.Now(),
+		CreatedBy:    actor.String(),
+	}
+	if client.allows(GrantAuthorizationCode) && len(client.RedirectURIs) == 0 {
+		return Client{}, "", errors.New("the authorization_code grant needs at least one redirect URI")
+	}
+
+	var secret string
+	if !reg.Public {
+		raw := make([]byte, 32)
+		if _, err := rand.Read(raw); err != nil {
+			return Client{}, "", fmt.Errorf("failed to generate client secret: %w", err)
+		}
+		secret = base64.RawURLEncoding.EncodeToString(raw)
+		client.SecretHash = hashToken(secret)
+	}
+
+	err := im.batch.submit(ctx, mutation{Op: opRegisterClient, ID: client.ID, Client: &client, Actor: actor.String(), At: client.CreatedAt})
+	if err != nil {
+		return Client{}, "", err
+	}
+	im.log.Info(fmt.Sprintf("OIDC client %s (%s) registered by %s", client.ID, client.Name, actor))
+	return client, secret, nil
+}
+
+// Clients lists the registered clients, sorted by name.
+func (im *IdentityManager) Clients(ctx context.Context) ([]Client, error) {
+	db, err := im.loadDatabase(ctx)
+	if err != nil {
+		return nil, err
+	}
+	clients := make([]Client, 0, len(db.Clients))
+	for _, c := range db.Clients {
+		clients = append(clients, c)
+	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i].Name < clients[j].Name })
+	return clients, nil
+}
+
+// DeleteClient removes a registered client.
+func (im *IdentityManager) DeleteClient(ctx context.Context, actor Principal, id string) error {
+	if err := im.mode.checkWrite(); err != nil {
+		return err
+	}
+	if err := im.batch.submit(ctx, mutation{Op: opDeleteClient, ID: id, Actor: actor.String(), At: time.Now()}); err != nil {
+		return err
+	}
+	im.log.Info(fmt.Sprintf("OIDC client %s deleted by %s", id, actor))
+	return nil
+}
+
+// Client returns the registered client with the given ID.
+func (im *IdentityManager) Client(ctx context.Context, id string) (Client, error) {
+	db, err := im.loadDatabase(ctx)
+	if err != nil {
+		return Client{}, err
+	}
+	client, exists := db.Clients[id]
+	if !exists {
+		return Client{}, &OAuthError{Code: "invalid_client", Description: "unknown client"}
+	}
+	return client, nil
+}
+
+// AuthenticateClient checks the credentials a client presented to the token
+// endpoint. Public clients authenticate with their ID alone.
+func (im *IdentityManager) AuthenticateClient(ctx context.Context, id, secret string) (Client, error) {
+	client, err := im.Client(ctx, id)
+	if err != nil {
+		return Client{}, err
+	}
+	if client.Public() {
+		if secret != "" {
+			return Client{}, &OAuthError{Code: "invalid_client", Description: "public clients have no secret"}
+		}
+		return client, nil
+	}
+	if subtle.ConstantTimeCompare([]byte(hashToken(secret)), []byte(client.SecretHash)) != 1 {
+		return Client{}, &OAuthError{Code: "invalid_client", Description: "client authentication failed"}
+	}
+	return client, nil
+}
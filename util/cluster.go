@@ -0,0 +1,319 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	ipfsapi "github.com/ipfs/go-ipfs-api"
+
+	"ipfs-identity/logger"
+)
+
+// EndpointRole describes what an IPFS endpoint is used for.
+type EndpointRole string
+
+const (
+	// RolePrimary receives every write. Exactly one endpoint has this role.
+	RolePrimary EndpointRole = "primary"
+	// RoleSecondary pins every new root and serves reads.
+	RoleSecondary EndpointRole = "secondary"
+	// RoleReader only serves reads.
+	RoleReader EndpointRole = "reader"
+)
+
+// EndpointStatus is a snapshot of an endpoint's health and counters.
+type EndpointStatus struct {
+	URL         string       `json:"url"`
+	Role        EndpointRole `json:"role"`
+	Healthy     bool         `json:"healthy"`
+	Version     string       `json:"version,omitempty"`
+	LastCheck   time.Time    `json:"last_check"`
+	Reads       uint64       `json:"reads"`
+	ReadErrors  uint64       `json:"read_errors"`
+	Writes      uint64       `json:"writes"`
+	WriteErrors uint64       `json:"write_errors"`
+	Pins        uint64       `json:"pins"`
+	PinErrors   uint64       `json:"pin_errors"`
+	LatencyMs   float64      `json:"last_latency_ms"`
+}
+
+// endpoint is one IPFS HTTP API node in a Cluster.
+type endpoint struct {
+	url   string
+	role  EndpointRole
+	shell *ipfsapi.Shell
+
+	healthy     atomic.Bool
+	reads       atomic.Uint64
+	readErrors  atomic.Uint64
+	writes      atomic.Uint64
+	writeErrors atomic.Uint64
+	pins        atomic.Uint64
+	pinErrors   atomic.Uint64
+	latency     atomic.Int64 // Nanoseconds of the last request
+
+	mu        sync.Mutex
+	version   string
+	lastCheck time.Time
+}
+
+// observe records the latency and outcome of a request.
+func (e *endpoint) observe(start time.Time, total, failed *atomic.Uint64, err error) {
+	e.latency.Store(int64(time.Since(start)))
+	total.Add(1)
+	if err != nil {
+		failed.Add(1)
+	}
+}
+
+func (e *endpoint) status() EndpointStatus {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return EndpointStatus{
+		URL:         e.url,
+		Role:        e.role,
+		Healthy:     e.healthy.Load(),
+		Version:     e.version,
+		LastCheck:   e.lastCheck,
+		Reads:       e.reads.Load(),
+		ReadErrors:  e.readErrors.Load(),
+		Writes:      e.writes.Load(),
+		WriteErrors: e.writeErrors.Load(),
+		Pins:        e.pins.Load(),
+		PinErrors:   e.pinErrors.Load(),
+		LatencyMs:   float64(e.latency.Load()) / float64(time.Millisecond),
+	}
+}
+
+// Cluster is a Store backed by several IPFS nodes. Reads are spread across
+// healthy nodes and fall back to the others on failure. Writes go to the
+// primary and are pinned on every secondary; a write succeeds once the number
+// of nodes holding it reaches the write quorum.
+type Cluster struct {
+	endpoints  []*endpoint
+	primary    *endpoint
+	quorum     int
+	pinTimeout time.Duration
+	next       atomic.Uint32
+	log        logger.Logger
+}
+
+// parseEndpoints parses a comma-separated list of IPFS API addresses, each
+// optionally prefixed with a role, e.g. "primary=localhost:5001,
+// secondary=10.0.0.2:5001". Without a prefix the first address is the primary
+// and the rest are secondaries.
+func parseEndpoints(spec string) ([]*endpoint, error) {
+	var endpoints []*endpoint
+	primaries := 0
+	for i, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		role := RoleSecondary
+		if i == 0 {
+			role = RolePrimary
+		}
+		if name, url, ok := strings.Cut(item, "="); ok {
+			role, item = EndpointRole(strings.ToLower(strings.TrimSpace(name))), strings.TrimSpace(url)
+		}
+		switch role {
+		case RolePrimary:
+			primaries++
+		case RoleSecondary, RoleReader:
+		default:
+			return nil, fmt.Errorf("unknown IPFS endpoint role %q", role)
+		}
+		e := &endpoint{url: item, role: role, shell: ipfsapi.NewShell(item)}
+		e.healthy.Store(true) // Assume healthy until the first check says otherwise
+		endpoints = append(endpoints, e)
+	}
+
+	if primaries != 1 {
+		return nil, fmt.Errorf("exactly one primary IPFS endpoint is required, got %d", primaries)
+	}
+	return endpoints, nil
+}
+
+// NewCluster creates a Cluster for the endpoints described by spec (see
+// parseEndpoints). A quorum of 0 selects a majority of the primary and
+// secondaries.
+func NewCluster(spec string, quorum int, pinTimeout time.Duration, log logger.Logger) (*Cluster, error) {
+	endpoints, err := parseEndpoints(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Cluster{endpoints: endpoints, pinTimeout: pinTimeout, log: log}
+	replicas := 0
+	for _, e := range endpoints {
+		if e.role == RolePrimary {
+			c.primary = e
+		}
+		if e.role != RoleReader {
+			replicas++
+		}
+	}
+
+	if quorum <= 0 {
+		quorum = replicas/2 + 1
+	}
+	if quorum > replicas {
+		return nil, fmt.Errorf("write quorum %d exceeds the %d writable IPFS endpoints", quorum, replicas)
+	}
+	c.quorum = quorum
+	return c, nil
+}
+
+// StartHealthChecks probes every endpoint's version every interval until ctx
+// is done. Endpoints that fail the probe are tried last for reads.
+func (c *Cluster) StartHealthChecks(ctx context.Context, interval time.Duration) {
+	go func() {
+		c.checkHealth()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				c.checkHealth()
+			}
+		}
+	}()
+}
+
+func (c *Cluster) checkHealth() {
+	var wg sync.WaitGroup
+	for _, e := range c.endpoints {
+		wg.Add(1)
+		go func(e *endpoint) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			version, err := shellVersion(ctx, e.shell)
+			cancel()
+			up := err == nil
+
+			e.mu.Lock()
+			e.lastCheck = time.Now()
+			if err == nil {
+				e.version = version
+			}
+			e.mu.Unlock()
+
+			if e.healthy.Swap(up) != up {
+				c.log.Warn(fmt.Sprintf("IPFS endpoint %s (%s) healthy=%t", e.url, e.role, up))
+			}
+		}(e)
+	}
+	wg.Wait()
+}
+
+// readOrder returns the endpoints to try for a read: healthy ones first,
+// rotated so that consecutive reads start at different nodes.
+func (c *Cluster) readOrder() []*endpoint {
+	n := len(c.endpoints)
+	start := int(c.next.Add(1)) % n
+	healthy := make([]*endpoint, 0, n)
+	var unhealthy []*endpoint
+	for i := 0; i < n; i++ {
+		e := c.endpoints[(start+i)%n]
+		if e.healthy.Load() {
+			healthy = append(healthy, e)
+		} else {
+			unhealthy = append(unhealthy, e)
+		}
+	}
+	return append(healthy, unhealthy...)
+}
+
+// Cat reads cid from the first endpoint that returns it.
+func (c *Cluster) Cat(ctx context.Context, cid string) (io.ReadCloser, error) {
+	var errs []error
+	for _, e := range c.readOrder() {
+		if ctx.Err() != nil {
+			break
+		}
+		start := time.Now()
+		reader, err := shellCat(ctx, e.shell, cid)
+		e.observe(start, &e.reads, &e.readErrors, err)
+		if err == nil {
+			return reader, nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", e.url, err))
+	}
+	if ctx.Err() != nil {
+		errs = append(errs, ctx.Err())
+	}
+	return nil, errors.Join(errs...)
+}
+
+// Add writes r to the primary and pins the resulting CID on every secondary.
+// It fails unless at least quorum nodes hold the content.
+func (c *Cluster) Add(ctx context.Context, r io.Reader) (string, error) {
+	start := time.Now()
+	cid, err := shellAdd(ctx, c.primary.shell, r)
+	c.primary.observe(start, &c.primary.writes, &c.primary.writeErrors, err)
+	if err != nil {
+		return "", err
+	}
+
+	acks := 1
+	var mu sync.Mutex
+	var errs []error
+	var wg sync.WaitGroup
+	for _, e := range c.endpoints {
+		if e.role != RoleSecondary {
+			continue
+		}
+		wg.Add(1)
+		go func(e *endpoint) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctx, c.pinTimeout)
+			defer cancel()
+
+			start := time.Now()
+			err := e.shell.Request("pin/add", cid).Option("recursive", true).Exec(ctx, nil)
+			e.observe(start, &e.pins, &e.pinErrors, err)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", e.url, err))
+				return
+			}
+			acks++
+		}(e)
+	}
+	wg.Wait()
+
+	if acks < c.quorum {
+		return "", fmt.Errorf("write quorum not reached for %s (%d/%d): %w", cid, acks, c.quorum, errors.Join(errs...))
+	}
+	if len(errs) > 0 {
+		c.log.Warn(fmt.Sprintf("Replication of %s incomplete: %v", cid, errors.Join(errs...)))
+	}
+	return cid, nil
+}
+
+// IsUp reports whether the primary is reachable.
+func (c *Cluster) IsUp(ctx context.Context) bool {
+	_, err := shellVersion(ctx, c.primary.shell)
+	return err == nil
+}
+
+// Endpoints returns a status snapshot for every endpoint.
+func (c *Cluster) Endpoints() []EndpointStatus {
+	statuses := make([]EndpointStatus, 0, len(c.endpoints))
+	for _, e := range c.endpoints {
+		statuses = append(statuses, e.status())
+	}
+	return statuses
+}
@@ -0,0 +1,190 @@
+package util
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Stored blobs start with a small header so the format can evolve:
+//
+//	magic (4 bytes) | version (1 byte) | flags (1 byte) | payload
+//
+// State blobs without the header are the bare JSON map written by earlier
+// versions.
+var stateMagic = []byte("IDDB")
+
+const (
+	// formatLegacy is the bare, headerless JSON map of schema 1 users.
+	formatLegacy byte = 1
+	// formatCanonical is canonical JSON of the schema 1 user map.
+	formatCanonical byte = 2
+	// formatVersioned is canonical JSON of a versionedState.
+	formatVersioned byte = 3
+
+	flagGzip byte = 1 << 0
+)
+
+// versionedState is the payload of a formatVersioned blob.
+type versionedState struct {
+	Schema   int                        `json:"schema"`
+	Users    map[string]json.RawMessage `json:"users"`
+	Roles    map[string]Role            `json:"roles,omitempty"`    // Since schema 3
+	Policies map[string]Policy          `json:"policies,omitempty"` // Since schema 3
+	Clients  map[string]Client          `json:"clients,omitempty"`  // Since schema 3
+
+	Credentials map[string]IssuedCredential `json:"credentials,omitempty"` // Since schema 3
+	StatusList  *StatusList                 `json:"status_list,omitempty"` // Since schema 3
+}
+
+// encodeState serializes db canonically at CurrentSchemaVersion, so the same
+// logical state always yields the same bytes and therefore the same CID.
+func encodeState(db *database, compress bool) ([]byte, error) {
+	users := make(map[string]User, len(db.Users))
+	for id, user := range db.Users {
+		users[id] = user.canonical()
+	}
+	roles := make(map[string]Role, len(db.Roles))
+	for name, role := range db.Roles {
+		roles[name] = role.canonical()
+	}
+	policies := make(map[string]Policy, len(db.Policies))
+	for id, policy := range db.Policies {
+		policies[id] = policy.canonical()
+	}
+	clients := make(map[string]Client, len(db.Clients))
+	for id, client := range db.Clients {
+		clients[id] = client.canonical()
+	}
+	credentials := make(map[string]IssuedCredential, len(db.Credentials))
+	for id, credential := range db.Credentials {
+		credentials[id] = credential.canonical()
+	}
+	var statusList *StatusList
+	if db.StatusList != nil {
+		list := *db.StatusList
+		list.PublishedAt = list.PublishedAt.UTC()
+		statusList = &list
+	}
+	// encoding/json writes map keys in sorted order and struct fields in
+	// declaration order.
+	payload, err := json.Marshal(struct {
+		Schema   int               `json:"schema"`
+		Users    map[string]User   `json:"users"`
+		Roles    map[string]Role   `json:"roles,omitempty"`
+		Policies map[string]Policy `json:"policies,omitempty"`
+		Clients  map[string]Client `json:"clients,omitempty"`
+
+		Credentials map[string]IssuedCredential `json:"credentials,omitempty"`
+		StatusList  *StatusList                 `json:"status_list,omitempty"`
+	}{CurrentSchemaVersion, users, roles, policies, clients, credentials, statusList})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal users: %w", err)
+	}
+	return frame(stateMagic, formatVersioned, payload, compress)
+}
+
+// decodeState parses any stored state format and migrates its records to
+// CurrentSchemaVersion. It also returns the schema version found in data.
+func decodeState(data []byte) (*database, int, error) {
+	version, payload := formatLegacy, data
+	if bytes.HasPrefix(data, stateMagic) {
+		var err error
+		if version, payload, err = unframe(stateMagic, data); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	var state versionedState
+	switch version {
+	case formatLegacy, formatCanonical:
+		state.Schema = 1
+		if err := json.Unmarshal(payload, &state.Users); err != nil {
+			return nil, 0, fmt.Errorf("failed to unmarshal user data: %w", err)
+		}
+	case formatVersioned:
+		if err := json.Unmarshal(payload, &state); err != nil {
+			return nil, 0, fmt.Errorf("failed to unmarshal user data: %w", err)
+		}
+	default:
+		return nil, 0, fmt.Errorf("unsupported state format version %d", version)
+	}
+
+	db := newDatabase()
+	for id, raw := range state.Users {
+		user, err := migrateRecord(raw, state.Schema)
+		if err != nil {
+			return nil, 0, fmt.Errorf("user %s: %w", id, err)
+		}
+		db.Users[id] = user
+	}
+	for name, role := range state.Roles {
+		db.Roles[name] = role
+	}
+	for id, policy := range state.Policies {
+		db.Policies[id] = policy
+	}
+	for id, client := range state.Clients {
+		db.Clients[id] = client
+	}
+	for id, credential := range state.Credentials {
+		db.Credentials[id] = credential
+	}
+	db.StatusList = state.StatusList
+	return db, state.Schema, nil
+}
+
+// frame prepends the blob header to payload, gzipping it if compress is set.
+func frame(magic []byte, version byte, payload []byte, compress bool) ([]byte, error) {
+	var flags byte
+	if compress {
+		flags |= flagGzip
+	}
+	var buf bytes.Buffer
+	buf.Write(magic)
+	buf.WriteByte(version)
+	buf.WriteByte(flags)
+
+	if !compress {
+		buf.Write(payload)
+		return buf.Bytes(), nil
+	}
+	// A zero gzip header carries no timestamp, keeping the output stable.
+	zw, err := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := zw.Write(payload); err != nil {
+		return nil, fmt.Errorf("failed to compress data: %w", err)
+	}
+	if err := zw.Close(); err != nil {
+		return nil, fmt.Errorf("failed to compress data: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// unframe validates the blob header and returns the format version and the
+// decompressed payload.
+func unframe(magic []byte, data []byte) (byte, []byte, error) {
+	if !bytes.HasPrefix(data, magic) || len(data) < len(magic)+2 {
+		return 0, nil, errors.New("missing or truncated blob header")
+	}
+	version, flags := data[len(magic)], data[len(magic)+1]
+	payload := data[len(magic)+2:]
+	if flags&flagGzip == 0 {
+		return version, payload, nil
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(payload))
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to decompress data: %w", err)
+	}
+	defer zr.Close()
+	if payload, err = io.ReadAll(zr); err != nil {
+		return 0, nil, fmt.Errorf("failed to decompress data: %w", err)
+	}
+	return version, payload, nil
+}
@@ -0,0 +1,150 @@
+package util
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEncodeStateCanonical(t *testing.T) {
+	at := time.Date(2026, 6, 1, 12, 0, 0, 0, time.UTC)
+	berlin := time.FixedZone("CEST", 2*60*60)
+
+	// The same logical state, built in a different order and time zone.
+	build := func(ids []string, zone *time.Location) *database {
+		db := newDatabase()
+		for _, id := range ids {
+			db.Users[id] = User{ID: id, Username: "user-" + id, CreatedAt: at.In(zone), UpdatedAt: at.In(zone), Status: StatusActive}
+		}
+		db.Roles["auditor"] = Role{Name: "auditor", Permissions: []string{"audit:read"}, CreatedAt: at.In(zone)}
+		return db
+	}
+	a := build([]string{"a", "b", "c", "d"}, time.UTC)
+	b := build([]string{"d", "c", "b", "a"}, berlin)
+
+	for _, compress := range []bool{false, true} {
+		encA, err := encodeState(a, compress)
+		if err != nil {
+			t.Fatalf("encodeState: %v", err)
+		}
+		encB, err := encodeState(b, compress)
+		if err != nil {
+			t.Fatalf("encodeState: %v", err)
+		}
+		if !bytes.Equal(encA, encB) {
+			t.Errorf("compress=%v: equal states encode differently", compress)
+		}
+		if got := encA[len(stateMagic)+1] & flagGzip; (got != 0) != compress {
+			t.Errorf("compress=%v: gzip flag %d", compress, got)
+		}
+	}
+}
+
+func TestStateRoundTrip(t *testing.T) {
+	data, err := os.ReadFile("testdata/state/v3-gzip.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, schema, err := decodeState(data)
+	if err != nil {
+		t.Fatalf("decodeState: %v", err)
+	}
+	if schema != CurrentSchemaVersion {
+		t.Fatalf("schema = %d, want %d", schema, CurrentSchemaVersion)
+	}
+	for _, compress := range []bool{true, false} {
+		enc, err := encodeState(db, compress)
+		if err != nil {
+			t.Fatalf("encodeState: %v", err)
+		}
+		if compress && !bytes.Equal(enc, data) {
+			t.Error("re-encoding the fixture changed its bytes, and so its CID")
+		}
+		again, _, err := decodeState(enc)
+		if err != nil {
+			t.Fatalf("decodeState: %v", err)
+		}
+		reenc, _ := encodeState(again, compress)
+		if !bytes.Equal(enc, reenc) {
+			t.Errorf("compress=%v: decode and encode is not stable", compress)
+		}
+	}
+}
+
+func TestUnframeErrors(t *testing.T) {
+	valid, err := frame(stateMagic, formatVersioned, []byte(`{"schema":3,"users":{}}`), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"truncated header", []byte("IDDB\x03"), "truncated blob header"},
+		{"corrupt gzip", append([]byte("IDDB\x03\x01"), "not gzip"...), "decompress"},
+		{"truncated gzip", valid[:len(valid)-8], "decompress"},
+		{"unknown format", []byte("IDDB\x09\x00{}"), "unsupported state format version 9"},
+		{"garbage", []byte("IDDB\x03\x00{"), "unmarshal"},
+		{"legacy garbage", []byte("[1,2,3]"), "unmarshal"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := decodeState(tt.data)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("decodeState = %v, want error containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestLedgerEntryCodec(t *testing.T) {
+	at := time.Date(2026, 6, 1, 14, 0, 0, 0, time.FixedZone("CEST", 2*60*60))
+	entry := ledgerEntry{
+		Prev:   "QmbFMke1KXqnYyBBWxB74N4c5SBnJMVAiMNRcGu6x1AwQH",
+		State:  "QmT78zSuBmuS4z925WZfrqQ1qHaJ56DQaTfyMUF7F8ff5o",
+		Schema: CurrentSchemaVersion,
+		Kind:   transitionWrite,
+		At:     at,
+		Mutations: []mutation{
+			{Op: opAddUser, ID: "1", Username: "alice", At: at},
+			{Op: opAssignRole, ID: "1", Role: "auditor", Actor: "user:admin", At: at},
+		},
+	}
+	data, err := encodeEntry(entry)
+	if err != nil {
+		t.Fatalf("encodeEntry: %v", err)
+	}
+	if !bytes.HasPrefix(data, ledgerMagic) {
+		t.Fatalf("entry does not start with %q", ledgerMagic)
+	}
+	if entry.Mutations[0].At.Location() == time.UTC {
+		t.Error("encodeEntry modified the caller's mutations")
+	}
+	got, err := decodeEntry(data)
+	if err != nil {
+		t.Fatalf("decodeEntry: %v", err)
+	}
+	if !got.At.Equal(at) || got.At.Location() != time.UTC {
+		t.Errorf("At = %v, want %v in UTC", got.At, at)
+	}
+	if got.Prev != entry.Prev || got.State != entry.State || got.Kind != entry.Kind || len(got.Mutations) != 2 || got.Mutations[1].Role != "auditor" {
+		t.Errorf("decoded entry = %+v", got)
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"state blob", []byte("IDDB\x03\x00{}")},
+		{"unknown version", []byte("IDLG\x02\x00{}")},
+		{"malformed", []byte("IDLG\x01\x00{")},
+	}
+	for _, tt := range tests {
+		if _, err := decodeEntry(tt.data); err == nil {
+			t.Errorf("%s: decodeEntry succeeded", tt.name)
+		}
+	}
+}
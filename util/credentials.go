@@ -0,0 +1,789 @@
+package util
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/multiformats/go-multibase"
+
+	"ipfs-identity/did"
+)
+
+// PermCredentialsIssue allows issuing and revoking verifiable credentials.
+const PermCredentialsIssue = "credentials:issue"
+
+// Formats credentials are issued in.
+const (
+	FormatVCJWT         = "jwt"            // VC-JWT, signed with EdDSA
+	FormatDataIntegrity = "data-integrity" // Embedded eddsa-jcs-2022 proof
+)
+
+const (
+	contextCredentials   = "https://www.w3.org/2018/credentials/v1"
+	contextDataIntegrity = "https://w3id.org/security/data-integrity/v2"
+	contextStatusList    = "https://w3id.org/vc/status-list/2021/v1"
+
+	cryptosuiteEdDSAJCS = "eddsa-jcs-2022"
+
+	// statusListSize is the number of entries in the status list, the
+	// 16 KiB minimum that keeps one credential's index from standing out.
+	statusListSize = 131072
+
+	// vcKeyFragment names the credential signing key in the service DID
+	// document.
+	vcKeyFragment = "vc-key"
+)
+
+// errStaleStatusList is returned when publishing a status list older than
+// the one already published.
+var errStaleStatusList = errors.New("a newer status list is already published")
+
+// IssuedCredential records a credential issued by the service. The signed
+// credential itself is stored on IPFS.
+type IssuedCredential struct {
+	ID          string     `json:"id"`      // UUID; the credential ID is urn:uuid:<ID>
+	UserID      string     `json:"user_id"` // User the credential was issued to
+	Subject     string     `json:"subject"` // The user's DID
+	Types       []string   `json:"types"`
+	Format      string     `json:"format"`
+	CID         string     `json:"cid"`
+	StatusIndex int        `json:"status_index"` // Entry in the status list
+	IssuedAt    time.Time  `json:"issued_at"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+	IssuedBy    string     `json:"issued_by"`
+	RevokedAt   *time.Time `json:"revoked_at,omitempty"`
+	RevokedBy   string     `json:"revoked_by,omitempty"`
+}
+
+func (c IssuedCredential) canonical() IssuedCredential {
+	c.IssuedAt = c.IssuedAt.UTC()
+	c.ExpiresAt = utcPtr(c.ExpiresAt)
+	c.RevokedAt = utcPtr(c.RevokedAt)
+	return c
+}
+
+func utcPtr(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+	u := t.UTC()
+	return &u
+}
+
+// StatusList is the most recently published StatusList2021 credential.
+type StatusList struct {
+	CID         string    `json:"cid"`
+	Revision    int       `json:"revision"` // Number of revocations it reflects
+	PublishedAt time.Time `json:"published_at"`
+}
+
+// CredentialRequest asks for a credential to be issued to a user.
+type CredentialRequest struct {
+	UserID    string                 `json:"subject"` // User ID
+	Type      string                 `json:"type"`    // e.g. "EmployeeCredential"
+	Claims    map[string]interface{} `json:"claims"`  // Properties of credentialSubject
+	Format    string                 `json:"format"`  // FormatVCJWT or FormatDataIntegrity
+	ExpiresAt *time.Time             `json:"expires_at,omitempty"`
+}
+
+// statusListURL returns the URL the status list is served at.
+func statusListURL(baseURL string) string {
+	return baseURL + "/credentials/status/1"
+}
+
+// credentialVerificationMethod returns the DID URL of the key credentials are
+// signed with.
+func (im *IdentityManager) credentialVerificationMethod() string {
+	return im.ServiceDID() + "#" + vcKeyFragment
+}
+
+func (im *IdentityManager) credentialKey() ed25519.PrivateKey {
+	return im.vcSigner.key.(ed25519.PrivateKey)
+}
+
+// IssueCredential issues a credential to the DID of a user, stores it on IPFS
+// and returns its record and the credential: a JSON string for VC-JWT, an
+// object for Data Integrity. baseURL is where the status list is served.
+func (im *IdentityManager) IssueCredential(ctx context.Context, actor Principal, baseURL string, req CredentialRequest) (IssuedCredential, json.RawMessage, error) {
+	if err := im.mode.checkWrite(); err != nil {
+		return IssuedCredential{}, nil, err
+	}
+	if req.Format == "" {
+		req.Format = FormatVCJWT
+	}
+	if req.Format != FormatVCJWT && req.Format != FormatDataIntegrity {
+		return IssuedCredential{}, nil, fmt.Errorf("unsupported credential format %q", req.Format)
+	}
+	if req.Type == "" || req.Type == "VerifiableCredential" || strings.ContainsAny(req.Type, " ,") {
+		return IssuedCredential{}, nil, errors.New("a credential type such as EmployeeCredential is required")
+	}
+	if _, ok := req.Claims["id"]; ok {
+		return IssuedCredential{}, nil, errors.New("claims must not set id; the subject is the user's DID")
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(now) {
+		return IssuedCredential{}, nil, errors.New("expires_at is in the past")
+	}
+
+	db, err := im.loadDatabase(ctx)
+	if err != nil {
+		return IssuedCredential{}, nil, err
+	}
+	user, exists := db.Users[req.UserID]
+	if !exists {
+		return IssuedCredential{}, nil, errors.New("user not found")
+	}
+	if user.DID == nil {
+		return IssuedCredential{}, nil, errors.New("user has no DID")
+	}
+	index, err := freeStatusIndex(db)
+	if err != nil {
+		return IssuedCredential{}, nil, err
+	}
+
+	record := IssuedCredential{
+		ID:          uuid.New().String(),
+		UserID:      user.ID,
+		Subject:     user.DID.ID,
+		Types:       []string{"VerifiableCredential", req.Type},
+		Format:      req.Format,
+		StatusIndex: index,
+		IssuedAt:    now,
+		ExpiresAt:   utcPtr(req.ExpiresAt),
+		IssuedBy:    actor.String(),
+	}
+	subject := map[string]interface{}{"id": record.Subject}
+	for k, v := range req.Claims {
+		subject[k] = v
+	}
+	listURL := statusListURL(baseURL)
+	vc := map[string]interface{}{
+		"@context":          []interface{}{contextCredentials, contextStatusList},
+		"id":                "urn:uuid:" + record.ID,
+		"type":              []interface{}{"VerifiableCredential", req.Type},
+		"issuer":            im.ServiceDID(),
+		"issuanceDate":      now.Format(time.RFC3339),
+		"credentialSubject": subject,
+		"credentialStatus": map[string]interface{}{
+			"id":                   fmt.Sprintf("%s#%d", listURL, index),
+			"type":                 "StatusList2021Entry",
+			"statusPurpose":        "revocation",
+			"statusListIndex":      strconv.Itoa(index),
+			"statusListCredential": listURL,
+		},
+	}
+	if record.ExpiresAt != nil {
+		vc["expirationDate"] = record.ExpiresAt.Format(time.RFC3339)
+	}
+
+	var stored, credential []byte
+	switch req.Format {
+	case FormatVCJWT:
+		claims := map[string]interface{}{
+			"iss": im.ServiceDID(),
+			"sub": record.Subject,
+			"jti": vc["id"],
+			"nbf": now.Unix(),
+			"iat": now.Unix(),
+			"vc":  vc,
+		}
+		if record.ExpiresAt != nil {
+			claims["exp"] = record.ExpiresAt.Unix()
+		}
+		token, err := im.vcSigner.signWithHeader(jwtHeader{Alg: AlgEdDSA, Typ: "JWT", Kid: im.credentialVerificationMethod()}, claims)
+		if err != nil {
+			return IssuedCredential{}, nil, err
+		}
+		stored = []byte(token)
+		credential, _ = json.Marshal(token)
+	case FormatDataIntegrity:
+		vc["@context"] = []interface{}{contextCredentials, contextDataIntegrity, contextStatusList}
+		signed, err := addProof(vc, im.credentialKey(), im.credentialVerificationMethod(), "assertionMethod", nil)
+		if err != nil {
+			return IssuedCredential{}, nil, err
+		}
+		if stored, err = json.Marshal(signed); err != nil {
+			return IssuedCredential{}, nil, err
+		}
+		credential = stored
+	}
+	if record.CID, err = im.ipfs.Add(ctx, bytes.NewReader(stored)); err != nil {
+		return IssuedCredential{}, nil, fmt.Errorf("failed to store credential: %w", err)
+	}
+
+	err = im.batch.submit(ctx, mutation{Op: opIssueCredential, ID: record.ID, IssuedCredential: &record, Actor: actor.String(), At: now})
+	if err != nil {
+		return IssuedCredential{}, nil, err
+	}
+	im.log.Info(fmt.Sprintf("Credential %s (%s) issued to user %s by %s", record.ID, req.Type, user.ID, actor))
+
+	// Verifiers need a status list to check even before anything is revoked.
+	if db.StatusList == nil {
+		if err := im.publishStatusList(ctx, baseURL); err != nil {
+			im.log.Warn(fmt.Sprintf("Failed to publish the initial status list: %v", err))
+		}
+	}
+	return record, credential, nil
+}
+
+// freeStatusIndex picks a random unused status list entry, so a credential's
+// index says nothing about when it was issued.
+func freeStatusIndex(db *database) (int, error) {
+	if len(db.Credentials) >= statusListSize/2 {
+		return 0, errors.New("the status list is full")
+	}
+	used := make(map[int]bool, len(db.Credentials))
+	for _, c := range db.Credentials {
+		used[c.StatusIndex] = true
+	}
+	var buf [4]byte
+	for {
+		if _, err := rand.Read(buf[:]); err != nil {
+			return 0, err
+		}
+		if index := int(binary.BigEndian.Uint32(buf[:]) % statusListSize); !used[index] {
+			return index, nil
+		}
+	}
+}
+
+// IssuedCredentials lists issued credentials, oldest first, limited to those
+// of the user with ID userID unless it is empty.
+func (im *IdentityManager) IssuedCredentials(ctx context.Context, userID string) ([]IssuedCredential, error) {
+	db, err := im.loadDatabase(ctx)
+	if err != nil {
+		return nil, err
+	}
+	list := make([]IssuedCredential, 0)
+	for _, c := range db.Credentials {
+		if userID == "" || c.UserID == userID {
+			list = append(list, c)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if !list[i].IssuedAt.Equal(list[j].IssuedAt) {
+			return list[i].IssuedAt.Before(list[j].IssuedAt)
+		}
+		return list[i].ID < list[j].ID
+	})
+	return list, nil
+}
+
+// CredentialDocument returns an issued credential as stored on IPFS: a JSON
+// string for VC-JWT, an object for Data Integrity.
+func (im *IdentityManager) CredentialDocument(ctx context.Context, c IssuedCredential) (json.RawMessage, error) {
+	data, err := im.fetchBlob(ctx, c.CID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read credential: %w", err)
+	}
+	if c.Format == FormatVCJWT {
+		return json.Marshal(string(data))
+	}
+	return data, nil
+}
+
+// RevokeCredential revokes an issued credential and publishes the updated
+// status list.
+func (im *IdentityManager) RevokeCredential(ctx context.Context, actor Principal, baseURL, id string) error {
+	if err := im.mode.checkWrite(); err != nil {
+		return err
+	}
+	if err := im.batch.submit(ctx, mutation{Op: opRevokeCredential, ID: id, Actor: actor.String(), At: time.Now()}); err != nil {
+		return err
+	}
+	im.log.Info(fmt.Sprintf("Credential %s revoked by %s", id, actor))
+	if err := im.publishStatusList(ctx, baseURL); err != nil {
+		return fmt.Errorf("credential revoked, but publishing the status list failed: %w", err)
+	}
+	return nil
+}
+
+// publishStatusList signs the current revocation bitstring as a
+// StatusList2021 credential, stores it on IPFS and records its CID.
+func (im *IdentityManager) publishStatusList(ctx context.Context, baseURL string) error {
+	db, err := im.loadDatabase(ctx)
+	if err != nil {
+		return err
+	}
+	bits := make([]byte, statusListSize/8)
+	revision := 0
+	for _, c := range db.Credentials {
+		if c.RevokedAt != nil {
+			// Entry 0 is the most significant bit of the first byte.
+			bits[c.StatusIndex/8] |= 0x80 >> (c.StatusIndex % 8)
+			revision++
+		}
+	}
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	zw.Write(bits)
+	if err := zw.Close(); err != nil {
+		return err
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	listURL := statusListURL(baseURL)
+	list := map[string]interface{}{
+		"@context":     []interface{}{contextCredentials, contextDataIntegrity, contextStatusList},
+		"id":           listURL,
+		"type":         []interface{}{"VerifiableCredential", "StatusList2021Credential"},
+		"issuer":       im.ServiceDID(),
+		"issuanceDate": now.Format(time.RFC3339),
+		"credentialSubject": map[string]interface{}{
+			"id":            listURL + "#list",
+			"type":          "StatusList2021",
+			"statusPurpose": "revocation",
+			"encodedList":   base64.RawURLEncoding.EncodeToString(compressed.Bytes()),
+		},
+	}
+	signed, err := addProof(list, im.credentialKey(), im.credentialVerificationMethod(), "assertionMethod", nil)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(signed)
+	if err != nil {
+		return err
+	}
+	cid, err := im.ipfs.Add(ctx, bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("failed to store status list: %w", err)
+	}
+	published := StatusList{CID: cid, Revision: revision, PublishedAt: now}
+	err = im.batch.submit(ctx, mutation{Op: opPublishStatusList, StatusList: &published, At: now})
+	if errors.Is(err, errStaleStatusList) {
+		return nil // A concurrent revocation published a newer list
+	}
+	return err
+}
+
+// StatusListCredential returns the published status list credential.
+func (im *IdentityManager) StatusListCredential(ctx context.Context) ([]byte, error) {
+	db, err := im.loadDatabase(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if db.StatusList == nil {
+		return nil, errors.New("no status list has been published")
+	}
+	return im.fetchBlob(ctx, db.StatusList.CID)
+}
+
+// CredentialVerification is the outcome of verifying a credential.
+type CredentialVerification struct {
+	Verified  bool       `json:"verified"`
+	Format    string     `json:"format,omitempty"`
+	ID        string     `json:"id,omitempty"`
+	Issuer    string     `json:"issuer,omitempty"`
+	Subject   string     `json:"subject,omitempty"`
+	Types     []string   `json:"types,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	Error     string     `json:"error,omitempty"`
+}
+
+// VerifyCredential checks a credential's signature, validity period and
+// revocation status. credential is a VC-JWT as a JSON string or a Data
+// Integrity credential as an object. Credentials from any issuer whose DID
+// resolves are accepted. baseURL identifies this service's own status list,
+// which is read from IPFS rather than over HTTP.
+func (im *IdentityManager) VerifyCredential(ctx context.Context, baseURL string, credential json.RawMessage) CredentialVerification {
+	result := CredentialVerification{}
+	vc, err := im.verifyCredential(ctx, baseURL, credential, &result)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	status, _ := vc["credentialStatus"].(map[string]interface{})
+	if status != nil {
+		if err := im.checkStatus(ctx, baseURL, status, result.Issuer); err != nil {
+			result.Error = err.Error()
+			return result
+		}
+	}
+	result.Verified = true
+	return result
+}
+
+// verifyCredential checks the proof and validity period of a credential and
+// returns the credential object, filling in result as it goes.
+func (im *IdentityManager) verifyCredential(ctx context.Context, baseURL string, credential json.RawMessage, result *CredentialVerification) (map[string]interface{}, error) {
+	now := time.Now()
+	var token string
+	if json.Unmarshal(credential, &token) == nil {
+		result.Format = FormatVCJWT
+		claims, err := im.verifyDIDJWT(ctx, token, "assertionMethod")
+		if err != nil {
+			return nil, err
+		}
+		vc, _ := claims["vc"].(map[string]interface{})
+		if vc == nil {
+			return nil, errors.New("token has no vc claim")
+		}
+		result.Issuer, _ = claims["iss"].(string)
+		result.Subject, _ = claims["sub"].(string)
+		result.ID, _ = claims["jti"].(string)
+		result.Types = stringList(vc["type"])
+		if exp, ok := claims["exp"].(float64); ok {
+			t := time.Unix(int64(exp), 0).UTC()
+			result.ExpiresAt = &t
+		}
+		if nbf, ok := claims["nbf"].(float64); ok && now.Unix() < int64(nbf) {
+			return nil, errors.New("credential is not valid yet")
+		}
+		if result.ExpiresAt != nil && now.After(*result.ExpiresAt) {
+			return nil, errors.New("credential has expired")
+		}
+		if !hasString(result.Types, "VerifiableCredential") {
+			return nil, errors.New("vc claim is not a VerifiableCredential")
+		}
+		return vc, nil
+	}
+
+	var vc map[string]interface{}
+	if err := json.Unmarshal(credential, &vc); err != nil {
+		return nil, errors.New("credential must be a VC-JWT string or a JSON object")
+	}
+	result.Format = FormatDataIntegrity
+	result.ID, _ = vc["id"].(string)
+	result.Types = stringList(vc["type"])
+	result.Issuer = credentialIssuer(vc)
+	if subject, ok := vc["credentialSubject"].(map[string]interface{}); ok {
+		result.Subject, _ = subject["id"].(string)
+	}
+	if !hasString(result.Types, "VerifiableCredential") {
+		return nil, errors.New("not a VerifiableCredential")
+	}
+	signer, err := im.verifyProof(ctx, vc, "assertionMethod", nil)
+	if err != nil {
+		return nil, err
+	}
+	if signer != result.Issuer {
+		return nil, errors.New("credential was not signed by its issuer")
+	}
+	if s, ok := vc["expirationDate"].(string); ok {
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			return nil, errors.New("malformed expirationDate")
+		}
+		result.ExpiresAt = &t
+		if now.After(t) {
+			return nil, errors.New("credential has expired")
+		}
+	}
+	if s, ok := vc["issuanceDate"].(string); ok {
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			return nil, errors.New("malformed issuanceDate")
+		}
+		if now.Before(t) {
+			return nil, errors.New("credential is not valid yet")
+		}
+	}
+	return vc, nil
+}
+
+// checkStatus looks up a StatusList2021 entry and fails if it is set.
+func (im *IdentityManager) checkStatus(ctx context.Context, baseURL string, status map[string]interface{}, issuer string) error {
+	if status["type"] != "StatusList2021Entry" {
+		return fmt.Errorf("unsupported credential status type %v", status["type"])
+	}
+	if status["statusPurpose"] != "revocation" {
+		return fmt.Errorf("unsupported status purpose %v", status["statusPurpose"])
+	}
+	indexText, _ := status["statusListIndex"].(string)
+	index, err := strconv.Atoi(indexText)
+	if err != nil || index < 0 {
+		return errors.New("malformed statusListIndex")
+	}
+	listURL, _ := status["statusListCredential"].(string)
+
+	var data []byte
+	if listURL == statusListURL(baseURL) {
+		if data, err = im.StatusListCredential(ctx); err != nil {
+			return err
+		}
+	} else if data, err = fetchStatusList(ctx, listURL); err != nil {
+		return err
+	}
+	var list map[string]interface{}
+	if err := json.Unmarshal(data, &list); err != nil {
+		return errors.New("malformed status list credential")
+	}
+	signer, err := im.verifyProof(ctx, list, "assertionMethod", nil)
+	if err != nil {
+		return fmt.Errorf("status list: %w", err)
+	}
+	if signer != issuer || credentialIssuer(list) != issuer {
+		return errors.New("status list was not issued by the credential's issuer")
+	}
+	if !hasString(stringList(list["type"]), "StatusList2021Credential") {
+		return errors.New("status list credential has the wrong type")
+	}
+	subject, _ := list["credentialSubject"].(map[string]interface{})
+	encoded, _ := subject["encodedList"].(string)
+	bits, err := decodeStatusList(encoded)
+	if err != nil {
+		return err
+	}
+	if index >= len(bits)*8 {
+		return errors.New("statusListIndex is outside the status list")
+	}
+	if bits[index/8]&(0x80>>(index%8)) != 0 {
+		return errors.New("credential has been revoked")
+	}
+	return nil
+}
+
+func fetchStatusList(ctx context.Context, url string) ([]byte, error) {
+	data, err := fetchPublic(ctx, url)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch status list: %w", err)
+	}
+	return data, nil
+}
+
+// decodeStatusList decodes an encodedList: a gzipped bitstring in base64,
+// with or without padding and in either alphabet.
+func decodeStatusList(encoded string) ([]byte, error) {
+	encoded = strings.TrimRight(encoded, "=")
+	compressed, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		if compressed, err = base64.RawStdEncoding.DecodeString(encoded); err != nil {
+			return nil, errors.New("malformed encodedList")
+		}
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, errors.New("malformed encodedList")
+	}
+	bits, err := io.ReadAll(io.LimitReader(zr, 16<<20))
+	if err != nil {
+		return nil, errors.New("malformed encodedList")
+	}
+	return bits, nil
+}
+
+// addProof returns a copy of doc with an eddsa-jcs-2022 Data Integrity proof
+// made by key. extra holds additional proof options, such as a challenge.
+func addProof(doc map[string]interface{}, key ed25519.PrivateKey, verificationMethod, purpose string, extra map[string]interface{}) (map[string]interface{}, error) {
+	proof := map[string]interface{}{
+		"type":               "DataIntegrityProof",
+		"cryptosuite":        cryptosuiteEdDSAJCS,
+		"created":            time.Now().UTC().Format(time.RFC3339),
+		"verificationMethod": verificationMethod,
+		"proofPurpose":       purpose,
+	}
+	for k, v := range extra {
+		proof[k] = v
+	}
+	hash, err := proofHash(doc, proof)
+	if err != nil {
+		return nil, err
+	}
+	proof["proofValue"], _ = multibase.Encode(multibase.Base58BTC, ed25519.Sign(key, hash))
+
+	signed := make(map[string]interface{}, len(doc)+1)
+	for k, v := range doc {
+		signed[k] = v
+	}
+	signed["proof"] = proof
+	return signed, nil
+}
+
+// proofHash returns the data an eddsa-jcs-2022 proof signs: the hash of the
+// canonical proof options, with the document's context, followed by the hash
+// of the canonical document.
+func proofHash(doc, proof map[string]interface{}) ([]byte, error) {
+	config := make(map[string]interface{}, len(proof)+1)
+	for k, v := range proof {
+		if k != "proofValue" {
+			config[k] = v
+		}
+	}
+	if ctx, ok := doc["@context"]; ok {
+		config["@context"] = ctx
+	}
+	unsecured := make(map[string]interface{}, len(doc))
+	for k, v := range doc {
+		if k != "proof" {
+			unsecured[k] = v
+		}
+	}
+	canonicalConfig, err := canonicalJSON(config)
+	if err != nil {
+		return nil, err
+	}
+	canonicalDoc, err := canonicalJSON(unsecured)
+	if err != nil {
+		return nil, err
+	}
+	configHash, docHash := sha256.Sum256(canonicalConfig), sha256.Sum256(canonicalDoc)
+	return append(configHash[:], docHash[:]...), nil
+}
+
+// verifyProof checks the eddsa-jcs-2022 proof of doc for purpose and returns
+// the DID that made it. Proof options in expect, such as a challenge, must
+// match.
+func (im *IdentityManager) verifyProof(ctx context.Context, doc map[string]interface{}, purpose string, expect map[string]string) (string, error) {
+	proof, ok := doc["proof"].(map[string]interface{})
+	if !ok {
+		return "", errors.New("document has no proof")
+	}
+	if proof["type"] != "DataIntegrityProof" || proof["cryptosuite"] != cryptosuiteEdDSAJCS {
+		return "", fmt.Errorf("unsupported proof: only DataIntegrityProof with %s is supported", cryptosuiteEdDSAJCS)
+	}
+	if proof["proofPurpose"] != purpose {
+		return "", fmt.Errorf("proof purpose must be %s", purpose)
+	}
+	for k, want := range expect {
+		if got, _ := proof[k].(string); got != want {
+			return "", fmt.Errorf("proof %s does not match", k)
+		}
+	}
+	value, _ := proof["proofValue"].(string)
+	enc, sig, err := multibase.Decode(value)
+	if err != nil || enc != multibase.Base58BTC || len(sig) != ed25519.SignatureSize {
+		return "", errors.New("malformed proofValue")
+	}
+	vmID, _ := proof["verificationMethod"].(string)
+	signer, pub, err := im.verificationKey(ctx, vmID, purpose)
+	if err != nil {
+		return "", err
+	}
+	hash, err := proofHash(doc, proof)
+	if err != nil {
+		return "", err
+	}
+	if !ed25519.Verify(pub, hash, sig) {
+		return "", errors.New("invalid proof signature")
+	}
+	return signer, nil
+}
+
+// verificationKey resolves a verification method, checks that its DID
+// document allows it for purpose ("assertionMethod" or "authentication") and
+// returns the DID and the Ed25519 key.
+func (im *IdentityManager) verificationKey(ctx context.Context, vmID, purpose string) (string, ed25519.PublicKey, error) {
+	id, fragment := did.SplitURL(vmID)
+	if fragment == "" {
+		return "", nil, errors.New("verification method must be a DID URL with a fragment")
+	}
+	doc, err := im.ResolveDID(ctx, id)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to resolve %s: %w", id, err)
+	}
+	allowed := doc.Asserts(vmID)
+	if purpose == "authentication" {
+		allowed = doc.Authenticates(vmID)
+	}
+	if !allowed {
+		return "", nil, fmt.Errorf("%s is not authorized for %s", vmID, purpose)
+	}
+	vm, ok := doc.VerificationMethodByID(vmID)
+	if !ok {
+		return "", nil, fmt.Errorf("%s is not in the DID document", vmID)
+	}
+	pub, err := vm.Ed25519PublicKey()
+	if err != nil {
+		return "", nil, err
+	}
+	return id, pub, nil
+}
+
+// verifyDIDJWT checks an EdDSA JWS whose kid is a DID URL allowed for purpose
+// and whose issuer is that DID, and returns its claims. It does not check
+// time claims.
+func (im *IdentityManager) verifyDIDJWT(ctx context.Context, token, purpose string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed JWT")
+	}
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errors.New("malformed JWT header")
+	}
+	var header jwtHeader
+	if err := json.Unmarshal(headerJSON, &header); err != nil {
+		return nil, errors.New("malformed JWT header")
+	}
+	if header.Alg != AlgEdDSA {
+		return nil, fmt.Errorf("unsupported JWT algorithm %q", header.Alg)
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errors.New("malformed JWT payload")
+	}
+	var claims map[string]interface{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, errors.New("malformed JWT payload")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed JWT signature")
+	}
+	signer, pub, err := im.verificationKey(ctx, header.Kid, purpose)
+	if err != nil {
+		return nil, err
+	}
+	if iss, _ := claims["iss"].(string); iss != signer {
+		return nil, errors.New("JWT was not signed by its issuer")
+	}
+	if !ed25519.Verify(pub, []byte(parts[0]+"."+parts[1]), sig) {
+		return nil, errors.New("invalid JWT signature")
+	}
+	return claims, nil
+}
+
+// credentialIssuer returns the issuer of a credential, which may be a string
+// or an object with an id.
+func credentialIssuer(vc map[string]interface{}) string {
+	switch issuer := vc["issuer"].(type) {
+	case string:
+		return issuer
+	case map[string]interface{}:
+		id, _ := issuer["id"].(string)
+		return id
+	}
+	return ""
+}
+
+// stringList returns v as a list of strings; a single string is a list of
+// one.
+func stringList(v interface{}) []string {
+	switch x := v.(type) {
+	case string:
+		return []string{x}
+	case []interface{}:
+		var list []string
+		for _, item := range x {
+			if s, ok := item.(string); ok {
+				list = append(list, s)
+			}
+		}
+		return list
+	}
+	return nil
+}
+
+func hasString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
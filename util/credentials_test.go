@@ -0,0 +1,127 @@
+package util
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testBaseURL = "https://id.example.com"
+
+// TestCredentialLifecycle issues a credential in each format, verifies it,
+// revokes it and checks that verification then fails.
+func TestCredentialLifecycle(t *testing.T) {
+	im := newTestManager(t, newTestNode(t))
+	ctx := context.Background()
+	id, _, err := im.AddUser(ctx, "alice", "secret", "")
+	if err != nil {
+		t.Fatalf("AddUser: %v", err)
+	}
+	admin := Principal{ID: "admin", Kind: PrincipalUser}
+	expires := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+
+	for _, format := range []string{FormatVCJWT, FormatDataIntegrity} {
+		t.Run(format, func(t *testing.T) {
+			record, credential, err := im.IssueCredential(ctx, admin, testBaseURL, CredentialRequest{
+				UserID:    id,
+				Type:      "EmployeeCredential",
+				Claims:    map[string]interface{}{"role": "engineer", "level": 3},
+				Format:    format,
+				ExpiresAt: &expires,
+			})
+			if err != nil {
+				t.Fatalf("IssueCredential: %v", err)
+			}
+
+			stored, err := im.CredentialDocument(ctx, record)
+			if err != nil {
+				t.Fatalf("CredentialDocument: %v", err)
+			}
+			if string(stored) != string(credential) {
+				t.Errorf("stored credential differs from the issued one")
+			}
+
+			result := im.VerifyCredential(ctx, testBaseURL, credential)
+			if !result.Verified {
+				t.Fatalf("VerifyCredential: %s", result.Error)
+			}
+			if result.Format != format || result.ID != "urn:uuid:"+record.ID || result.Issuer != im.ServiceDID() ||
+				result.Subject != record.Subject || strings.Join(result.Types, " ") != "VerifiableCredential EmployeeCredential" ||
+				result.ExpiresAt == nil || !result.ExpiresAt.Equal(expires) {
+				t.Errorf("VerifyCredential = %+v, does not describe the issued credential", result)
+			}
+
+			if err := im.RevokeCredential(ctx, admin, testBaseURL, record.ID); err != nil {
+				t.Fatalf("RevokeCredential: %v", err)
+			}
+			result = im.VerifyCredential(ctx, testBaseURL, credential)
+			if result.Verified || !strings.Contains(result.Error, "revoked") {
+				t.Errorf("VerifyCredential after revocation = %+v, want a revoked error", result)
+			}
+		})
+	}
+}
+
+func TestVerifyCredentialTampered(t *testing.T) {
+	im := newTestManager(t, newTestNode(t))
+	ctx := context.Background()
+	id, _, err := im.AddUser(ctx, "alice", "secret", "")
+	if err != nil {
+		t.Fatalf("AddUser: %v", err)
+	}
+	admin := Principal{ID: "admin", Kind: PrincipalUser}
+	_, credential, err := im.IssueCredential(ctx, admin, testBaseURL, CredentialRequest{
+		UserID: id,
+		Type:   "EmployeeCredential",
+		Claims: map[string]interface{}{"role": "engineer"},
+		Format: FormatDataIntegrity,
+	})
+	if err != nil {
+		t.Fatalf("IssueCredential: %v", err)
+	}
+
+	tamper := func(change func(vc map[string]interface{})) json.RawMessage {
+		var vc map[string]interface{}
+		json.Unmarshal(credential, &vc)
+		change(vc)
+		data, _ := json.Marshal(vc)
+		return data
+	}
+	tests := []struct {
+		name       string
+		credential json.RawMessage
+		want       string
+	}{
+		{"claim changed", tamper(func(vc map[string]interface{}) {
+			vc["credentialSubject"].(map[string]interface{})["role"] = "admin"
+		}), "invalid proof signature"},
+		{"proof option changed", tamper(func(vc map[string]interface{}) {
+			vc["proof"].(map[string]interface{})["created"] = "2000-01-01T00:00:00Z"
+		}), "invalid proof signature"},
+		{"proof removed", tamper(func(vc map[string]interface{}) { delete(vc, "proof") }), "no proof"},
+		{"wrong purpose", tamper(func(vc map[string]interface{}) {
+			vc["proof"].(map[string]interface{})["proofPurpose"] = "authentication"
+		}), "proof purpose"},
+		{"issuer changed", tamper(func(vc map[string]interface{}) { vc["issuer"] = "did:web:evil.example" }), "invalid proof signature"},
+		{"issuance date changed", tamper(func(vc map[string]interface{}) {
+			vc["issuanceDate"] = time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+		}), "invalid proof signature"},
+	}
+	for _, tt := range tests {
+		result := im.VerifyCredential(ctx, testBaseURL, tt.credential)
+		if result.Verified || !strings.Contains(result.Error, tt.want) {
+			t.Errorf("%s: VerifyCredential = %+v, want an error containing %q", tt.name, result, tt.want)
+		}
+	}
+
+	// Key order and whitespace do not matter to the proof, which signs the
+	// canonical form.
+	var vc map[string]interface{}
+	json.Unmarshal(credential, &vc)
+	reformatted, _ := json.MarshalIndent(vc, "", "    ")
+	if result := im.VerifyCredential(ctx, testBaseURL, reformatted); !result.Verified {
+		t.Errorf("reformatted credential: %s", result.Error)
+	}
+}
@@ -0,0 +1,279 @@
+package util
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"ipfs-identity/did"
+)
+
+// UserDID is a user's decentralized identifier. The did:web identifier stays
+// the same for the life of the account; its document lists the current key,
+// whose did:key form is given as alsoKnownAs.
+type UserDID struct {
+	ID          string   `json:"id"`           // did:web identifier
+	KeyDID      string   `json:"key_did"`      // did:key of the current key
+	DocumentCID string   `json:"document_cid"` // Current DID document on IPFS
+	Keys        []DIDKey `json:"keys"`         // Every key, oldest first; the last is current
+}
+
+// DIDKey is one version of a user's DID key and the document published with
+// it.
+type DIDKey struct {
+	ID                 string     `json:"id"` // Fragment, e.g. "key-1"
+	PublicKeyMultibase string     `json:"public_key_multibase"`
+	DocumentCID        string     `json:"document_cid"`
+	CreatedAt          time.Time  `json:"created_at"`
+	RotatedAt          *time.Time `json:"rotated_at,omitempty"` // Nil while current
+}
+
+func (d UserDID) canonical() UserDID {
+	keys := make([]DIDKey, len(d.Keys))
+	for i, k := range d.Keys {
+		k.CreatedAt = k.CreatedAt.UTC()
+		if k.RotatedAt != nil {
+			rotated := k.RotatedAt.UTC()
+			k.RotatedAt = &rotated
+		}
+		keys[i] = k
+	}
+	d.Keys = keys
+	return d
+}
+
+// didDomain returns the domain did:web identifiers are issued under:
+// DID_WEB_DOMAIN, else the host of JWT_ISSUER, else localhost.
+func didDomain() string {
+	if domain := os.Getenv("DID_WEB_DOMAIN"); domain != "" {
+		return domain
+	}
+	if u, err := url.Parse(os.Getenv("JWT_ISSUER")); err == nil && u.Host != "" {
+		return u.Host
+	}
+	return "localhost"
+}
+
+// ServiceDID returns the did:web identifier of the service itself, served at
+// /.well-known/did.json.
+func (im *IdentityManager) ServiceDID() string {
+	return did.WebDID(im.didDomain)
+}
+
+// ServiceDIDDocument returns the DID document of the service, listing the key
+// it signs tokens with and, for assertions only, the key it signs verifiable
+// credentials with.
+func (im *IdentityManager) ServiceDIDDocument() *did.Document {
+	id := im.ServiceDID()
+	jwk := im.signer.PublicJWK()
+	vm := id + "#" + jwk["kid"]
+	vcKey := im.credentialVerificationMethod()
+	return &did.Document{
+		Context: []string{did.ContextDID, did.ContextJWK, did.ContextMultikey},
+		ID:      id,
+		VerificationMethod: []did.VerificationMethod{{
+			ID:           vm,
+			Type:         "JsonWebKey2020",
+			Controller:   id,
+			PublicKeyJWK: jwk,
+		}, {
+			ID:                 vcKey,
+			Type:               "Multikey",
+			Controller:         id,
+			PublicKeyMultibase: did.EncodeMultikey(im.credentialKey().Public().(ed25519.PublicKey)),
+		}},
+		Authentication:  []string{vm},
+		AssertionMethod: []string{vm, vcKey},
+	}
+}
+
+// userDIDDocument returns the DID document of the user DID d, with its
+// current key.
+func userDIDDocument(d UserDID) *did.Document {
+	key := d.Keys[len(d.Keys)-1]
+	vm := d.ID + "#" + key.ID
+	return &did.Document{
+		Context:     []string{did.ContextDID, did.ContextMultikey},
+		ID:          d.ID,
+		AlsoKnownAs: []string{d.KeyDID},
+		VerificationMethod: []did.VerificationMethod{{
+			ID:                 vm,
+			Type:               "Multikey",
+			Controller:         d.ID,
+			PublicKeyMultibase: key.PublicKeyMultibase,
+		}},
+		Authentication:  []string{vm},
+		AssertionMethod: []string{vm},
+	}
+}
+
+// nextDID returns current with pub as its new key. current may be nil for a
+// user without a DID. The new document is published with the state that
+// records it, by publishDIDDocuments.
+func nextDID(domain, userID string, current *UserDID, pub ed25519.PublicKey) *UserDID {
+	now := time.Now()
+	next := UserDID{ID: did.WebDID(domain, "users", userID)}
+	if current != nil {
+		next.ID = current.ID
+		next.Keys = append([]DIDKey{}, current.Keys...)
+		next.Keys[len(next.Keys)-1].RotatedAt = &now
+	}
+	multikey := did.EncodeMultikey(pub)
+	next.KeyDID = "did:key:" + multikey
+	next.Keys = append(next.Keys, DIDKey{
+		ID:                 fmt.Sprintf("key-%d", len(next.Keys)+1),
+		PublicKeyMultibase: multikey,
+		CreatedAt:          now,
+	})
+	return &next
+}
+
+// version returns d as it was while key i was current.
+func (d UserDID) version(i int) UserDID {
+	return UserDID{
+		ID:     d.ID,
+		KeyDID: "did:key:" + d.Keys[i].PublicKeyMultibase,
+		Keys:   d.Keys[:i+1],
+	}
+}
+
+// publishDIDDocuments stores every DID document in db that is not on IPFS
+// yet and records its CID. It runs whenever a state is stored, so documents
+// of writes queued in the WAL are published once IPFS is back.
+func (im *IdentityManager) publishDIDDocuments(ctx context.Context, db *database) error {
+	for id, user := range db.Users {
+		if user.DID == nil {
+			continue
+		}
+		var published *UserDID
+		for i, key := range user.DID.Keys {
+			if key.DocumentCID != "" {
+				continue
+			}
+			if published == nil {
+				// The DID may be shared with a cached state or a mutation.
+				d := *user.DID
+				d.Keys = append([]DIDKey(nil), d.Keys...)
+				published = &d
+			}
+			data, err := json.Marshal(userDIDDocument(published.version(i)))
+			if err != nil {
+				return err
+			}
+			cid, err := im.ipfs.Add(ctx, bytes.NewReader(data))
+			if err != nil {
+				return fmt.Errorf("failed to store DID document: %w", err)
+			}
+			published.Keys[i].DocumentCID = cid
+		}
+		if published != nil {
+			published.DocumentCID = published.Keys[len(published.Keys)-1].DocumentCID
+			user.DID = published
+			db.Users[id] = user
+		}
+	}
+	return nil
+}
+
+// RotateDIDKey replaces the key of the user's DID and publishes a new
+// document. With a nil pub, a key pair is generated and its private key
+// returned; it is not stored and cannot be shown again. Users registered
+// before DIDs were introduced get their first DID this way.
+func (im *IdentityManager) RotateDIDKey(ctx context.Context, actor Principal, id string, pub ed25519.PublicKey) (*UserDID, ed25519.PrivateKey, error) {
+	if err := im.mode.checkWrite(); err != nil {
+		return nil, nil, err
+	}
+	var priv ed25519.PrivateKey
+	if pub == nil {
+		var err error
+		if pub, priv, err = ed25519.GenerateKey(rand.Reader); err != nil {
+			return nil, nil, fmt.Errorf("failed to generate DID key: %w", err)
+		}
+	}
+	db, err := im.loadDatabase(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	user, exists := db.Users[id]
+	if !exists {
+		return nil, nil, errors.New("user not found")
+	}
+	next := nextDID(im.didDomain, id, user.DID, pub)
+	err = im.batch.submit(ctx, mutation{Op: opRotateDIDKey, ID: id, DID: next, Actor: actor.String(), At: time.Now()})
+	if err != nil {
+		return nil, nil, err
+	}
+	im.log.Info(fmt.Sprintf("DID key of user %s rotated to %s by %s", id, next.KeyDID, actor))
+	return next, priv, nil
+}
+
+// UserDID returns the DID of the user with ID id.
+func (im *IdentityManager) UserDID(ctx context.Context, id string) (*UserDID, error) {
+	db, err := im.loadDatabase(ctx)
+	if err != nil {
+		return nil, err
+	}
+	user, exists := db.Users[id]
+	if !exists || user.DID == nil {
+		return nil, errors.New("DID not found")
+	}
+	d := *user.DID
+	return &d, nil
+}
+
+// UserDIDDocument returns the stored DID document of the user with ID id.
+// version selects a past document, counting from 1; 0 is the current one.
+func (im *IdentityManager) UserDIDDocument(ctx context.Context, id string, version int) ([]byte, error) {
+	d, err := im.UserDID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	i := len(d.Keys) - 1
+	if version != 0 {
+		if version < 0 || version > len(d.Keys) {
+			return nil, errors.New("DID document version not found")
+		}
+		i = version - 1
+	}
+	cid := d.Keys[i].DocumentCID
+	if cid == "" {
+		// Not published yet while the write is queued in the WAL.
+		return json.Marshal(userDIDDocument(d.version(i)))
+	}
+	r, err := im.ipfs.Cat(ctx, cid)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read DID document: %w", err)
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// ResolveDID resolves a DID to its document. The service's own DID and those
+// of its users are answered from the store; others go to the resolver set
+// with SetDIDResolver.
+func (im *IdentityManager) ResolveDID(ctx context.Context, id string) (*did.Document, error) {
+	if id == im.ServiceDID() {
+		return im.ServiceDIDDocument(), nil
+	}
+	if prefix := did.WebDID(im.didDomain, "users") + ":"; strings.HasPrefix(id, prefix) {
+		data, err := im.UserDIDDocument(ctx, strings.TrimPrefix(id, prefix), 0)
+		if err != nil {
+			return nil, err
+		}
+		var doc did.Document
+		if err := json.Unmarshal(data, &doc); err != nil {
+			return nil, fmt.Errorf("malformed DID document: %w", err)
+		}
+		return &doc, nil
+	}
+	return im.resolver.Resolve(ctx, id)
+}
@@ -0,0 +1,65 @@
+package util
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+)
+
+func TestDIDDocumentPublishedWithState(t *testing.T) {
+	ctx := context.Background()
+	store := &flakyStore{Store: newTestNode(t)}
+	im := newTestManager(t, store)
+
+	tests := []struct {
+		name string
+		down bool
+	}{
+		{"IPFS up", false},
+		{"queued in WAL", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store.down.Store(tt.down)
+			defer store.down.Store(false)
+
+			id, _, err := im.AddUser(ctx, "user-"+tt.name, "secret", "")
+			if err != nil {
+				t.Fatalf("AddUser: %v", err)
+			}
+			d, err := im.UserDID(ctx, id)
+			if err != nil {
+				t.Fatalf("UserDID: %v", err)
+			}
+			if published := d.DocumentCID != ""; published == tt.down {
+				t.Fatalf("DocumentCID = %q with IPFS down %v", d.DocumentCID, tt.down)
+			}
+			want, err := im.UserDIDDocument(ctx, id, 0)
+			if err != nil {
+				t.Fatalf("UserDIDDocument: %v", err)
+			}
+
+			store.down.Store(false)
+			im.syncWAL(ctx)
+			if d, err = im.UserDID(ctx, id); err != nil {
+				t.Fatalf("UserDID: %v", err)
+			}
+			if d.DocumentCID == "" || d.Keys[0].DocumentCID != d.DocumentCID {
+				t.Fatalf("document not published after replay: %+v", d)
+			}
+			r, err := store.Cat(ctx, d.DocumentCID)
+			if err != nil {
+				t.Fatalf("Cat: %v", err)
+			}
+			defer r.Close()
+			got, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatalf("ReadAll: %v", err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("published document = %s, want %s", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,236 @@
+package util
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"ipfs-identity/did"
+)
+
+// AMRProofOfPossession is the amr value of sessions started by proving
+// control of a DID key (RFC 8176 "pop").
+const AMRProofOfPossession = "pop"
+
+// didAuthConfig holds the nonces issued for DID logins.
+type didAuthConfig struct {
+	nonceTTL time.Duration
+
+	mu     sync.Mutex
+	nonces map[string]time.Time // Unused nonces and when they expire
+}
+
+func newDIDAuthConfig() *didAuthConfig {
+	return &didAuthConfig{
+		nonceTTL: durationFromEnv("DID_AUTH_NONCE_TTL", 5*time.Minute),
+		nonces:   make(map[string]time.Time),
+	}
+}
+
+// newDIDResolver returns the resolver for DIDs the service does not answer
+// itself: did:key offline, did:web over HTTPS to public addresses only and,
+// if DID_RESOLVER_URL is set, every other method through that Universal
+// Resolver.
+func newDIDResolver() did.Resolver {
+	methods := did.MethodResolver{
+		"key": did.KeyResolver{},
+		"web": did.WebResolver{Client: publicClient},
+	}
+	if url := os.Getenv("DID_RESOLVER_URL"); url != "" {
+		methods["*"] = did.UniversalResolver{URL: url, Client: &http.Client{Timeout: 10 * time.Second}}
+	}
+	return methods
+}
+
+// SetDIDResolver replaces the resolver used for DIDs the service does not
+// answer itself, for programs that embed the IdentityManager and support
+// further methods. Call it before serving requests.
+func (im *IdentityManager) SetDIDResolver(r did.Resolver) {
+	im.resolver = r
+}
+
+// DIDAuthNonce returns a new challenge for a DID login or link, the audience
+// the response must name and when the challenge expires. The audience is
+// JWT_ISSUER; DID authentication is refused without it.
+func (im *IdentityManager) DIDAuthNonce() (string, string, time.Time, error) {
+	audience, err := im.configuredIssuer("DID authentication")
+	if err != nil {
+		return "", "", time.Time{}, err
+	}
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		return "", "", time.Time{}, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	nonce := base64.RawURLEncoding.EncodeToString(raw)
+	expires := time.Now().Add(im.didAuth.nonceTTL)
+
+	im.didAuth.mu.Lock()
+	defer im.didAuth.mu.Unlock()
+	now := time.Now()
+	for n, exp := range im.didAuth.nonces {
+		if now.After(exp) {
+			delete(im.didAuth.nonces, n)
+		}
+	}
+	im.didAuth.nonces[nonce] = expires
+	return nonce, audience, expires, nil
+}
+
+// takeNonce consumes nonce, reporting whether it was issued and unexpired.
+func (c *didAuthConfig) takeNonce(nonce string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	expires, ok := c.nonces[nonce]
+	delete(c.nonces, nonce)
+	return ok && time.Now().Before(expires)
+}
+
+// VerifyDIDAuth checks a response to a nonce from DIDAuthNonce and returns
+// the DID that made it. The response is either a compact JWS, given as a JSON
+// string, whose kid is an authentication method of the DID and whose payload
+// holds iss (the DID), aud and nonce; or a JSON object with an eddsa-jcs-2022
+// Data Integrity proof for authentication whose challenge is the nonce and
+// whose domain is the audience, JWT_ISSUER. The nonce is consumed.
+func (im *IdentityManager) VerifyDIDAuth(ctx context.Context, response json.RawMessage) (string, error) {
+	audience, err := im.configuredIssuer("DID authentication")
+	if err != nil {
+		return "", err
+	}
+	var token string
+	if json.Unmarshal(response, &token) == nil {
+		claims, err := decodeUnverifiedClaims(token)
+		if err != nil {
+			return "", err
+		}
+		nonce, _ := claims["nonce"].(string)
+		if !im.didAuth.takeNonce(nonce) {
+			return "", errors.New("unknown or expired nonce")
+		}
+		if aud, _ := claims["aud"].(string); aud != audience {
+			return "", fmt.Errorf("JWS is for %q, not %q", aud, audience)
+		}
+		if exp, ok := claims["exp"].(float64); ok && time.Now().Unix() >= int64(exp) {
+			return "", errors.New("JWS has expired")
+		}
+		if _, err := im.verifyDIDJWT(ctx, token, "authentication"); err != nil {
+			return "", err
+		}
+		iss, _ := claims["iss"].(string)
+		return iss, nil
+	}
+
+	var doc map[string]interface{}
+	if err := json.Unmarshal(response, &doc); err != nil {
+		return "", errors.New("response must be a JWS string or a JSON object with a proof")
+	}
+	proof, _ := doc["proof"].(map[string]interface{})
+	nonce, _ := proof["challenge"].(string)
+	if !im.didAuth.takeNonce(nonce) {
+		return "", errors.New("unknown or expired nonce")
+	}
+	return im.verifyProof(ctx, doc, "authentication", map[string]string{"challenge": nonce, "domain": audience})
+}
+
+// decodeUnverifiedClaims returns the payload of a compact JWS without checking
+// its signature, to find the nonce before the key is resolved.
+func decodeUnverifiedClaims(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed JWS")
+	}
+	var claims map[string]interface{}
+	data, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || json.Unmarshal(data, &claims) != nil {
+		return nil, errors.New("malformed JWS payload")
+	}
+	return claims, nil
+}
+
+// DIDLogin verifies a DID login response and returns the user whose DID made
+// it: the user's own did:web, the did:key of its current key, or a linked
+// DID.
+func (im *IdentityManager) DIDLogin(ctx context.Context, response json.RawMessage) (string, []string, error) {
+	if err := im.mode.checkRead(); err != nil {
+		return "", nil, err
+	}
+	id, err := im.VerifyDIDAuth(ctx, response)
+	if err != nil {
+		return "", nil, err
+	}
+	db, err := im.loadDatabase(ctx)
+	if err != nil {
+		return "", nil, err
+	}
+	user, found := findDID(db, id)
+	if !found || user.Status != StatusActive {
+		return "", nil, errors.New("no account uses this DID")
+	}
+	im.log.Info(fmt.Sprintf("User %s logged in with DID %s", user.ID, id))
+	return user.ID, []string{AMRProofOfPossession}, nil
+}
+
+func findDID(db *database, id string) (User, bool) {
+	for _, user := range db.Users {
+		if user.DID != nil && (user.DID.ID == id || user.DID.KeyDID == id) {
+			return user, true
+		}
+		for _, linked := range user.LinkedDIDs {
+			if linked == id {
+				return user, true
+			}
+		}
+	}
+	return User{}, false
+}
+
+// LinkDID links the DID that made response to the user with ID id, so it can
+// be used to log in. The response proves the user controls the DID.
+func (im *IdentityManager) LinkDID(ctx context.Context, actor Principal, id string, response json.RawMessage) (string, error) {
+	if err := im.mode.checkWrite(); err != nil {
+		return "", err
+	}
+	linked, err := im.VerifyDIDAuth(ctx, response)
+	if err != nil {
+		return "", err
+	}
+	err = im.batch.submit(ctx, mutation{Op: opLinkDID, ID: id, LinkedDID: linked, Actor: actor.String(), At: time.Now()})
+	if err != nil {
+		return "", err
+	}
+	im.log.Info(fmt.Sprintf("DID %s linked to user %s by %s", linked, id, actor))
+	return linked, nil
+}
+
+// UnlinkDID removes a linked DID from the user with ID id.
+func (im *IdentityManager) UnlinkDID(ctx context.Context, actor Principal, id, linked string) error {
+	if err := im.mode.checkWrite(); err != nil {
+		return err
+	}
+	err := im.batch.submit(ctx, mutation{Op: opUnlinkDID, ID: id, LinkedDID: linked, Actor: actor.String(), At: time.Now()})
+	if err != nil {
+		return err
+	}
+	im.log.Info(fmt.Sprintf("DID %s unlinked from user %s by %s", linked, id, actor))
+	return nil
+}
+
+// LinkedDIDs returns the DIDs linked to the user with ID id.
+func (im *IdentityManager) LinkedDIDs(ctx context.Context, id string) ([]string, error) {
+	db, err := im.loadDatabase(ctx)
+	if err != nil {
+		return nil, err
+	}
+	user, exists := db.Users[id]
+	if !exists {
+		return nil, errors.New("user not found")
+	}
+	return append([]string{}, user.LinkedDIDs...), nil
+}
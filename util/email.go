@@ -0,0 +1,314 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/mail"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Policies for accounts without a verified email address, set with
+// EMAIL_VERIFICATION_POLICY.
+const (
+	EmailPolicyOff      = "off"      // No restriction
+	EmailPolicyRestrict = "restrict" // Roles grant no permissions; users can still manage their own account
+	EmailPolicyBlock    = "block"    // No password logins, and access tokens are refused; users without an address are restricted until they set one
+)
+
+// ErrEmailUnverified is returned when the email verification policy denies
+// an account.
+var ErrEmailUnverified = errors.New("email address not verified")
+
+// emailVerificationAudience is the aud of email verification tokens, so they
+// cannot pass for access tokens signed with the same key.
+const emailVerificationAudience = "email-verification"
+
+// emailClaims are the claims of the token in a verification link.
+type emailClaims struct {
+	Claims
+	Email string `json:"email"`
+}
+
+// emailConfig holds the email verification settings.
+type emailConfig struct {
+	policy string
+	grace  time.Duration // Age before the policy applies to a new account
+	ttl    time.Duration // Validity of verification links
+	url    string        // Page verification links point to; empty for the API endpoint under JWT_ISSUER
+}
+
+func newEmailConfig() (*emailConfig, error) {
+	c := &emailConfig{
+		policy: os.Getenv("EMAIL_VERIFICATION_POLICY"),
+		grace:  optionalDurationFromEnv("EMAIL_VERIFICATION_GRACE", 0),
+		ttl:    durationFromEnv("EMAIL_VERIFICATION_TTL", 48*time.Hour),
+		url:    os.Getenv("EMAIL_VERIFY_URL"),
+	}
+	switch c.policy {
+	case "":
+		c.policy = EmailPolicyOff
+	case EmailPolicyOff, EmailPolicyRestrict, EmailPolicyBlock:
+	default:
+		return nil, fmt.Errorf("invalid EMAIL_VERIFICATION_POLICY %q", c.policy)
+	}
+	return c, nil
+}
+
+// restricted reports whether the policy applies to user at now.
+func (c *emailConfig) restricted(user User, now time.Time) bool {
+	return c.policy != EmailPolicyOff && !user.EmailVerified && now.After(user.CreatedAt.Add(c.grace))
+}
+
+// blocked reports whether the block policy keeps user from logging in at now.
+// Users without an address have nothing to verify and need a session to set
+// one, so they are only restricted until they do.
+func (c *emailConfig) blocked(user User, now time.Time) bool {
+	return c.policy == EmailPolicyBlock && user.Email != "" && c.restricted(user, now)
+}
+
+// normalizeEmail returns addr as stored: a bare address, lowercased.
+func normalizeEmail(addr string) (string, error) {
+	addr = strings.TrimSpace(addr)
+	parsed, err := mail.ParseAddress(addr)
+	if err != nil || parsed.Address != addr {
+		return "", fmt.Errorf("invalid email address %q", addr)
+	}
+	return strings.ToLower(parsed.Address), nil
+}
+
+// emailTaken reports whether a user other than id has email as verified
+// address or, ignoring case, as username. Unverified addresses do not count,
+// so nobody can hold on to an address they do not own; see
+// releaseEmailClaims.
+func emailTaken(users map[string]User, id, email string) bool {
+	for _, user := range users {
+		if user.ID == id {
+			continue
+		}
+		if (user.EmailVerified && user.Email == email) || strings.EqualFold(user.Username, email) {
+			return true
+		}
+	}
+	return false
+}
+
+// releaseEmailClaims drops email from users other than id that set it but
+// have not verified it, once id has.
+func releaseEmailClaims(users map[string]User, id, email string, at time.Time) {
+	for _, user := range users {
+		if user.ID == id {
+			continue
+		}
+		released := false
+		if !user.EmailVerified && user.Email == email {
+			user.Email = ""
+			released = true
+		}
+		if user.PendingEmail == email {
+			user.PendingEmail = ""
+			released = true
+		}
+		if released {
+			user.UpdatedAt = at
+			users[user.ID] = user
+		}
+	}
+}
+
+// verificationLink returns the page verification links point to:
+// EMAIL_VERIFY_URL, or JWT_ISSUER/email/verify. Links are never built from the
+// request, whose Host header the client controls.
+func (im *IdentityManager) verificationLink() (string, error) {
+	if im.email.url != "" {
+		return im.email.url, nil
+	}
+	if im.tokens.issuer == "" {
+		return "", errors.New("email verification needs EMAIL_VERIFY_URL or JWT_ISSUER to be set")
+	}
+	return im.tokens.issuer + "/email/verify", nil
+}
+
+// usernameIsEmail reports whether username is the email address of a user
+// other than id, which would make logins by that address ambiguous.
+func usernameIsEmail(users map[string]User, id, username string) bool {
+	for _, user := range users {
+		if user.ID != id && user.Email != "" && strings.EqualFold(user.Email, username) {
+			return true
+		}
+	}
+	return false
+}
+
+// findLogin returns the user identifier names: by username, or else by
+// verified email address.
+func findLogin(db *database, identifier string) (User, bool) {
+	for _, user := range db.Users {
+		if user.Username == identifier {
+			return user, true
+		}
+	}
+	email, err := normalizeEmail(identifier)
+	if err != nil {
+		return User{}, false
+	}
+	for _, user := range db.Users {
+		if user.EmailVerified && user.Email == email {
+			return user, true
+		}
+	}
+	return User{}, false
+}
+
+// SetEmail sets the email address of the user with ID id and sends a
+// verification link to it. A user without a verified address gets the new
+// one straight away, unverified; otherwise it is held as pending and replaces
+// the current address only once verified. Setting the current address
+// cancels a pending change.
+func (im *IdentityManager) SetEmail(ctx context.Context, actor Principal, id, email string) error {
+	if err := im.mode.checkWrite(); err != nil {
+		return err
+	}
+	if _, err := im.verificationLink(); err != nil {
+		return err
+	}
+	email, err := normalizeEmail(email)
+	if err != nil {
+		return err
+	}
+	err = im.batch.submit(ctx, mutation{Op: opSetEmail, ID: id, Email: email, Actor: actor.String(), At: time.Now()})
+	if err != nil {
+		return err
+	}
+	im.log.Info(fmt.Sprintf("Email address of user %s set by %s", id, actor))
+	return im.SendEmailVerification(ctx, id)
+}
+
+// SendEmailVerification sends a verification link for the address of the
+// user with ID id that awaits verification. The link is EMAIL_VERIFY_URL, or
+// JWT_ISSUER/email/verify, with a signed token as ?token=.
+func (im *IdentityManager) SendEmailVerification(ctx context.Context, id string) error {
+	link, err := im.verificationLink()
+	if err != nil {
+		return err
+	}
+	db, err := im.loadDatabase(ctx)
+	if err != nil {
+		return err
+	}
+	user, exists := db.Users[id]
+	if !exists {
+		return errors.New("user not found")
+	}
+	email := user.PendingEmail
+	if email == "" && !user.EmailVerified {
+		email = user.Email
+	}
+	if email == "" {
+		return errors.New("no email address awaits verification")
+	}
+
+	now := time.Now()
+	token, err := im.signer.Sign(emailClaims{
+		Claims: Claims{
+			Issuer:    im.tokens.issuer,
+			Subject:   user.ID,
+			Audience:  emailVerificationAudience,
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Add(im.email.ttl).Unix(),
+			ID:        uuid.New().String(),
+		},
+		Email: email,
+	})
+	if err != nil {
+		return err
+	}
+	err = im.notifier.Notify(ctx, Notification{
+		To:      email,
+		Subject: "Verify your email address",
+		Body: fmt.Sprintf("To confirm %s as the email address of your account %s, open this link within %d hours:\n\n%s?token=%s\n\n"+
+			"If you did not ask for this, ignore this message.\n",
+			email, user.Username, int(im.email.ttl.Hours()), link, url.QueryEscape(token)),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to send verification link: %w", err)
+	}
+	im.log.Info(fmt.Sprintf("Email verification link sent to user %s", id))
+	return nil
+}
+
+// VerifyEmail verifies the address in a token from a verification link and
+// returns the ID of its user. When the address replaces a verified one, the
+// old address is told of the change.
+func (im *IdentityManager) VerifyEmail(ctx context.Context, token string) (string, error) {
+	if err := im.mode.checkWrite(); err != nil {
+		return "", err
+	}
+	var claims emailClaims
+	if err := im.signer.Parse(token, &claims); err != nil {
+		return "", err
+	}
+	if err := claims.valid(emailVerificationAudience, time.Now()); err != nil {
+		return "", err
+	}
+	db, err := im.loadDatabase(ctx)
+	if err != nil {
+		return "", err
+	}
+	user, exists := db.Users[claims.Subject]
+	if !exists {
+		return "", ErrInvalidToken
+	}
+
+	actor := Principal{ID: user.ID, Kind: PrincipalUser}
+	err = im.batch.submit(ctx, mutation{Op: opVerifyEmail, ID: user.ID, Email: claims.Email, Actor: actor.String(), At: time.Now()})
+	if err != nil {
+		return "", err
+	}
+	im.log.Info(fmt.Sprintf("Email address of user %s verified", user.ID))
+
+	if user.EmailVerified && user.Email != claims.Email {
+		err := im.notifier.Notify(ctx, Notification{
+			To:      user.Email,
+			Subject: "Your email address was changed",
+			Body: fmt.Sprintf("The email address of your account %s was changed from %s to %s.\n\n"+
+				"If you did not make this change, reset your password and contact support.\n",
+				user.Username, user.Email, claims.Email),
+		})
+		if err != nil {
+			im.log.Error(fmt.Sprintf("Failed to notify the old email address of user %s: %v", user.ID, err))
+		}
+	}
+	return user.ID, nil
+}
+
+// EmailStatus is a user's email address and its verification state.
+type EmailStatus struct {
+	Email        string `json:"email,omitempty"`
+	Verified     bool   `json:"email_verified"`
+	PendingEmail string `json:"pending_email,omitempty"` // Replaces Email once verified
+	Restricted   bool   `json:"restricted,omitempty"`    // Whether the verification policy currently applies
+}
+
+// Email returns the email status of the user with ID id.
+func (im *IdentityManager) Email(ctx context.Context, id string) (EmailStatus, error) {
+	db, err := im.loadDatabase(ctx)
+	if err != nil {
+		return EmailStatus{}, err
+	}
+	user, exists := db.Users[id]
+	if !exists {
+		return EmailStatus{}, errors.New("user not found")
+	}
+	return EmailStatus{
+		Email:        user.Email,
+		Verified:     user.EmailVerified,
+		PendingEmail: user.PendingEmail,
+		Restricted:   im.email.restricted(user, time.Now()),
+	}, nil
+}
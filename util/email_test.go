@@ -0,0 +1,131 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestEmailClaims(t *testing.T) {
+	at := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		users   []User
+		ms      []mutation
+		wantErr bool
+		want    map[string]User // Email fields expected afterwards, by ID
+	}{
+		{
+			name:  "unverified claim does not block the owner",
+			users: []User{{ID: "squatter", Username: "s", Email: "a@example.com"}, {ID: "owner", Username: "o"}},
+			ms: []mutation{
+				{Op: opSetEmail, ID: "owner", Email: "a@example.com"},
+				{Op: opVerifyEmail, ID: "owner", Email: "a@example.com"},
+			},
+			want: map[string]User{
+				"squatter": {},
+				"owner":    {Email: "a@example.com", EmailVerified: true},
+			},
+		},
+		{
+			name: "verifying releases pending claims",
+			users: []User{
+				{ID: "squatter", Username: "s", Email: "b@example.com", EmailVerified: true, PendingEmail: "a@example.com"},
+				{ID: "owner", Username: "o", Email: "a@example.com"},
+			},
+			ms: []mutation{{Op: opVerifyEmail, ID: "owner", Email: "a@example.com"}},
+			want: map[string]User{
+				"squatter": {Email: "b@example.com", EmailVerified: true},
+				"owner":    {Email: "a@example.com", EmailVerified: true},
+			},
+		},
+		{
+			name:    "verified address is taken",
+			users:   []User{{ID: "owner", Username: "o", Email: "a@example.com", EmailVerified: true}, {ID: "other", Username: "x"}},
+			ms:      []mutation{{Op: opSetEmail, ID: "other", Email: "a@example.com"}},
+			wantErr: true,
+		},
+		{
+			name:    "username is taken",
+			users:   []User{{ID: "owner", Username: "A@example.com"}, {ID: "other", Username: "x"}},
+			ms:      []mutation{{Op: opSetEmail, ID: "other", Email: "a@example.com"}},
+			wantErr: true,
+		},
+		{
+			name:    "verifying an address verified meanwhile by another user",
+			users:   []User{{ID: "owner", Username: "o", Email: "a@example.com", EmailVerified: true}, {ID: "late", Username: "l", Email: "a@example.com"}},
+			ms:      []mutation{{Op: opVerifyEmail, ID: "late", Email: "a@example.com"}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newDatabase()
+			for _, user := range tt.users {
+				db.Users[user.ID] = user
+			}
+			var err error
+			for _, m := range tt.ms {
+				m.At = at
+				if err = m.apply(db); err != nil {
+					break
+				}
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("apply error = %v, want error %v", err, tt.wantErr)
+			}
+			for id, want := range tt.want {
+				got := db.Users[id]
+				if got.Email != want.Email || got.EmailVerified != want.EmailVerified || got.PendingEmail != want.PendingEmail {
+					t.Errorf("user %s: email %q verified %v pending %q, want %q %v %q",
+						id, got.Email, got.EmailVerified, got.PendingEmail, want.Email, want.EmailVerified, want.PendingEmail)
+				}
+			}
+		})
+	}
+}
+
+// TestEmailPolicyBlock checks that block does not lock out users who have no
+// address to verify: they keep a restricted session in which to set one.
+func TestEmailPolicyBlock(t *testing.T) {
+	t.Setenv("EMAIL_VERIFICATION_POLICY", EmailPolicyBlock)
+	t.Setenv("JWT_ISSUER", "https://id.example.com")
+	ctx := context.Background()
+	im := newTestManager(t, newTestNode(t))
+
+	id, err := im.BootstrapAdmin(ctx, "ada", "ada-password")
+	if err != nil {
+		t.Fatalf("BootstrapAdmin: %v", err)
+	}
+	authenticate := func() (Principal, error) {
+		t.Helper()
+		tokens, err := im.IssueTokens(id, []string{AMRPassword, AMROTP, AMRMFA})
+		if err != nil {
+			t.Fatalf("IssueTokens: %v", err)
+		}
+		return im.AuthenticateToken(ctx, tokens.AccessToken)
+	}
+
+	if _, err := im.Login(ctx, "ada", "ada-password"); err != nil {
+		t.Fatalf("Login without an address: %v", err)
+	}
+	p, err := authenticate()
+	if err != nil {
+		t.Fatalf("AuthenticateToken without an address: %v", err)
+	}
+	if len(p.Permissions) != 0 {
+		t.Errorf("permissions without a verified address = %v, want none", p.Permissions)
+	}
+
+	// Once an address is set, it must be verified.
+	if err := im.SetEmail(ctx, p, id, "ada@example.com"); err != nil {
+		t.Fatalf("SetEmail: %v", err)
+	}
+	if _, err := im.Login(ctx, "ada", "ada-password"); !errors.Is(err, ErrEmailUnverified) {
+		t.Errorf("Login with an unverified address = %v, want ErrEmailUnverified", err)
+	}
+	if _, err := authenticate(); !errors.Is(err, ErrEmailUnverified) {
+		t.Errorf("AuthenticateToken with an unverified address = %v, want ErrEmailUnverified", err)
+	}
+}
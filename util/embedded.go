@@ -0,0 +1,260 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ipfs/boxo/bitswap"
+	bsnet "github.com/ipfs/boxo/bitswap/network"
+	"github.com/ipfs/boxo/blockservice"
+	"github.com/ipfs/boxo/blockstore"
+	chunker "github.com/ipfs/boxo/chunker"
+	"github.com/ipfs/boxo/exchange"
+	"github.com/ipfs/boxo/exchange/offline"
+	"github.com/ipfs/boxo/ipld/merkledag"
+	"github.com/ipfs/boxo/ipld/unixfs/importer"
+	uio "github.com/ipfs/boxo/ipld/unixfs/io"
+	gocid "github.com/ipfs/go-cid"
+	flatfs "github.com/ipfs/go-ds-flatfs"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/libp2p/go-libp2p"
+	routinghelpers "github.com/libp2p/go-libp2p-routing-helpers"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/pnet"
+	"github.com/libp2p/go-libp2p/p2p/security/noise"
+	"github.com/libp2p/go-libp2p/p2p/transport/tcp"
+)
+
+// EmbeddedConfig configures an in-process IPFS node.
+type EmbeddedConfig struct {
+	RepoDir      string   // Directory holding the blockstore and the node identity
+	SwarmKeyPath string   // Optional swarm.key restricting the node to a private network
+	ListenAddrs  []string // libp2p listen multiaddrs
+	Peers        []string // Peer multiaddrs (with /p2p/<id>) to connect to at startup
+	Offline      bool     // Serve only local blocks and never open network connections
+}
+
+// NewEmbeddedConfigFromEnv creates EmbeddedConfig from environment variables:
+// IPFS_REPO (default: data/ipfs), IPFS_SWARM_KEY, IPFS_LISTEN (default:
+// /ip4/0.0.0.0/tcp/4001), IPFS_PEERS (comma-separated) and IPFS_OFFLINE.
+func NewEmbeddedConfigFromEnv() EmbeddedConfig {
+	repo := os.Getenv("IPFS_REPO")
+	if repo == "" {
+		repo = "data/ipfs"
+	}
+
+	listen := splitList(os.Getenv("IPFS_LISTEN"))
+	if len(listen) == 0 {
+		listen = []string{"/ip4/0.0.0.0/tcp/4001"}
+	}
+
+	return EmbeddedConfig{
+		RepoDir:      repo,
+		SwarmKeyPath: os.Getenv("IPFS_SWARM_KEY"),
+		ListenAddrs:  listen,
+		Peers:        splitList(os.Getenv("IPFS_PEERS")),
+		Offline:      os.Getenv("IPFS_OFFLINE") == "true",
+	}
+}
+
+// splitList splits a comma-separated value, dropping empty items.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// EmbeddedNode is an IPFS node running inside the server process. It stores
+// blocks in a flatfs blockstore and, unless offline, exchanges them with its
+// peers over bitswap. Content is chunked as UnixFS, so CIDs match `ipfs add`.
+type EmbeddedNode struct {
+	host     host.Host // nil when offline
+	exchange exchange.Interface
+	dag      ipld.DAGService
+	store    *flatfs.Datastore
+}
+
+// NewEmbeddedNode opens the repository in config.RepoDir, creating it on first
+// use, and starts the node.
+func NewEmbeddedNode(ctx context.Context, config EmbeddedConfig) (*EmbeddedNode, error) {
+	if config.RepoDir == "" {
+		return nil, errors.New("embedded IPFS repository directory must be specified")
+	}
+	if err := os.MkdirAll(config.RepoDir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create IPFS repository: %w", err)
+	}
+
+	ds, err := flatfs.CreateOrOpen(filepath.Join(config.RepoDir, "blocks"), flatfs.NextToLast(2), true)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open blockstore: %w", err)
+	}
+	bstore := blockstore.NewBlockstoreNoPrefix(ds)
+
+	node := &EmbeddedNode{store: ds}
+	if config.Offline {
+		node.exchange = offline.Exchange(bstore)
+	} else {
+		node.host, err = newEmbeddedHost(config)
+		if err != nil {
+			ds.Close()
+			return nil, err
+		}
+		node.exchange = bitswap.New(ctx, bsnet.NewFromIpfsHost(node.host, routinghelpers.Null{}), bstore)
+		node.connectPeers(ctx, config.Peers)
+	}
+
+	node.dag = merkledag.NewDAGService(blockservice.New(bstore, node.exchange))
+	return node, nil
+}
+
+// newEmbeddedHost creates the libp2p host with the persisted node identity.
+// Only TCP with noise is enabled because private networks do not support the
+// other transports.
+func newEmbeddedHost(config EmbeddedConfig) (host.Host, error) {
+	key, err := loadOrCreateIdentity(filepath.Join(config.RepoDir, "identity.key"))
+	if err != nil {
+		return nil, err
+	}
+
+	opts := []libp2p.Option{
+		libp2p.Identity(key),
+		libp2p.ListenAddrStrings(config.ListenAddrs...),
+		libp2p.Transport(tcp.NewTCPTransport),
+		libp2p.Security(noise.ID, noise.New),
+		libp2p.DisableRelay(),
+	}
+	if config.SwarmKeyPath != "" {
+		psk, err := loadSwarmKey(config.SwarmKeyPath)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, libp2p.PrivateNetwork(psk))
+	}
+
+	h, err := libp2p.New(opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start libp2p host: %w", err)
+	}
+	return h, nil
+}
+
+// loadOrCreateIdentity reads the node's private key from path, generating and
+// saving a new Ed25519 key on first start.
+func loadOrCreateIdentity(path string) (crypto.PrivKey, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		key, err := crypto.UnmarshalPrivateKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse node identity: %w", err)
+		}
+		return key, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read node identity: %w", err)
+	}
+
+	key, _, err := crypto.GenerateEd25519Key(nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate node identity: %w", err)
+	}
+	data, err = crypto.MarshalPrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal node identity: %w", err)
+	}
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		return nil, fmt.Errorf("failed to save node identity: %w", err)
+	}
+	return key, nil
+}
+
+// loadSwarmKey reads a go-ipfs style swarm.key file.
+func loadSwarmKey(path string) (pnet.PSK, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open swarm key: %w", err)
+	}
+	defer file.Close()
+
+	psk, err := pnet.DecodeV1PSK(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode swarm key: %w", err)
+	}
+	return psk, nil
+}
+
+// connectPeers dials every configured peer in the background. Failures are
+// not fatal: bitswap only needs whichever peers are reachable.
+func (n *EmbeddedNode) connectPeers(ctx context.Context, peers []string) {
+	for _, addr := range peers {
+		info, err := peer.AddrInfoFromString(addr)
+		if err != nil {
+			continue
+		}
+		go n.host.Connect(ctx, *info)
+	}
+}
+
+// ID returns the node's peer ID, or an empty string when offline.
+func (n *EmbeddedNode) ID() string {
+	if n.host == nil {
+		return ""
+	}
+	return n.host.ID().String()
+}
+
+// Cat returns the UnixFS file stored under cid, fetching missing blocks from
+// peers when online.
+func (n *EmbeddedNode) Cat(ctx context.Context, cid string) (io.ReadCloser, error) {
+	c, err := gocid.Decode(strings.TrimPrefix(cid, "/ipfs/"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid CID %q: %w", cid, err)
+	}
+
+	root, err := n.dag.Get(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	return uio.NewDagReader(ctx, root, n.dag)
+}
+
+// Add chunks r into a UnixFS file in the local blockstore and returns its CID.
+func (n *EmbeddedNode) Add(ctx context.Context, r io.Reader) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	root, err := importer.BuildDagFromReader(n.dag, chunker.DefaultSplitter(r))
+	if err != nil {
+		return "", err
+	}
+	return root.Cid().String(), nil
+}
+
+// IsUp always reports true: the local blockstore accepts writes even when no
+// peers are connected.
+func (n *EmbeddedNode) IsUp(ctx context.Context) bool {
+	return true
+}
+
+// Close stops the node and releases the blockstore.
+func (n *EmbeddedNode) Close() error {
+	var errs []error
+	if n.exchange != nil {
+		errs = append(errs, n.exchange.Close())
+	}
+	if n.host != nil {
+		errs = append(errs, n.host.Close())
+	}
+	errs = append(errs, n.store.Close())
+	return errors.Join(errs...)
+}
@@ -0,0 +1,209 @@
+package util
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"ipfs-identity/logger"
+)
+
+func catAll(t *testing.T, s Store, cid string) []byte {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	r, err := s.Cat(ctx, cid)
+	if err != nil {
+		t.Fatalf("Cat(%s): %v", cid, err)
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("ReadAll(%s): %v", cid, err)
+	}
+	return data
+}
+
+func TestEmbeddedNodeAddCat(t *testing.T) {
+	large := make([]byte, 600*1024) // Spans three 256 KiB chunks
+	rand.Read(large)
+
+	tests := []struct {
+		name    string
+		data    []byte
+		wantCID string // As printed by `ipfs add`, if pinned down
+	}{
+		{"empty", []byte{}, "QmbFMke1KXqnYyBBWxB74N4c5SBnJMVAiMNRcGu6x1AwQH"},
+		{"hello world", []byte("hello world\n"), "QmT78zSuBmuS4z925WZfrqQ1qHaJ56DQaTfyMUF7F8ff5o"},
+		{"several chunks", large, ""},
+	}
+	node := newTestNode(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cid, err := node.Add(context.Background(), bytes.NewReader(tt.data))
+			if err != nil {
+				t.Fatalf("Add: %v", err)
+			}
+			if tt.wantCID != "" && cid != tt.wantCID {
+				t.Errorf("CID = %s, want %s", cid, tt.wantCID)
+			}
+			if got := catAll(t, node, cid); !bytes.Equal(got, tt.data) {
+				t.Errorf("Cat returned %d bytes, want %d", len(got), len(tt.data))
+			}
+			if got := catAll(t, node, "/ipfs/"+cid); !bytes.Equal(got, tt.data) {
+				t.Errorf("Cat of /ipfs/ path returned %d bytes, want %d", len(got), len(tt.data))
+			}
+		})
+	}
+
+	if _, err := node.Cat(context.Background(), "not-a-cid"); err == nil {
+		t.Error("Cat of a malformed CID succeeded")
+	}
+}
+
+func TestEmbeddedNodeReopen(t *testing.T) {
+	ctx := context.Background()
+	repo := t.TempDir()
+	node, err := NewEmbeddedNode(ctx, EmbeddedConfig{RepoDir: repo, Offline: true})
+	if err != nil {
+		t.Fatalf("NewEmbeddedNode: %v", err)
+	}
+	cid, err := node.Add(ctx, strings.NewReader("kept across restarts"))
+	if err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	if err := node.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	node, err = NewEmbeddedNode(ctx, EmbeddedConfig{RepoDir: repo, Offline: true})
+	if err != nil {
+		t.Fatalf("reopening: %v", err)
+	}
+	defer node.Close()
+	if got := catAll(t, node, cid); string(got) != "kept across restarts" {
+		t.Errorf("Cat after reopening = %q", got)
+	}
+}
+
+func TestLoadSwarmKey(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr bool
+	}{
+		{"base16", "/key/swarm/psk/1.0.0/\n/base16/\n" + strings.Repeat("0f", 32) + "\n", false},
+		{"wrong header", "/key/swarm/psk/2.0.0/\n/base16/\n" + strings.Repeat("0f", 32) + "\n", true},
+		{"short key", "/key/swarm/psk/1.0.0/\n/base16/\n0f0f\n", true},
+		{"not hex", "/key/swarm/psk/1.0.0/\n/base16/\n" + strings.Repeat("zz", 32) + "\n", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "swarm.key")
+			if err := os.WriteFile(path, []byte(tt.content), 0600); err != nil {
+				t.Fatal(err)
+			}
+			psk, err := loadSwarmKey(path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("loadSwarmKey error = %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && len(psk) != 32 {
+				t.Errorf("key has %d bytes, want 32", len(psk))
+			}
+		})
+	}
+	if _, err := loadSwarmKey(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("loadSwarmKey of a missing file succeeded")
+	}
+}
+
+// TestEmbeddedNodesPrivateNetwork starts two nodes on loopback that share a
+// swarm key and fetches a block added to one from the other over bitswap.
+func TestEmbeddedNodesPrivateNetwork(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts libp2p hosts")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	keyPath := filepath.Join(t.TempDir(), "swarm.key")
+	key := "/key/swarm/psk/1.0.0/\n/base16/\n" + strings.Repeat("a5", 32) + "\n"
+	if err := os.WriteFile(keyPath, []byte(key), 0600); err != nil {
+		t.Fatal(err)
+	}
+	listen := []string{"/ip4/127.0.0.1/tcp/0"}
+
+	a, err := NewEmbeddedNode(ctx, EmbeddedConfig{RepoDir: t.TempDir(), SwarmKeyPath: keyPath, ListenAddrs: listen})
+	if err != nil {
+		t.Fatalf("starting first node: %v", err)
+	}
+	defer a.Close()
+	cid, err := a.Add(ctx, strings.NewReader("shared over bitswap"))
+	if err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+
+	var peers []string
+	for _, addr := range a.host.Addrs() {
+		peers = append(peers, addr.String()+"/p2p/"+a.ID())
+	}
+	b, err := NewEmbeddedNode(ctx, EmbeddedConfig{RepoDir: t.TempDir(), SwarmKeyPath: keyPath, ListenAddrs: listen, Peers: peers})
+	if err != nil {
+		t.Fatalf("starting second node: %v", err)
+	}
+	defer b.Close()
+	if b.ID() == "" || b.ID() == a.ID() {
+		t.Fatalf("peer IDs %q and %q", a.ID(), b.ID())
+	}
+	if got := catAll(t, b, cid); string(got) != "shared over bitswap" {
+		t.Errorf("Cat on the second node = %q", got)
+	}
+}
+
+// TestIdentityManagerRestart checks that a manager reopened on the same
+// embedded node and WAL directory sees the users stored before.
+func TestIdentityManagerRestart(t *testing.T) {
+	ctx := context.Background()
+	node := newTestNode(t)
+	walDir := t.TempDir()
+	open := func() *IdentityManager {
+		log, err := logger.NewLogger(logger.Config{Level: "error", Format: "console", BaseDir: t.TempDir(), RotateTime: time.Hour})
+		if err != nil {
+			t.Fatalf("NewLogger: %v", err)
+		}
+		im, err := NewIdentityManagerWithStore(node, walDir, log)
+		if err != nil {
+			t.Fatalf("NewIdentityManagerWithStore: %v", err)
+		}
+		return im
+	}
+
+	im := open()
+	id, _, err := im.AddUser(ctx, "alice", "correct horse", "")
+	if err != nil {
+		t.Fatalf("AddUser: %v", err)
+	}
+
+	im = open()
+	tests := []struct {
+		password string
+		wantErr  bool
+	}{
+		{"correct horse", false},
+		{"battery staple", true},
+	}
+	for _, tt := range tests {
+		got, err := im.Login(ctx, "alice", tt.password)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("Login with %q: error = %v, want error %v", tt.password, err, tt.wantErr)
+		}
+		if err == nil && got != id {
+			t.Errorf("Login returned %q, want %q", got, id)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package util
+
+import (
+	"os"
+	"strconv"
+	"time"
+)
+
+// durationFromEnv reads a positive time.Duration from the named environment
+// variable, falling back to def when it is unset, malformed or not positive.
+// Intervals, timeouts and lifetimes use it: a zero ticker interval panics.
+func durationFromEnv(key string, def time.Duration) time.Duration {
+	d, ok := parseDurationEnv(key)
+	if !ok || d <= 0 {
+		return def
+	}
+	return d
+}
+
+// optionalDurationFromEnv is like durationFromEnv but accepts 0, for
+// settings where 0 turns a delay or allowance off.
+func optionalDurationFromEnv(key string, def time.Duration) time.Duration {
+	d, ok := parseDurationEnv(key)
+	if !ok || d < 0 {
+		return def
+	}
+	return d
+}
+
+func parseDurationEnv(key string) (time.Duration, bool) {
+	value := os.Getenv(key)
+	if value == "" {
+		return 0, false
+	}
+	d, err := time.ParseDuration(value)
+	return d, err == nil
+}
+
+// intFromEnv reads a positive integer from the named environment variable,
+// falling back to def when it is unset or malformed.
+func intFromEnv(key string, def int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return def
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 {
+		return def
+	}
+	return n
+}
@@ -0,0 +1,536 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Policy conditions are written in a small expression language modelled on
+// CEL:
+//
+//	"support" in subject.roles && subject.tenant == resource.tenant
+//	env.hour >= 9 && env.hour < 17 && !startsWith(action, "admin:")
+//
+// Operands are string, number and boolean literals, null, lists and attribute
+// paths rooted at subject, resource, action or env. The operators are ||, &&,
+// !, ==, !=, <, <=, >, >=, in and parentheses, and the functions are size,
+// startsWith, endsWith and contains. Missing attributes evaluate to null.
+
+// exprRoots are the variables a condition may refer to.
+var exprRoots = map[string]bool{"subject": true, "resource": true, "action": true, "env": true}
+
+type exprNode interface {
+	eval(vars map[string]interface{}) (interface{}, error)
+}
+
+type (
+	literalNode struct{ value interface{} }
+	listNode    struct{ items []exprNode }
+	pathNode    struct{ path []string }
+	notNode     struct{ x exprNode }
+	binaryNode  struct {
+		op          string
+		left, right exprNode
+	}
+	callNode struct {
+		name string
+		args []exprNode
+	}
+)
+
+// exprFuncs maps each function to its number of arguments.
+var exprFuncs = map[string]int{"size": 1, "startsWith": 2, "endsWith": 2, "contains": 2}
+
+// compileExpr parses src into an evaluable expression.
+func compileExpr(src string) (exprNode, error) {
+	tokens, err := lexExpr(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &exprParser{tokens: tokens}
+	node, err := p.parseBinary(0)
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != tokEOF {
+		return nil, fmt.Errorf("unexpected %q at offset %d", tok.text, tok.pos)
+	}
+	return node, nil
+}
+
+// evalCondition compiles and evaluates src, which must produce a boolean.
+func evalCondition(src string, vars map[string]interface{}) (bool, error) {
+	node, err := compileExpr(src)
+	if err != nil {
+		return false, err
+	}
+	value, err := node.eval(vars)
+	if err != nil {
+		return false, err
+	}
+	result, ok := value.(bool)
+	if !ok {
+		return false, fmt.Errorf("condition evaluated to %s, not a boolean", typeName(value))
+	}
+	return result, nil
+}
+
+// Lexer
+
+const (
+	tokEOF = iota
+	tokIdent
+	tokString
+	tokNumber
+	tokOp
+)
+
+type exprToken struct {
+	kind int
+	text string
+	pos  int
+}
+
+func lexExpr(src string) ([]exprToken, error) {
+	var tokens []exprToken
+	for i := 0; i < len(src); {
+		c := rune(src[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '_' || unicode.IsLetter(c):
+			start := i
+			for i < len(src) && (src[i] == '_' || unicode.IsLetter(rune(src[i])) || unicode.IsDigit(rune(src[i]))) {
+				i++
+			}
+			tokens = append(tokens, exprToken{tokIdent, src[start:i], start})
+		case unicode.IsDigit(c):
+			start := i
+			for i < len(src) && (unicode.IsDigit(rune(src[i])) || src[i] == '.') {
+				i++
+			}
+			tokens = append(tokens, exprToken{tokNumber, src[start:i], start})
+		case c == '"' || c == '\'':
+			start := i
+			i++
+			for i < len(src) && rune(src[i]) != c {
+				if src[i] == '\\' {
+					i++
+				}
+				i++
+			}
+			if i >= len(src) {
+				return nil, fmt.Errorf("unterminated string at offset %d", start)
+			}
+			i++
+			tokens = append(tokens, exprToken{tokString, src[start:i], start})
+		default:
+			op := src[i : i+1]
+			if i+1 < len(src) {
+				switch two := src[i : i+2]; two {
+				case "==", "!=", "<=", ">=", "&&", "||":
+					op = two
+				}
+			}
+			if !strings.Contains("()[],.!<>", op) && len(op) == 1 {
+				return nil, fmt.Errorf("unexpected character %q at offset %d", op, i)
+			}
+			tokens = append(tokens, exprToken{tokOp, op, i})
+			i += len(op)
+		}
+	}
+	return append(tokens, exprToken{tokEOF, "end of expression", len(src)}), nil
+}
+
+// Parser
+
+type exprParser struct {
+	tokens []exprToken
+	pos    int
+}
+
+func (p *exprParser) peek() exprToken { return p.tokens[p.pos] }
+
+func (p *exprParser) next() exprToken {
+	tok := p.tokens[p.pos]
+	if tok.kind != tokEOF {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *exprParser) expect(op string) error {
+	if tok := p.next(); tok.kind != tokOp || tok.text != op {
+		return fmt.Errorf("expected %q at offset %d, found %q", op, tok.pos, tok.text)
+	}
+	return nil
+}
+
+// binaryPrecedence returns the binding power of a binary operator token, or 0.
+func binaryPrecedence(tok exprToken) int {
+	switch {
+	case tok.kind == tokOp && tok.text == "||":
+		return 1
+	case tok.kind == tokOp && tok.text == "&&":
+		return 2
+	case tok.kind == tokOp && (tok.text == "==" || tok.text == "!="):
+		return 3
+	case tok.kind == tokOp && (tok.text == "<" || tok.text == "<=" || tok.text == ">" || tok.text == ">="):
+		return 4
+	case tok.kind == tokIdent && tok.text == "in":
+		return 4
+	}
+	return 0
+}
+
+func (p *exprParser) parseBinary(minPrec int) (exprNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		prec := binaryPrecedence(p.peek())
+		if prec == 0 || prec <= minPrec {
+			return left, nil
+		}
+		op := p.next().text
+		right, err := p.parseBinary(prec)
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryNode{op: op, left: left, right: right}
+	}
+}
+
+func (p *exprParser) parseUnary() (exprNode, error) {
+	if tok := p.peek(); tok.kind == tokOp && tok.text == "!" {
+		p.next()
+		x, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &notNode{x}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *exprParser) parsePrimary() (exprNode, error) {
+	tok := p.next()
+	switch tok.kind {
+	case tokNumber:
+		n, err := strconv.ParseFloat(tok.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q at offset %d", tok.text, tok.pos)
+		}
+		return &literalNode{n}, nil
+	case tokString:
+		s, err := unquote(tok.text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid string at offset %d: %w", tok.pos, err)
+		}
+		return &literalNode{s}, nil
+	case tokIdent:
+		switch tok.text {
+		case "true", "false":
+			return &literalNode{tok.text == "true"}, nil
+		case "null":
+			return &literalNode{nil}, nil
+		}
+		if next := p.peek(); next.kind == tokOp && next.text == "(" {
+			return p.parseCall(tok)
+		}
+		if !exprRoots[tok.text] {
+			return nil, fmt.Errorf("unknown variable %q at offset %d", tok.text, tok.pos)
+		}
+		path := []string{tok.text}
+		for next := p.peek(); next.kind == tokOp && next.text == "."; next = p.peek() {
+			p.next()
+			field := p.next()
+			if field.kind != tokIdent {
+				return nil, fmt.Errorf("expected attribute name at offset %d", field.pos)
+			}
+			path = append(path, field.text)
+		}
+		return &pathNode{path}, nil
+	case tokOp:
+		switch tok.text {
+		case "(":
+			x, err := p.parseBinary(0)
+			if err != nil {
+				return nil, err
+			}
+			return x, p.expect(")")
+		case "[":
+			list := &listNode{}
+			if next := p.peek(); next.kind == tokOp && next.text == "]" {
+				p.next()
+				return list, nil
+			}
+			for {
+				item, err := p.parseBinary(0)
+				if err != nil {
+					return nil, err
+				}
+				list.items = append(list.items, item)
+				if next := p.peek(); next.kind == tokOp && next.text == "," {
+					p.next()
+					continue
+				}
+				return list, p.expect("]")
+			}
+		}
+	}
+	return nil, fmt.Errorf("unexpected %q at offset %d", tok.text, tok.pos)
+}
+
+func (p *exprParser) parseCall(name exprToken) (exprNode, error) {
+	arity, ok := exprFuncs[name.text]
+	if !ok {
+		return nil, fmt.Errorf("unknown function %q at offset %d", name.text, name.pos)
+	}
+	p.next() // (
+	call := &callNode{name: name.text}
+	for {
+		arg, err := p.parseBinary(0)
+		if err != nil {
+			return nil, err
+		}
+		call.args = append(call.args, arg)
+		if next := p.peek(); next.kind == tokOp && next.text == "," {
+			p.next()
+			continue
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		break
+	}
+	if len(call.args) != arity {
+		return nil, fmt.Errorf("%s takes %d arguments, got %d", name.text, arity, len(call.args))
+	}
+	return call, nil
+}
+
+func unquote(text string) (string, error) {
+	if text[0] == '\'' {
+		// Reuse Go's rules by turning 'x' into "x".
+		inner := strings.ReplaceAll(text[1:len(text)-1], `\'`, `'`)
+		text = `"` + strings.ReplaceAll(inner, `"`, `\"`) + `"`
+	}
+	return strconv.Unquote(text)
+}
+
+// Evaluation
+
+func (n *literalNode) eval(map[string]interface{}) (interface{}, error) { return n.value, nil }
+
+func (n *listNode) eval(vars map[string]interface{}) (interface{}, error) {
+	items := make([]interface{}, len(n.items))
+	for i, item := range n.items {
+		value, err := item.eval(vars)
+		if err != nil {
+			return nil, err
+		}
+		items[i] = value
+	}
+	return items, nil
+}
+
+func (n *pathNode) eval(vars map[string]interface{}) (interface{}, error) {
+	value := vars[n.path[0]]
+	for _, field := range n.path[1:] {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, nil
+		}
+		value = object[field]
+	}
+	return normalize(value), nil
+}
+
+func (n *notNode) eval(vars map[string]interface{}) (interface{}, error) {
+	value, err := n.x.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	b, ok := value.(bool)
+	if !ok {
+		return nil, fmt.Errorf("! needs a boolean, got %s", typeName(value))
+	}
+	return !b, nil
+}
+
+func (n *binaryNode) eval(vars map[string]interface{}) (interface{}, error) {
+	left, err := n.left.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+
+	// && and || short-circuit.
+	if n.op == "&&" || n.op == "||" {
+		l, ok := left.(bool)
+		if !ok {
+			return nil, fmt.Errorf("%s needs booleans, got %s", n.op, typeName(left))
+		}
+		if (n.op == "&&" && !l) || (n.op == "||" && l) {
+			return l, nil
+		}
+		right, err := n.right.eval(vars)
+		if err != nil {
+			return nil, err
+		}
+		r, ok := right.(bool)
+		if !ok {
+			return nil, fmt.Errorf("%s needs booleans, got %s", n.op, typeName(right))
+		}
+		return r, nil
+	}
+
+	right, err := n.right.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	switch n.op {
+	case "==":
+		return equalValues(left, right), nil
+	case "!=":
+		return !equalValues(left, right), nil
+	case "in":
+		return contains(right, left)
+	}
+
+	if l, ok := left.(float64); ok {
+		if r, ok := right.(float64); ok {
+			return compareOrdered(n.op, l, r), nil
+		}
+	}
+	if l, ok := left.(string); ok {
+		if r, ok := right.(string); ok {
+			return compareOrdered(n.op, l, r), nil
+		}
+	}
+	return nil, fmt.Errorf("cannot compare %s %s %s", typeName(left), n.op, typeName(right))
+}
+
+func (n *callNode) eval(vars map[string]interface{}) (interface{}, error) {
+	args := make([]interface{}, len(n.args))
+	for i, arg := range n.args {
+		value, err := arg.eval(vars)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = value
+	}
+
+	switch n.name {
+	case "size":
+		switch v := args[0].(type) {
+		case string:
+			return float64(len(v)), nil
+		case []interface{}:
+			return float64(len(v)), nil
+		case map[string]interface{}:
+			return float64(len(v)), nil
+		}
+		return nil, fmt.Errorf("size of %s", typeName(args[0]))
+	case "contains":
+		return contains(args[0], args[1])
+	default: // startsWith, endsWith
+		s, ok1 := args[0].(string)
+		affix, ok2 := args[1].(string)
+		if !ok1 || !ok2 {
+			return nil, fmt.Errorf("%s needs strings", n.name)
+		}
+		if n.name == "startsWith" {
+			return strings.HasPrefix(s, affix), nil
+		}
+		return strings.HasSuffix(s, affix), nil
+	}
+}
+
+// normalize converts attribute values decoded from JSON or built in Go into
+// the types the evaluator works with: float64 numbers, []interface{} lists.
+func normalize(value interface{}) interface{} {
+	switch v := value.(type) {
+	case int:
+		return float64(v)
+	case int64:
+		return float64(v)
+	case []string:
+		items := make([]interface{}, len(v))
+		for i, s := range v {
+			items[i] = s
+		}
+		return items
+	}
+	return value
+}
+
+func equalValues(a, b interface{}) bool {
+	return reflect.DeepEqual(normalize(a), normalize(b))
+}
+
+// contains reports whether item is an element of a list, a substring of a
+// string or a key of an object.
+func contains(container, item interface{}) (interface{}, error) {
+	switch c := normalize(container).(type) {
+	case []interface{}:
+		for _, element := range c {
+			if equalValues(element, item) {
+				return true, nil
+			}
+		}
+		return false, nil
+	case string:
+		s, ok := item.(string)
+		if !ok {
+			return nil, fmt.Errorf("cannot look for %s in a string", typeName(item))
+		}
+		return strings.Contains(c, s), nil
+	case map[string]interface{}:
+		key, ok := item.(string)
+		if !ok {
+			return nil, fmt.Errorf("cannot look for %s in an object", typeName(item))
+		}
+		_, exists := c[key]
+		return exists, nil
+	case nil:
+		return false, nil
+	}
+	return nil, errors.New("in needs a list, string or object on the right")
+}
+
+func compareOrdered[T float64 | string](op string, l, r T) bool {
+	switch op {
+	case "<":
+		return l < r
+	case "<=":
+		return l <= r
+	case ">":
+		return l > r
+	default:
+		return l >= r
+	}
+}
+
+func typeName(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "list"
+	case map[string]interface{}:
+		return "object"
+	}
+	return fmt.Sprintf("%T", value)
+}
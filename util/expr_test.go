@@ -0,0 +1,120 @@
+package util
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEvalCondition(t *testing.T) {
+	vars := map[string]interface{}{
+		"subject": map[string]interface{}{
+			"id":     "u1",
+			"roles":  []string{"support", "auditor"},
+			"tenant": "acme",
+			"age":    float64(30),
+			"level":  3,
+			"profile": map[string]interface{}{
+				"country": "DE",
+			},
+		},
+		"resource": map[string]interface{}{"tenant": "acme", "owner": "u2", "tags": []interface{}{"a", "b"}},
+		"action":   "users:reset_password",
+		"env":      map[string]interface{}{"hour": float64(10)},
+	}
+	tests := []struct {
+		src  string
+		want bool
+	}{
+		{`true`, true},
+		{`!false`, true},
+		{`!!true`, true},
+		{`"support" in subject.roles`, true},
+		{`"admin" in subject.roles`, false},
+		{`subject.tenant == resource.tenant`, true},
+		{`subject.tenant != resource.tenant`, false},
+		{`env.hour >= 9 && env.hour < 17`, true},
+		{`env.hour >= 11 || env.hour < 10`, false},
+		{`subject.age > 18`, true},
+		{`subject.level == 3`, true}, // Go ints compare as numbers
+		{`subject.level <= 2.5`, false},
+		{`"abc" < "abd"`, true},
+		{`subject.missing == null`, true},       // Missing attributes are null
+		{`subject.tenant.deeper == null`, true}, // So are fields of non-objects
+		{`subject.profile.country == "DE"`, true},
+		{`"country" in subject.profile`, true},
+		{`"ac" in subject.tenant`, true},
+		{`"x" in subject.missing`, false},
+		{`resource.tags == ["a", "b"]`, true},
+		{`[] == []`, true},
+		{`1 in [1, 2, 3]`, true},
+		{`size(subject.roles) == 2`, true},
+		{`size("four") == 4`, true},
+		{`size(subject.profile) == 1`, true},
+		{`startsWith(action, "users:")`, true},
+		{`endsWith(action, "password")`, true},
+		{`contains(resource.tags, "b")`, true},
+		{`!startsWith(action, "admin:")`, true},
+		{`'single \'quoted\'' == "single 'quoted'"`, true},
+		{`"tab\tnew" == 'tab\tnew'`, true},
+		// && binds tighter than ||, comparisons tighter than &&.
+		{`true || false && false`, true},
+		{`(true || false) && false`, false},
+		{`1 < 2 == true`, true},
+		// Short-circuiting skips the invalid right-hand side.
+		{`false && size(1) == 1`, false},
+		{`true || size(1) == 1`, true},
+		{`"support" in subject.roles == false`, false}, // in binds tighter than ==
+	}
+	for _, tt := range tests {
+		got, err := evalCondition(tt.src, vars)
+		if err != nil {
+			t.Errorf("%s: %v", tt.src, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s = %v, want %v", tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestEvalConditionErrors(t *testing.T) {
+	vars := map[string]interface{}{"subject": map[string]interface{}{"name": "x"}, "action": "read"}
+	tests := []struct {
+		src  string
+		want string
+	}{
+		// Syntax
+		{``, `unexpected "end of expression"`},
+		{`subject.name = "x"`, `unexpected character "="`},
+		{`subject.name == "x`, "unterminated string"},
+		{`"a" & "b"`, `unexpected character "&"`},
+		{`user.name == "x"`, `unknown variable "user"`},
+		{`subject. == "x"`, "expected attribute name"},
+		{`(true`, `expected ")"`},
+		{`[1, 2`, `expected "]"`},
+		{`true true`, `unexpected "true" at offset 5`},
+		{`1.2.3 == 1`, `invalid number "1.2.3"`},
+		{`"\q" == ""`, "invalid string"},
+		{`lower("A") == "a"`, `unknown function "lower"`},
+		{`size() == 0`, `unexpected ")"`},
+		{`startsWith("a") == true`, "startsWith takes 2 arguments, got 1"},
+		// Types
+		{`"x"`, "condition evaluated to string, not a boolean"},
+		{`subject.name`, "condition evaluated to string, not a boolean"},
+		{`!"x"`, "! needs a boolean, got string"},
+		{`1 && true`, "&& needs booleans, got number"},
+		{`true && 1`, "&& needs booleans, got number"},
+		{`1 < "2"`, "cannot compare number < string"},
+		{`null > 1`, "cannot compare null > number"},
+		{`1 in 2`, "in needs a list, string or object"},
+		{`1 in "123"`, "cannot look for number in a string"},
+		{`size(1) == 1`, "size of number"},
+		{`startsWith(1, "a")`, "startsWith needs strings"},
+	}
+	for _, tt := range tests {
+		_, err := evalCondition(tt.src, vars)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%q: error = %v, want one containing %q", tt.src, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"ipfs-identity/logger"
+)
+
+// newTestNode starts an offline embedded IPFS node in a temporary directory.
+func newTestNode(t testing.TB) *EmbeddedNode {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	node, err := NewEmbeddedNode(ctx, EmbeddedConfig{RepoDir: t.TempDir(), Offline: true})
+	if err != nil {
+		t.Fatalf("NewEmbeddedNode: %v", err)
+	}
+	t.Cleanup(func() { node.Close() })
+	return node
+}
+
+// newTestManager returns an IdentityManager backed by store, with its WAL and
+// logs in temporary directories.
+func newTestManager(t testing.TB, store Store) *IdentityManager {
+	t.Helper()
+	return openTestManager(t, store, t.TempDir())
+}
+
+// openTestManager returns an IdentityManager backed by store with its WAL in
+// walDir, so that tests can restart a manager on the same directory.
+func openTestManager(t testing.TB, store Store, walDir string) *IdentityManager {
+	t.Helper()
+	log, err := logger.NewLogger(logger.Config{Level: "error", Format: "console", BaseDir: t.TempDir(), RotateTime: time.Hour})
+	if err != nil {
+		t.Fatalf("NewLogger: %v", err)
+	}
+	im, err := NewIdentityManagerWithStore(store, walDir, log)
+	if err != nil {
+		t.Fatalf("NewIdentityManagerWithStore: %v", err)
+	}
+	return im
+}
+
+// flakyStore is a Store that can be switched off, as when the IPFS node is
+// unreachable.
+type flakyStore struct {
+	Store
+	down atomic.Bool
+}
+
+func (s *flakyStore) Cat(ctx context.Context, cid string) (io.ReadCloser, error) {
+	if s.down.Load() {
+		return nil, errors.New("store is down")
+	}
+	return s.Store.Cat(ctx, cid)
+}
+
+func (s *flakyStore) Add(ctx context.Context, r io.Reader) (string, error) {
+	if s.down.Load() {
+		return "", errors.New("store is down")
+	}
+	return s.Store.Add(ctx, r)
+}
+
+func (s *flakyStore) IsUp(ctx context.Context) bool {
+	return !s.down.Load() && s.Store.IsUp(ctx)
+}
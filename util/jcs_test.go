@@ -0,0 +1,137 @@
+package util
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+)
+
+// TestCanonicalJSON checks the examples of RFC 8785.
+func TestCanonicalJSON(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{
+			"section 3.2.2",
+			`{
+				"numbers": [333333333.33333329, 1E30, 4.50, 2e-3, 0.000000000000000000000000001],
+				"string": "\u20ac$\u000F\u000aA'\u0042\u0022\u005c\\\"\/",
+				"literals": [null, true, false]
+			}`,
+			`{"literals":[null,true,false],"numbers":[333333333.3333333,1e+30,4.5,0.002,1e-27],"string":"€$\u000f\nA'B\"\\\\\"/"}`,
+		},
+		{
+			// Keys sort by UTF-16 code units, which puts U+1F600 (a
+			// surrogate pair) before U+FB33.
+			"section 3.2.3",
+			`{
+				"\u20ac": "Euro Sign",
+				"\r": "Carriage Return",
+				"\ufb33": "Hebrew Letter Dalet With Dagesh",
+				"1": "One",
+				"\ud83d\ude00": "Emoji: Grinning Face",
+				"\u0080": "Control",
+				"\u00f6": "Latin Small Letter O With Diaeresis"
+			}`,
+			"{\"\\r\":\"Carriage Return\",\"1\":\"One\",\"\u0080\":\"Control\",\"ö\":\"Latin Small Letter O With Diaeresis\"," +
+				"\"\u20ac\":\"Euro Sign\",\"\U0001F600\":\"Emoji: Grinning Face\",\"\ufb33\":\"Hebrew Letter Dalet With Dagesh\"}",
+		},
+		{
+			"nested objects",
+			`{"b": {"z": 1, "a": [{"y": 2, "x": 1}]}, "a": {}}`,
+			`{"a":{},"b":{"a":[{"x":1,"y":2}],"z":1}}`,
+		},
+		{
+			"control characters",
+			`"\u0000\u0001\b\f\n\r\t\u001f\u007f"`,
+			"\"\\u0000\\u0001\\b\\f\\n\\r\\t\\u001f\u007f\"",
+		},
+		{
+			// HTML characters and U+2028 are not escaped, unlike in
+			// encoding/json.
+			"no HTML escaping",
+			`"<a href=\"x\">&amp;</a>\u2028"`,
+			"\"<a href=\\\"x\\\">&amp;</a>\u2028\"",
+		},
+	}
+	for _, tt := range tests {
+		var v interface{}
+		if err := json.Unmarshal([]byte(tt.input), &v); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		got, err := canonicalJSON(v)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if string(got) != tt.want {
+			t.Errorf("%s:\n got %s\nwant %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+// TestFormatES6Number checks the number serialization samples of appendix B
+// of RFC 8785.
+func TestFormatES6Number(t *testing.T) {
+	tests := []struct {
+		bits uint64
+		want string
+	}{
+		{0x0000000000000000, "0"},
+		{0x8000000000000000, "0"},
+		{0x0000000000000001, "5e-324"},
+		{0x8000000000000001, "-5e-324"},
+		{0x7fefffffffffffff, "1.7976931348623157e+308"},
+		{0xffefffffffffffff, "-1.7976931348623157e+308"},
+		{0x4340000000000000, "9007199254740992"},
+		{0xc340000000000000, "-9007199254740992"},
+		{0x4430000000000000, "295147905179352830000"},
+		{0x44b52d02c7e14af5, "9.999999999999997e+22"},
+		{0x44b52d02c7e14af6, "1e+23"},
+		{0x44b52d02c7e14af7, "1.0000000000000001e+23"},
+		{0x444b1ae4d6e2ef4e, "999999999999999700000"},
+		{0x444b1ae4d6e2ef4f, "999999999999999900000"},
+		{0x444b1ae4d6e2ef50, "1e+21"},
+		{0x3eb0c6f7a0b5ed8c, "9.999999999999997e-7"},
+		{0x3eb0c6f7a0b5ed8d, "0.000001"},
+		{0x41b3de4355555553, "333333333.3333332"},
+		{0x41b3de4355555554, "333333333.33333325"},
+		{0x41b3de4355555555, "333333333.3333333"},
+		{0x41b3de4355555556, "333333333.3333334"},
+		{0x41b3de4355555557, "333333333.33333343"},
+		{0xbecbf647612f3696, "-0.0000033333333333333333"},
+		{0x43143ff3c1cb0959, "1424953923781206.2"},
+	}
+	for _, tt := range tests {
+		got, err := formatES6Number(math.Float64frombits(tt.bits))
+		if err != nil || got != tt.want {
+			t.Errorf("formatES6Number(%#016x) = %q, %v, want %q", tt.bits, got, err, tt.want)
+		}
+	}
+
+	for _, bits := range []uint64{0x7fffffffffffffff, 0x7ff0000000000000, 0xfff0000000000000} {
+		if got, err := formatES6Number(math.Float64frombits(bits)); err == nil {
+			t.Errorf("formatES6Number(%#016x) = %q, want an error", bits, got)
+		}
+	}
+}
+
+// TestCanonicalJSONStruct checks that values are canonicalized after
+// marshaling, so struct field order and json tags do not matter.
+func TestCanonicalJSONStruct(t *testing.T) {
+	v := struct {
+		Zeta  float64           `json:"zeta"`
+		Alpha string            `json:"alpha"`
+		Map   map[string]string `json:"map,omitempty"`
+		Skip  string            `json:"-"`
+	}{Zeta: 1e21, Alpha: "<>", Skip: "x"}
+	got, err := canonicalJSON(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"alpha":"<>","zeta":1e+21}`; string(got) != want {
+		t.Errorf("canonicalJSON = %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,231 @@
+package util
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+)
+
+// Supported JWS algorithms.
+const (
+	AlgEdDSA = "EdDSA" // Ed25519
+	AlgES256 = "ES256" // ECDSA P-256 with SHA-256
+)
+
+// ErrInvalidToken is returned for any token that is malformed, badly signed,
+// expired, meant for another audience or revoked.
+var ErrInvalidToken = errors.New("invalid or expired token")
+
+// Claims are the registered JWT claims carried by access tokens.
+type Claims struct {
+	Issuer    string `json:"iss,omitempty"`
+	Subject   string `json:"sub"`
+	Audience  string `json:"aud"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+	ID        string `json:"jti"`
+
+	// Authentication methods used for the session, such as "pwd" and "otp".
+	AMR []string `json:"amr,omitempty"`
+
+	// Set on tokens issued to OIDC clients.
+	Scope    string `json:"scope,omitempty"`
+	ClientID string `json:"client_id,omitempty"`
+}
+
+// valid checks the time and audience claims.
+func (c Claims) valid(audience string, now time.Time) error {
+	if c.ExpiresAt <= now.Unix() {
+		return ErrInvalidToken
+	}
+	if c.Audience != audience {
+		return ErrInvalidToken
+	}
+	return nil
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ,omitempty"`
+	Kid string `json:"kid,omitempty"`
+}
+
+// Signer signs and verifies compact JWS tokens with a single key.
+type Signer struct {
+	alg string
+	kid string
+	key crypto.Signer
+}
+
+// loadOrCreateSigner reads the PKCS #8 PEM private key at path, generating and
+// saving a key for alg if the file does not exist yet.
+func loadOrCreateSigner(path, alg string) (*Signer, error) {
+	var key crypto.Signer
+	data, err := os.ReadFile(path)
+	switch {
+	case err == nil:
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, errors.New("failed to parse signing key: no PEM block found")
+		}
+		parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse signing key: %w", err)
+		}
+		var ok bool
+		if key, ok = parsed.(crypto.Signer); !ok {
+			return nil, errors.New("failed to parse signing key: unsupported key type")
+		}
+	case errors.Is(err, os.ErrNotExist):
+		if key, err = generateSigningKey(alg); err != nil {
+			return nil, err
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal signing key: %w", err)
+		}
+		data = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+		if err := os.WriteFile(path, data, 0600); err != nil {
+			return nil, fmt.Errorf("failed to save signing key: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("failed to read signing key: %w", err)
+	}
+	return newSigner(key, alg)
+}
+
+func generateSigningKey(alg string) (crypto.Signer, error) {
+	switch alg {
+	case AlgEdDSA:
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	case AlgES256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	default:
+		return nil, fmt.Errorf("unsupported signing algorithm %q", alg)
+	}
+}
+
+// newSigner checks that key suits alg and derives the key ID from the public
+// key.
+func newSigner(key crypto.Signer, alg string) (*Signer, error) {
+	switch k := key.(type) {
+	case ed25519.PrivateKey:
+		if alg != AlgEdDSA {
+			return nil, fmt.Errorf("an Ed25519 key cannot sign %s tokens", alg)
+		}
+	case *ecdsa.PrivateKey:
+		if alg != AlgES256 || k.Curve != elliptic.P256() {
+			return nil, fmt.Errorf("this ECDSA key cannot sign %s tokens", alg)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported signing key type %T", key)
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal public key: %w", err)
+	}
+	sum := sha256.Sum256(der)
+	return &Signer{alg: alg, kid: base64.RawURLEncoding.EncodeToString(sum[:12]), key: key}, nil
+}
+
+// Sign returns claims as a compact JWS.
+func (s *Signer) Sign(claims interface{}) (string, error) {
+	return s.signWithHeader(jwtHeader{Alg: s.alg, Typ: "JWT", Kid: s.kid}, claims)
+}
+
+// signWithHeader returns claims as a compact JWS with the given header, for
+// tokens that name their key differently, such as by DID URL.
+func (s *Signer) signWithHeader(h jwtHeader, claims interface{}) (string, error) {
+	header, err := json.Marshal(h)
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal claims: %w", err)
+	}
+	input := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	var sig []byte
+	switch key := s.key.(type) {
+	case ed25519.PrivateKey:
+		sig = ed25519.Sign(key, []byte(input))
+	case *ecdsa.PrivateKey:
+		digest := sha256.Sum256([]byte(input))
+		r, ss, err := ecdsa.Sign(rand.Reader, key, digest[:])
+		if err != nil {
+			return "", fmt.Errorf("failed to sign token: %w", err)
+		}
+		// JWS uses the fixed-size r || s encoding rather than ASN.1.
+		sig = make([]byte, 64)
+		r.FillBytes(sig[:32])
+		ss.FillBytes(sig[32:])
+	}
+	return input + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// Parse verifies the signature of token and decodes its payload into claims.
+// It does not check the time or audience claims.
+func (s *Signer) Parse(token string, claims interface{}) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return ErrInvalidToken
+	}
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return ErrInvalidToken
+	}
+	var header jwtHeader
+	if err := json.Unmarshal(headerJSON, &header); err != nil {
+		return ErrInvalidToken
+	}
+	// Only ever accept our own algorithm, never "none" or a downgrade.
+	if header.Alg != s.alg || (header.Kid != "" && header.Kid != s.kid) {
+		return ErrInvalidToken
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return ErrInvalidToken
+	}
+
+	input := []byte(parts[0] + "." + parts[1])
+	switch pub := s.key.Public().(type) {
+	case ed25519.PublicKey:
+		if !ed25519.Verify(pub, input, sig) {
+			return ErrInvalidToken
+		}
+	case *ecdsa.PublicKey:
+		if len(sig) != 64 {
+			return ErrInvalidToken
+		}
+		digest := sha256.Sum256(input)
+		r, ss := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+		if !ecdsa.Verify(pub, digest[:], r, ss) {
+			return ErrInvalidToken
+		}
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return ErrInvalidToken
+	}
+	if err := json.Unmarshal(payload, claims); err != nil {
+		return ErrInvalidToken
+	}
+	return nil
+}
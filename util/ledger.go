@@ -0,0 +1,327 @@
+package util
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ledgerMagic marks a ledger entry blob; see frame for the header layout.
+var ledgerMagic = []byte("IDLG")
+
+const formatLedgerEntry byte = 1
+
+// Ledger entry kinds.
+const (
+	transitionWrite   = "write"   // Mutations submitted through the API
+	transitionMigrate = "migrate" // Rewrite of every record at a new schema version
+)
+
+// ledgerEntry is one transition of the user database. The root CID tracked by
+// the IdentityManager is the CID of the latest entry; each entry links to the
+// state it produced and to the previous entry, so the history of the database
+// can be walked and verified from any root.
+type ledgerEntry struct {
+	Prev       string     `json:"prev,omitempty"`        // CID of the previous entry
+	State      string     `json:"state"`                 // CID of the resulting state blob
+	Schema     int        `json:"schema"`                // Schema version of that state
+	Kind       string     `json:"kind"`                  // transitionWrite or transitionMigrate
+	At         time.Time  `json:"at"`                    // When the transition was recorded
+	FromSchema int        `json:"from_schema,omitempty"` // For migrations, the schema upgraded from
+	Mutations  []mutation `json:"mutations,omitempty"`   // For writes, the mutations applied in order
+}
+
+func encodeEntry(entry ledgerEntry) ([]byte, error) {
+	entry.At = entry.At.UTC()
+	entry.Mutations = append([]mutation(nil), entry.Mutations...)
+	for i := range entry.Mutations {
+		entry.Mutations[i].At = entry.Mutations[i].At.UTC()
+	}
+	payload, err := json.Marshal(entry)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal ledger entry: %w", err)
+	}
+	return frame(ledgerMagic, formatLedgerEntry, payload, false)
+}
+
+func decodeEntry(data []byte) (ledgerEntry, error) {
+	var entry ledgerEntry
+	version, payload, err := unframe(ledgerMagic, data)
+	if err != nil {
+		return entry, err
+	}
+	if version != formatLedgerEntry {
+		return entry, fmt.Errorf("unsupported ledger entry version %d", version)
+	}
+	if err := json.Unmarshal(payload, &entry); err != nil {
+		return entry, fmt.Errorf("failed to unmarshal ledger entry: %w", err)
+	}
+	return entry, nil
+}
+
+// fetchBlob reads the whole content stored under cid.
+func (im *IdentityManager) fetchBlob(ctx context.Context, cid string) ([]byte, error) {
+	reader, err := im.ipfs.Cat(ctx, cid)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch data from IPFS: %w", err)
+	}
+	defer reader.Close()
+
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed reading data: %w", err)
+	}
+	return data, nil
+}
+
+// fetchRoot reads the state stored at root, which is a ledger entry or, for
+// roots written before the ledger existed, a bare state blob. It also returns
+// the schema version the state was stored at.
+func (im *IdentityManager) fetchRoot(ctx context.Context, root string) (*database, int, error) {
+	data, err := im.fetchBlob(ctx, root)
+	if err != nil {
+		return nil, 0, err
+	}
+	if bytes.HasPrefix(data, ledgerMagic) {
+		entry, err := decodeEntry(data)
+		if err != nil {
+			return nil, 0, err
+		}
+		if data, err = im.fetchBlob(ctx, entry.State); err != nil {
+			return nil, 0, err
+		}
+	}
+	return decodeState(data)
+}
+
+// walkLedger calls fn for each ledger entry, from the current root back to
+// the first entry, until fn returns false. Roots written before the ledger
+// existed end the walk.
+func (im *IdentityManager) walkLedger(ctx context.Context, fn func(cid string, entry ledgerEntry) bool) error {
+	im.mu.RLock()
+	cid := im.cid
+	im.mu.RUnlock()
+
+	for cid != "" {
+		entry, ok, err := im.readEntry(ctx, cid)
+		if err != nil || !ok {
+			return err
+		}
+		if !fn(cid, entry) {
+			return nil
+		}
+		cid = entry.Prev
+	}
+	return nil
+}
+
+// readEntry returns the ledger entry stored under cid, and false if cid is a
+// root written before the ledger existed.
+func (im *IdentityManager) readEntry(ctx context.Context, cid string) (ledgerEntry, bool, error) {
+	data, err := im.fetchBlob(ctx, cid)
+	if err != nil {
+		return ledgerEntry{}, false, err
+	}
+	if !bytes.HasPrefix(data, ledgerMagic) {
+		return ledgerEntry{}, false, nil
+	}
+	entry, err := decodeEntry(data)
+	if err != nil {
+		return ledgerEntry{}, false, fmt.Errorf("ledger entry %s: %w", cid, err)
+	}
+	return entry, true, nil
+}
+
+// historyPageEntries is the most ledger entries one page of a history listing
+// reads, so that a request costs the same however long the history is.
+const historyPageEntries = 100
+
+// ErrInvalidCursor is returned for a history cursor this process did not
+// issue.
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// scanHistory calls fn with each mutation, newest first, and the CID of its
+// ledger entry: first the writes still queued in the WAL, with an empty CID,
+// then the ledger. It starts where cursor, returned by an earlier call, left
+// off, or at the newest write if cursor is empty, and stops once fn returns
+// false or historyPageEntries ledger entries have been read. It returns the
+// cursor for the rest of the history, empty when there is none. A page that
+// ends among queued writes may be followed by some of them again if they
+// reach IPFS before the next page is read.
+func (im *IdentityManager) scanHistory(ctx context.Context, cursor string, fn func(m mutation, entry string) bool) (string, error) {
+	var from historyPosition
+	if cursor != "" {
+		var err error
+		if from, err = im.parseCursor(cursor); err != nil {
+			return "", err
+		}
+	}
+
+	if from.entry == "" {
+		pending := im.wal.pending()
+		for i := len(pending) - 1; i >= 0; i-- {
+			if from.seq != 0 && pending[i].Seq > from.seq {
+				continue
+			}
+			if !fn(pending[i].Mutation, "") {
+				if i > 0 {
+					return im.cursor(historyPosition{seq: pending[i-1].Seq}), nil
+				}
+				im.mu.RLock()
+				root := im.cid
+				im.mu.RUnlock()
+				return im.cursor(historyPosition{entry: root}), nil
+			}
+		}
+		im.mu.RLock()
+		from = historyPosition{entry: im.cid}
+		im.mu.RUnlock()
+	}
+
+	cid, skip := from.entry, from.skip
+	for read := 0; cid != ""; read++ {
+		if read == historyPageEntries {
+			return im.cursor(historyPosition{entry: cid}), nil
+		}
+		entry, ok, err := im.readEntry(ctx, cid)
+		if err != nil || !ok {
+			return "", err
+		}
+		for i := len(entry.Mutations) - 1 - skip; i >= 0; i-- {
+			if !fn(entry.Mutations[i], cid) {
+				if i > 0 {
+					return im.cursor(historyPosition{entry: cid, skip: len(entry.Mutations) - i}), nil
+				}
+				return im.cursor(historyPosition{entry: entry.Prev}), nil
+			}
+		}
+		cid, skip = entry.Prev, 0
+	}
+	return "", nil
+}
+
+// historyPosition is where a history listing continues: the newest queued
+// write with a sequence number up to seq, or else the ledger entry with CID
+// entry, less the skip newest of its mutations.
+type historyPosition struct {
+	seq   uint64
+	entry string
+	skip  int
+}
+
+// cursor encodes p, authenticated so that clients cannot point the service at
+// arbitrary CIDs. It returns an empty cursor for the end of the history.
+func (im *IdentityManager) cursor(p historyPosition) string {
+	var payload string
+	switch {
+	case p.entry != "":
+		payload = fmt.Sprintf("%s:%d", p.entry, p.skip)
+	case p.seq != 0:
+		payload = fmt.Sprintf("wal:%d", p.seq)
+	default:
+		return ""
+	}
+	mac := hmac.New(sha256.New, im.historyKey)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// parseCursor decodes a cursor made by cursor.
+func (im *IdentityManager) parseCursor(cursor string) (historyPosition, error) {
+	encoded, sig, _ := strings.Cut(cursor, ".")
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return historyPosition{}, ErrInvalidCursor
+	}
+	got, err := base64.RawURLEncoding.DecodeString(sig)
+	mac := hmac.New(sha256.New, im.historyKey)
+	mac.Write(payload)
+	if err != nil || !hmac.Equal(got, mac.Sum(nil)) {
+		return historyPosition{}, ErrInvalidCursor
+	}
+
+	var p historyPosition
+	before, after, _ := strings.Cut(string(payload), ":")
+	if before == "wal" {
+		p.seq, err = strconv.ParseUint(after, 10, 64)
+	} else {
+		p.entry = before
+		p.skip, err = strconv.Atoi(after)
+	}
+	if err != nil {
+		return historyPosition{}, ErrInvalidCursor
+	}
+	return p, nil
+}
+
+// storeTransition uploads db, with any DID documents it names, and a ledger
+// entry describing how it was produced, and returns the CID of the new entry.
+func (im *IdentityManager) storeTransition(ctx context.Context, db *database, entry ledgerEntry) (string, error) {
+	if err := im.publishDIDDocuments(ctx, db); err != nil {
+		return "", err
+	}
+	data, err := encodeState(db, im.compress)
+	if err != nil {
+		return "", err
+	}
+	if entry.State, err = im.ipfs.Add(ctx, bytes.NewReader(data)); err != nil {
+		return "", fmt.Errorf("failed to add data to IPFS: %w", err)
+	}
+
+	im.mu.RLock()
+	entry.Prev = im.cid
+	im.mu.RUnlock()
+	entry.Schema = CurrentSchemaVersion
+	entry.At = time.Now()
+
+	if data, err = encodeEntry(entry); err != nil {
+		return "", err
+	}
+	root, err := im.ipfs.Add(ctx, bytes.NewReader(data))
+	if err != nil {
+		return "", fmt.Errorf("failed to add ledger entry to IPFS: %w", err)
+	}
+	return root, nil
+}
+
+// Migrate rewrites the stored state at CurrentSchemaVersion and records the
+// upgrade as a ledger transition. It is meant to be run offline, with the
+// write-ahead log drained. It returns the schema version migrated from and the
+// new root CID.
+func (im *IdentityManager) Migrate(ctx context.Context) (int, string, error) {
+	if depth, _ := im.wal.stats(); depth > 0 {
+		return 0, "", fmt.Errorf("%d writes are still queued in the WAL; replay them first", depth)
+	}
+
+	im.mu.RLock()
+	root := im.cid
+	im.mu.RUnlock()
+	if root == "" {
+		return 0, "", errors.New("no stored state to migrate")
+	}
+
+	db, schema, err := im.fetchRoot(ctx, root)
+	if err != nil {
+		return 0, "", err
+	}
+	if schema == CurrentSchemaVersion {
+		return schema, root, nil
+	}
+
+	entry := ledgerEntry{Kind: transitionMigrate, FromSchema: schema}
+	if err := im.saveState(ctx, db, entry, im.wal.lastSeq()); err != nil {
+		return schema, "", err
+	}
+	im.mu.RLock()
+	defer im.mu.RUnlock()
+	return schema, im.cid, nil
+}
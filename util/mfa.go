@@ -0,0 +1,523 @@
+package util
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Authentication methods recorded in the amr claim of access tokens
+// (RFC 8176).
+const (
+	AMRPassword = "pwd"
+	AMROTP      = "otp"
+	AMRMFA      = "mfa"
+)
+
+// TOTP parameters. These are the defaults of RFC 6238 and the only values
+// most authenticator apps support.
+const (
+	totpPeriod = 30 * time.Second
+	totpDigits = 6
+
+	recoveryCodeCount = 10
+	// mfaMaxAttempts is how many wrong codes a challenge token survives.
+	mfaMaxAttempts = 5
+)
+
+// ErrMFARequired is returned when an operation needs a second factor.
+var ErrMFARequired = errors.New("a one-time code is required")
+
+var errInvalidCode = errors.New("invalid or already used code")
+
+// TOTP is a user's authenticator enrollment, stored with the user record.
+type TOTP struct {
+	Secret        string    `json:"secret"` // AES-GCM encrypted with the MFA key, base64
+	Confirmed     bool      `json:"confirmed"`
+	LastStep      int64     `json:"last_step,omitempty"`      // Newest time step accepted; codes for it or older are replays
+	RecoveryCodes []string  `json:"recovery_codes,omitempty"` // Hashes of unused recovery codes
+	EnrolledAt    time.Time `json:"enrolled_at"`
+}
+
+// mfaConfig holds the settings and in-memory state for multi-factor logins.
+type mfaConfig struct {
+	key           []byte          // Encrypts TOTP secrets
+	issuer        string          // Account issuer shown in authenticator apps
+	skew          int64           // Time steps accepted either side of now
+	challengeTTL  time.Duration   // Lifetime of MFA challenge tokens
+	requiredRoles map[string]bool // Roles that only count in sessions that used MFA
+
+	mu       sync.Mutex
+	attempts map[string]mfaAttempts // Attempts per challenge token ID, and per user at disabling TOTP
+	used     map[string]int64       // Last accepted step per user, for when the state cannot be written
+}
+
+// mfaAttempts counts the codes tried against one challenge token.
+type mfaAttempts struct {
+	count   int
+	expires time.Time // When the challenge expires and the count can go
+}
+
+func newMFAConfig(key []byte) *mfaConfig {
+	issuer := os.Getenv("MFA_ISSUER")
+	if issuer == "" {
+		issuer = "ipfs-identity"
+	}
+	required := make(map[string]bool)
+	for _, role := range splitList(os.Getenv("MFA_REQUIRED_ROLES")) {
+		required[role] = true
+	}
+	if _, set := os.LookupEnv("MFA_REQUIRED_ROLES"); !set {
+		required[RoleAdmin] = true
+	}
+	return &mfaConfig{
+		key:           key,
+		issuer:        issuer,
+		skew:          int64(optionalDurationFromEnv("MFA_CLOCK_SKEW", totpPeriod) / totpPeriod),
+		challengeTTL:  durationFromEnv("MFA_CHALLENGE_TTL", 5*time.Minute),
+		requiredRoles: required,
+		attempts:      make(map[string]mfaAttempts),
+		used:          make(map[string]int64),
+	}
+}
+
+// loadOrCreateMFAKey reads the 256-bit key TOTP secrets are encrypted with,
+// generating it on first use.
+func loadOrCreateMFAKey(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	switch {
+	case err == nil:
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil || len(key) != 32 {
+			return nil, errors.New("failed to parse MFA key: want 32 base64-encoded bytes")
+		}
+		return key, nil
+	case errors.Is(err, os.ErrNotExist):
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, fmt.Errorf("failed to generate MFA key: %w", err)
+		}
+		if err := os.WriteFile(path, []byte(base64.StdEncoding.EncodeToString(key)+"\n"), 0600); err != nil {
+			return nil, fmt.Errorf("failed to save MFA key: %w", err)
+		}
+		return key, nil
+	default:
+		return nil, fmt.Errorf("failed to read MFA key: %w", err)
+	}
+}
+
+// seal encrypts secret for userID, which is bound to the ciphertext so it
+// cannot be moved to another account.
+func (c *mfaConfig) seal(secret []byte, userID string) (string, error) {
+	gcm, err := c.gcm()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, secret, []byte(userID))), nil
+}
+
+func (c *mfaConfig) open(sealed, userID string) ([]byte, error) {
+	gcm, err := c.gcm()
+	if err != nil {
+		return nil, err
+	}
+	data, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil || len(data) < gcm.NonceSize() {
+		return nil, errors.New("malformed TOTP secret")
+	}
+	secret, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], []byte(userID))
+	if err != nil {
+		return nil, errors.New("failed to decrypt TOTP secret; was MFA_KEY_FILE changed?")
+	}
+	return secret, nil
+}
+
+func (c *mfaConfig) gcm() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(c.key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// hotp computes an RFC 4226 one-time password.
+func hotp(secret []byte, counter int64) string {
+	mac := hmac.New(sha1.New, secret)
+	binary.Write(mac, binary.BigEndian, counter)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+// prune drops the attempt counts of expired challenges and used steps that
+// matchTOTP no longer accepts anyway. Callers must hold c.mu.
+func (c *mfaConfig) prune(now time.Time) {
+	for id, a := range c.attempts {
+		if now.After(a.expires) {
+			delete(c.attempts, id)
+		}
+	}
+	oldest := now.Unix()/int64(totpPeriod.Seconds()) - c.skew
+	for id, step := range c.used {
+		if step < oldest {
+			delete(c.used, id)
+		}
+	}
+}
+
+// countAttempt counts an attempt against key, forgotten after expires, and
+// reports the count and whether it is within mfaMaxAttempts. Attempts are
+// counted before the code is checked, so that concurrent requests cannot all
+// pass the limit.
+func (c *mfaConfig) countAttempt(key string, expires time.Time) (int, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.prune(time.Now())
+	attempts := c.attempts[key]
+	if attempts.count >= mfaMaxAttempts {
+		return attempts.count, false
+	}
+	attempts.count++
+	attempts.expires = expires
+	c.attempts[key] = attempts
+	return attempts.count, true
+}
+
+// matchTOTP returns the time step within the skew window that code is valid
+// for, if it is newer than after.
+func (c *mfaConfig) matchTOTP(secret []byte, code string, after int64, now time.Time) (int64, bool) {
+	code = strings.ReplaceAll(code, " ", "")
+	current := now.Unix() / int64(totpPeriod.Seconds())
+	for step := current - c.skew; step <= current+c.skew; step++ {
+		if step > after && subtle.ConstantTimeCompare([]byte(hotp(secret, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+var base32NoPadding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// TOTPEnrollment is returned when a user starts enrolling an authenticator.
+type TOTPEnrollment struct {
+	Secret    string `json:"secret"` // Base32, for manual entry
+	URI       string `json:"otpauth_uri"`
+	QRCodePNG []byte `json:"-"`
+}
+
+// EnrollTOTP generates a new TOTP secret for the user with ID id. The
+// enrollment takes effect once confirmed with ConfirmTOTP; until then it can
+// be replaced by enrolling again.
+func (im *IdentityManager) EnrollTOTP(ctx context.Context, id string) (TOTPEnrollment, error) {
+	if err := im.mode.checkWrite(); err != nil {
+		return TOTPEnrollment{}, err
+	}
+	db, err := im.loadDatabase(ctx)
+	if err != nil {
+		return TOTPEnrollment{}, err
+	}
+	user, exists := db.Users[id]
+	if !exists {
+		return TOTPEnrollment{}, errors.New("user not found")
+	}
+	if user.TOTP != nil && user.TOTP.Confirmed {
+		return TOTPEnrollment{}, errors.New("TOTP is already enabled; disable it before enrolling again")
+	}
+
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		return TOTPEnrollment{}, fmt.Errorf("failed to generate TOTP secret: %w", err)
+	}
+	sealed, err := im.mfa.seal(secret, id)
+	if err != nil {
+		return TOTPEnrollment{}, err
+	}
+	totp := &TOTP{Secret: sealed, EnrolledAt: time.Now()}
+	if err := im.batch.submit(ctx, mutation{Op: opEnrollTOTP, ID: id, TOTP: totp, At: totp.EnrolledAt}); err != nil {
+		return TOTPEnrollment{}, err
+	}
+
+	encoded := base32NoPadding.EncodeToString(secret)
+	query := url.Values{
+		"secret":    {encoded},
+		"issuer":    {im.mfa.issuer},
+		"algorithm": {"SHA1"},
+		"digits":    {fmt.Sprint(totpDigits)},
+		"period":    {fmt.Sprint(int(totpPeriod.Seconds()))},
+	}
+	label := url.PathEscape(im.mfa.issuer) + ":" + url.PathEscape(user.Username)
+	enrollment := TOTPEnrollment{Secret: encoded, URI: "otpauth://totp/" + label + "?" + query.Encode()}
+	if enrollment.QRCodePNG, err = QRCodePNG([]byte(enrollment.URI), 6); err != nil {
+		return TOTPEnrollment{}, err
+	}
+	im.log.Info(fmt.Sprintf("TOTP enrollment started for user %s", id))
+	return enrollment, nil
+}
+
+// ConfirmTOTP enables a pending enrollment once the user proves their
+// authenticator works, and returns one-time recovery codes. They are stored
+// only as hashes and cannot be shown again.
+func (im *IdentityManager) ConfirmTOTP(ctx context.Context, id, code string) ([]string, error) {
+	if err := im.mode.checkWrite(); err != nil {
+		return nil, err
+	}
+	db, err := im.loadDatabase(ctx)
+	if err != nil {
+		return nil, err
+	}
+	user, exists := db.Users[id]
+	if !exists || user.TOTP == nil {
+		return nil, errors.New("no TOTP enrollment is pending")
+	}
+	if user.TOTP.Confirmed {
+		return nil, errors.New("TOTP is already enabled")
+	}
+	secret, err := im.mfa.open(user.TOTP.Secret, id)
+	if err != nil {
+		return nil, err
+	}
+	step, ok := im.mfa.matchTOTP(secret, code, 0, time.Now())
+	if !ok {
+		return nil, errInvalidCode
+	}
+
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		raw := make([]byte, 8)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, fmt.Errorf("failed to generate recovery code: %w", err)
+		}
+		encoded := strings.ToLower(base32NoPadding.EncodeToString(raw))[:10]
+		codes[i] = encoded[:5] + "-" + encoded[5:]
+		hashes[i] = hashRecoveryCode(codes[i])
+	}
+	err = im.batch.submit(ctx, mutation{Op: opConfirmTOTP, ID: id, Step: step, RecoveryCodes: hashes, At: time.Now()})
+	if err != nil {
+		return nil, err
+	}
+	im.log.Info(fmt.Sprintf("TOTP enabled for user %s", id))
+	return codes, nil
+}
+
+// DisableTOTP removes the user's authenticator enrollment and recovery codes.
+// Once TOTP is enabled this needs a session that used MFA, or a current TOTP
+// code or recovery code, so that one stolen factor cannot remove the other.
+func (im *IdentityManager) DisableTOTP(ctx context.Context, actor Principal, id, code string) error {
+	if err := im.mode.checkWrite(); err != nil {
+		return err
+	}
+	db, err := im.loadDatabase(ctx)
+	if err != nil {
+		return err
+	}
+	if user := db.Users[id]; user.TOTP != nil && user.TOTP.Confirmed && !hasMethod(actor.AMR, AMRMFA) {
+		if code == "" {
+			return ErrMFARequired
+		}
+		count, ok := im.mfa.countAttempt("disable:"+id, time.Now().Add(im.mfa.challengeTTL))
+		if !ok {
+			return errors.New("too many wrong codes; try again later")
+		}
+		if _, err := im.VerifyMFA(ctx, id, code); err != nil {
+			im.log.Warn(fmt.Sprintf("Failed attempt %d to disable TOTP for user %s by %s: %v", count, id, actor, err))
+			return err
+		}
+	}
+	if err := im.batch.submit(ctx, mutation{Op: opDisableTOTP, ID: id, Actor: actor.String(), At: time.Now()}); err != nil {
+		return err
+	}
+	im.log.Info(fmt.Sprintf("TOTP disabled for user %s by %s", id, actor))
+	return nil
+}
+
+func hashRecoveryCode(code string) string {
+	return hashToken(strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code)))
+}
+
+// MFAChallenge is returned instead of tokens when a password login needs a
+// second factor.
+type MFAChallenge struct {
+	Required  bool   `json:"mfa_required"`
+	Token     string `json:"mfa_token"`
+	ExpiresIn int    `json:"expires_in"`
+}
+
+// BeginMFA returns a challenge for the user with ID id, who has just passed
+// the password check, or nil if the user has no second factor.
+func (im *IdentityManager) BeginMFA(ctx context.Context, id string) (*MFAChallenge, error) {
+	db, err := im.loadDatabase(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if user := db.Users[id]; user.TOTP == nil || !user.TOTP.Confirmed {
+		return nil, nil
+	}
+	now := time.Now()
+	token, err := im.signer.Sign(Claims{
+		Issuer:    im.tokens.issuer,
+		Subject:   id,
+		Audience:  im.mfaAudience(),
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(im.mfa.challengeTTL).Unix(),
+		ID:        uuid.New().String(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &MFAChallenge{Required: true, Token: token, ExpiresIn: int(im.mfa.challengeTTL.Seconds())}, nil
+}
+
+// mfaAudience keeps challenge tokens from being accepted as access tokens.
+func (im *IdentityManager) mfaAudience() string {
+	return im.tokens.audience + "#mfa"
+}
+
+// CompleteMFA checks a TOTP code or recovery code against a challenge from
+// BeginMFA and returns the user ID and the authentication methods used. A
+// challenge is spent once it succeeds or after too many wrong codes.
+func (im *IdentityManager) CompleteMFA(ctx context.Context, challenge, code, recoveryCode string) (string, []string, error) {
+	if err := im.mode.checkRead(); err != nil {
+		return "", nil, err
+	}
+	var claims Claims
+	if err := im.signer.Parse(challenge, &claims); err != nil {
+		return "", nil, err
+	}
+	if err := claims.valid(im.mfaAudience(), time.Now()); err != nil {
+		return "", nil, err
+	}
+
+	count, ok := im.mfa.countAttempt(claims.ID, time.Unix(claims.ExpiresAt, 0))
+	if !ok {
+		return "", nil, ErrInvalidToken
+	}
+
+	amr, err := im.verifySecondFactor(ctx, claims.Subject, code, recoveryCode)
+	im.mfa.mu.Lock()
+	defer im.mfa.mu.Unlock()
+	if err != nil {
+		im.log.Warn(fmt.Sprintf("Failed MFA attempt %d for user %s: %v", count, claims.Subject, err))
+		return "", nil, err
+	}
+	im.mfa.attempts[claims.ID] = mfaAttempts{count: mfaMaxAttempts, expires: time.Unix(claims.ExpiresAt, 0)}
+	return claims.Subject, amr, nil
+}
+
+// VerifyMFA checks a TOTP code or recovery code for the user with ID id if the
+// user has a second factor, for logins that collect both factors at once. It
+// returns the authentication methods used, and ErrMFARequired if a code is
+// needed but none was given.
+func (im *IdentityManager) VerifyMFA(ctx context.Context, id, code string) ([]string, error) {
+	db, err := im.loadDatabase(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if user := db.Users[id]; user.TOTP == nil || !user.TOTP.Confirmed {
+		return []string{AMRPassword}, nil
+	}
+	if code == "" {
+		return nil, ErrMFARequired
+	}
+	if strings.Contains(code, "-") {
+		return im.verifySecondFactor(ctx, id, "", code)
+	}
+	return im.verifySecondFactor(ctx, id, code, "")
+}
+
+// verifySecondFactor accepts a TOTP code newer than the last one used, or an
+// unused recovery code, and records it so it cannot be used again.
+func (im *IdentityManager) verifySecondFactor(ctx context.Context, id, code, recoveryCode string) ([]string, error) {
+	db, err := im.loadDatabase(ctx)
+	if err != nil {
+		return nil, err
+	}
+	user, exists := db.Users[id]
+	if !exists || user.Status != StatusActive || user.TOTP == nil || !user.TOTP.Confirmed {
+		return nil, ErrInvalidToken
+	}
+
+	if recoveryCode != "" {
+		// Recovery codes are only spent once the state records it, so they
+		// cannot be used while writes are refused.
+		err := im.batch.submit(ctx, mutation{Op: opUseTOTP, ID: id, RecoveryCodes: []string{hashRecoveryCode(recoveryCode)}, At: time.Now()})
+		if err != nil {
+			return nil, err
+		}
+		im.log.Warn(fmt.Sprintf("User %s logged in with a recovery code", id))
+		return []string{AMRPassword, AMRMFA}, nil
+	}
+
+	secret, err := im.mfa.open(user.TOTP.Secret, id)
+	if err != nil {
+		return nil, err
+	}
+	im.mfa.mu.Lock()
+	im.mfa.prune(time.Now())
+	last := max(user.TOTP.LastStep, im.mfa.used[id])
+	step, ok := im.mfa.matchTOTP(secret, code, last, time.Now())
+	if ok {
+		im.mfa.used[id] = step
+	}
+	im.mfa.mu.Unlock()
+	if !ok {
+		return nil, errInvalidCode
+	}
+
+	// Recording the step in the state stops replays across restarts and
+	// instances; in read-only mode the in-memory record has to do.
+	err = im.mode.checkWrite()
+	if err == nil {
+		err = im.batch.submit(ctx, mutation{Op: opUseTOTP, ID: id, Step: step, At: time.Now()})
+	}
+	var modeErr *ModeError
+	if err != nil && !errors.As(err, &modeErr) {
+		return nil, err
+	}
+	return []string{AMRPassword, AMROTP, AMRMFA}, nil
+}
+
+func hasMethod(amr []string, method string) bool {
+	for _, m := range amr {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// effectiveRoles returns the roles of user that count in a session
+// authenticated with amr: roles listed in MFA_REQUIRED_ROLES need MFA.
+func (c *mfaConfig) effectiveRoles(roles, amr []string) []string {
+	if hasMethod(amr, AMRMFA) {
+		return roles
+	}
+	var out []string
+	for _, role := range roles {
+		if !c.requiredRoles[role] {
+			out = append(out, role)
+		}
+	}
+	return out
+}
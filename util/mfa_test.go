@@ -0,0 +1,224 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// TestHOTPVectors checks the SHA-1 test vectors of appendix B of RFC 6238.
+// The RFC gives eight digits; six-digit codes are their last six.
+func TestHOTPVectors(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},          // 94287082
+		{1111111109, "081804"},  // 07081804
+		{1111111111, "050471"},  // 14050471
+		{1234567890, "005924"},  // 89005924
+		{2000000000, "279037"},  // 69279037
+		{20000000000, "353130"}, // 65353130
+	}
+	c := &mfaConfig{}
+	for _, tt := range tests {
+		step := tt.unix / 30
+		if got := hotp(secret, step); got != tt.want {
+			t.Errorf("hotp at %d = %s, want %s", tt.unix, got, tt.want)
+		}
+		if got, ok := c.matchTOTP(secret, tt.want, 0, time.Unix(tt.unix, 0)); !ok || got != step {
+			t.Errorf("matchTOTP at %d = %d, %v, want step %d", tt.unix, got, ok, step)
+		}
+	}
+}
+
+func TestMatchTOTPSkew(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	now := time.Unix(1111111111, 0)
+	current := now.Unix() / 30
+	tests := []struct {
+		skew   int64
+		offset int64 // Steps between the code and now
+		want   bool
+	}{
+		{0, 0, true},
+		{0, -1, false},
+		{0, 1, false},
+		{1, -1, true},
+		{1, 1, true},
+		{1, -2, false},
+		{1, 2, false},
+		{2, -2, true},
+	}
+	for _, tt := range tests {
+		c := &mfaConfig{skew: tt.skew}
+		code := hotp(secret, current+tt.offset)
+		if _, ok := c.matchTOTP(secret, code, 0, now); ok != tt.want {
+			t.Errorf("skew %d, code %+d steps away: matched %v, want %v", tt.skew, tt.offset, ok, tt.want)
+		}
+	}
+
+	// Codes for steps up to after are replays.
+	c := &mfaConfig{skew: 1}
+	if _, ok := c.matchTOTP(secret, hotp(secret, current), current, now); ok {
+		t.Error("matchTOTP accepted the code of an already used step")
+	}
+	if step, ok := c.matchTOTP(secret, hotp(secret, current+1), current, now); !ok || step != current+1 {
+		t.Errorf("matchTOTP of the next step = %d, %v", step, ok)
+	}
+	if _, ok := c.matchTOTP(secret, "12 34 56", 0, now); ok {
+		t.Error("matchTOTP accepted a wrong code")
+	}
+}
+
+// enrollTestTOTP enables TOTP for a new user and returns its ID, the secret,
+// the step of the code used to confirm it and the recovery codes.
+func enrollTestTOTP(t *testing.T, im *IdentityManager) (string, []byte, int64, []string) {
+	t.Helper()
+	ctx := context.Background()
+	id, _, err := im.AddUser(ctx, "alice", "secret", "")
+	if err != nil {
+		t.Fatalf("AddUser: %v", err)
+	}
+	enrollment, err := im.EnrollTOTP(ctx, id)
+	if err != nil {
+		t.Fatalf("EnrollTOTP: %v", err)
+	}
+	secret, err := base32NoPadding.DecodeString(enrollment.Secret)
+	if err != nil {
+		t.Fatalf("secret %q: %v", enrollment.Secret, err)
+	}
+	step := time.Now().Unix() / 30
+	recovery, err := im.ConfirmTOTP(ctx, id, hotp(secret, step))
+	if err != nil {
+		t.Fatalf("ConfirmTOTP: %v", err)
+	}
+	return id, secret, step, recovery
+}
+
+func TestTOTPReplay(t *testing.T) {
+	ctx := context.Background()
+	im := newTestManager(t, newTestNode(t))
+	id, secret, step, recovery := enrollTestTOTP(t, im)
+
+	if _, err := im.VerifyMFA(ctx, id, hotp(secret, step)); !errors.Is(err, errInvalidCode) {
+		t.Errorf("code used to confirm: %v, want errInvalidCode", err)
+	}
+	amr, err := im.VerifyMFA(ctx, id, hotp(secret, step+1))
+	if err != nil {
+		t.Fatalf("code of the next step: %v", err)
+	}
+	if !hasMethod(amr, AMRMFA) || !hasMethod(amr, AMROTP) {
+		t.Errorf("amr = %v, want otp and mfa", amr)
+	}
+	if _, err := im.VerifyMFA(ctx, id, hotp(secret, step+1)); !errors.Is(err, errInvalidCode) {
+		t.Errorf("replayed code: %v, want errInvalidCode", err)
+	}
+	// The step is recorded in the state, not only in memory.
+	db, err := im.loadDatabase(ctx)
+	if err != nil {
+		t.Fatalf("loadDatabase: %v", err)
+	}
+	if got := db.Users[id].TOTP.LastStep; got != step+1 {
+		t.Errorf("LastStep = %d, want %d", got, step+1)
+	}
+
+	if _, err := im.VerifyMFA(ctx, id, recovery[0]); err != nil {
+		t.Fatalf("recovery code: %v", err)
+	}
+	if _, err := im.VerifyMFA(ctx, id, recovery[0]); err == nil {
+		t.Error("recovery code accepted twice")
+	}
+	if _, err := im.VerifyMFA(ctx, id, ""); !errors.Is(err, ErrMFARequired) {
+		t.Errorf("no code: %v, want ErrMFARequired", err)
+	}
+}
+
+func TestMFAAttemptLimit(t *testing.T) {
+	ctx := context.Background()
+	im := newTestManager(t, newTestNode(t))
+	id, secret, step, _ := enrollTestTOTP(t, im)
+
+	challenge, err := im.BeginMFA(ctx, id)
+	if err != nil || challenge == nil {
+		t.Fatalf("BeginMFA = %v, %v", challenge, err)
+	}
+	for i := 0; i < mfaMaxAttempts; i++ {
+		if _, _, err := im.CompleteMFA(ctx, challenge.Token, "000000", ""); err == nil {
+			t.Fatalf("attempt %d: wrong code accepted", i+1)
+		}
+	}
+	if _, _, err := im.CompleteMFA(ctx, challenge.Token, hotp(secret, step+1), ""); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("right code after %d wrong ones: %v, want ErrInvalidToken", mfaMaxAttempts, err)
+	}
+
+	// A new challenge starts a new count, and is spent once it succeeds.
+	challenge, err = im.BeginMFA(ctx, id)
+	if err != nil {
+		t.Fatalf("BeginMFA: %v", err)
+	}
+	if got, _, err := im.CompleteMFA(ctx, challenge.Token, hotp(secret, step+1), ""); err != nil || got != id {
+		t.Fatalf("CompleteMFA = %q, %v", got, err)
+	}
+	if _, _, err := im.CompleteMFA(ctx, challenge.Token, hotp(secret, step+2), ""); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("spent challenge: %v, want ErrInvalidToken", err)
+	}
+}
+
+func TestDisableTOTP(t *testing.T) {
+	ctx := context.Background()
+	im := newTestManager(t, newTestNode(t))
+	id, secret, step, _ := enrollTestTOTP(t, im)
+	enabled := func() bool {
+		db, err := im.loadDatabase(ctx)
+		if err != nil {
+			t.Fatalf("loadDatabase: %v", err)
+		}
+		return db.Users[id].TOTP != nil
+	}
+
+	// Sessions from a single factor, such as a password, a wallet or a DID
+	// key, need a code.
+	for _, amr := range [][]string{{AMRPassword}, {"swk"}, {"pop"}} {
+		actor := Principal{ID: id, Kind: PrincipalUser, AMR: amr}
+		if err := im.DisableTOTP(ctx, actor, id, ""); !errors.Is(err, ErrMFARequired) {
+			t.Errorf("DisableTOTP from a %v session = %v, want ErrMFARequired", amr, err)
+		}
+	}
+	actor := Principal{ID: id, Kind: PrincipalUser, AMR: []string{AMRPassword}}
+	for i := 0; i < mfaMaxAttempts; i++ {
+		if err := im.DisableTOTP(ctx, actor, id, "000000"); !errors.Is(err, errInvalidCode) {
+			t.Errorf("attempt %d with a wrong code: %v, want errInvalidCode", i+1, err)
+		}
+	}
+	if err := im.DisableTOTP(ctx, actor, id, hotp(secret, step+1)); err == nil {
+		t.Errorf("DisableTOTP after %d wrong codes succeeded", mfaMaxAttempts)
+	}
+	if !enabled() {
+		t.Fatal("TOTP was disabled")
+	}
+
+	// A session that used MFA needs nothing more.
+	mfa := Principal{ID: id, Kind: PrincipalUser, AMR: []string{AMRPassword, AMROTP, AMRMFA}}
+	if err := im.DisableTOTP(ctx, mfa, id, ""); err != nil {
+		t.Fatalf("DisableTOTP from an MFA session: %v", err)
+	}
+	if enabled() {
+		t.Error("TOTP is still enabled")
+	}
+}
+
+func TestDisableTOTPWithCode(t *testing.T) {
+	ctx := context.Background()
+	im := newTestManager(t, newTestNode(t))
+	id, secret, step, _ := enrollTestTOTP(t, im)
+	actor := Principal{ID: id, Kind: PrincipalUser, AMR: []string{AMRPassword}}
+	if err := im.DisableTOTP(ctx, actor, id, hotp(secret, step)); !errors.Is(err, errInvalidCode) {
+		t.Errorf("DisableTOTP with a used code = %v, want errInvalidCode", err)
+	}
+	if err := im.DisableTOTP(ctx, actor, id, hotp(secret, step+1)); err != nil {
+		t.Errorf("DisableTOTP with a current code: %v", err)
+	}
+}
@@ -0,0 +1,264 @@
+package util
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	ipfsapi "github.com/ipfs/go-ipfs-api"
+
+	"ipfs-identity/logger"
+)
+
+// mfsSnapshot is a stored state waiting to be mirrored into MFS.
+type mfsSnapshot struct {
+	cid   string
+	users map[string]User
+}
+
+// MFSMirror mirrors the user database into the Mutable File System of an IPFS
+// node so it can be browsed with `ipfs files`:
+//
+//	<root>/HEAD                     root CID of the canonical database
+//	<root>/users/<id>.json          one file per user
+//	<root>/index/usernames/<name>   user ID for each username
+//
+// Updates are staged in a copy of the tree and swapped in with FilesMv, so
+// readers never see a half-written state. The root CID stays canonical; the
+// mirror is only a view of it.
+type MFSMirror struct {
+	shell   *ipfsapi.Shell
+	root    string
+	log     logger.Logger
+	pending chan mfsSnapshot
+
+	mirrored map[string]User // State currently in MFS, nil if unknown
+}
+
+// NewMFSMirror creates a mirror under root on the node behind shell and starts
+// the goroutine that publishes snapshots.
+func NewMFSMirror(shell *ipfsapi.Shell, root string, log logger.Logger) *MFSMirror {
+	m := &MFSMirror{
+		shell:   shell,
+		root:    path.Clean("/" + root),
+		log:     log,
+		pending: make(chan mfsSnapshot, 1),
+	}
+	go m.run()
+	return m
+}
+
+// Publish schedules users, stored under cid, to be mirrored. If the mirror is
+// behind, intermediate states are skipped and only the latest is written.
+func (m *MFSMirror) Publish(cid string, users map[string]User) {
+	snapshot := mfsSnapshot{cid: cid, users: cloneUsers(users)}
+	for {
+		select {
+		case m.pending <- snapshot:
+			return
+		default:
+			// Drop the stale snapshot and retry.
+			select {
+			case <-m.pending:
+			default:
+			}
+		}
+	}
+}
+
+func (m *MFSMirror) run() {
+	for snapshot := range m.pending {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		err := m.write(ctx, snapshot)
+		cancel()
+		if err != nil {
+			m.mirrored = nil // Rebuild from scratch next time
+			m.log.Warn(fmt.Sprintf("Failed to mirror %s to MFS: %v", snapshot.cid, err))
+		}
+	}
+}
+
+// write stages snapshot next to the root and swaps it in. When the current
+// MFS content is known, the stage starts as a copy of it and only changed
+// users are rewritten; otherwise the tree is built from scratch.
+func (m *MFSMirror) write(ctx context.Context, snapshot mfsSnapshot) error {
+	stage := m.root + ".staging"
+	_ = m.shell.FilesRm(ctx, stage, true)
+
+	previous := m.mirrored
+	if previous != nil {
+		if err := m.shell.FilesCp(ctx, m.root, stage); err != nil {
+			previous = nil
+		}
+	}
+	if previous == nil {
+		_ = m.shell.FilesRm(ctx, stage, true)
+		previous = map[string]User{}
+	}
+
+	for _, dir := range []string{"users", "index/usernames"} {
+		if err := m.shell.FilesMkdir(ctx, path.Join(stage, dir), ipfsapi.FilesMkdir.Parents(true)); err != nil {
+			return fmt.Errorf("failed to create %s: %w", dir, err)
+		}
+	}
+
+	for id, old := range previous {
+		user, exists := snapshot.users[id]
+		if !exists {
+			if err := m.shell.FilesRm(ctx, m.userPath(stage, id), true); err != nil {
+				return err
+			}
+		}
+		if !exists || user.Username != old.Username {
+			if err := m.shell.FilesRm(ctx, m.usernamePath(stage, old.Username), true); err != nil {
+				return err
+			}
+		}
+	}
+	for id, user := range snapshot.users {
+		old, exists := previous[id]
+		if exists && sameUser(old, user) {
+			continue
+		}
+		data, err := json.MarshalIndent(user, "", "  ")
+		if err != nil {
+			return fmt.Errorf("failed to marshal user %s: %w", id, err)
+		}
+		if err := m.writeFile(ctx, m.userPath(stage, id), data); err != nil {
+			return err
+		}
+		if !exists || old.Username != user.Username {
+			if err := m.writeFile(ctx, m.usernamePath(stage, user.Username), []byte(id)); err != nil {
+				return err
+			}
+		}
+	}
+	if err := m.writeFile(ctx, path.Join(stage, "HEAD"), []byte(snapshot.cid)); err != nil {
+		return err
+	}
+
+	if err := m.swap(ctx, stage); err != nil {
+		return err
+	}
+	if _, err := m.shell.FilesFlush(ctx, m.root); err != nil {
+		return fmt.Errorf("failed to flush %s: %w", m.root, err)
+	}
+	m.mirrored = snapshot.users
+	return nil
+}
+
+// swap replaces the root with stage.
+func (m *MFSMirror) swap(ctx context.Context, stage string) error {
+	old := m.root + ".old"
+	_ = m.shell.FilesRm(ctx, old, true)
+	if _, err := m.shell.FilesStat(ctx, m.root); err == nil {
+		if err := m.shell.FilesMv(ctx, m.root, old); err != nil {
+			return fmt.Errorf("failed to move %s aside: %w", m.root, err)
+		}
+	}
+	if err := m.shell.FilesMv(ctx, stage, m.root); err != nil {
+		return fmt.Errorf("failed to swap in %s: %w", stage, err)
+	}
+	_ = m.shell.FilesRm(ctx, old, true)
+	return nil
+}
+
+func (m *MFSMirror) writeFile(ctx context.Context, name string, data []byte) error {
+	err := m.shell.FilesWrite(ctx, name, bytes.NewReader(data),
+		ipfsapi.FilesWrite.Create(true),
+		ipfsapi.FilesWrite.Truncate(true),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %w", name, err)
+	}
+	return nil
+}
+
+func (m *MFSMirror) userPath(root, id string) string {
+	return path.Join(root, "users", url.PathEscape(id)+".json")
+}
+
+func (m *MFSMirror) usernamePath(root, username string) string {
+	return path.Join(root, "index/usernames", url.PathEscape(username))
+}
+
+// Check compares the mirrored tree with users, the state stored under cid,
+// and returns a description of every difference found.
+func (m *MFSMirror) Check(ctx context.Context, cid string, users map[string]User) ([]string, error) {
+	var problems []string
+
+	head, err := m.readFile(ctx, path.Join(m.root, "HEAD"))
+	if err != nil {
+		return nil, err
+	}
+	if string(head) != cid {
+		problems = append(problems, fmt.Sprintf("HEAD is %q, canonical root is %q", head, cid))
+	}
+
+	entries, err := m.shell.FilesLs(ctx, path.Join(m.root, "users"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list users: %w", err)
+	}
+	seen := make(map[string]bool)
+	for _, entry := range entries {
+		id, err := url.PathUnescape(strings.TrimSuffix(entry.Name, ".json"))
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("users/%s: invalid file name", entry.Name))
+			continue
+		}
+		seen[id] = true
+		user, exists := users[id]
+		if !exists {
+			problems = append(problems, fmt.Sprintf("users/%s: not in canonical state", entry.Name))
+			continue
+		}
+		data, err := m.readFile(ctx, m.userPath(m.root, id))
+		if err != nil {
+			return nil, err
+		}
+		var mirrored User
+		if err := json.Unmarshal(data, &mirrored); err != nil || !sameUser(mirrored, user) {
+			problems = append(problems, fmt.Sprintf("users/%s: differs from canonical state", entry.Name))
+		}
+	}
+	for id, user := range users {
+		if !seen[id] {
+			problems = append(problems, fmt.Sprintf("users/%s.json: missing", id))
+		}
+		data, err := m.readFile(ctx, m.usernamePath(m.root, user.Username))
+		if err != nil || string(data) != id {
+			problems = append(problems, fmt.Sprintf("index/usernames/%s: does not point to %s", user.Username, id))
+		}
+	}
+
+	names, err := m.shell.FilesLs(ctx, path.Join(m.root, "index/usernames"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list username index: %w", err)
+	}
+	if len(names) != len(users) {
+		problems = append(problems, fmt.Sprintf("index/usernames has %d entries, canonical state has %d users", len(names), len(users)))
+	}
+	return problems, nil
+}
+
+// sameUser reports whether a and b encode to the same stored record.
+func sameUser(a, b User) bool {
+	x, errX := json.Marshal(a)
+	y, errY := json.Marshal(b)
+	return errX == nil && errY == nil && bytes.Equal(x, y)
+}
+
+func (m *MFSMirror) readFile(ctx context.Context, name string) ([]byte, error) {
+	reader, err := m.shell.FilesRead(ctx, name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", name, err)
+	}
+	defer reader.Close()
+	return io.ReadAll(reader)
+}
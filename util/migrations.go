@@ -0,0 +1,94 @@
+package util
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// CurrentSchemaVersion is the schema version of the User records written by
+// this build. Bump it together with registering a Migration from the previous
+// version.
+const CurrentSchemaVersion = 3
+
+// Migration upgrades a stored user record from schema From to From+1. Records
+// are handled as plain JSON objects so that a migration keeps working after
+// the User struct has moved on.
+type Migration struct {
+	From        int
+	Description string
+	Up          func(record map[string]interface{}) error
+}
+
+var migrations = make(map[int]Migration)
+
+// RegisterMigration adds m to the migrations applied when older records are
+// read. It is meant to be called from init functions and panics if a
+// migration from the same version is already registered.
+func RegisterMigration(m Migration) {
+	if _, exists := migrations[m.From]; exists {
+		panic(fmt.Sprintf("migration from schema %d registered twice", m.From))
+	}
+	migrations[m.From] = m
+}
+
+func init() {
+	RegisterMigration(Migration{
+		From:        1,
+		Description: "add account status",
+		Up: func(record map[string]interface{}) error {
+			if _, ok := record["status"]; !ok {
+				record["status"] = StatusActive
+			}
+			return nil
+		},
+	})
+	// Schema 3 adds state next to the users (roles, policies, OIDC clients,
+	// issued credentials and the status list) and optional fields to users
+	// (roles, MFA and WebAuthn enrollments, wallets, DIDs, attributes, update
+	// keys and email addresses). All of them start out empty, so records need
+	// no change; the bump keeps older builds, which would drop the new data on
+	// their next write, from opening the state.
+	RegisterMigration(Migration{
+		From:        2,
+		Description: "add roles, policies, clients, credentials and optional user fields",
+		Up:          func(record map[string]interface{}) error { return nil },
+	})
+}
+
+// migrateRecord decodes raw, a user record stored at schema, applying every
+// migration needed to reach CurrentSchemaVersion.
+func migrateRecord(raw json.RawMessage, schema int) (User, error) {
+	var user User
+	if schema > CurrentSchemaVersion {
+		return user, fmt.Errorf("schema version %d is newer than supported version %d", schema, CurrentSchemaVersion)
+	}
+
+	if schema < CurrentSchemaVersion {
+		var record map[string]interface{}
+		decoder := json.NewDecoder(bytes.NewReader(raw))
+		decoder.UseNumber()
+		if err := decoder.Decode(&record); err != nil {
+			return user, fmt.Errorf("failed to decode record: %w", err)
+		}
+		for version := schema; version < CurrentSchemaVersion; version++ {
+			m, ok := migrations[version]
+			if !ok {
+				return user, fmt.Errorf("no migration registered from schema %d", version)
+			}
+			if err := m.Up(record); err != nil {
+				return user, fmt.Errorf("migration from schema %d (%s): %w", version, m.Description, err)
+			}
+		}
+
+		var err error
+		if raw, err = json.Marshal(record); err != nil {
+			return user, fmt.Errorf("failed to encode migrated record: %w", err)
+		}
+	}
+
+	if err := json.Unmarshal(raw, &user); err != nil {
+		return user, fmt.Errorf("failed to unmarshal record: %w", err)
+	}
+	return user, nil
+}
@@ -0,0 +1,203 @@
+package util
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	aliceID = "2b4c3a0e-1f6d-4d8e-9a51-7c2e3f4b5a61"
+	bobID   = "9f1e2d3c-4b5a-4678-8912-a3b4c5d6e7f8"
+)
+
+// TestDecodeStateFixtures reads a state blob of every stored format and
+// schema version, as written by earlier builds.
+func TestDecodeStateFixtures(t *testing.T) {
+	aliceCreated := time.Date(2024, 3, 1, 8, 30, 0, 0, time.UTC)
+	tests := []struct {
+		file       string
+		wantSchema int
+		wantUsers  []string
+		wantRoles  int
+		check      func(t *testing.T, db *database)
+	}{
+		{"v1-legacy.json", 1, []string{aliceID, bobID}, 0, func(t *testing.T, db *database) {
+			bob := db.Users[bobID]
+			if want := time.Date(2024, 4, 15, 21, 45, 12, 5e8, time.UTC); !bob.CreatedAt.Equal(want) {
+				t.Errorf("bob created %v, want %v", bob.CreatedAt, want)
+			}
+		}},
+		{"v1-canonical.bin", 1, []string{aliceID, bobID}, 0, nil},
+		{"v1-canonical-gzip.bin", 1, []string{aliceID, bobID}, 0, nil},
+		{"v2.bin", 2, []string{aliceID}, 0, nil},
+		{"v3-gzip.bin", 3, []string{aliceID}, 1, func(t *testing.T, db *database) {
+			alice := db.Users[aliceID]
+			if alice.Email != "alice@example.com" || !alice.EmailVerified || alice.DID == nil || len(alice.Roles) != 1 {
+				t.Errorf("alice = %+v", alice)
+			}
+			if len(db.Policies) != 1 || len(db.Clients) != 1 || len(db.Credentials) != 1 || db.StatusList == nil {
+				t.Errorf("state beside the users was lost: %d policies, %d clients, %d credentials, status list %v",
+					len(db.Policies), len(db.Clients), len(db.Credentials), db.StatusList)
+			}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			data, err := os.ReadFile(filepath.Join("testdata", "state", tt.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			db, schema, err := decodeState(data)
+			if err != nil {
+				t.Fatalf("decodeState: %v", err)
+			}
+			if schema != tt.wantSchema {
+				t.Errorf("schema = %d, want %d", schema, tt.wantSchema)
+			}
+			if len(db.Users) != len(tt.wantUsers) || len(db.Roles) != tt.wantRoles {
+				t.Fatalf("decoded %d users and %d roles, want %d and %d", len(db.Users), len(db.Roles), len(tt.wantUsers), tt.wantRoles)
+			}
+			for _, id := range tt.wantUsers {
+				user := db.Users[id]
+				if user.ID != id || user.Password == "" {
+					t.Errorf("user %s = %+v", id, user)
+				}
+				if user.Status != StatusActive {
+					t.Errorf("user %s has status %q after migration, want %q", id, user.Status, StatusActive)
+				}
+			}
+			if alice := db.Users[aliceID]; tt.wantSchema < 3 && !alice.CreatedAt.Equal(aliceCreated) {
+				t.Errorf("alice created %v, want %v", alice.CreatedAt, aliceCreated)
+			}
+			if tt.check != nil {
+				tt.check(t, db)
+			}
+		})
+	}
+}
+
+// TestOlderFormatsEncodeAlike checks that a schema 1 state gets the same
+// bytes, and so the same CID, whichever format it was read from.
+func TestOlderFormatsEncodeAlike(t *testing.T) {
+	var want []byte
+	for _, file := range []string{"v1-legacy.json", "v1-canonical.bin", "v1-canonical-gzip.bin"} {
+		data, err := os.ReadFile(filepath.Join("testdata", "state", file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		db, _, err := decodeState(data)
+		if err != nil {
+			t.Fatalf("%s: %v", file, err)
+		}
+		got, err := encodeState(db, true)
+		if err != nil {
+			t.Fatalf("%s: %v", file, err)
+		}
+		if want == nil {
+			want = got
+		} else if !bytes.Equal(got, want) {
+			t.Errorf("%s encodes differently from v1-legacy.json", file)
+		}
+	}
+}
+
+func TestMigrateRecord(t *testing.T) {
+	tests := []struct {
+		name       string
+		record     string
+		schema     int
+		wantStatus string
+		wantErr    string
+	}{
+		{"schema 1 gets a status", `{"id":"1","username":"a"}`, 1, StatusActive, ""},
+		{"schema 2 keeps its status", `{"id":"1","username":"a","status":"active"}`, 2, StatusActive, ""},
+		{"current schema is read as is", `{"id":"1","username":"a","status":"active"}`, CurrentSchemaVersion, StatusActive, ""},
+		{"newer schema", `{"id":"1"}`, CurrentSchemaVersion + 1, "", "newer than supported"},
+		{"unregistered schema", `{"id":"1"}`, 0, "", "no migration registered from schema 0"},
+		{"malformed", `{"id":`, 1, "", "failed to decode record"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user, err := migrateRecord(json.RawMessage(tt.record), tt.schema)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("migrateRecord = %v, want error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("migrateRecord: %v", err)
+			}
+			if user.Status != tt.wantStatus {
+				t.Errorf("status = %q, want %q", user.Status, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestMigrationsCoverEverySchema(t *testing.T) {
+	for from := 1; from < CurrentSchemaVersion; from++ {
+		if _, ok := migrations[from]; !ok {
+			t.Errorf("no migration from schema %d", from)
+		}
+	}
+}
+
+// TestMigrate runs the migrate command on a state written by an earlier
+// build and checks the recorded transition.
+func TestMigrate(t *testing.T) {
+	ctx := context.Background()
+	for _, file := range []string{"v1-legacy.json", "v2.bin"} {
+		t.Run(file, func(t *testing.T) {
+			node := newTestNode(t)
+			data, err := os.ReadFile(filepath.Join("testdata", "state", file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			oldRoot, err := node.Add(ctx, bytes.NewReader(data))
+			if err != nil {
+				t.Fatalf("Add: %v", err)
+			}
+			im := newTestManager(t, node)
+			im.cid = oldRoot
+
+			from, root, err := im.Migrate(ctx)
+			if err != nil {
+				t.Fatalf("Migrate: %v", err)
+			}
+			_, wantFrom, _ := decodeState(data)
+			if from != wantFrom || root == oldRoot {
+				t.Fatalf("Migrate = %d, %s; want %d and a new root", from, root, wantFrom)
+			}
+
+			var entries []ledgerEntry
+			if err := im.walkLedger(ctx, func(cid string, entry ledgerEntry) bool {
+				entries = append(entries, entry)
+				return true
+			}); err != nil {
+				t.Fatalf("walkLedger: %v", err)
+			}
+			if len(entries) != 1 {
+				t.Fatalf("ledger has %d entries, want 1", len(entries))
+			}
+			e := entries[0]
+			if e.Kind != transitionMigrate || e.FromSchema != wantFrom || e.Schema != CurrentSchemaVersion || e.Prev != oldRoot {
+				t.Errorf("migration entry = %+v", e)
+			}
+			db, schema, err := im.fetchRoot(ctx, root)
+			if err != nil || schema != CurrentSchemaVersion || db.Users[aliceID].Status != StatusActive {
+				t.Errorf("fetchRoot = schema %d, err %v", schema, err)
+			}
+
+			if again, sameRoot, err := im.Migrate(ctx); err != nil || again != CurrentSchemaVersion || sameRoot != root {
+				t.Errorf("second Migrate = %d, %s, %v; want a no-op", again, sameRoot, err)
+			}
+		})
+	}
+}
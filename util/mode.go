@@ -0,0 +1,181 @@
+package util
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"ipfs-identity/logger"
+)
+
+// Mode decides which operations the service accepts.
+type Mode string
+
+const (
+	ModeNormal      Mode = "normal"      // Reads and writes are served
+	ModeReadOnly    Mode = "read_only"   // Writes are refused; reads and logins use the cached state
+	ModeMaintenance Mode = "maintenance" // Only health and admin requests are served
+)
+
+// ModeError is returned for an operation refused in the current mode.
+type ModeError struct {
+	Mode       Mode
+	RetryAfter time.Duration // Suggested wait before retrying
+}
+
+func (e *ModeError) Error() string {
+	return fmt.Sprintf("service is in %s mode", e.Mode)
+}
+
+// ModeStatus describes the current mode and how it was entered.
+type ModeStatus struct {
+	Mode              Mode      `json:"mode"`
+	Manual            bool      `json:"manual"` // Set by an operator; automatic switching is suspended
+	Reason            string    `json:"reason,omitempty"`
+	Since             time.Time `json:"since"`
+	RetryAfterSeconds int       `json:"retry_after_seconds"`
+}
+
+// modeSwitch is the service mode state machine. Outside of manual control it
+// moves between normal and read-only as backend health checks fail and
+// recover; maintenance is only ever entered by an operator. The backend
+// counts as healthy while either IPFS or the write-ahead log accepts writes,
+// since the WAL exists to take writes during IPFS outages.
+type modeSwitch struct {
+	mu             sync.Mutex
+	status         ModeStatus
+	retryAfter     time.Duration
+	readOnlyAfter  time.Duration // Sustained failure of IPFS and the WAL before going read-only, 0 to never
+	unhealthySince time.Time
+	log            logger.Logger
+}
+
+func newModeSwitch(retryAfter, readOnlyAfter time.Duration, log logger.Logger) *modeSwitch {
+	return &modeSwitch{
+		status: ModeStatus{
+			Mode:              ModeNormal,
+			Since:             time.Now(),
+			RetryAfterSeconds: int(retryAfter.Seconds()),
+		},
+		retryAfter:    retryAfter,
+		readOnlyAfter: readOnlyAfter,
+		log:           log,
+	}
+}
+
+func (s *modeSwitch) current() ModeStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.status
+}
+
+// set switches to mode. Callers must hold s.mu.
+func (s *modeSwitch) set(mode Mode, manual bool, reason string) {
+	if s.status.Mode != mode {
+		s.log.Warn(fmt.Sprintf("Service mode changed from %s to %s: %s", s.status.Mode, mode, reason))
+		s.status.Since = time.Now()
+	}
+	s.status.Mode = mode
+	s.status.Manual = manual
+	s.status.Reason = reason
+}
+
+// observe feeds the outcome of a backend health check to the state machine.
+func (s *modeSwitch) observe(healthy bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if healthy {
+		s.unhealthySince = time.Time{}
+		if !s.status.Manual && s.status.Mode == ModeReadOnly {
+			s.set(ModeNormal, false, "writes can be stored again")
+		}
+		return
+	}
+
+	if s.unhealthySince.IsZero() {
+		s.unhealthySince = time.Now()
+	}
+	outage := time.Since(s.unhealthySince)
+	if !s.status.Manual && s.status.Mode == ModeNormal && s.readOnlyAfter > 0 && outage >= s.readOnlyAfter {
+		s.set(ModeReadOnly, false, fmt.Sprintf("IPFS and the write-ahead log unavailable for %s", outage.Round(time.Second)))
+	}
+}
+
+// checkWrite returns a *ModeError unless writes are accepted.
+func (s *modeSwitch) checkWrite() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.status.Mode != ModeNormal {
+		return &ModeError{Mode: s.status.Mode, RetryAfter: s.retryAfter}
+	}
+	return nil
+}
+
+// checkRead returns a *ModeError unless reads and logins are accepted.
+func (s *modeSwitch) checkRead() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.status.Mode == ModeMaintenance {
+		return &ModeError{Mode: s.status.Mode, RetryAfter: s.retryAfter}
+	}
+	return nil
+}
+
+// StartModeChecks probes IPFS and the write-ahead log every interval until ctx
+// is cancelled and switches between normal and read-only mode accordingly.
+// While IPFS is down but the WAL works, writes are queued and the mode stays
+// normal.
+func (im *IdentityManager) StartModeChecks(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				im.mode.observe(im.ipfs.IsUp(ctx) || im.wal.probe() == nil)
+			}
+		}
+	}()
+}
+
+// Mode returns the current service mode.
+func (im *IdentityManager) Mode() ModeStatus {
+	return im.mode.current()
+}
+
+// CheckRequest returns a *ModeError unless requests other than health checks
+// and administration are served, that is unless the service is in
+// maintenance mode.
+func (im *IdentityManager) CheckRequest() error {
+	return im.mode.checkRead()
+}
+
+// SetMode puts the service in mode under operator control, suspending
+// automatic switching until ReleaseMode is called.
+func (im *IdentityManager) SetMode(mode Mode, reason string) error {
+	switch mode {
+	case ModeNormal, ModeReadOnly, ModeMaintenance:
+	default:
+		return fmt.Errorf("unknown mode %q", mode)
+	}
+	if reason == "" {
+		reason = "set by operator"
+	}
+
+	im.mode.mu.Lock()
+	defer im.mode.mu.Unlock()
+	im.mode.set(mode, true, reason)
+	return nil
+}
+
+// ReleaseMode hands the mode back to automatic control. The service returns
+// to normal mode and the next health check decides from there.
+func (im *IdentityManager) ReleaseMode() {
+	im.mode.mu.Lock()
+	defer im.mode.mu.Unlock()
+	im.mode.set(ModeNormal, false, "automatic switching resumed")
+}
@@ -0,0 +1,167 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"ipfs-identity/logger"
+)
+
+func TestModeSwitch(t *testing.T) {
+	// Steps are applied in order: "healthy" and "unhealthy" feed a health
+	// check, "outage" backdates the start of the current outage past
+	// readOnlyAfter, and the others are operator actions.
+	type step struct {
+		do   string // "healthy", "unhealthy", "outage", "read_only", "maintenance" or "release"
+		want Mode
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{
+			name:  "short outage keeps normal",
+			steps: []step{{"unhealthy", ModeNormal}, {"unhealthy", ModeNormal}, {"healthy", ModeNormal}},
+		},
+		{
+			name:  "sustained outage goes read-only and recovers",
+			steps: []step{{"unhealthy", ModeNormal}, {"outage", ModeNormal}, {"unhealthy", ModeReadOnly}, {"healthy", ModeNormal}},
+		},
+		{
+			name:  "recovery resets the outage",
+			steps: []step{{"unhealthy", ModeNormal}, {"healthy", ModeNormal}, {"unhealthy", ModeNormal}},
+		},
+		{
+			name:  "manual read-only survives healthy checks",
+			steps: []step{{"read_only", ModeReadOnly}, {"healthy", ModeReadOnly}, {"release", ModeNormal}},
+		},
+		{
+			name:  "manual maintenance survives checks",
+			steps: []step{{"maintenance", ModeMaintenance}, {"unhealthy", ModeMaintenance}, {"outage", ModeMaintenance}, {"unhealthy", ModeMaintenance}, {"healthy", ModeMaintenance}},
+		},
+		{
+			name:  "release hands control back to the checks",
+			steps: []step{{"maintenance", ModeMaintenance}, {"release", ModeNormal}, {"unhealthy", ModeNormal}, {"outage", ModeNormal}, {"unhealthy", ModeReadOnly}},
+		},
+		{
+			name:  "automatic read-only can be overridden",
+			steps: []step{{"unhealthy", ModeNormal}, {"outage", ModeNormal}, {"unhealthy", ModeReadOnly}, {"maintenance", ModeMaintenance}, {"healthy", ModeMaintenance}},
+		},
+	}
+	log, err := logger.NewLogger(logger.Config{Level: "error", Format: "console", BaseDir: t.TempDir(), RotateTime: time.Hour})
+	if err != nil {
+		t.Fatalf("NewLogger: %v", err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			im := &IdentityManager{mode: newModeSwitch(time.Minute, time.Hour, log)}
+			for i, s := range tt.steps {
+				switch s.do {
+				case "healthy", "unhealthy":
+					im.mode.observe(s.do == "healthy")
+				case "outage":
+					im.mode.unhealthySince = time.Now().Add(-2 * time.Hour)
+				case "release":
+					im.ReleaseMode()
+				default:
+					if err := im.SetMode(Mode(s.do), ""); err != nil {
+						t.Fatalf("SetMode: %v", err)
+					}
+				}
+				if got := im.Mode().Mode; got != s.want {
+					t.Fatalf("step %d (%s): mode %s, want %s", i, s.do, got, s.want)
+				}
+			}
+		})
+	}
+
+	t.Run("unknown mode", func(t *testing.T) {
+		im := &IdentityManager{mode: newModeSwitch(time.Minute, time.Hour, log)}
+		if err := im.SetMode("closed", ""); err == nil {
+			t.Error("SetMode accepted an unknown mode")
+		}
+	})
+
+	t.Run("never read-only", func(t *testing.T) {
+		s := newModeSwitch(time.Minute, 0, log)
+		s.observe(false)
+		s.unhealthySince = time.Now().Add(-24 * time.Hour)
+		s.observe(false)
+		if got := s.current().Mode; got != ModeNormal {
+			t.Errorf("mode %s with read-only switching disabled, want %s", got, ModeNormal)
+		}
+	})
+}
+
+func TestModeChecks(t *testing.T) {
+	tests := []struct {
+		mode      Mode
+		readErr   bool
+		writeErr  bool
+		requestOK bool
+	}{
+		{mode: ModeNormal, requestOK: true},
+		{mode: ModeReadOnly, writeErr: true, requestOK: true},
+		{mode: ModeMaintenance, readErr: true, writeErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.mode), func(t *testing.T) {
+			s := &modeSwitch{status: ModeStatus{Mode: tt.mode}, retryAfter: 30 * time.Second}
+			im := &IdentityManager{mode: s}
+			for _, check := range []struct {
+				name    string
+				err     error
+				wantErr bool
+			}{
+				{"checkRead", s.checkRead(), tt.readErr},
+				{"checkWrite", s.checkWrite(), tt.writeErr},
+				{"CheckRequest", im.CheckRequest(), !tt.requestOK},
+			} {
+				if (check.err != nil) != check.wantErr {
+					t.Errorf("%s = %v, want error %v", check.name, check.err, check.wantErr)
+				}
+				var modeErr *ModeError
+				if check.err != nil && (!errors.As(check.err, &modeErr) || modeErr.Mode != tt.mode || modeErr.RetryAfter != 30*time.Second) {
+					t.Errorf("%s = %#v, want a ModeError for %s with RetryAfter 30s", check.name, check.err, tt.mode)
+				}
+			}
+		})
+	}
+}
+
+// TestReadOnlyMode checks that read-only mode refuses writes but keeps
+// serving logins, and that maintenance refuses both.
+func TestReadOnlyMode(t *testing.T) {
+	t.Setenv("JWT_ISSUER", "https://id.example.com")
+	ctx := context.Background()
+	im := newTestManager(t, newTestNode(t))
+	id, _, err := im.AddUser(ctx, "ada", "ada-password", "")
+	if err != nil {
+		t.Fatalf("AddUser: %v", err)
+	}
+
+	if err := im.SetMode(ModeReadOnly, "backup"); err != nil {
+		t.Fatalf("SetMode: %v", err)
+	}
+	var modeErr *ModeError
+	if err := im.EditUser(ctx, id, "ada.lovelace", ""); !errors.As(err, &modeErr) {
+		t.Errorf("EditUser in read-only mode = %v, want a ModeError", err)
+	}
+	if _, err := im.Login(ctx, "ada", "ada-password"); err != nil {
+		t.Errorf("Login in read-only mode: %v", err)
+	}
+
+	if err := im.SetMode(ModeMaintenance, "upgrade"); err != nil {
+		t.Fatalf("SetMode: %v", err)
+	}
+	if _, err := im.Login(ctx, "ada", "ada-password"); !errors.As(err, &modeErr) {
+		t.Errorf("Login in maintenance mode = %v, want a ModeError", err)
+	}
+
+	im.ReleaseMode()
+	if err := im.EditUser(ctx, id, "ada.lovelace", ""); err != nil {
+		t.Errorf("EditUser after ReleaseMode: %v", err)
+	}
+}
@@ -0,0 +1,140 @@
+package util
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	ipfsapi "github.com/ipfs/go-ipfs-api"
+	"github.com/libp2p/go-libp2p/core/metrics"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// NetworkConfig declares the private network the identity data may replicate
+// in. It is applied to every endpoint of a Cluster at startup.
+type NetworkConfig struct {
+	Peers        []string // Multiaddrs, including /p2p/<id>, of every node in the network
+	RefusePublic bool     // Fail startup instead of warning when a node talks to outside peers
+}
+
+// NewNetworkConfigFromEnv creates NetworkConfig from environment variables:
+// IPFS_PRIVATE_PEERS (comma-separated multiaddrs) and IPFS_PUBLIC_NETWORK
+// (warn or refuse, default: warn).
+func NewNetworkConfigFromEnv() NetworkConfig {
+	return NetworkConfig{
+		Peers:        splitList(os.Getenv("IPFS_PRIVATE_PEERS")),
+		RefusePublic: strings.EqualFold(os.Getenv("IPFS_PUBLIC_NETWORK"), "refuse"),
+	}
+}
+
+// Private reports whether a private network has been declared.
+func (n NetworkConfig) Private() bool {
+	return len(n.Peers) > 0
+}
+
+// ConfigureNetwork restricts every endpoint to the declared private network:
+// the bootstrap list is replaced by the declared peers, which are also added
+// to the peering subsystem and dialed. Afterwards each endpoint is checked for
+// connections to peers outside the network.
+func (c *Cluster) ConfigureNetwork(ctx context.Context, config NetworkConfig) error {
+	if !config.Private() {
+		return nil
+	}
+
+	allowed := make(map[string]bool)
+	for _, addr := range config.Peers {
+		info, err := peer.AddrInfoFromString(addr)
+		if err != nil {
+			return fmt.Errorf("invalid private peer %q: %w", addr, err)
+		}
+		allowed[info.ID.String()] = true
+	}
+	for _, e := range c.endpoints {
+		if id, err := e.shell.ID(); err == nil {
+			allowed[id.ID] = true
+		}
+	}
+
+	for _, e := range c.endpoints {
+		if err := configureEndpointNetwork(ctx, e.shell, config.Peers); err != nil {
+			return fmt.Errorf("%s: %w", e.url, err)
+		}
+
+		outside, err := outsidePeers(ctx, e.shell, allowed)
+		if err != nil {
+			return fmt.Errorf("%s: failed to list swarm peers: %w", e.url, err)
+		}
+		if len(outside) == 0 {
+			continue
+		}
+		msg := fmt.Sprintf("IPFS endpoint %s is connected to %d peers outside the private network (e.g. %s); is it missing a swarm key?", e.url, len(outside), outside[0])
+		if config.RefusePublic {
+			return fmt.Errorf("%s", msg)
+		}
+		c.log.Warn(msg)
+	}
+	return nil
+}
+
+// configureEndpointNetwork replaces the bootstrap list of shell's node with
+// peers and keeps persistent connections to them.
+func configureEndpointNetwork(ctx context.Context, shell *ipfsapi.Shell, peers []string) error {
+	if _, err := shell.BootstrapRmAll(); err != nil {
+		return fmt.Errorf("failed to clear bootstrap list: %w", err)
+	}
+	if _, err := shell.BootstrapAdd(peers); err != nil {
+		return fmt.Errorf("failed to add bootstrap peers: %w", err)
+	}
+	for _, addr := range peers {
+		if _, err := shell.SwarmPeeringAdd(ctx, addr); err != nil {
+			return fmt.Errorf("failed to add peering for %s: %w", addr, err)
+		}
+	}
+	// Peers that are down now are retried by the peering subsystem.
+	_ = shell.SwarmConnect(ctx, peers...)
+	return nil
+}
+
+// outsidePeers returns the IDs of connected peers that are not in allowed.
+func outsidePeers(ctx context.Context, shell *ipfsapi.Shell, allowed map[string]bool) ([]string, error) {
+	conns, err := shell.SwarmPeers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var outside []string
+	for _, conn := range conns.Peers {
+		if !allowed[conn.Peer] {
+			outside = append(outside, conn.Peer)
+		}
+	}
+	return outside, nil
+}
+
+// EndpointNetwork describes the swarm connections and bandwidth of an endpoint.
+type EndpointNetwork struct {
+	URL       string                  `json:"url"`
+	Peers     []ipfsapi.SwarmConnInfo `json:"peers"`
+	Bandwidth *metrics.Stats          `json:"bandwidth,omitempty"`
+	Error     string                  `json:"error,omitempty"`
+}
+
+// Network returns the connected peers and bandwidth totals of every endpoint.
+func (c *Cluster) Network(ctx context.Context) []EndpointNetwork {
+	result := make([]EndpointNetwork, 0, len(c.endpoints))
+	for _, e := range c.endpoints {
+		status := EndpointNetwork{URL: e.url}
+		conns, err := e.shell.SwarmPeers(ctx)
+		if err != nil {
+			status.Error = err.Error()
+			result = append(result, status)
+			continue
+		}
+		status.Peers = conns.Peers
+		if bw, err := e.shell.StatsBW(ctx); err == nil {
+			status.Bandwidth = bw
+		}
+		result = append(result, status)
+	}
+	return result
+}
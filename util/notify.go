@@ -0,0 +1,127 @@
+package util
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Notification is a message to a user, such as a password reset link.
+type Notification struct {
+	To      string // Email address
+	Subject string
+	Body    string // Plain text
+}
+
+// Notifier delivers notifications to users.
+type Notifier interface {
+	Notify(ctx context.Context, n Notification) error
+}
+
+// SMTPNotifier sends notifications as email through an SMTP server. The
+// connection is upgraded with STARTTLS when the server offers it.
+type SMTPNotifier struct {
+	Addr string    // host:port of the server
+	From string    // Sender address
+	Auth smtp.Auth // Optional
+}
+
+// Notify sends n. ctx is not honored once the message is handed to the
+// server.
+func (s SMTPNotifier) Notify(ctx context.Context, n Notification) error {
+	msg, err := formatMessage(s.From, n)
+	if err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := smtp.SendMail(s.Addr, s.Auth, s.From, []string{n.To}, msg); err != nil {
+		return fmt.Errorf("failed to send mail to %s: %w", n.To, err)
+	}
+	return nil
+}
+
+// FileNotifier writes each notification as an .eml file to Dir instead of
+// sending it, for local testing.
+type FileNotifier struct {
+	Dir  string
+	From string
+}
+
+// Notify writes n to a new file in the outbox.
+func (f FileNotifier) Notify(ctx context.Context, n Notification) error {
+	msg, err := formatMessage(f.From, n)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(f.Dir, 0o700); err != nil {
+		return fmt.Errorf("failed to create outbox: %w", err)
+	}
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%d-%s.eml", time.Now().UnixNano(), hex.EncodeToString(suffix))
+	if err := os.WriteFile(filepath.Join(f.Dir, name), msg, 0o600); err != nil {
+		return fmt.Errorf("failed to write to outbox: %w", err)
+	}
+	return nil
+}
+
+// formatMessage renders n as an RFC 5322 message.
+func formatMessage(from string, n Notification) ([]byte, error) {
+	for _, header := range []string{from, n.To, n.Subject} {
+		if strings.ContainsAny(header, "\r\n") {
+			return nil, errors.New("notification headers cannot contain line breaks")
+		}
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", from)
+	fmt.Fprintf(&buf, "To: %s\r\n", n.To)
+	fmt.Fprintf(&buf, "Subject: %s\r\n", n.Subject)
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+	buf.WriteString(strings.ReplaceAll(n.Body, "\n", "\r\n"))
+	return buf.Bytes(), nil
+}
+
+// newNotifier returns the notifier configured by the environment: SMTP
+// through NOTIFY_SMTP_ADDR if it is set, otherwise a file outbox in
+// NOTIFY_OUTBOX_DIR, by default outbox in walDir.
+func newNotifier(walDir string) Notifier {
+	from := os.Getenv("NOTIFY_FROM")
+	if from == "" {
+		from = "no-reply@localhost"
+	}
+	if addr := os.Getenv("NOTIFY_SMTP_ADDR"); addr != "" {
+		notifier := SMTPNotifier{Addr: addr, From: from}
+		if username := os.Getenv("NOTIFY_SMTP_USERNAME"); username != "" {
+			host, _, _ := net.SplitHostPort(addr)
+			notifier.Auth = smtp.PlainAuth("", username, os.Getenv("NOTIFY_SMTP_PASSWORD"), host)
+		}
+		return notifier
+	}
+	dir := os.Getenv("NOTIFY_OUTBOX_DIR")
+	if dir == "" {
+		dir = filepath.Join(walDir, "outbox")
+	}
+	return FileNotifier{Dir: dir, From: from}
+}
+
+// SetNotifier replaces the notifier, for programs that embed the
+// IdentityManager and deliver messages another way. Call it before serving
+// requests.
+func (im *IdentityManager) SetNotifier(n Notifier) {
+	im.notifier = n
+}
@@ -0,0 +1,420 @@
+package util
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Scopes supported by the OpenID Connect provider.
+const (
+	ScopeOpenID        = "openid"
+	ScopeProfile       = "profile"
+	ScopeOfflineAccess = "offline_access"
+)
+
+var supportedScopes = map[string]bool{ScopeOpenID: true, ScopeProfile: true, ScopeOfflineAccess: true}
+
+// authCodeTTL is how long an authorization code can be redeemed.
+const authCodeTTL = time.Minute
+
+// OAuthError is an error with an OAuth 2.0 error code, reported to clients as
+// the error and error_description parameters.
+type OAuthError struct {
+	Code        string
+	Description string
+}
+
+func (e *OAuthError) Error() string {
+	return e.Code + ": " + e.Description
+}
+
+// AuthorizationRequest holds the parameters of an /authorize request.
+type AuthorizationRequest struct {
+	ClientID            string
+	RedirectURI         string
+	ResponseType        string
+	Scope               string
+	State               string
+	Nonce               string
+	CodeChallenge       string
+	CodeChallengeMethod string
+}
+
+// authCode is an issued authorization code waiting to be redeemed.
+type authCode struct {
+	clientID    string
+	userID      string
+	redirectURI string
+	scope       string
+	nonce       string
+	challenge   string
+	amr         []string
+	authTime    time.Time
+	expires     time.Time
+}
+
+// codeStore keeps authorization codes in memory, keyed by their hash. Codes
+// live for a minute, so losing them on restart only fails logins in flight.
+type codeStore struct {
+	mu    sync.Mutex
+	codes map[string]authCode
+}
+
+func newCodeStore() *codeStore {
+	return &codeStore{codes: make(map[string]authCode)}
+}
+
+// put stores c under a new random code and returns the code.
+func (s *codeStore) put(c authCode) (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", fmt.Errorf("failed to generate authorization code: %w", err)
+	}
+	code := base64.RawURLEncoding.EncodeToString(raw)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for hash, existing := range s.codes {
+		if now.After(existing.expires) {
+			delete(s.codes, hash)
+		}
+	}
+	s.codes[hashToken(code)] = c
+	return code, nil
+}
+
+// take removes and returns the grant for code. Each code can be taken once.
+func (s *codeStore) take(code string) (authCode, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	hash := hashToken(code)
+	c, ok := s.codes[hash]
+	delete(s.codes, hash)
+	if !ok || time.Now().After(c.expires) {
+		return authCode{}, false
+	}
+	return c, true
+}
+
+// Issuer returns the configured issuer identifier, JWT_ISSUER, for what, the
+// feature that needs it. It is never derived from a request.
+func (im *IdentityManager) Issuer(what string) (string, error) {
+	return im.configuredIssuer(what)
+}
+
+// configuredIssuer returns JWT_ISSUER for uses that must not fall back to the
+// request's Host header, which the client controls: what names the feature,
+// for the error returned when it is unset.
+func (im *IdentityManager) configuredIssuer(what string) (string, error) {
+	if im.tokens.issuer == "" {
+		return "", fmt.Errorf("%s needs JWT_ISSUER to be set", what)
+	}
+	return im.tokens.issuer, nil
+}
+
+// AuthorizationClient returns the client of an /authorize request after
+// checking that redirectURI is registered for it. Errors from this check must
+// be shown to the user rather than sent to the redirect URI.
+func (im *IdentityManager) AuthorizationClient(ctx context.Context, clientID, redirectURI string) (Client, error) {
+	client, err := im.Client(ctx, clientID)
+	if err != nil {
+		return Client{}, err
+	}
+	if !client.allowsRedirect(redirectURI) {
+		return Client{}, &OAuthError{Code: "invalid_request", Description: "redirect_uri is not registered for this client"}
+	}
+	return client, nil
+}
+
+// ValidateAuthorization checks the remaining parameters of an /authorize
+// request from client. Its errors can be sent to the redirect URI.
+func (im *IdentityManager) ValidateAuthorization(client Client, req AuthorizationRequest) error {
+	if req.ResponseType != "code" {
+		return &OAuthError{Code: "unsupported_response_type", Description: "only the code response type is supported"}
+	}
+	if !client.allows(GrantAuthorizationCode) {
+		return &OAuthError{Code: "unauthorized_client", Description: "client may not use the authorization code grant"}
+	}
+	if req.CodeChallenge == "" || req.CodeChallengeMethod != "S256" {
+		return &OAuthError{Code: "invalid_request", Description: "PKCE with code_challenge_method S256 is required"}
+	}
+	return checkScope(client, req.Scope)
+}
+
+// checkScope verifies that every scope in scope is allowed for client.
+func checkScope(client Client, scope string) error {
+	for _, s := range strings.Fields(scope) {
+		allowed := false
+		for _, c := range client.Scopes {
+			allowed = allowed || c == s
+		}
+		if !allowed {
+			return &OAuthError{Code: "invalid_scope", Description: fmt.Sprintf("scope %q is not allowed for this client", s)}
+		}
+	}
+	return nil
+}
+
+func hasScope(scope, want string) bool {
+	for _, s := range strings.Fields(scope) {
+		if s == want {
+			return true
+		}
+	}
+	return false
+}
+
+// GrantAuthorizationCode issues a code for req, which userID has just
+// authenticated, with the methods in amr, and consented to.
+func (im *IdentityManager) GrantAuthorizationCode(req AuthorizationRequest, userID string, amr []string) (string, error) {
+	now := time.Now()
+	code, err := im.codes.put(authCode{
+		clientID:    req.ClientID,
+		userID:      userID,
+		redirectURI: req.RedirectURI,
+		scope:       req.Scope,
+		nonce:       req.Nonce,
+		challenge:   req.CodeChallenge,
+		amr:         amr,
+		authTime:    now,
+		expires:     now.Add(authCodeTTL),
+	})
+	if err != nil {
+		return "", err
+	}
+	im.log.Info(fmt.Sprintf("Authorization code issued to client %s for user %s", req.ClientID, userID))
+	return code, nil
+}
+
+// OAuthTokens is the response of the token endpoint.
+type OAuthTokens struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	IDToken      string `json:"id_token,omitempty"`
+	Scope        string `json:"scope,omitempty"`
+}
+
+// idTokenClaims are the claims of an OpenID Connect ID token.
+type idTokenClaims struct {
+	Claims
+	Nonce             string `json:"nonce,omitempty"`
+	AuthTime          int64  `json:"auth_time"`
+	PreferredUsername string `json:"preferred_username,omitempty"`
+}
+
+// ExchangeCode redeems an authorization code for tokens.
+func (im *IdentityManager) ExchangeCode(ctx context.Context, client Client, code, redirectURI, verifier, issuer string) (OAuthTokens, error) {
+	grant, ok := im.codes.take(code)
+	if !ok || grant.clientID != client.ID || grant.redirectURI != redirectURI {
+		return OAuthTokens{}, &OAuthError{Code: "invalid_grant", Description: "invalid, expired or already used authorization code"}
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	if base64.RawURLEncoding.EncodeToString(sum[:]) != grant.challenge {
+		return OAuthTokens{}, &OAuthError{Code: "invalid_grant", Description: "code_verifier does not match code_challenge"}
+	}
+
+	user, err := im.activeUser(ctx, grant.userID)
+	if err != nil {
+		return OAuthTokens{}, err
+	}
+	session := refreshFamily{UserID: user.ID, ClientID: client.ID, Scope: grant.scope, AMR: grant.amr}
+	tokens, err := im.clientTokens(client, session, issuer, "")
+	if err != nil {
+		return OAuthTokens{}, err
+	}
+
+	if hasScope(grant.scope, ScopeOpenID) {
+		now := time.Now()
+		claims := idTokenClaims{
+			Claims: Claims{
+				Issuer:    issuer,
+				Subject:   user.ID,
+				Audience:  client.ID,
+				IssuedAt:  now.Unix(),
+				ExpiresAt: now.Add(im.tokens.accessTTL).Unix(),
+				ID:        uuid.New().String(),
+				AMR:       grant.amr,
+			},
+			Nonce:    grant.nonce,
+			AuthTime: grant.authTime.Unix(),
+		}
+		if hasScope(grant.scope, ScopeProfile) {
+			claims.PreferredUsername = user.Username
+		}
+		if tokens.IDToken, err = im.signer.Sign(claims); err != nil {
+			return OAuthTokens{}, err
+		}
+	}
+	im.log.Info(fmt.Sprintf("Client %s redeemed an authorization code for user %s", client.ID, user.ID))
+	return tokens, nil
+}
+
+// RefreshClientTokens exchanges a refresh token issued to client for new
+// tokens. As with first-party refresh tokens, reuse revokes the family.
+func (im *IdentityManager) RefreshClientTokens(ctx context.Context, client Client, refreshToken, issuer string) (OAuthTokens, error) {
+	if !client.allows(GrantRefreshToken) {
+		return OAuthTokens{}, &OAuthError{Code: "unauthorized_client", Description: "client may not use the refresh_token grant"}
+	}
+	family, next, reused, err := im.refresh.rotate(refreshToken, client.ID, im.tokens.refreshTTL)
+	if reused {
+		im.log.Warn(fmt.Sprintf("Refresh token reuse detected, revoked session of user %s with client %s", family.UserID, client.ID))
+	}
+	if err != nil {
+		return OAuthTokens{}, &OAuthError{Code: "invalid_grant", Description: err.Error()}
+	}
+	if _, err := im.activeUser(ctx, family.UserID); err != nil {
+		if err := im.refresh.revoke(next); err != nil {
+			im.log.Error(fmt.Sprintf("Failed to revoke refresh tokens: %v", err))
+		}
+		return OAuthTokens{}, err
+	}
+	return im.clientTokens(client, family, issuer, next)
+}
+
+// ClientCredentialsToken issues an access token to client itself.
+func (im *IdentityManager) ClientCredentialsToken(client Client, scope, issuer string) (OAuthTokens, error) {
+	if client.Public() || !client.allows(GrantClientCredentials) {
+		return OAuthTokens{}, &OAuthError{Code: "unauthorized_client", Description: "client may not use the client_credentials grant"}
+	}
+	if err := checkScope(client, scope); err != nil {
+		return OAuthTokens{}, err
+	}
+	access, err := im.signer.Sign(im.clientAccessClaims(client.ID, client.ID, scope, issuer))
+	if err != nil {
+		return OAuthTokens{}, err
+	}
+	im.log.Info(fmt.Sprintf("Client %s obtained a client_credentials token", client.ID))
+	return OAuthTokens{
+		AccessToken: access,
+		TokenType:   "Bearer",
+		ExpiresIn:   int(im.tokens.accessTTL.Seconds()),
+		Scope:       scope,
+	}, nil
+}
+
+// clientTokens issues an access token for the user and scope of session to
+// client and, if the client may refresh, a refresh token: refresh if
+// rotating, or a new family.
+func (im *IdentityManager) clientTokens(client Client, session refreshFamily, issuer, refresh string) (OAuthTokens, error) {
+	claims := im.clientAccessClaims(session.UserID, client.ID, session.Scope, issuer)
+	claims.AMR = session.AMR
+	access, err := im.signer.Sign(claims)
+	if err != nil {
+		return OAuthTokens{}, err
+	}
+	tokens := OAuthTokens{
+		AccessToken:  access,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(im.tokens.accessTTL.Seconds()),
+		RefreshToken: refresh,
+		Scope:        session.Scope,
+	}
+	if refresh == "" && client.allows(GrantRefreshToken) {
+		if tokens.RefreshToken, err = im.refresh.start(session, im.tokens.refreshTTL); err != nil {
+			return OAuthTokens{}, err
+		}
+	}
+	return tokens, nil
+}
+
+func (im *IdentityManager) clientAccessClaims(subject, clientID, scope, issuer string) Claims {
+	now := time.Now()
+	return Claims{
+		Issuer:    issuer,
+		Subject:   subject,
+		Audience:  im.tokens.audience,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(im.tokens.accessTTL).Unix(),
+		ID:        uuid.New().String(),
+		Scope:     scope,
+		ClientID:  clientID,
+	}
+}
+
+// activeUser returns the user with ID id if it exists and may log in.
+func (im *IdentityManager) activeUser(ctx context.Context, id string) (User, error) {
+	db, err := im.loadDatabase(ctx)
+	if err != nil {
+		return User{}, err
+	}
+	user, exists := db.Users[id]
+	if !exists || user.Status != StatusActive {
+		return User{}, &OAuthError{Code: "invalid_grant", Description: "the user no longer exists or is not active"}
+	}
+	return user, nil
+}
+
+// UserInfo returns the claims about the user an access token was issued for,
+// limited to the token's scopes.
+func (im *IdentityManager) UserInfo(ctx context.Context, accessToken string) (map[string]interface{}, error) {
+	claims, err := im.VerifyAccessToken(accessToken)
+	if err != nil {
+		return nil, &OAuthError{Code: "invalid_token", Description: err.Error()}
+	}
+	if claims.ClientID != "" && !hasScope(claims.Scope, ScopeOpenID) {
+		return nil, &OAuthError{Code: "insufficient_scope", Description: "the openid scope is required"}
+	}
+	db, err := im.loadDatabase(ctx)
+	if err != nil {
+		return nil, err
+	}
+	user, exists := db.Users[claims.Subject]
+	if !exists || user.Status != StatusActive {
+		return nil, &OAuthError{Code: "invalid_token", Description: "the token does not belong to an active user"}
+	}
+
+	info := map[string]interface{}{"sub": user.ID}
+	if claims.ClientID == "" || hasScope(claims.Scope, ScopeProfile) {
+		info["preferred_username"] = user.Username
+		info["updated_at"] = user.UpdatedAt.Unix()
+	}
+	return info, nil
+}
+
+// JWKS returns the JSON Web Key Set with the public key tokens are signed with.
+func (im *IdentityManager) JWKS() map[string]interface{} {
+	return map[string]interface{}{"keys": []interface{}{im.signer.PublicJWK()}}
+}
+
+// PublicJWK returns the public key of s as a JSON Web Key.
+func (s *Signer) PublicJWK() map[string]string {
+	jwk := map[string]string{"kid": s.kid, "alg": s.alg, "use": "sig"}
+	switch pub := s.key.Public().(type) {
+	case ed25519.PublicKey:
+		jwk["kty"] = "OKP"
+		jwk["crv"] = "Ed25519"
+		jwk["x"] = base64.RawURLEncoding.EncodeToString(pub)
+	case *ecdsa.PublicKey:
+		x, y := make([]byte, 32), make([]byte, 32)
+		pub.X.FillBytes(x)
+		pub.Y.FillBytes(y)
+		jwk["kty"] = "EC"
+		jwk["crv"] = "P-256"
+		jwk["x"] = base64.RawURLEncoding.EncodeToString(x)
+		jwk["y"] = base64.RawURLEncoding.EncodeToString(y)
+	}
+	return jwk
+}
+
+// Alg returns the JWS algorithm s signs with.
+func (s *Signer) Alg() string {
+	return s.alg
+}
+
+// SigningAlg returns the JWS algorithm tokens are signed with.
+func (im *IdentityManager) SigningAlg() string {
+	return im.signer.Alg()
+}
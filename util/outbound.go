@@ -0,0 +1,97 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"syscall"
+	"time"
+)
+
+// maxFetchSize bounds documents fetched from URLs in untrusted input.
+const maxFetchSize = 1 << 20
+
+// publicClient fetches URLs taken from untrusted input, such as the status
+// list of a credential posted for verification or the did:web of its issuer.
+// It only connects to public addresses over HTTPS, so such URLs cannot reach
+// the service's own network, and gives up after 10 seconds. Proxies are not
+// used, as the address checked would be the proxy's.
+var publicClient = &http.Client{
+	Timeout: 10 * time.Second,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: 5 * time.Second,
+			Control: dialPublic,
+		}).DialContext,
+		TLSHandshakeTimeout: 5 * time.Second,
+		ForceAttemptHTTP2:   true,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if req.URL.Scheme != "https" {
+			return errors.New("refusing to follow a redirect away from HTTPS")
+		}
+		if len(via) >= 3 {
+			return errors.New("too many redirects")
+		}
+		return nil
+	},
+}
+
+// cgnat is the shared address space of RFC 6598, private in all but name.
+var cgnat = netip.MustParsePrefix("100.64.0.0/10")
+
+// dialPublic refuses connections to loopback, private, link-local and other
+// addresses that are not globally routable. It runs after name resolution,
+// so a public name pointing at an internal address is refused as well.
+func dialPublic(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return err
+	}
+	if !publicAddr(ip) {
+		return fmt.Errorf("refusing to connect to non-public address %s", ip)
+	}
+	return nil
+}
+
+// publicAddr reports whether ip is a globally routable unicast address.
+func publicAddr(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	return ip.IsGlobalUnicast() && !ip.IsPrivate() && !cgnat.Contains(ip)
+}
+
+// fetchPublic GETs url with publicClient and returns the body, which must be
+// at most maxFetchSize bytes.
+func fetchPublic(ctx context.Context, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if req.URL.Scheme != "https" {
+		return nil, fmt.Errorf("%s is not an HTTPS URL", url)
+	}
+	resp, err := publicClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %s returned %s", url, resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxFetchSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxFetchSize {
+		return nil, fmt.Errorf("%s is larger than %d bytes", url, maxFetchSize)
+	}
+	return data, nil
+}
@@ -0,0 +1,309 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Policy effects.
+const (
+	EffectAllow = "allow"
+	EffectDeny  = "deny"
+)
+
+// Permissions for managing policies and asking for decisions.
+const (
+	PermPoliciesManage = "policies:manage"
+	PermAuthzCheck     = "authz:check"
+)
+
+// Policy is an attribute-based authorization rule. It applies to requests for
+// one of its actions and takes effect when its condition, an expression in
+// the language described in expr.go, evaluates to true. An empty condition
+// always holds.
+type Policy struct {
+	ID          string    `json:"id"`
+	Description string    `json:"description,omitempty"`
+	Effect      string    `json:"effect"`
+	Actions     []string  `json:"actions"` // Exact names, "prefix:*" or "*"
+	Condition   string    `json:"condition,omitempty"`
+	Version     int       `json:"version"`
+	UpdatedAt   time.Time `json:"updated_at"`
+	UpdatedBy   string    `json:"updated_by,omitempty"`
+}
+
+func (p Policy) canonical() Policy {
+	p.UpdatedAt = p.UpdatedAt.UTC()
+	return p
+}
+
+// validate checks the policy's shape and compiles its condition.
+func (p Policy) validate() error {
+	if !policyID.MatchString(p.ID) {
+		return errors.New("policy id must be 1-64 letters, digits, '.', '-' or '_'")
+	}
+	if p.Effect != EffectAllow && p.Effect != EffectDeny {
+		return fmt.Errorf("effect must be %q or %q", EffectAllow, EffectDeny)
+	}
+	if len(p.Actions) == 0 {
+		return errors.New("a policy needs at least one action")
+	}
+	if p.Condition != "" {
+		if _, err := compileExpr(p.Condition); err != nil {
+			return fmt.Errorf("invalid condition: %w", err)
+		}
+	}
+	return nil
+}
+
+// appliesTo reports whether the policy covers action.
+func (p Policy) appliesTo(action string) bool {
+	for _, pattern := range p.Actions {
+		if pattern == "*" || pattern == action {
+			return true
+		}
+		if prefix, ok := strings.CutSuffix(pattern, "*"); ok && strings.HasPrefix(action, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+var policyID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// AuthzRequest asks whether subject may perform action on resource.
+type AuthzRequest struct {
+	Subject     map[string]interface{} `json:"subject"`
+	Resource    map[string]interface{} `json:"resource"`
+	Action      string                 `json:"action"`
+	Environment map[string]interface{} `json:"environment"`
+}
+
+// PolicyTrace records how one policy was evaluated, for explain mode.
+type PolicyTrace struct {
+	ID      string `json:"id"`
+	Version int    `json:"version"`
+	Effect  string `json:"effect"`
+	Applies bool   `json:"applies"` // The policy covers the action
+	Matched bool   `json:"matched"` // Its condition held
+	Error   string `json:"error,omitempty"`
+}
+
+// AuthzDecision is the outcome of an AuthzRequest.
+type AuthzDecision struct {
+	Allowed bool   `json:"allowed"`
+	Policy  string `json:"policy,omitempty"` // The policy that decided, if any
+	Reason  string `json:"reason"`
+
+	// Explain mode only.
+	Attributes map[string]interface{} `json:"attributes,omitempty"`
+	Trace      []PolicyTrace          `json:"trace,omitempty"`
+}
+
+// Policies lists the stored policies, sorted by ID.
+func (im *IdentityManager) Policies(ctx context.Context) ([]Policy, error) {
+	db, err := im.loadDatabase(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return sortedPolicies(db), nil
+}
+
+func sortedPolicies(db *database) []Policy {
+	policies := make([]Policy, 0, len(db.Policies))
+	for _, p := range db.Policies {
+		policies = append(policies, p)
+	}
+	sort.Slice(policies, func(i, j int) bool { return policies[i].ID < policies[j].ID })
+	return policies
+}
+
+// PutPolicy creates policy or replaces the stored policy with the same ID as
+// its next version, and returns the stored policy.
+func (im *IdentityManager) PutPolicy(ctx context.Context, actor Principal, policy Policy) (Policy, error) {
+	if err := im.mode.checkWrite(); err != nil {
+		return Policy{}, err
+	}
+	if err := policy.validate(); err != nil {
+		return Policy{}, err
+	}
+	db, err := im.loadDatabase(ctx)
+	if err != nil {
+		return Policy{}, err
+	}
+
+	// The version is fixed here so the ledger records it; apply rejects the
+	// write if another one got in first.
+	policy.Version = db.Policies[policy.ID].Version + 1
+	policy.UpdatedAt = time.Now()
+	policy.UpdatedBy = actor.String()
+	err = im.batch.submit(ctx, mutation{Op: opPutPolicy, ID: policy.ID, Policy: &policy, Actor: actor.String(), At: policy.UpdatedAt})
+	if err != nil {
+		return Policy{}, err
+	}
+	im.log.Info(fmt.Sprintf("Policy %s version %d stored by %s", policy.ID, policy.Version, actor))
+	return policy, nil
+}
+
+// DeletePolicy removes the policy with the given ID.
+func (im *IdentityManager) DeletePolicy(ctx context.Context, actor Principal, id string) error {
+	if err := im.mode.checkWrite(); err != nil {
+		return err
+	}
+	if err := im.batch.submit(ctx, mutation{Op: opDeletePolicy, ID: id, Actor: actor.String(), At: time.Now()}); err != nil {
+		return err
+	}
+	im.log.Info(fmt.Sprintf("Policy %s deleted by %s", id, actor))
+	return nil
+}
+
+// PolicyRevision is one stored version, or the deletion, of a policy.
+type PolicyRevision struct {
+	Policy  *Policy   `json:"policy,omitempty"` // nil for a deletion
+	Deleted bool      `json:"deleted,omitempty"`
+	At      time.Time `json:"at"`
+	Actor   string    `json:"actor"`
+	Entry   string    `json:"entry,omitempty"` // CID of the ledger entry; empty while queued in the WAL
+}
+
+// PolicyHistory returns up to limit revisions of the policy with the given ID,
+// newest first, read from the WAL and the ledger, and the cursor of the next
+// page; see scanHistory.
+func (im *IdentityManager) PolicyHistory(ctx context.Context, id string, limit int, cursor string) ([]PolicyRevision, string, error) {
+	revisions := []PolicyRevision{}
+	next, err := im.scanHistory(ctx, cursor, func(m mutation, entry string) bool {
+		if m.ID != id || (m.Op != opPutPolicy && m.Op != opDeletePolicy) {
+			return true
+		}
+		revisions = append(revisions, PolicyRevision{
+			Policy:  m.Policy,
+			Deleted: m.Op == opDeletePolicy,
+			At:      m.At,
+			Actor:   m.Actor,
+			Entry:   entry,
+		})
+		return len(revisions) < limit
+	})
+	return revisions, next, err
+}
+
+// Authorize evaluates req against the stored policies. Deny policies take
+// precedence over allow policies, and requests no policy allows are denied.
+// A condition that fails to evaluate, for instance because the caller left out
+// an attribute it uses, fails closed: an allow policy does not match and a
+// deny policy denies. With explain set, the decision includes the attributes
+// used and a trace of every policy.
+func (im *IdentityManager) Authorize(ctx context.Context, req AuthzRequest, explain bool) (AuthzDecision, error) {
+	return im.authorize(ctx, req, explain, time.Now())
+}
+
+func (im *IdentityManager) authorize(ctx context.Context, req AuthzRequest, explain bool, now time.Time) (AuthzDecision, error) {
+	if err := im.mode.checkRead(); err != nil {
+		return AuthzDecision{}, err
+	}
+	if req.Action == "" {
+		return AuthzDecision{}, errors.New("action is required")
+	}
+	db, err := im.loadDatabase(ctx)
+	if err != nil {
+		return AuthzDecision{}, err
+	}
+
+	vars := map[string]interface{}{
+		"subject":  subjectAttributes(db, req.Subject),
+		"resource": orEmpty(req.Resource),
+		"action":   req.Action,
+		"env":      environmentAttributes(req.Environment, now),
+	}
+
+	decision := AuthzDecision{Reason: fmt.Sprintf("no policy allows %q", req.Action)}
+	var allowedBy *Policy
+	for _, policy := range sortedPolicies(db) {
+		trace := PolicyTrace{ID: policy.ID, Version: policy.Version, Effect: policy.Effect, Applies: policy.appliesTo(req.Action)}
+		if trace.Applies {
+			trace.Matched = true
+			if policy.Condition != "" {
+				matched, err := evalCondition(policy.Condition, vars)
+				if err != nil {
+					// Fail closed: the deny might have held had the
+					// attributes been there.
+					trace.Error = err.Error()
+					matched = policy.Effect == EffectDeny
+				}
+				trace.Matched = matched
+			}
+		}
+		if explain {
+			decision.Trace = append(decision.Trace, trace)
+		}
+		if !trace.Matched {
+			continue
+		}
+		if policy.Effect == EffectDeny && decision.Policy == "" {
+			decision.Policy = policy.ID
+			decision.Reason = fmt.Sprintf("denied by policy %q version %d", policy.ID, policy.Version)
+			if trace.Error != "" {
+				decision.Reason += fmt.Sprintf(", whose condition failed to evaluate: %s", trace.Error)
+			}
+		}
+		if policy.Effect == EffectAllow && allowedBy == nil {
+			allowedBy = &policy
+		}
+	}
+	if decision.Policy == "" && allowedBy != nil {
+		decision.Allowed = true
+		decision.Policy = allowedBy.ID
+		decision.Reason = fmt.Sprintf("allowed by policy %q version %d", allowedBy.ID, allowedBy.Version)
+	}
+	if explain {
+		decision.Attributes = vars
+	}
+	return decision, nil
+}
+
+// subjectAttributes returns the caller-supplied subject attributes. If they
+// name a stored user by id, the stored username, status, roles and
+// permissions replace any supplied values, so callers cannot claim them.
+func subjectAttributes(db *database, supplied map[string]interface{}) map[string]interface{} {
+	attrs := make(map[string]interface{}, len(supplied)+4)
+	for k, v := range supplied {
+		attrs[k] = v
+	}
+	id, _ := attrs["id"].(string)
+	if user, exists := db.Users[id]; exists {
+		attrs["username"] = user.Username
+		attrs["status"] = user.Status
+		attrs["roles"] = normalize(append([]string{}, user.Roles...))
+		attrs["permissions"] = normalize(permissionsOf(db, user))
+	}
+	return attrs
+}
+
+// environmentAttributes adds the server's current time to the supplied
+// environment attributes: env.time (RFC 3339), env.unix, env.hour (0-23) and
+// env.weekday (0 is Sunday), all in UTC. Supplied values for these are
+// ignored, so callers cannot move themselves into business hours.
+func environmentAttributes(supplied map[string]interface{}, now time.Time) map[string]interface{} {
+	attrs := make(map[string]interface{}, len(supplied)+4)
+	for k, v := range supplied {
+		attrs[k] = v
+	}
+	now = now.UTC()
+	attrs["time"] = now.Format(time.RFC3339)
+	attrs["unix"] = float64(now.Unix())
+	attrs["hour"] = float64(now.Hour())
+	attrs["weekday"] = float64(now.Weekday())
+	return attrs
+}
+
+func orEmpty(m map[string]interface{}) map[string]interface{} {
+	if m == nil {
+		return map[string]interface{}{}
+	}
+	return m
+}
@@ -0,0 +1,95 @@
+package util
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestAuthorize checks the rule that role checks alone could not express:
+// support may reset passwords only in their own tenant and only during
+// business hours.
+func TestAuthorize(t *testing.T) {
+	ctx := context.Background()
+	im := newTestManager(t, newTestNode(t))
+	admin := Principal{ID: "admin", Kind: PrincipalUser}
+	for _, p := range []Policy{
+		{ID: "support-reset", Effect: EffectAllow, Actions: []string{"users:reset_password"},
+			Condition: `"support" in subject.groups && subject.tenant == resource.tenant`},
+		{ID: "after-hours", Effect: EffectDeny, Actions: []string{"users:*"},
+			Condition: `env.hour < 9 || env.hour >= 17`},
+		{ID: "docs-read", Effect: EffectAllow, Actions: []string{"docs:read"}},
+		{ID: "clearance", Effect: EffectDeny, Actions: []string{"docs:*"},
+			Condition: `subject.clearance < resource.level`},
+		{ID: "broken-allow", Effect: EffectAllow, Actions: []string{"files:read"},
+			Condition: `subject.tenant > 3`},
+	} {
+		if _, err := im.PutPolicy(ctx, admin, p); err != nil {
+			t.Fatalf("PutPolicy %s: %v", p.ID, err)
+		}
+	}
+
+	support := map[string]interface{}{"groups": []interface{}{"support"}, "tenant": "acme"}
+	tests := []struct {
+		name       string
+		subject    map[string]interface{}
+		resource   map[string]interface{}
+		action     string
+		hour       int                    // Server time
+		env        map[string]interface{} // Supplied by the caller
+		want       bool
+		wantPolicy string
+		failed     string // Policy whose condition should fail to evaluate
+	}{
+		{"own tenant in hours", support, map[string]interface{}{"tenant": "acme"}, "users:reset_password", 10, nil, true, "support-reset", ""},
+		{"other tenant", support, map[string]interface{}{"tenant": "globex"}, "users:reset_password", 10, nil, false, "", ""},
+		{"after hours", support, map[string]interface{}{"tenant": "acme"}, "users:reset_password", 20, nil, false, "after-hours", ""},
+		{"supplied hour ignored", support, map[string]interface{}{"tenant": "acme"}, "users:reset_password", 20,
+			map[string]interface{}{"hour": 10, "time": "2024-01-01T10:00:00Z", "unix": 1704103200, "weekday": 1}, false, "after-hours", ""},
+		{"other action", support, map[string]interface{}{"tenant": "acme"}, "users:delete", 10, nil, false, "", ""},
+		{"not support", map[string]interface{}{"tenant": "acme"}, map[string]interface{}{"tenant": "acme"}, "users:reset_password", 10, nil, false, "", ""},
+		{"cleared", map[string]interface{}{"clearance": 3}, map[string]interface{}{"level": 2}, "docs:read", 10, nil, true, "docs-read", ""},
+		{"not cleared", map[string]interface{}{"clearance": 1}, map[string]interface{}{"level": 2}, "docs:read", 10, nil, false, "clearance", ""},
+		// Leaving out an attribute a deny uses must not skip the deny.
+		{"clearance left out", map[string]interface{}{}, map[string]interface{}{"level": 2}, "docs:read", 10, nil, false, "clearance", "clearance"},
+		{"broken allow", support, nil, "files:read", 10, nil, false, "", "broken-allow"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now := time.Date(2024, 1, 1, tt.hour, 30, 0, 0, time.UTC)
+			decision, err := im.authorize(ctx, AuthzRequest{
+				Subject:     tt.subject,
+				Resource:    tt.resource,
+				Action:      tt.action,
+				Environment: tt.env,
+			}, true, now)
+			if err != nil {
+				t.Fatalf("Authorize: %v", err)
+			}
+			if decision.Allowed != tt.want || decision.Policy != tt.wantPolicy {
+				t.Errorf("decision = %v by %q (%s), want %v by %q", decision.Allowed, decision.Policy, decision.Reason, tt.want, tt.wantPolicy)
+			}
+			if len(decision.Trace) != 5 {
+				t.Fatalf("trace has %d policies, want 5", len(decision.Trace))
+			}
+			// A condition that fails to evaluate says why, and only
+			// matches if it denies.
+			for _, trace := range decision.Trace {
+				if (trace.Error != "") != (trace.ID == tt.failed) {
+					t.Errorf("trace of %s has error %q", trace.ID, trace.Error)
+				}
+				if trace.Error != "" && trace.Matched != (trace.Effect == EffectDeny) {
+					t.Errorf("failed %s policy %s matched = %v", trace.Effect, trace.ID, trace.Matched)
+				}
+			}
+			if tt.failed == "clearance" && !strings.Contains(decision.Reason, "failed to evaluate") {
+				t.Errorf("reason %q does not say the condition failed", decision.Reason)
+			}
+			env := decision.Attributes["env"].(map[string]interface{})
+			if env["hour"] != float64(tt.hour) || env["time"] != now.Format(time.RFC3339) {
+				t.Errorf("env = %v, want the server time", env)
+			}
+		})
+	}
+}
@@ -0,0 +1,195 @@
+package util
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"ipfs-identity/did"
+)
+
+// ProfileUpdateType is the type of a signed profile update document.
+const ProfileUpdateType = "ProfileUpdate"
+
+// profileUpdateFields are the changes a signed update may make. update_key
+// replaces the key later updates must be signed with, or removes it when
+// empty.
+var profileUpdateFields = map[string]bool{"username": true, "update_key": true}
+
+// ProfileUpdate is a change to a user's profile as recorded in the ledger.
+// Signed updates carry the document the user signed; the registration of the
+// first update key, which needs no signature, has none.
+type ProfileUpdate struct {
+	Sequence int                    `json:"sequence"`           // 0 for the registration of the first key
+	Document json.RawMessage        `json:"document,omitempty"` // As signed: a JWS string or an object with a proof
+	Changes  map[string]interface{} `json:"changes"`
+	Actor    string                 `json:"actor"`
+	At       time.Time              `json:"at"`
+	Entry    string                 `json:"entry,omitempty"` // CID of the ledger entry; empty while queued in the WAL
+}
+
+// RegisterUpdateKey registers the Ed25519 key, as a Multikey, that the user
+// with ID id will sign profile updates with. From then on the username can
+// only be changed by a signed update, and the key only replaced by one signed
+// with it.
+func (im *IdentityManager) RegisterUpdateKey(ctx context.Context, actor Principal, id, publicKeyMultibase string) error {
+	if err := im.mode.checkWrite(); err != nil {
+		return err
+	}
+	if _, err := did.DecodeMultikey(publicKeyMultibase); err != nil {
+		return err
+	}
+	err := im.batch.submit(ctx, mutation{Op: opSetUpdateKey, ID: id, UpdateKey: &publicKeyMultibase, Actor: actor.String(), At: time.Now()})
+	if err != nil {
+		return err
+	}
+	im.log.Info(fmt.Sprintf("Update key of user %s registered by %s", id, actor))
+	return nil
+}
+
+// ApplySignedUpdate verifies a profile update document signed with the
+// user's update key and applies it. The document is a JSON object
+//
+//	{"type": "ProfileUpdate", "user": "<id>", "sequence": N, "changes": {"username": "..."}}
+//
+// either signed as a compact EdDSA JWS, given as a JSON string, or carrying an
+// eddsa-jcs-2022 proof for assertionMethod by the did:key of the update key.
+// sequence must be one more than that of the user's last signed update, so
+// documents cannot be replayed or reordered. The document is stored in the
+// ledger as it was received.
+func (im *IdentityManager) ApplySignedUpdate(ctx context.Context, actor Principal, id string, signed json.RawMessage) (*ProfileUpdate, error) {
+	if err := im.mode.checkWrite(); err != nil {
+		return nil, err
+	}
+	db, err := im.loadDatabase(ctx)
+	if err != nil {
+		return nil, err
+	}
+	user, exists := db.Users[id]
+	if !exists {
+		return nil, errors.New("user not found")
+	}
+	if user.UpdateKey == "" {
+		return nil, errors.New("user has no update key registered")
+	}
+	key, err := did.DecodeMultikey(user.UpdateKey)
+	if err != nil {
+		return nil, err
+	}
+	doc, err := im.verifyProfileUpdate(ctx, signed, key)
+	if err != nil {
+		return nil, err
+	}
+
+	if doc["type"] != ProfileUpdateType {
+		return nil, fmt.Errorf("document type must be %s", ProfileUpdateType)
+	}
+	if doc["user"] != id {
+		return nil, errors.New("document is for another user")
+	}
+	sequence, ok := doc["sequence"].(float64)
+	if !ok || sequence != float64(user.UpdateSequence+1) {
+		return nil, fmt.Errorf("sequence must be %d", user.UpdateSequence+1)
+	}
+	changes, ok := doc["changes"].(map[string]interface{})
+	if !ok || len(changes) == 0 {
+		return nil, errors.New("document has no changes")
+	}
+	m := mutation{Op: opSignedUpdate, ID: id, Sequence: int(sequence), SignedUpdate: signed, Actor: actor.String(), At: time.Now()}
+	for field, value := range changes {
+		if !profileUpdateFields[field] {
+			return nil, fmt.Errorf("%s cannot be changed by a signed update", field)
+		}
+		s, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("%s must be a string", field)
+		}
+		switch field {
+		case "username":
+			if s == "" {
+				return nil, errors.New("username cannot be empty")
+			}
+			m.Username = s
+		case "update_key":
+			if s != "" {
+				if _, err := did.DecodeMultikey(s); err != nil {
+					return nil, err
+				}
+			}
+			m.UpdateKey = &s
+		}
+	}
+
+	if err := im.batch.submit(ctx, m); err != nil {
+		return nil, err
+	}
+	im.log.Info(fmt.Sprintf("Signed update %d of user %s applied", m.Sequence, id))
+	return &ProfileUpdate{Sequence: m.Sequence, Document: signed, Changes: changes, Actor: m.Actor, At: m.At}, nil
+}
+
+// verifyProfileUpdate checks the signature of a profile update with key and
+// returns the document.
+func (im *IdentityManager) verifyProfileUpdate(ctx context.Context, signed json.RawMessage, key ed25519.PublicKey) (map[string]interface{}, error) {
+	var token string
+	if json.Unmarshal(signed, &token) == nil {
+		parts := strings.Split(token, ".")
+		if len(parts) != 3 {
+			return nil, errors.New("malformed JWS")
+		}
+		headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+		if err != nil {
+			return nil, errors.New("malformed JWS header")
+		}
+		var header jwtHeader
+		if err := json.Unmarshal(headerJSON, &header); err != nil || header.Alg != AlgEdDSA {
+			return nil, errors.New("JWS must be signed with EdDSA")
+		}
+		sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+		if err != nil || !ed25519.Verify(key, []byte(parts[0]+"."+parts[1]), sig) {
+			return nil, errors.New("invalid signature")
+		}
+		return decodeUnverifiedClaims(token)
+	}
+
+	var doc map[string]interface{}
+	if err := json.Unmarshal(signed, &doc); err != nil {
+		return nil, errors.New("update must be a JWS string or a JSON object with a proof")
+	}
+	signer, err := im.verifyProof(ctx, doc, "assertionMethod", nil)
+	if err != nil {
+		return nil, err
+	}
+	if signer != did.KeyDID(key) {
+		return nil, errors.New("update was not signed with the registered update key")
+	}
+	delete(doc, "proof")
+	return doc, nil
+}
+
+// ProfileUpdates returns up to limit profile updates of the user with ID id,
+// newest first, read from the WAL and the ledger, and the cursor of the next
+// page; see scanHistory. A page may hold fewer than limit updates even though
+// more follow.
+func (im *IdentityManager) ProfileUpdates(ctx context.Context, id string, limit int, cursor string) ([]ProfileUpdate, string, error) {
+	updates := []ProfileUpdate{}
+	next, err := im.scanHistory(ctx, cursor, func(m mutation, entry string) bool {
+		if m.ID != id || (m.Op != opSignedUpdate && m.Op != opSetUpdateKey) {
+			return true
+		}
+		update := ProfileUpdate{Sequence: m.Sequence, Document: m.SignedUpdate, Changes: map[string]interface{}{}, Actor: m.Actor, At: m.At, Entry: entry}
+		if m.Op == opSignedUpdate && m.Username != "" {
+			update.Changes["username"] = m.Username
+		}
+		if m.UpdateKey != nil {
+			update.Changes["update_key"] = *m.UpdateKey
+		}
+		updates = append(updates, update)
+		return len(updates) < limit
+	})
+	return updates, next, err
+}
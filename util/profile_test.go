@@ -0,0 +1,210 @@
+package util
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"ipfs-identity/did"
+)
+
+// signUpdate signs doc with key as a compact EdDSA JWS, given as a JSON
+// string.
+func signUpdate(t *testing.T, key ed25519.PrivateKey, doc map[string]interface{}) json.RawMessage {
+	t.Helper()
+	payload, err := json.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"EdDSA"}`)) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	token, _ := json.Marshal(input + "." + base64.RawURLEncoding.EncodeToString(ed25519.Sign(key, []byte(input))))
+	return token
+}
+
+func TestApplySignedUpdate(t *testing.T) {
+	ctx := context.Background()
+	im := newTestManager(t, newTestNode(t))
+	id, _, err := im.AddUser(ctx, "alice", "secret", "")
+	if err != nil {
+		t.Fatalf("AddUser: %v", err)
+	}
+	bobID, _, err := im.AddUser(ctx, "bob", "secret", "")
+	if err != nil {
+		t.Fatalf("AddUser: %v", err)
+	}
+	pub, key, _ := ed25519.GenerateKey(rand.Reader)
+	_, otherKey, _ := ed25519.GenerateKey(rand.Reader)
+	actor := Principal{ID: id, Kind: PrincipalUser}
+	if err := im.RegisterUpdateKey(ctx, actor, id, did.EncodeMultikey(pub)); err != nil {
+		t.Fatalf("RegisterUpdateKey: %v", err)
+	}
+	update := func(user string, sequence int, username string) map[string]interface{} {
+		return map[string]interface{}{"type": ProfileUpdateType, "user": user, "sequence": sequence, "changes": map[string]interface{}{"username": username}}
+	}
+	first := signUpdate(t, key, update(id, 1, "alice2"))
+
+	tests := []struct {
+		name    string
+		id      string
+		signed  json.RawMessage
+		wantErr bool
+	}{
+		{"other key", id, signUpdate(t, otherKey, update(id, 1, "mallory")), true},
+		{"tampered", id, tamperUpdate(t, first), true},
+		{"other user", id, signUpdate(t, key, update(bobID, 1, "mallory")), true},
+		{"for a user without a key", bobID, signUpdate(t, key, update(bobID, 1, "mallory")), true},
+		{"skipped sequence", id, signUpdate(t, key, update(id, 2, "alice3")), true},
+		{"first", id, first, false},
+		{"replayed", id, first, true},
+		{"next", id, signUpdate(t, key, update(id, 2, "alice3")), false},
+		{"old sequence", id, signUpdate(t, key, update(id, 1, "alice4")), true},
+		{"field not allowed", id, signUpdate(t, key, map[string]interface{}{"type": ProfileUpdateType, "user": id, "sequence": 3, "changes": map[string]interface{}{"password": "x"}}), true},
+	}
+	for _, tt := range tests {
+		_, err := im.ApplySignedUpdate(ctx, actor, tt.id, tt.signed)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: ApplySignedUpdate error = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+
+	db, err := im.loadDatabase(ctx)
+	if err != nil {
+		t.Fatalf("loadDatabase: %v", err)
+	}
+	if user := db.Users[id]; user.Username != "alice3" || user.UpdateSequence != 2 {
+		t.Errorf("user = %s at sequence %d, want alice3 at 2", user.Username, user.UpdateSequence)
+	}
+	if db.Users[bobID].Username != "bob" {
+		t.Errorf("bob was renamed to %s", db.Users[bobID].Username)
+	}
+}
+
+// tamperUpdate changes the username in a signed update without signing it
+// again.
+func tamperUpdate(t *testing.T, signed json.RawMessage) json.RawMessage {
+	t.Helper()
+	var token string
+	json.Unmarshal(signed, &token)
+	parts := strings.Split(token, ".")
+	raw, _ := base64.RawURLEncoding.DecodeString(parts[1])
+	var doc map[string]interface{}
+	json.Unmarshal(raw, &doc)
+	doc["changes"] = map[string]interface{}{"username": "mallory"}
+	raw, _ = json.Marshal(doc)
+	tampered, _ := json.Marshal(parts[0] + "." + base64.RawURLEncoding.EncodeToString(raw) + "." + parts[2])
+	return tampered
+}
+
+// TestHistoryPages checks that history listings read a bounded number of
+// ledger entries per page and that their cursors continue where a page
+// stopped, including in the middle of a batch of writes.
+func TestHistoryPages(t *testing.T) {
+	ctx := context.Background()
+	im := newTestManager(t, newTestNode(t))
+	admin := Principal{ID: "admin", Kind: PrincipalUser}
+	put := func(id, description string) {
+		t.Helper()
+		if _, err := im.PutPolicy(ctx, admin, Policy{ID: id, Effect: EffectAllow, Actions: []string{"docs:read"}, Description: description}); err != nil {
+			t.Fatalf("PutPolicy %s: %v", id, err)
+		}
+	}
+
+	// Revisions of p: v1, then more writes than one page reads, then v2
+	// to v4 in one ledger entry.
+	put("p", "v1")
+	for i := 0; i < historyPageEntries; i++ {
+		put("other", "")
+	}
+	m := func(version int, description string) mutation {
+		return mutation{Op: opPutPolicy, ID: "p", Policy: &Policy{ID: "p", Version: version, Effect: EffectAllow, Actions: []string{"docs:read"}, Description: description}, Actor: admin.String()}
+	}
+	db, err := im.loadDatabase(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch := []mutation{m(2, "v2"), m(3, "v3"), m(4, "v4")}
+	for _, b := range batch {
+		if err := b.apply(db); err != nil {
+			t.Fatalf("apply: %v", err)
+		}
+	}
+	if err := im.commit(ctx, batch, db); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+
+	var got []string
+	var cursor string
+	pages := 0
+	for {
+		revisions, next, err := im.PolicyHistory(ctx, "p", 2, cursor)
+		if err != nil {
+			t.Fatalf("PolicyHistory page %d: %v", pages+1, err)
+		}
+		for _, r := range revisions {
+			got = append(got, r.Policy.Description)
+		}
+		pages++
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	// v4 v3 | v2 and the page limit | v1
+	if want := []string{"v4", "v3", "v2", "v1"}; len(got) != len(want) || got[0] != want[0] || got[1] != want[1] || got[2] != want[2] || got[3] != want[3] {
+		t.Errorf("revisions = %v, want %v", got, want)
+	}
+	if pages != 3 {
+		t.Errorf("read %d pages, want 3", pages)
+	}
+
+	for _, bad := range []string{"bafy:0", cursor + "x", "d2FsOjE.AAAA"} {
+		if _, _, err := im.PolicyHistory(ctx, "p", 2, bad); err != ErrInvalidCursor {
+			t.Errorf("cursor %q: %v, want ErrInvalidCursor", bad, err)
+		}
+	}
+}
+
+func TestHistoryPagesFromWAL(t *testing.T) {
+	t.Setenv("WAL_SYNC_INTERVAL", "1h")
+	ctx := context.Background()
+	store := &flakyStore{Store: newTestNode(t)}
+	im := newTestManager(t, store)
+	admin := Principal{ID: "admin", Kind: PrincipalUser}
+	for version := 1; version <= 4; version++ {
+		// v1 reaches IPFS; the rest are queued.
+		store.down.Store(version > 1)
+		policy := Policy{ID: "p", Effect: EffectAllow, Actions: []string{"docs:read"}, Description: fmt.Sprintf("v%d", version)}
+		if _, err := im.PutPolicy(ctx, admin, policy); err != nil {
+			t.Fatalf("PutPolicy v%d: %v", version, err)
+		}
+	}
+
+	store.down.Store(false)
+	var got []string
+	var entries []string
+	cursor := ""
+	for pages := 0; pages < 3; pages++ {
+		revisions, next, err := im.PolicyHistory(ctx, "p", 2, cursor)
+		if err != nil {
+			t.Fatalf("PolicyHistory: %v", err)
+		}
+		for _, r := range revisions {
+			got = append(got, r.Policy.Description)
+			entries = append(entries, r.Entry)
+		}
+		if cursor = next; cursor == "" {
+			break
+		}
+	}
+	if fmt.Sprint(got) != "[v4 v3 v2 v1]" || cursor != "" {
+		t.Errorf("revisions = %v, cursor %q; want [v4 v3 v2 v1] and the end", got, cursor)
+	}
+	if entries[2] != "" || entries[3] == "" {
+		t.Errorf("entries = %q; want queued revisions without one", entries)
+	}
+}
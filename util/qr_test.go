@@ -0,0 +1,340 @@
+package util
+
+import (
+	"bytes"
+	"fmt"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+// qrBlockLayout is the level M block structure of each version, from table 9
+// of ISO/IEC 18004: the error correction codewords per block and the data
+// codewords of each block, in order.
+var qrBlockLayout = [11]struct {
+	ecc    int
+	blocks []int
+}{
+	1:  {10, []int{16}},
+	2:  {16, []int{28}},
+	3:  {26, []int{44}},
+	4:  {18, []int{32, 32}},
+	5:  {24, []int{43, 43}},
+	6:  {16, []int{27, 27, 27, 27}},
+	7:  {18, []int{31, 31, 31, 31}},
+	8:  {22, []int{38, 38, 39, 39}},
+	9:  {22, []int{36, 36, 36, 37, 37}},
+	10: {26, []int{43, 43, 43, 43, 44}},
+}
+
+func TestQRCapacity(t *testing.T) {
+	raw := [11]int{1: 208, 359, 567, 807, 1079, 1383, 1568, 1936, 2336, 2768}
+	for v := 1; v <= 10; v++ {
+		if got := qrRawModules(v); got != raw[v] {
+			t.Errorf("qrRawModules(%d) = %d, want %d", v, got, raw[v])
+		}
+		data := 0
+		for _, n := range qrBlockLayout[v].blocks {
+			data += n
+		}
+		if got := qrDataCodewords(v); got != data {
+			t.Errorf("qrDataCodewords(%d) = %d, want %d", v, got, data)
+		}
+		// Every module that is not a function module carries a codeword bit,
+		// except for the remainder bits.
+		free := 0
+		qr := newQRCode(v)
+		for y := range qr.function {
+			for x := range qr.function[y] {
+				if !qr.function[y][x] {
+					free++
+				}
+			}
+		}
+		if free != raw[v] {
+			t.Errorf("version %d has %d data modules, want %d", v, free, raw[v])
+		}
+	}
+}
+
+func TestQRVersion(t *testing.T) {
+	tests := []struct {
+		length  int
+		version int // 0 for too long
+	}{
+		{0, 1},
+		{14, 1},
+		{15, 2},
+		{26, 2},
+		{27, 3},
+		{122, 7},
+		{123, 8},
+		{180, 9},
+		{181, 10}, // Needs the 16-bit length of version 10 and up
+		{213, 10},
+		{214, 0},
+	}
+	for _, tt := range tests {
+		qr, err := encodeQR(bytes.Repeat([]byte{'a'}, tt.length))
+		if tt.version == 0 {
+			if err == nil {
+				t.Errorf("%d bytes: got a version %d symbol, want an error", tt.length, (qr.size-17)/4)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%d bytes: %v", tt.length, err)
+			continue
+		}
+		if want := 4*tt.version + 17; qr.size != want {
+			t.Errorf("%d bytes: size %d, want %d (version %d)", tt.length, qr.size, want, tt.version)
+		}
+	}
+}
+
+func TestReedSolomon(t *testing.T) {
+	if got := gfMul(0x80, 2); got != 0x1D {
+		t.Errorf("gfMul(0x80, 2) = %#x, want 0x1d", got)
+	}
+	if got := gfMul(0x53, 0xCA); got != gfMul(0xCA, 0x53) {
+		t.Errorf("gfMul is not commutative")
+	}
+
+	// The 1-M symbol for "01234567" from annex I of ISO/IEC 18004.
+	data := []byte{0x10, 0x20, 0x0C, 0x56, 0x61, 0x80, 0xEC, 0x11, 0xEC, 0x11, 0xEC, 0x11, 0xEC, 0x11, 0xEC, 0x11}
+	want := []byte{0xA5, 0x24, 0xD4, 0xC1, 0xED, 0x36, 0xC7, 0x87, 0x2C, 0x55}
+	if got := rsRemainder(data, rsDivisor(10)); !bytes.Equal(got, want) {
+		t.Errorf("error correction codewords = % X, want % X", got, want)
+	}
+}
+
+func TestQRFormat(t *testing.T) {
+	// Format information for level M and each mask, after the 0x5412 mask.
+	want := []int{0x5412, 0x5125, 0x5E7C, 0x5B4B, 0x45F9, 0x40CE, 0x4F97, 0x4AA0}
+	for mask, bits := range want {
+		qr := newQRCode(1)
+		qr.drawFormat(mask)
+		first, second := readQRFormat(qr)
+		if first != bits || second != bits {
+			t.Errorf("mask %d: format bits %015b and %015b, want %015b", mask, first, second, bits)
+		}
+	}
+}
+
+func TestQRVersionInformation(t *testing.T) {
+	want := map[int]int{7: 0x07C94, 8: 0x085BC, 9: 0x09A99, 10: 0x0A4D3}
+	for version, bits := range want {
+		qr := newQRCode(version)
+		var below, right int
+		for i := 0; i < 18; i++ {
+			a, b := qr.size-11+i%3, i/3
+			if qr.modules[b][a] {
+				below |= 1 << i
+			}
+			if qr.modules[a][b] {
+				right |= 1 << i
+			}
+		}
+		if below != bits || right != bits {
+			t.Errorf("version %d: version information %018b and %018b, want %018b", version, below, right, bits)
+		}
+	}
+}
+
+// TestQRDecode reads symbols back the way a scanner does and checks that they
+// hold the data, with valid error correction in every block.
+func TestQRDecode(t *testing.T) {
+	inputs := []string{
+		"",
+		"otpauth://totp/ipfs-identity:alice?secret=JBSWY3DPEHPK3PXP&issuer=ipfs-identity",
+		"otpauth://totp/Example%20Corp:alice%40example.com?secret=GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ&issuer=Example%20Corp&algorithm=SHA1&digits=6&period=30",
+		strings.Repeat("\x00\xff", 60),
+		strings.Repeat("x", 213),
+	}
+	for _, input := range inputs {
+		qr, err := encodeQR([]byte(input))
+		if err != nil {
+			t.Errorf("encodeQR(%d bytes): %v", len(input), err)
+			continue
+		}
+		got, err := readQR(qr)
+		if err != nil {
+			t.Errorf("%d bytes: %v", len(input), err)
+			continue
+		}
+		if got != input {
+			t.Errorf("%d bytes: read back %q", len(input), got)
+		}
+	}
+}
+
+func TestQRCodePNG(t *testing.T) {
+	const scale = 3
+	data, err := QRCodePNG([]byte("otpauth://totp/x?secret=AA"), scale)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("png.Decode: %v", err)
+	}
+	side := (25 + 8) * scale // Version 2 and the quiet zone
+	if b := img.Bounds(); b.Dx() != side || b.Dy() != side {
+		t.Fatalf("image is %dx%d, want %dx%d", b.Dx(), b.Dy(), side, side)
+	}
+	dark := func(x, y int) bool {
+		r, _, _, _ := img.At(x, y).RGBA()
+		return r == 0
+	}
+	if dark(4*scale-1, 4*scale-1) {
+		t.Error("quiet zone is dark")
+	}
+	// The corner of the top-left finder pattern, and the light ring inside it.
+	if !dark(4*scale, 4*scale) || !dark(5*scale-1, 5*scale-1) {
+		t.Error("finder pattern corner is light")
+	}
+	if dark(5*scale, 5*scale) {
+		t.Error("finder pattern ring is dark")
+	}
+}
+
+// readQRFormat returns the two copies of the format information.
+func readQRFormat(qr *qrCode) (int, int) {
+	var first, second int
+	bit := func(v *int, i int, x, y int) {
+		if qr.modules[y][x] {
+			*v |= 1 << i
+		}
+	}
+	for i := 0; i <= 5; i++ {
+		bit(&first, i, 8, i)
+	}
+	bit(&first, 6, 8, 7)
+	bit(&first, 7, 8, 8)
+	bit(&first, 8, 7, 8)
+	for i := 9; i < 15; i++ {
+		bit(&first, i, 14-i, 8)
+	}
+	for i := 0; i < 8; i++ {
+		bit(&second, i, qr.size-1-i, 8)
+	}
+	for i := 8; i < 15; i++ {
+		bit(&second, i, 8, qr.size-15+i)
+	}
+	return first, second
+}
+
+// readQR decodes a level M, byte mode symbol.
+func readQR(qr *qrCode) (string, error) {
+	version := (qr.size - 17) / 4
+	first, second := readQRFormat(qr)
+	if first != second {
+		return "", fmt.Errorf("format copies differ: %015b and %015b", first, second)
+	}
+	format := first ^ 0x5412
+	if format>>13 != 0b00 {
+		return "", fmt.Errorf("error correction level %02b, want M", format>>13)
+	}
+	mask := format >> 10 & 7
+	if !qr.modules[qr.size-8][8] {
+		return "", fmt.Errorf("dark module is light")
+	}
+
+	// Unmask and collect the codeword bits, two columns at a time from the
+	// bottom right, alternating upwards and downwards.
+	function := newQRCode(version).function
+	masks := []func(i, j int) bool{
+		func(i, j int) bool { return (i+j)%2 == 0 },
+		func(i, j int) bool { return i%2 == 0 },
+		func(i, j int) bool { return j%3 == 0 },
+		func(i, j int) bool { return (i+j)%3 == 0 },
+		func(i, j int) bool { return (i/2+j/3)%2 == 0 },
+		func(i, j int) bool { return i*j%2+i*j%3 == 0 },
+		func(i, j int) bool { return (i*j%2+i*j%3)%2 == 0 },
+		func(i, j int) bool { return ((i+j)%2+i*j%3)%2 == 0 },
+	}
+	var bits []bool
+	upward := true
+	for col := qr.size - 1; col > 0; col -= 2 {
+		if col == 6 {
+			col--
+		}
+		for k := 0; k < qr.size; k++ {
+			row := k
+			if upward {
+				row = qr.size - 1 - k
+			}
+			for _, x := range []int{col, col - 1} {
+				if !function[row][x] {
+					bits = append(bits, qr.modules[row][x] != masks[mask](row, x))
+				}
+			}
+		}
+		upward = !upward
+	}
+	codewords := make([]byte, len(bits)/8)
+	for i := range codewords {
+		for _, bit := range bits[8*i : 8*i+8] {
+			codewords[i] <<= 1
+			if bit {
+				codewords[i] |= 1
+			}
+		}
+	}
+
+	// De-interleave: data codewords round-robin over the blocks, then error
+	// correction codewords the same way.
+	layout := qrBlockLayout[version]
+	blocks := make([][]byte, len(layout.blocks))
+	next := 0
+	for i := 0; i < layout.blocks[len(layout.blocks)-1]; i++ {
+		for b, n := range layout.blocks {
+			if i < n {
+				blocks[b] = append(blocks[b], codewords[next])
+				next++
+			}
+		}
+	}
+	var data []byte
+	for b := range blocks {
+		data = append(data, blocks[b]...)
+	}
+	for i := 0; i < layout.ecc; i++ {
+		for b := range blocks {
+			blocks[b] = append(blocks[b], codewords[next])
+			next++
+		}
+	}
+	for b, block := range blocks {
+		n := layout.blocks[b]
+		if want := rsRemainder(block[:n], rsDivisor(layout.ecc)); !bytes.Equal(block[n:], want) {
+			return "", fmt.Errorf("block %d has wrong error correction codewords", b)
+		}
+	}
+
+	// Byte mode segment.
+	pos := 0
+	read := func(n int) int {
+		v := 0
+		for i := 0; i < n; i++ {
+			v = v<<1 | int(data[pos/8]>>(7-pos%8)&1)
+			pos++
+		}
+		return v
+	}
+	if mode := read(4); mode != 0b0100 {
+		return "", fmt.Errorf("mode %04b, want byte mode", mode)
+	}
+	countBits := 8
+	if version >= 10 {
+		countBits = 16
+	}
+	out := make([]byte, read(countBits))
+	if 4+countBits+8*len(out) > 8*len(data) {
+		return "", fmt.Errorf("length %d exceeds the symbol", len(out))
+	}
+	for i := range out {
+		out[i] = byte(read(8))
+	}
+	return string(out), nil
+}
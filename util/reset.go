@@ -0,0 +1,225 @@
+package util
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/mail"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ErrInvalidResetToken is returned for a password reset token that is
+// unknown, expired, already used or issued before the password last changed.
+var ErrInvalidResetToken = errors.New("invalid or expired reset token")
+
+// resetToken is an unredeemed password reset token.
+type resetToken struct {
+	UserID    string    `json:"user_id"`
+	Password  string    `json:"password"` // Hash of the password hash the token was issued for
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// resetStore keeps password reset tokens in a local JSON file, keyed by the
+// hash of the token. A user has at most one token at a time.
+type resetStore struct {
+	mu     sync.Mutex
+	path   string
+	ttl    time.Duration
+	tokens map[string]resetToken
+}
+
+func openResetStore(path string, ttl time.Duration) (*resetStore, error) {
+	s := &resetStore{path: path, ttl: ttl, tokens: make(map[string]resetToken)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read reset tokens: %w", err)
+	}
+	if err := json.Unmarshal(data, &s.tokens); err != nil {
+		return nil, fmt.Errorf("failed to parse reset tokens: %w", err)
+	}
+	return s, nil
+}
+
+// save writes the store to disk, dropping expired tokens. Callers must hold
+// s.mu.
+func (s *resetStore) save() error {
+	now := time.Now()
+	for hash, token := range s.tokens {
+		if now.After(token.ExpiresAt) {
+			delete(s.tokens, hash)
+		}
+	}
+	data, err := json.Marshal(s.tokens)
+	if err != nil {
+		return fmt.Errorf("failed to marshal reset tokens: %w", err)
+	}
+	if err := writeFileAtomic(s.path, data); err != nil {
+		return fmt.Errorf("failed to save reset tokens: %w", err)
+	}
+	return nil
+}
+
+// issue returns a new token for user, replacing any earlier one.
+func (s *resetStore) issue(user User) (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", fmt.Errorf("failed to generate reset token: %w", err)
+	}
+	token := base64.RawURLEncoding.EncodeToString(secret)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for hash, t := range s.tokens {
+		if t.UserID == user.ID {
+			delete(s.tokens, hash)
+		}
+	}
+	s.tokens[hashToken(token)] = resetToken{
+		UserID:    user.ID,
+		Password:  hashToken(user.Password),
+		ExpiresAt: time.Now().Add(s.ttl),
+	}
+	return token, s.save()
+}
+
+// take consumes token and returns what it was issued for.
+func (s *resetStore) take(token string) (resetToken, error) {
+	hash := hashToken(token)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, exists := s.tokens[hash]
+	if !exists {
+		return resetToken{}, ErrInvalidResetToken
+	}
+	delete(s.tokens, hash)
+	if err := s.save(); err != nil {
+		return resetToken{}, err
+	}
+	if time.Now().After(t.ExpiresAt) {
+		return resetToken{}, ErrInvalidResetToken
+	}
+	return t, nil
+}
+
+// contactAddress returns the address notifications for user are sent to: the
+// verified email address or else the username, if it is an email address.
+func contactAddress(user User) string {
+	if user.EmailVerified {
+		return user.Email
+	}
+	if addr, err := mail.ParseAddress(user.Username); err == nil && addr.Address == user.Username {
+		return addr.Address
+	}
+	return ""
+}
+
+// RequestPasswordReset sends a reset link for the account named username, or
+// with username as its verified email address. The link is
+// PASSWORD_RESET_URL, or JWT_ISSUER/password/reset, with the token as ?token=;
+// resets are refused if neither is set. The lookup and delivery happen in the
+// background and every outcome is reported the same way, so callers cannot
+// learn whether the account exists.
+func (im *IdentityManager) RequestPasswordReset(ctx context.Context, username string) error {
+	if err := im.mode.checkWrite(); err != nil {
+		return err
+	}
+	link := os.Getenv("PASSWORD_RESET_URL")
+	if link == "" {
+		if im.tokens.issuer == "" {
+			return errors.New("password reset needs PASSWORD_RESET_URL or JWT_ISSUER to be set")
+		}
+		link = im.tokens.issuer + "/password/reset"
+	}
+	go im.sendPasswordReset(username, link)
+	return nil
+}
+
+func (im *IdentityManager) sendPasswordReset(username, link string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	db, err := im.loadDatabase(ctx)
+	if err != nil {
+		im.log.Error(fmt.Sprintf("Password reset for %q failed: %v", username, err))
+		return
+	}
+	user, found := findLogin(db, username)
+	if !found || user.Status != StatusActive {
+		im.log.Info(fmt.Sprintf("Password reset requested for unknown or inactive account %q", username))
+		return
+	}
+	to := contactAddress(user)
+	if to == "" {
+		im.log.Warn(fmt.Sprintf("Password reset requested for user %s, who has no address to send it to", user.ID))
+		return
+	}
+
+	token, err := im.resets.issue(user)
+	if err != nil {
+		im.log.Error(fmt.Sprintf("Password reset for user %s failed: %v", user.ID, err))
+		return
+	}
+	err = im.notifier.Notify(ctx, Notification{
+		To:      to,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Someone asked to reset the password of your account %s.\n\n"+
+			"To choose a new password, open this link within %d minutes:\n\n%s?token=%s\n\n"+
+			"If it was not you, ignore this message; your password has not changed.\n",
+			user.Username, int(im.resets.ttl.Minutes()), link, url.QueryEscape(token)),
+	})
+	if err != nil {
+		im.log.Error(fmt.Sprintf("Failed to deliver password reset for user %s: %v", user.ID, err))
+		return
+	}
+	im.log.Info(fmt.Sprintf("Password reset link sent to user %s", user.ID))
+}
+
+// ResetPassword sets a new password for the user a reset token was issued to.
+// The token is consumed, and only works if the password has not changed since
+// it was issued, up to the moment the write is applied, so a change that
+// races with the reset wins. Every refresh token of the user is revoked.
+func (im *IdentityManager) ResetPassword(ctx context.Context, token, newPassword string) error {
+	if err := im.mode.checkWrite(); err != nil {
+		return err
+	}
+	if newPassword == "" {
+		return errors.New("password is required")
+	}
+	t, err := im.resets.take(token)
+	if err != nil {
+		return err
+	}
+	db, err := im.loadDatabase(ctx)
+	if err != nil {
+		return err
+	}
+	user, exists := db.Users[t.UserID]
+	if !exists || user.Status != StatusActive || hashToken(user.Password) != t.Password {
+		return ErrInvalidResetToken
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(newPassword), bcrypt.DefaultCost)
+	if err != nil {
+		return fmt.Errorf("failed to hash new password: %w", err)
+	}
+	actor := Principal{ID: user.ID, Kind: PrincipalUser}
+	err = im.batch.submit(ctx, mutation{Op: opEditUser, ID: user.ID, Password: string(hashedPassword), ExpectPassword: t.Password, Actor: actor.String(), At: time.Now()})
+	if err != nil {
+		return err
+	}
+	if err := im.refresh.revokeUser(user.ID); err != nil {
+		return err
+	}
+	im.log.Info(fmt.Sprintf("Password of user %s reset", user.ID))
+	return nil
+}
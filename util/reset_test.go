@@ -0,0 +1,109 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestResetPassword(t *testing.T) {
+	t.Setenv("JWT_ISSUER", "https://id.example.com")
+	ctx := context.Background()
+	im := newTestManager(t, newTestNode(t))
+
+	id, err := im.BootstrapAdmin(ctx, "ada", "ada-password")
+	if err != nil {
+		t.Fatalf("BootstrapAdmin: %v", err)
+	}
+	issue := func() string {
+		t.Helper()
+		db, err := im.loadDatabase(ctx)
+		if err != nil {
+			t.Fatalf("loadDatabase: %v", err)
+		}
+		token, err := im.resets.issue(db.Users[id])
+		if err != nil {
+			t.Fatalf("issue: %v", err)
+		}
+		return token
+	}
+
+	t.Run("single use", func(t *testing.T) {
+		token := issue()
+		if err := im.ResetPassword(ctx, token, "first-password"); err != nil {
+			t.Fatalf("ResetPassword: %v", err)
+		}
+		if _, err := im.Login(ctx, "ada", "first-password"); err != nil {
+			t.Errorf("Login with the new password: %v", err)
+		}
+		if _, err := im.Login(ctx, "ada", "ada-password"); err == nil {
+			t.Error("Login with the old password succeeded")
+		}
+		if err := im.ResetPassword(ctx, token, "second-password"); !errors.Is(err, ErrInvalidResetToken) {
+			t.Errorf("second ResetPassword = %v, want ErrInvalidResetToken", err)
+		}
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		ttl := im.resets.ttl
+		im.resets.ttl = -time.Minute
+		token := issue()
+		im.resets.ttl = ttl
+		if err := im.ResetPassword(ctx, token, "expired-password"); !errors.Is(err, ErrInvalidResetToken) {
+			t.Errorf("ResetPassword with an expired token = %v, want ErrInvalidResetToken", err)
+		}
+	})
+
+	t.Run("password changed since", func(t *testing.T) {
+		token := issue()
+		if err := im.EditUser(ctx, id, "", "changed-password"); err != nil {
+			t.Fatalf("EditUser: %v", err)
+		}
+		if err := im.ResetPassword(ctx, token, "stale-password"); !errors.Is(err, ErrInvalidResetToken) {
+			t.Errorf("ResetPassword after a password change = %v, want ErrInvalidResetToken", err)
+		}
+		if _, err := im.Login(ctx, "ada", "changed-password"); err != nil {
+			t.Errorf("Login with the changed password: %v", err)
+		}
+	})
+}
+
+// TestResetPasswordRace checks that a reset checked against one password is
+// not applied over a change that was committed before it.
+func TestResetPasswordRace(t *testing.T) {
+	hash := func(password string) string {
+		t.Helper()
+		h, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+		if err != nil {
+			t.Fatalf("GenerateFromPassword: %v", err)
+		}
+		return string(h)
+	}
+	issuedFor, changed := hash("old"), hash("changed")
+	db := newDatabase()
+	db.Users["ada"] = User{ID: "ada", Username: "ada", Password: issuedFor}
+	at := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	change := mutation{Op: opEditUser, ID: "ada", Password: changed, At: at}
+	if err := change.apply(db); err != nil {
+		t.Fatalf("apply change: %v", err)
+	}
+	reset := mutation{Op: opEditUser, ID: "ada", Password: hash("reset"), ExpectPassword: hashToken(issuedFor), At: at}
+	if err := reset.apply(db); !errors.Is(err, ErrInvalidResetToken) {
+		t.Fatalf("apply stale reset = %v, want ErrInvalidResetToken", err)
+	}
+	if db.Users["ada"].Password != changed {
+		t.Error("stale reset changed the password")
+	}
+
+	reset.ExpectPassword = hashToken(changed)
+	if err := reset.apply(db); err != nil {
+		t.Fatalf("apply current reset: %v", err)
+	}
+	if db.Users["ada"].Password != reset.Password {
+		t.Error("current reset did not change the password")
+	}
+}
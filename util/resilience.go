@@ -0,0 +1,208 @@
+package util
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/ipfs/boxo/files"
+	ipfsapi "github.com/ipfs/go-ipfs-api"
+)
+
+// ErrCircuitOpen is returned without contacting IPFS while the circuit
+// breaker considers it unhealthy.
+var ErrCircuitOpen = errors.New("IPFS circuit breaker is open")
+
+// shellCat is Shell.Cat honouring ctx.
+func shellCat(ctx context.Context, shell *ipfsapi.Shell, cid string) (io.ReadCloser, error) {
+	resp, err := shell.Request("cat", cid).Send(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Error != nil {
+		return nil, resp.Error
+	}
+	return resp.Output, nil
+}
+
+// shellAdd is Shell.Add honouring ctx.
+func shellAdd(ctx context.Context, shell *ipfsapi.Shell, r io.Reader) (string, error) {
+	dir := files.NewSliceDirectory([]files.DirEntry{files.FileEntry("", files.NewReaderFile(r))})
+	var out struct{ Hash string }
+	err := shell.Request("add").Body(files.NewMultiFileReader(dir, true, false)).Exec(ctx, &out)
+	return out.Hash, err
+}
+
+// shellVersion is Shell.Version honouring ctx.
+func shellVersion(ctx context.Context, shell *ipfsapi.Shell) (string, error) {
+	var out struct{ Version string }
+	err := shell.Request("version").Exec(ctx, &out)
+	return out.Version, err
+}
+
+// backoff returns the delay before retry number attempt (starting at 0):
+// exponential growth from base, capped at max, with full jitter.
+func backoff(attempt int, base, max time.Duration) time.Duration {
+	d := base << attempt
+	if d <= 0 || d > max {
+		d = max
+	}
+	return time.Duration(rand.Int63n(int64(d) + 1))
+}
+
+// circuitBreaker stops calls to a failing dependency. After threshold
+// consecutive failures it opens and rejects calls for cooldown; then a single
+// trial call is let through, which closes it again on success.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	openUntil time.Time
+	trial     bool // A half-open trial call is in flight
+}
+
+// allow reports whether a call may proceed.
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures < b.threshold {
+		return true
+	}
+	if time.Now().Before(b.openUntil) || b.trial {
+		return false
+	}
+	b.trial = true
+	return true
+}
+
+// record updates the breaker with the outcome of an allowed call. Errors
+// caused by the caller's own context are not held against the dependency.
+func (b *circuitBreaker) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.trial = false
+	switch {
+	case err == nil:
+		b.failures = 0
+	case errors.Is(err, context.Canceled):
+	default:
+		b.failures++
+		if b.failures >= b.threshold {
+			b.openUntil = time.Now().Add(b.cooldown)
+		}
+	}
+}
+
+// open reports whether calls are currently being rejected.
+func (b *circuitBreaker) open() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.failures >= b.threshold && time.Now().Before(b.openUntil)
+}
+
+// resilientStore wraps a Store with per-operation deadlines, retries with
+// backoff for reads, and a circuit breaker.
+type resilientStore struct {
+	inner        Store
+	breaker      *circuitBreaker
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+	readAttempts int
+	retryBase    time.Duration
+	retryMax     time.Duration
+}
+
+// newResilientStoreFromEnv wraps inner using IPFS_READ_TIMEOUT (default: 5s),
+// IPFS_WRITE_TIMEOUT (default: 15s), IPFS_READ_ATTEMPTS (default: 3),
+// IPFS_BREAKER_THRESHOLD (default: 5) and IPFS_BREAKER_COOLDOWN (default: 10s).
+func newResilientStoreFromEnv(inner Store) *resilientStore {
+	return &resilientStore{
+		inner: inner,
+		breaker: &circuitBreaker{
+			threshold: intFromEnv("IPFS_BREAKER_THRESHOLD", 5),
+			cooldown:  durationFromEnv("IPFS_BREAKER_COOLDOWN", 10*time.Second),
+		},
+		readTimeout:  durationFromEnv("IPFS_READ_TIMEOUT", 5*time.Second),
+		writeTimeout: durationFromEnv("IPFS_WRITE_TIMEOUT", 15*time.Second),
+		readAttempts: intFromEnv("IPFS_READ_ATTEMPTS", 3),
+		retryBase:    100 * time.Millisecond,
+		retryMax:     2 * time.Second,
+	}
+}
+
+// Cat reads cid, retrying failed attempts. Reads are idempotent, so a retry
+// can never apply anything twice.
+func (s *resilientStore) Cat(ctx context.Context, cid string) (io.ReadCloser, error) {
+	var lastErr error
+	for attempt := 0; attempt < s.readAttempts; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return nil, fmt.Errorf("%w (last error: %v)", ctx.Err(), lastErr)
+			case <-time.After(backoff(attempt-1, s.retryBase, s.retryMax)):
+			}
+		}
+		if !s.breaker.allow() {
+			return nil, ErrCircuitOpen
+		}
+
+		reader, err := s.catOnce(ctx, cid)
+		s.breaker.record(err)
+		if err == nil {
+			return reader, nil
+		}
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// catOnce reads cid within the read deadline. The content is buffered so the
+// deadline does not cut off a caller that is still reading.
+func (s *resilientStore) catOnce(ctx context.Context, cid string) (io.ReadCloser, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.readTimeout)
+	defer cancel()
+
+	reader, err := s.inner.Cat(ctx, cid)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+// Add writes r once within the write deadline. Writes are not retried here;
+// failed writes fall back to the write-ahead log.
+func (s *resilientStore) Add(ctx context.Context, r io.Reader) (string, error) {
+	if !s.breaker.allow() {
+		return "", ErrCircuitOpen
+	}
+	ctx, cancel := context.WithTimeout(ctx, s.writeTimeout)
+	defer cancel()
+
+	cid, err := s.inner.Add(ctx, r)
+	s.breaker.record(err)
+	return cid, err
+}
+
+// IsUp reports false without probing while the breaker is open.
+func (s *resilientStore) IsUp(ctx context.Context) bool {
+	if s.breaker.open() {
+		return false
+	}
+	ctx, cancel := context.WithTimeout(ctx, s.readTimeout)
+	defer cancel()
+	return s.inner.IsUp(ctx)
+}
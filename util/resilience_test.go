@@ -0,0 +1,274 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// scriptedStore fails the first failures calls to Cat and Add with err, or
+// blocks them until their context ends when hang is set.
+type scriptedStore struct {
+	failures int64
+	err      error
+	hang     bool
+	calls    atomic.Int64
+}
+
+func (s *scriptedStore) call(ctx context.Context) error {
+	if s.calls.Add(1) > s.failures {
+		return nil
+	}
+	if s.hang {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	return s.err
+}
+
+func (s *scriptedStore) Cat(ctx context.Context, cid string) (io.ReadCloser, error) {
+	if err := s.call(ctx); err != nil {
+		return nil, err
+	}
+	return io.NopCloser(strings.NewReader("content of " + cid)), nil
+}
+
+func (s *scriptedStore) Add(ctx context.Context, r io.Reader) (string, error) {
+	if err := s.call(ctx); err != nil {
+		return "", err
+	}
+	return "bafy", nil
+}
+
+func (s *scriptedStore) IsUp(ctx context.Context) bool {
+	return s.call(ctx) == nil
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	errDown := errors.New("down")
+	// Steps are applied in order. "ok", "fail" and "cancel" make a call and
+	// record its outcome; "cooldown" lets the open period pass.
+	type step struct {
+		do        string // "ok", "fail", "cancel" or "cooldown"
+		wantAllow bool   // Result of allow before the step; ignored for "cooldown"
+		wantOpen  bool   // Result of open after the step
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{
+			name: "opens after threshold consecutive failures",
+			steps: []step{
+				{do: "fail", wantAllow: true},
+				{do: "fail", wantAllow: true, wantOpen: true},
+			},
+		},
+		{
+			name: "success resets the count",
+			steps: []step{
+				{do: "fail", wantAllow: true},
+				{do: "ok", wantAllow: true},
+				{do: "fail", wantAllow: true},
+			},
+		},
+		{
+			name: "cancellation is not a failure",
+			steps: []step{
+				{do: "fail", wantAllow: true},
+				{do: "cancel", wantAllow: true},
+				{do: "cancel", wantAllow: true},
+			},
+		},
+		{
+			name: "half-open trial success closes",
+			steps: []step{
+				{do: "fail", wantAllow: true},
+				{do: "fail", wantAllow: true, wantOpen: true},
+				{do: "cooldown"},
+				{do: "ok", wantAllow: true},
+				{do: "fail", wantAllow: true},
+			},
+		},
+		{
+			name: "half-open trial failure reopens",
+			steps: []step{
+				{do: "fail", wantAllow: true},
+				{do: "fail", wantAllow: true, wantOpen: true},
+				{do: "cooldown"},
+				{do: "fail", wantAllow: true, wantOpen: true},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &circuitBreaker{threshold: 2, cooldown: time.Hour}
+			for i, s := range tt.steps {
+				if s.do == "cooldown" {
+					b.openUntil = time.Now().Add(-time.Second)
+				} else {
+					if allow := b.allow(); allow != s.wantAllow {
+						t.Fatalf("step %d: allow = %v, want %v", i, allow, s.wantAllow)
+					}
+					switch s.do {
+					case "ok":
+						b.record(nil)
+					case "fail":
+						b.record(errDown)
+					case "cancel":
+						b.record(context.Canceled)
+					}
+				}
+				if open := b.open(); open != s.wantOpen {
+					t.Fatalf("step %d (%s): open = %v, want %v", i, s.do, open, s.wantOpen)
+				}
+			}
+		})
+	}
+
+	t.Run("open rejects calls", func(t *testing.T) {
+		b := &circuitBreaker{threshold: 1, cooldown: time.Hour}
+		b.allow()
+		b.record(errDown)
+		if b.allow() {
+			t.Error("open breaker allowed a call")
+		}
+	})
+
+	t.Run("half-open lets one trial through", func(t *testing.T) {
+		b := &circuitBreaker{threshold: 1, cooldown: time.Hour}
+		b.allow()
+		b.record(errDown)
+		b.openUntil = time.Now().Add(-time.Second)
+		if b.open() {
+			t.Error("breaker is still open after the cooldown")
+		}
+		if !b.allow() {
+			t.Fatal("half-open breaker rejected the trial call")
+		}
+		if b.allow() {
+			t.Error("half-open breaker allowed a second call during the trial")
+		}
+		b.record(nil)
+		if !b.allow() || !b.allow() {
+			t.Error("breaker did not close after a successful trial")
+		}
+	})
+}
+
+func TestResilientStore(t *testing.T) {
+	errDown := errors.New("down")
+	newStore := func(inner Store, threshold int) *resilientStore {
+		return &resilientStore{
+			inner:        inner,
+			breaker:      &circuitBreaker{threshold: threshold, cooldown: time.Hour},
+			readTimeout:  50 * time.Millisecond,
+			writeTimeout: 50 * time.Millisecond,
+			readAttempts: 3,
+			retryBase:    time.Millisecond,
+			retryMax:     time.Millisecond,
+		}
+	}
+	ctx := context.Background()
+
+	tests := []struct {
+		name      string
+		inner     *scriptedStore
+		threshold int
+		op        string // "cat" or "add"
+		wantErr   error  // Checked with errors.Is; nil for success
+		wantCalls int64
+	}{
+		{name: "read succeeds after retries", inner: &scriptedStore{failures: 2, err: errDown}, threshold: 10, op: "cat", wantCalls: 3},
+		{name: "read gives up after the last attempt", inner: &scriptedStore{failures: 5, err: errDown}, threshold: 10, op: "cat", wantErr: errDown, wantCalls: 3},
+		{name: "read hits the read deadline", inner: &scriptedStore{failures: 5, hang: true}, threshold: 10, op: "cat", wantErr: context.DeadlineExceeded, wantCalls: 3},
+		{name: "read stops when the breaker opens", inner: &scriptedStore{failures: 5, err: errDown}, threshold: 2, op: "cat", wantErr: ErrCircuitOpen, wantCalls: 2},
+		{name: "write is not retried", inner: &scriptedStore{failures: 1, err: errDown}, threshold: 10, op: "add", wantErr: errDown, wantCalls: 1},
+		{name: "write hits the write deadline", inner: &scriptedStore{failures: 1, hang: true}, threshold: 10, op: "add", wantErr: context.DeadlineExceeded, wantCalls: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newStore(tt.inner, tt.threshold)
+			var err error
+			if tt.op == "cat" {
+				var r io.ReadCloser
+				if r, err = s.Cat(ctx, "bafy"); err == nil {
+					data, _ := io.ReadAll(r)
+					if string(data) != "content of bafy" {
+						t.Errorf("Cat read %q", data)
+					}
+				}
+			} else {
+				_, err = s.Add(ctx, strings.NewReader("data"))
+			}
+			if (tt.wantErr == nil && err != nil) || (tt.wantErr != nil && !errors.Is(err, tt.wantErr)) {
+				t.Errorf("error = %v, want %v", err, tt.wantErr)
+			}
+			if calls := tt.inner.calls.Load(); calls != tt.wantCalls {
+				t.Errorf("store called %d times, want %d", calls, tt.wantCalls)
+			}
+		})
+	}
+
+	t.Run("open breaker skips the store", func(t *testing.T) {
+		inner := &scriptedStore{failures: 1, err: errDown}
+		s := newStore(inner, 1)
+		s.Add(ctx, strings.NewReader("data"))
+		if _, err := s.Cat(ctx, "bafy"); !errors.Is(err, ErrCircuitOpen) {
+			t.Errorf("Cat = %v, want ErrCircuitOpen", err)
+		}
+		if _, err := s.Add(ctx, strings.NewReader("data")); !errors.Is(err, ErrCircuitOpen) {
+			t.Errorf("Add = %v, want ErrCircuitOpen", err)
+		}
+		if s.IsUp(ctx) {
+			t.Error("IsUp = true while the breaker is open")
+		}
+		if calls := inner.calls.Load(); calls != 1 {
+			t.Errorf("store called %d times, want 1", calls)
+		}
+	})
+
+	t.Run("cancelled caller stops retrying", func(t *testing.T) {
+		inner := &scriptedStore{failures: 5, err: errDown}
+		s := newStore(inner, 10)
+		s.retryBase, s.retryMax = time.Hour, time.Hour
+		ctx, cancel := context.WithCancel(ctx)
+		time.AfterFunc(20*time.Millisecond, cancel)
+		if _, err := s.Cat(ctx, "bafy"); !errors.Is(err, context.Canceled) {
+			t.Errorf("Cat = %v, want context.Canceled", err)
+		}
+		if calls := inner.calls.Load(); calls != 1 {
+			t.Errorf("store called %d times, want 1", calls)
+		}
+	})
+
+	t.Run("cancellation does not open the breaker", func(t *testing.T) {
+		inner := &scriptedStore{failures: 5, hang: true}
+		s := newStore(inner, 1)
+		ctx, cancel := context.WithCancel(ctx)
+		cancel()
+		s.Cat(ctx, "bafy")
+		if s.breaker.open() {
+			t.Error("breaker opened on the caller's cancellation")
+		}
+	})
+}
+
+func TestBackoff(t *testing.T) {
+	base, max := 10*time.Millisecond, 80*time.Millisecond
+	for attempt, limit := range []time.Duration{10, 20, 40, 80, 80, 80} {
+		limit *= time.Millisecond
+		for i := 0; i < 100; i++ {
+			if d := backoff(attempt, base, max); d < 0 || d > limit {
+				t.Fatalf("backoff(%d) = %v, want within [0, %v]", attempt, d, limit)
+			}
+		}
+	}
+	if d := backoff(70, base, max); d < 0 || d > max {
+		t.Errorf("backoff on overflow = %v, want within [0, %v]", d, max)
+	}
+}
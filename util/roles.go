@@ -0,0 +1,277 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Permissions checked by the API. Roles grant sets of these, and API keys can
+// be given them directly; PermAll grants every permission.
+const (
+	PermUsersRead   = "users:read"   // Read any user
+	PermUsersWrite  = "users:write"  // Modify or delete any user
+	PermRolesManage = "roles:manage" // Create roles and assign or revoke them
+	PermAuditRead   = "audit:read"   // Read the audit trail
+	PermSystem      = "system:admin" // Network, mirror and service mode endpoints
+	PermAll         = "*"
+)
+
+// RoleAdmin is the built-in role holding every permission.
+const RoleAdmin = "admin"
+
+// Role is a named set of permissions that can be assigned to users.
+type Role struct {
+	Name        string    `json:"name"`
+	Permissions []string  `json:"permissions"`
+	Description string    `json:"description,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	Builtin     bool      `json:"builtin,omitempty"` // Defined in code rather than stored
+}
+
+func (r Role) canonical() Role {
+	r.CreatedAt = r.CreatedAt.UTC()
+	return r
+}
+
+// builtinRoles exist in every database and cannot be redefined.
+var builtinRoles = map[string]Role{
+	RoleAdmin: {Name: RoleAdmin, Permissions: []string{PermAll}, Description: "Full access", Builtin: true},
+	"support": {Name: "support", Permissions: []string{PermUsersRead, PermUsersWrite}, Description: "Manage user accounts", Builtin: true},
+	"auditor": {Name: "auditor", Permissions: []string{PermUsersRead, PermAuditRead}, Description: "Read users and the audit trail", Builtin: true},
+}
+
+var roleName = regexp.MustCompile(`^[a-z][a-z0-9_-]{0,63}$`)
+
+// lookupRole finds a built-in or custom role by name.
+func lookupRole(db *database, name string) (Role, bool) {
+	if role, ok := builtinRoles[name]; ok {
+		return role, true
+	}
+	role, ok := db.Roles[name]
+	return role, ok
+}
+
+func hasRole(user User, name string) bool {
+	for _, held := range user.Roles {
+		if held == name {
+			return true
+		}
+	}
+	return false
+}
+
+// toggleRole returns a sorted copy of roles with name added or removed.
+func toggleRole(roles []string, name string, add bool) []string {
+	var out []string
+	for _, held := range roles {
+		if held != name {
+			out = append(out, held)
+		}
+	}
+	if add {
+		out = append(out, name)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// permissionsOf returns the union of the permissions granted by user's roles.
+func permissionsOf(db *database, user User) []string {
+	seen := make(map[string]bool)
+	var perms []string
+	for _, name := range user.Roles {
+		role, ok := lookupRole(db, name)
+		if !ok {
+			continue
+		}
+		for _, perm := range role.Permissions {
+			if !seen[perm] {
+				seen[perm] = true
+				perms = append(perms, perm)
+			}
+		}
+	}
+	sort.Strings(perms)
+	return perms
+}
+
+// Roles lists the built-in and custom roles, sorted by name.
+func (im *IdentityManager) Roles(ctx context.Context) ([]Role, error) {
+	db, err := im.loadDatabase(ctx)
+	if err != nil {
+		return nil, err
+	}
+	roles := make([]Role, 0, len(builtinRoles)+len(db.Roles))
+	for _, role := range builtinRoles {
+		roles = append(roles, role)
+	}
+	for _, role := range db.Roles {
+		roles = append(roles, role)
+	}
+	sort.Slice(roles, func(i, j int) bool { return roles[i].Name < roles[j].Name })
+	return roles, nil
+}
+
+// CreateRole stores a custom role granting perms. The actor must hold every
+// one of them.
+func (im *IdentityManager) CreateRole(ctx context.Context, actor Principal, name, description string, perms []string) error {
+	if err := im.mode.checkWrite(); err != nil {
+		return err
+	}
+	if !roleName.MatchString(name) {
+		return errors.New("role name must be 1-64 lowercase letters, digits, '-' or '_', starting with a letter")
+	}
+	if len(perms) == 0 {
+		return errors.New("a role needs at least one permission")
+	}
+	for _, perm := range perms {
+		if perm == "" || strings.ContainsAny(perm, " \t\n,") {
+			return fmt.Errorf("invalid permission %q", perm)
+		}
+	}
+	if !actor.CanGrant(perms) {
+		return fmt.Errorf("%w: role %s would grant permissions %s does not hold", ErrForbidden, name, actor)
+	}
+
+	err := im.batch.submit(ctx, mutation{
+		Op:          opCreateRole,
+		Role:        name,
+		Permissions: perms,
+		Description: description,
+		Actor:       actor.String(),
+		At:          time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	im.log.Info(fmt.Sprintf("Role %s created by %s with permissions %v", name, actor, perms))
+	return nil
+}
+
+// AssignRole gives the user with ID userID the named role. The actor must
+// hold every permission of the role.
+func (im *IdentityManager) AssignRole(ctx context.Context, actor Principal, userID, role string) error {
+	return im.changeRole(ctx, actor, opAssignRole, userID, role)
+}
+
+// RevokeRole takes the named role away from the user with ID userID. As with
+// AssignRole, the actor must hold every permission of the role, so that
+// managers cannot demote those above them.
+func (im *IdentityManager) RevokeRole(ctx context.Context, actor Principal, userID, role string) error {
+	return im.changeRole(ctx, actor, opRevokeRole, userID, role)
+}
+
+func (im *IdentityManager) changeRole(ctx context.Context, actor Principal, op mutationOp, userID, role string) error {
+	if err := im.mode.checkWrite(); err != nil {
+		return err
+	}
+	db, err := im.loadDatabase(ctx)
+	if err != nil {
+		return err
+	}
+	// Role definitions never change once created, so this check cannot race
+	// with the mutation.
+	definition, exists := lookupRole(db, role)
+	if !exists {
+		return fmt.Errorf("role %q does not exist", role)
+	}
+	if !actor.CanGrant(definition.Permissions) {
+		return fmt.Errorf("%w: role %s grants permissions %s does not hold", ErrForbidden, role, actor)
+	}
+	err = im.batch.submit(ctx, mutation{Op: op, ID: userID, Role: role, Actor: actor.String(), At: time.Now()})
+	if err != nil {
+		return err
+	}
+	im.log.Info(fmt.Sprintf("Role %s: %s on user %s by %s", op, role, userID, actor))
+	return nil
+}
+
+// BootstrapAdmin gives the admin role to username, creating the account with
+// password if it does not exist. It refuses once any user is an admin, so it
+// can only be used to set up the first one. It returns the user's ID.
+func (im *IdentityManager) BootstrapAdmin(ctx context.Context, username, password string) (string, error) {
+	db, err := im.loadDatabase(ctx)
+	if err != nil {
+		return "", err
+	}
+	var id string
+	for _, user := range db.Users {
+		if hasRole(user, RoleAdmin) {
+			return "", fmt.Errorf("user %s is already an admin", user.Username)
+		}
+		if user.Username == username {
+			id = user.ID
+		}
+	}
+
+	if id == "" {
+		if password == "" {
+			return "", errors.New("user does not exist; a password is needed to create it")
+		}
+		hashed, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return "", fmt.Errorf("failed to hash password: %w", err)
+		}
+		id = uuid.New().String()
+		err = im.batch.submit(ctx, mutation{Op: opAddUser, ID: id, Username: username, Password: string(hashed), At: time.Now()})
+		if err != nil {
+			return "", err
+		}
+	}
+
+	actor := Principal{ID: "bootstrap", Kind: "cli", Permissions: []string{PermAll}}
+	if err := im.AssignRole(ctx, actor, id, RoleAdmin); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// AuditRecord is one role change from the ledger.
+type AuditRecord struct {
+	At          time.Time  `json:"at"`
+	Actor       string     `json:"actor"`
+	Action      mutationOp `json:"action"`
+	UserID      string     `json:"user_id,omitempty"`
+	Role        string     `json:"role"`
+	Permissions []string   `json:"permissions,omitempty"`
+	Entry       string     `json:"entry,omitempty"` // CID of the ledger entry; empty while queued in the WAL
+}
+
+func auditRecord(m mutation, entry string) (AuditRecord, bool) {
+	switch m.Op {
+	case opCreateRole, opAssignRole, opRevokeRole:
+		return AuditRecord{
+			At:          m.At,
+			Actor:       m.Actor,
+			Action:      m.Op,
+			UserID:      m.ID,
+			Role:        m.Role,
+			Permissions: m.Permissions,
+			Entry:       entry,
+		}, true
+	}
+	return AuditRecord{}, false
+}
+
+// AuditTrail returns up to limit role changes, newest first, read from the
+// WAL and the ledger, and the cursor of the next page; see scanHistory.
+func (im *IdentityManager) AuditTrail(ctx context.Context, limit int, cursor string) ([]AuditRecord, string, error) {
+	records := []AuditRecord{}
+	next, err := im.scanHistory(ctx, cursor, func(m mutation, entry string) bool {
+		record, ok := auditRecord(m, entry)
+		if !ok {
+			return true
+		}
+		records = append(records, record)
+		return len(records) < limit
+	})
+	return records, next, err
+}
@@ -0,0 +1,57 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// TestRoleEscalation checks that a role manager cannot hand out permissions
+// it does not hold, to others or to itself.
+func TestRoleEscalation(t *testing.T) {
+	ctx := context.Background()
+	im := newTestManager(t, newTestNode(t))
+	manager := Principal{ID: "manager", Kind: PrincipalUser, Permissions: []string{PermRolesManage, PermUsersRead}}
+	admin := Principal{ID: "admin", Kind: PrincipalUser, Permissions: []string{PermAll}}
+	id, _, err := im.AddUser(ctx, "alice", "secret", "")
+	if err != nil {
+		t.Fatalf("AddUser: %v", err)
+	}
+	manager.ID = id
+
+	for _, perms := range [][]string{{PermAll}, {PermUsersRead, PermUsersWrite}, {PermSystem}} {
+		if err := im.CreateRole(ctx, manager, "escalated", "", perms); !errors.Is(err, ErrForbidden) {
+			t.Errorf("CreateRole with %v = %v, want ErrForbidden", perms, err)
+		}
+	}
+	if err := im.CreateRole(ctx, manager, "readers", "", []string{PermUsersRead}); err != nil {
+		t.Fatalf("CreateRole within the manager's permissions: %v", err)
+	}
+	if err := im.CreateRole(ctx, admin, "operators", "", []string{PermSystem}); err != nil {
+		t.Fatalf("CreateRole by an admin: %v", err)
+	}
+
+	for _, role := range []string{RoleAdmin, "support", "operators"} {
+		if err := im.AssignRole(ctx, manager, id, role); !errors.Is(err, ErrForbidden) {
+			t.Errorf("AssignRole %s = %v, want ErrForbidden", role, err)
+		}
+	}
+	if err := im.AssignRole(ctx, manager, id, "readers"); err != nil {
+		t.Errorf("AssignRole readers: %v", err)
+	}
+	if err := im.AssignRole(ctx, admin, id, "operators"); err != nil {
+		t.Fatalf("AssignRole by an admin: %v", err)
+	}
+	if err := im.RevokeRole(ctx, manager, id, "operators"); !errors.Is(err, ErrForbidden) {
+		t.Errorf("RevokeRole operators = %v, want ErrForbidden", err)
+	}
+
+	db, err := im.loadDatabase(ctx)
+	if err != nil {
+		t.Fatalf("loadDatabase: %v", err)
+	}
+	if user, want := db.Users[id], []string{"operators", "readers"}; !reflect.DeepEqual(user.Roles, want) {
+		t.Errorf("roles = %v, want %v", user.Roles, want)
+	}
+}
@@ -0,0 +1,188 @@
+package util
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"ipfs-identity/did"
+	"ipfs-identity/sdjwt"
+)
+
+// TypeUserSDJWT is the typ header of the SD-JWTs the service issues about its
+// users.
+const TypeUserSDJWT = "user+sd-jwt"
+
+// maxAttributes bounds the attributes stored on one user.
+const maxAttributes = 64
+
+var attributeName = regexp.MustCompile(`^[a-z][a-z0-9_]{0,63}$`)
+
+// reservedAttributes are claim names the service sets itself, so attributes
+// cannot shadow them.
+var reservedAttributes = map[string]bool{
+	"iss": true, "sub": true, "aud": true, "iat": true, "nbf": true, "exp": true,
+	"jti": true, "cnf": true, "status": true, "vct": true,
+	"username": true, "roles": true, "wallets": true,
+}
+
+// SetAttributes replaces the attributes of the user with ID id, such as
+// birthdate or organization. They are claims the service vouches for, so only
+// administrators set them. A birthdate must be given as YYYY-MM-DD.
+func (im *IdentityManager) SetAttributes(ctx context.Context, actor Principal, id string, attributes map[string]string) error {
+	if err := im.mode.checkWrite(); err != nil {
+		return err
+	}
+	if len(attributes) > maxAttributes {
+		return fmt.Errorf("at most %d attributes are allowed", maxAttributes)
+	}
+	stored := make(map[string]string, len(attributes))
+	for name, value := range attributes {
+		if !attributeName.MatchString(name) || reservedAttributes[name] || strings.HasPrefix(name, "age_over_") || strings.HasPrefix(name, "_") {
+			return fmt.Errorf("invalid attribute name %q", name)
+		}
+		if name == "birthdate" {
+			if _, err := time.Parse("2006-01-02", value); err != nil {
+				return errors.New("birthdate must be given as YYYY-MM-DD")
+			}
+		}
+		stored[name] = value
+	}
+	err := im.batch.submit(ctx, mutation{Op: opSetAttributes, ID: id, Attributes: stored, Actor: actor.String(), At: time.Now()})
+	if err != nil {
+		return err
+	}
+	im.log.Info(fmt.Sprintf("Attributes of user %s set by %s", id, actor))
+	return nil
+}
+
+// Attributes returns the attributes of the user with ID id.
+func (im *IdentityManager) Attributes(ctx context.Context, id string) (map[string]string, error) {
+	db, err := im.loadDatabase(ctx)
+	if err != nil {
+		return nil, err
+	}
+	user, exists := db.Users[id]
+	if !exists {
+		return nil, errors.New("user not found")
+	}
+	attributes := make(map[string]string, len(user.Attributes))
+	for name, value := range user.Attributes {
+		attributes[name] = value
+	}
+	return attributes, nil
+}
+
+// IssueSDJWT issues an SD-JWT about the user with ID id, signed with the
+// credential key of the service DID. Every claim except the issuer, subject
+// and validity is selectively disclosable: the username, each role and
+// wallet, each attribute, and age_over_18 and age_over_21 when a birthdate is
+// known. It is bound to holder, or to the user's current DID key if holder is
+// nil.
+func (im *IdentityManager) IssueSDJWT(ctx context.Context, actor Principal, id string, holder ed25519.PublicKey) (string, error) {
+	if err := im.mode.checkRead(); err != nil {
+		return "", err
+	}
+	db, err := im.loadDatabase(ctx)
+	if err != nil {
+		return "", err
+	}
+	user, exists := db.Users[id]
+	if !exists {
+		return "", errors.New("user not found")
+	}
+	subject := user.ID
+	if user.DID != nil {
+		subject = user.DID.ID
+		if holder == nil {
+			key := user.DID.Keys[len(user.DID.Keys)-1]
+			if holder, err = did.DecodeMultikey(key.PublicKeyMultibase); err != nil {
+				return "", err
+			}
+		}
+	}
+	if holder == nil {
+		return "", errors.New("a holder key is required for users without a DID")
+	}
+
+	now := time.Now()
+	claims := map[string]interface{}{
+		"iss":      im.ServiceDID(),
+		"sub":      subject,
+		"iat":      now.Unix(),
+		"exp":      now.Add(durationFromEnv("SD_JWT_TTL", 24*time.Hour)).Unix(),
+		"username": user.Username,
+	}
+	disclosable := []string{"username"}
+	if len(user.Roles) > 0 {
+		claims["roles"] = stringsToValues(user.Roles)
+		disclosable = append(disclosable, "roles")
+	}
+	if len(user.Wallets) > 0 {
+		claims["wallets"] = stringsToValues(user.Wallets)
+		disclosable = append(disclosable, "wallets")
+	}
+	names := make([]string, 0, len(user.Attributes))
+	for name := range user.Attributes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		claims[name] = user.Attributes[name]
+		disclosable = append(disclosable, name)
+	}
+	if birthdate, err := time.Parse("2006-01-02", user.Attributes["birthdate"]); err == nil {
+		for _, age := range []int{18, 21} {
+			name := fmt.Sprintf("age_over_%d", age)
+			claims[name] = !now.Before(birthdate.AddDate(age, 0, 0))
+			disclosable = append(disclosable, name)
+		}
+	}
+
+	token, err := sdjwt.Issue(claims, sdjwt.IssueOptions{
+		Key:         im.credentialKey(),
+		KeyID:       im.credentialVerificationMethod(),
+		Type:        TypeUserSDJWT,
+		Holder:      holder,
+		Disclosable: disclosable,
+	})
+	if err != nil {
+		return "", err
+	}
+	im.log.Info(fmt.Sprintf("SD-JWT issued for user %s to %s", id, actor))
+	return token, nil
+}
+
+func stringsToValues(list []string) []interface{} {
+	values := make([]interface{}, len(list))
+	for i, s := range list {
+		values[i] = s
+	}
+	return values
+}
+
+// VerifySDJWT verifies an SD-JWT presentation from any issuer whose DID
+// resolves: the issuer's kid must be a DID URL listed for assertions in its
+// DID document. audience and nonce, if set, must match the Key Binding JWT.
+func (im *IdentityManager) VerifySDJWT(ctx context.Context, presentation, audience, nonce string, requireKeyBinding bool) (*sdjwt.Result, error) {
+	return sdjwt.Verify(ctx, presentation, sdjwt.VerifyOptions{
+		IssuerKey: func(ctx context.Context, iss, kid string) (ed25519.PublicKey, error) {
+			signer, pub, err := im.verificationKey(ctx, kid, "assertionMethod")
+			if err != nil {
+				return nil, err
+			}
+			if signer != iss {
+				return nil, errors.New("SD-JWT was not signed by its issuer")
+			}
+			return pub, nil
+		},
+		Audience:          audience,
+		Nonce:             nonce,
+		RequireKeyBinding: requireKeyBinding,
+	})
+}
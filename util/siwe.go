@@ -0,0 +1,441 @@
+package util
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/decred/dcrd/dcrec/secp256k1/v4"
+	"github.com/decred/dcrd/dcrec/secp256k1/v4/ecdsa"
+	"golang.org/x/crypto/sha3"
+)
+
+// AMRWallet is the amr value of sessions started by signing in with an
+// Ethereum wallet, a proof of possession of a software-secured key.
+const AMRWallet = "swk"
+
+// SIWEMessage is a Sign-In with Ethereum message (EIP-4361).
+type SIWEMessage struct {
+	Scheme         string // Optional scheme of the requesting origin
+	Domain         string // Authority of the site asking for the signature
+	Address        string // EIP-55 checksummed account address
+	Statement      string
+	URI            string
+	Version        string
+	ChainID        int64
+	Nonce          string
+	IssuedAt       time.Time
+	ExpirationTime time.Time // Zero if the message does not expire
+	NotBefore      time.Time // Zero if the message is valid immediately
+	RequestID      string
+	Resources      []string
+}
+
+const siweHeaderSuffix = " wants you to sign in with your Ethereum account:"
+
+// String formats m as the text a wallet shows and signs.
+func (m SIWEMessage) String() string {
+	var b strings.Builder
+	if m.Scheme != "" {
+		b.WriteString(m.Scheme + "://")
+	}
+	b.WriteString(m.Domain + siweHeaderSuffix + "\n")
+	b.WriteString(m.Address + "\n\n")
+	if m.Statement != "" {
+		b.WriteString(m.Statement + "\n")
+	}
+	b.WriteString("\n")
+	fmt.Fprintf(&b, "URI: %s\nVersion: %s\nChain ID: %d\nNonce: %s\nIssued At: %s",
+		m.URI, m.Version, m.ChainID, m.Nonce, m.IssuedAt.UTC().Format(time.RFC3339))
+	if !m.ExpirationTime.IsZero() {
+		b.WriteString("\nExpiration Time: " + m.ExpirationTime.UTC().Format(time.RFC3339))
+	}
+	if !m.NotBefore.IsZero() {
+		b.WriteString("\nNot Before: " + m.NotBefore.UTC().Format(time.RFC3339))
+	}
+	if m.RequestID != "" {
+		b.WriteString("\nRequest ID: " + m.RequestID)
+	}
+	if len(m.Resources) > 0 {
+		b.WriteString("\nResources:")
+		for _, r := range m.Resources {
+			b.WriteString("\n- " + r)
+		}
+	}
+	return b.String()
+}
+
+// ParseSIWEMessage parses the text of a Sign-In with Ethereum message.
+func ParseSIWEMessage(text string) (SIWEMessage, error) {
+	var m SIWEMessage
+	lines := strings.Split(text, "\n")
+	if len(lines) < 4 || !strings.HasSuffix(lines[0], siweHeaderSuffix) {
+		return m, errors.New("not a Sign-In with Ethereum message")
+	}
+	m.Domain = strings.TrimSuffix(lines[0], siweHeaderSuffix)
+	if i := strings.Index(m.Domain, "://"); i >= 0 {
+		m.Scheme, m.Domain = m.Domain[:i], m.Domain[i+3:]
+	}
+	if m.Domain == "" {
+		return m, errors.New("message has no domain")
+	}
+	m.Address = lines[1]
+	if lines[2] != "" {
+		return m, errors.New("malformed message: expected a blank line after the address")
+	}
+
+	// An optional statement line and a blank line come before the fields.
+	// Older libraries leave out the second blank line when there is no
+	// statement, so that is accepted too.
+	i := 3
+	if lines[i] != "" && !strings.HasPrefix(lines[i], "URI: ") {
+		m.Statement = lines[i]
+		i++
+	}
+	if i < len(lines) && lines[i] == "" {
+		i++
+	}
+
+	field := func(name string, required bool) (string, error) {
+		prefix := name + ": "
+		if i < len(lines) && strings.HasPrefix(lines[i], prefix) {
+			i++
+			return strings.TrimPrefix(lines[i-1], prefix), nil
+		}
+		if required {
+			return "", fmt.Errorf("message has no %s", name)
+		}
+		return "", nil
+	}
+	timestamp := func(name string, required bool) (time.Time, error) {
+		value, err := field(name, required)
+		if err != nil || value == "" {
+			return time.Time{}, err
+		}
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("malformed %s: %w", name, err)
+		}
+		return t, nil
+	}
+
+	var err error
+	if m.URI, err = field("URI", true); err != nil {
+		return m, err
+	}
+	if m.Version, err = field("Version", true); err != nil {
+		return m, err
+	}
+	chainID, err := field("Chain ID", true)
+	if err != nil {
+		return m, err
+	}
+	if m.ChainID, err = strconv.ParseInt(chainID, 10, 64); err != nil || m.ChainID <= 0 {
+		return m, errors.New("malformed Chain ID")
+	}
+	if m.Nonce, err = field("Nonce", true); err != nil {
+		return m, err
+	}
+	if m.IssuedAt, err = timestamp("Issued At", true); err != nil {
+		return m, err
+	}
+	if m.ExpirationTime, err = timestamp("Expiration Time", false); err != nil {
+		return m, err
+	}
+	if m.NotBefore, err = timestamp("Not Before", false); err != nil {
+		return m, err
+	}
+	if m.RequestID, err = field("Request ID", false); err != nil {
+		return m, err
+	}
+	if i < len(lines) && lines[i] == "Resources:" {
+		for i++; i < len(lines) && strings.HasPrefix(lines[i], "- "); i++ {
+			m.Resources = append(m.Resources, strings.TrimPrefix(lines[i], "- "))
+		}
+	}
+	if i != len(lines) {
+		return m, fmt.Errorf("unexpected line %q", lines[i])
+	}
+	return m, nil
+}
+
+// siweConfig holds the Sign-In with Ethereum settings and issued nonces.
+type siweConfig struct {
+	domain   string  // Expected message domain; logins are refused if empty
+	chainIDs []int64 // Accepted chains; any if empty
+	nonceTTL time.Duration
+
+	mu     sync.Mutex
+	nonces map[string]time.Time // Unused nonces and when they expire
+}
+
+func newSIWEConfig() (*siweConfig, error) {
+	c := &siweConfig{
+		domain:   siweDomain(),
+		nonceTTL: durationFromEnv("SIWE_NONCE_TTL", 5*time.Minute),
+		nonces:   make(map[string]time.Time),
+	}
+	for _, item := range splitList(os.Getenv("SIWE_CHAIN_IDS")) {
+		id, err := strconv.ParseInt(item, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid chain ID %q in SIWE_CHAIN_IDS", item)
+		}
+		c.chainIDs = append(c.chainIDs, id)
+	}
+	return c, nil
+}
+
+// siweDomain returns SIWE_DOMAIN, or else the host of JWT_ISSUER. It is never
+// taken from a request, whose Host header the client controls.
+func siweDomain() string {
+	if domain := os.Getenv("SIWE_DOMAIN"); domain != "" {
+		return domain
+	}
+	if u, err := url.Parse(os.Getenv("JWT_ISSUER")); err == nil {
+		return u.Host
+	}
+	return ""
+}
+
+// SIWENonce returns a new nonce for a Sign-In with Ethereum message and when
+// it expires. Each nonce is accepted once.
+func (im *IdentityManager) SIWENonce() (string, time.Time, error) {
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		return "", time.Time{}, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	nonce := hex.EncodeToString(raw)
+	expires := time.Now().Add(im.siwe.nonceTTL)
+
+	im.siwe.mu.Lock()
+	defer im.siwe.mu.Unlock()
+	now := time.Now()
+	for n, exp := range im.siwe.nonces {
+		if now.After(exp) {
+			delete(im.siwe.nonces, n)
+		}
+	}
+	im.siwe.nonces[nonce] = expires
+	return nonce, expires, nil
+}
+
+// takeNonce consumes nonce, reporting whether it was issued and unexpired.
+func (c *siweConfig) takeNonce(nonce string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	expires, ok := c.nonces[nonce]
+	delete(c.nonces, nonce)
+	return ok && time.Now().Before(expires)
+}
+
+// VerifySIWE checks a signed Sign-In with Ethereum message and returns the
+// address that signed it. The message must be for the configured domain. The
+// message's nonce is consumed.
+func (im *IdentityManager) VerifySIWE(message, signature string) (string, error) {
+	if im.siwe.domain == "" {
+		return "", errors.New("SIWE_DOMAIN or JWT_ISSUER must be set for Sign-In with Ethereum")
+	}
+	m, err := ParseSIWEMessage(message)
+	if err != nil {
+		return "", err
+	}
+	if m.Domain != im.siwe.domain {
+		return "", fmt.Errorf("message is for %q, not %q", m.Domain, im.siwe.domain)
+	}
+	if m.Version != "1" {
+		return "", fmt.Errorf("unsupported message version %q", m.Version)
+	}
+	if len(im.siwe.chainIDs) > 0 && !containsChain(im.siwe.chainIDs, m.ChainID) {
+		return "", fmt.Errorf("chain %d is not accepted", m.ChainID)
+	}
+	if !isAddress(m.Address) || m.Address != checksumAddress(m.Address) {
+		return "", errors.New("address is not an EIP-55 checksummed address")
+	}
+	now := time.Now()
+	if !m.ExpirationTime.IsZero() && now.After(m.ExpirationTime) {
+		return "", errors.New("message has expired")
+	}
+	if !m.NotBefore.IsZero() && now.Before(m.NotBefore) {
+		return "", errors.New("message is not valid yet")
+	}
+
+	signer, err := recoverAddress([]byte(message), signature)
+	if err != nil {
+		return "", err
+	}
+	if signer != m.Address {
+		return "", errors.New("message was not signed by its address")
+	}
+	if !im.siwe.takeNonce(m.Nonce) {
+		return "", errors.New("unknown, used or expired nonce")
+	}
+	return m.Address, nil
+}
+
+func containsChain(ids []int64, id int64) bool {
+	for _, candidate := range ids {
+		if candidate == id {
+			return true
+		}
+	}
+	return false
+}
+
+// SIWELogin verifies a signed Sign-In with Ethereum message and returns the
+// user the signing wallet is linked to and the authentication methods used.
+func (im *IdentityManager) SIWELogin(ctx context.Context, message, signature string) (string, []string, error) {
+	if err := im.mode.checkRead(); err != nil {
+		return "", nil, err
+	}
+	address, err := im.VerifySIWE(message, signature)
+	if err != nil {
+		return "", nil, err
+	}
+	db, err := im.loadDatabase(ctx)
+	if err != nil {
+		return "", nil, err
+	}
+	user, found := findWallet(db, address)
+	if !found || user.Status != StatusActive {
+		return "", nil, errors.New("no account is linked to this wallet")
+	}
+	im.log.Info(fmt.Sprintf("User %s logged in with wallet %s", user.ID, address))
+	return user.ID, []string{AMRWallet}, nil
+}
+
+func findWallet(db *database, address string) (User, bool) {
+	for _, user := range db.Users {
+		for _, wallet := range user.Wallets {
+			if strings.EqualFold(wallet, address) {
+				return user, true
+			}
+		}
+	}
+	return User{}, false
+}
+
+// LinkWallet links the wallet that signed message to the user with ID id, so
+// it can be used to log in. The message proves the user controls the wallet.
+func (im *IdentityManager) LinkWallet(ctx context.Context, actor Principal, id, message, signature string) (string, error) {
+	if err := im.mode.checkWrite(); err != nil {
+		return "", err
+	}
+	address, err := im.VerifySIWE(message, signature)
+	if err != nil {
+		return "", err
+	}
+	err = im.batch.submit(ctx, mutation{Op: opLinkWallet, ID: id, Wallet: address, Actor: actor.String(), At: time.Now()})
+	if err != nil {
+		return "", err
+	}
+	im.log.Info(fmt.Sprintf("Wallet %s linked to user %s by %s", address, id, actor))
+	return address, nil
+}
+
+// UnlinkWallet removes a linked wallet from the user with ID id.
+func (im *IdentityManager) UnlinkWallet(ctx context.Context, actor Principal, id, address string) error {
+	if err := im.mode.checkWrite(); err != nil {
+		return err
+	}
+	if !isAddress(address) {
+		return errors.New("invalid address")
+	}
+	err := im.batch.submit(ctx, mutation{Op: opUnlinkWallet, ID: id, Wallet: checksumAddress(address), Actor: actor.String(), At: time.Now()})
+	if err != nil {
+		return err
+	}
+	im.log.Info(fmt.Sprintf("Wallet %s unlinked from user %s by %s", address, id, actor))
+	return nil
+}
+
+// Wallets lists the wallet addresses linked to the user with ID id.
+func (im *IdentityManager) Wallets(ctx context.Context, id string) ([]string, error) {
+	db, err := im.loadDatabase(ctx)
+	if err != nil {
+		return nil, err
+	}
+	user, exists := db.Users[id]
+	if !exists {
+		return nil, errors.New("user not found")
+	}
+	return append([]string{}, user.Wallets...), nil
+}
+
+func keccak256(data ...[]byte) []byte {
+	h := sha3.NewLegacyKeccak256()
+	for _, d := range data {
+		h.Write(d)
+	}
+	return h.Sum(nil)
+}
+
+// isAddress reports whether s is a 0x-prefixed, 20-byte hex address in any
+// case.
+func isAddress(s string) bool {
+	if len(s) != 42 || !strings.HasPrefix(s, "0x") {
+		return false
+	}
+	_, err := hex.DecodeString(s[2:])
+	return err == nil
+}
+
+// checksumAddress returns the EIP-55 mixed-case form of a hex address.
+func checksumAddress(address string) string {
+	lower := strings.ToLower(strings.TrimPrefix(address, "0x"))
+	hash := keccak256([]byte(lower))
+	out := []byte(lower)
+	for i, c := range out {
+		nibble := hash[i/2] >> 4
+		if i%2 == 1 {
+			nibble = hash[i/2] & 0x0f
+		}
+		if c >= 'a' && nibble >= 8 {
+			out[i] = c - 'a' + 'A'
+		}
+	}
+	return "0x" + string(out)
+}
+
+// personalMessageHash returns the hash personal_sign signs for message: the
+// Keccak-256 of the EIP-191 version 0x45 prefix and the message.
+func personalMessageHash(message []byte) []byte {
+	prefix := fmt.Sprintf("\x19Ethereum Signed Message:\n%d", len(message))
+	return keccak256([]byte(prefix), message)
+}
+
+// recoverAddress returns the checksummed address of the key that made
+// signature, a 65-byte r || s || v personal_sign (EIP-191) signature over
+// message.
+func recoverAddress(message []byte, signature string) (string, error) {
+	sig, err := hex.DecodeString(strings.TrimPrefix(signature, "0x"))
+	if err != nil || len(sig) != 65 {
+		return "", errors.New("signature must be 65 hex-encoded bytes")
+	}
+	v := sig[64]
+	if v >= 27 {
+		v -= 27
+	}
+	if v > 1 {
+		return "", errors.New("invalid signature recovery id")
+	}
+	// High s values are malleable copies of valid signatures (EIP-2).
+	var s secp256k1.ModNScalar
+	if overflow := s.SetByteSlice(sig[32:64]); overflow || s.IsOverHalfOrder() {
+		return "", errors.New("invalid signature s value")
+	}
+
+	compact := append([]byte{27 + v}, sig[:64]...)
+	key, _, err := ecdsa.RecoverCompact(compact, personalMessageHash(message))
+	if err != nil {
+		return "", errors.New("invalid signature")
+	}
+	return checksumAddress(hex.EncodeToString(keccak256(key.SerializeUncompressed()[1:])[12:])), nil
+}
@@ -0,0 +1,261 @@
+package util
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/decred/dcrd/dcrec/secp256k1/v4"
+	"github.com/decred/dcrd/dcrec/secp256k1/v4/ecdsa"
+)
+
+// The key and signature of the web3.js accounts.sign example.
+const (
+	testWalletKey       = "4c0883a69102937d6231471b5dbb6204fe5129617082792ae468d01a3f362318"
+	testWalletAddress   = "0x2c7536E3605D9C16a7a3D7b1898e529396a65c23"
+	testWalletSignature = "0xb91467e570a6466aa9e9876cbcd013baba02900b8979d43fe208a4a4f339f5fd6007e74cd82e037b800186422fc2da167c747ef045e5d18a5f5d4300f8e1a0291c"
+)
+
+// signPersonal signs message with personal_sign, as a wallet does.
+func signPersonal(t *testing.T, message string) string {
+	t.Helper()
+	raw, err := hex.DecodeString(testWalletKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compact := ecdsa.SignCompact(secp256k1.PrivKeyFromBytes(raw), personalMessageHash([]byte(message)), false)
+	sig := make([]byte, 0, 65)
+	sig = append(sig, compact[1:]...)
+	sig = append(sig, compact[0])
+	return "0x" + hex.EncodeToString(sig)
+}
+
+func TestParseSIWEMessage(t *testing.T) {
+	full := SIWEMessage{
+		Scheme:         "https",
+		Domain:         "login.example.com",
+		Address:        testWalletAddress,
+		Statement:      "Sign in to Example.",
+		URI:            "https://login.example.com/siwe",
+		Version:        "1",
+		ChainID:        1,
+		Nonce:          "32891756",
+		IssuedAt:       time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC),
+		ExpirationTime: time.Date(2026, 1, 1, 0, 5, 0, 0, time.UTC),
+		NotBefore:      time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC),
+		RequestID:      "request-1",
+		Resources:      []string{"ipfs://bafybeiemxf5abjwjbikoz4mc3a3dla6ual3jsgpdr4cjr3oz3evfyavhwq", "https://example.com/terms"},
+	}
+	got, err := ParseSIWEMessage(full.String())
+	if err != nil {
+		t.Fatalf("ParseSIWEMessage: %v", err)
+	}
+	if got.String() != full.String() || got.Scheme != "https" || len(got.Resources) != 2 {
+		t.Errorf("round trip:\n%s\nwant:\n%s", got, full)
+	}
+
+	minimal := "login.example.com wants you to sign in with your Ethereum account:\n" + testWalletAddress + "\n\n" +
+		"URI: https://login.example.com\nVersion: 1\nChain ID: 1\nNonce: 32891756\nIssued At: 2026-01-01T00:00:00Z"
+	tests := []struct {
+		name    string
+		text    string
+		wantErr bool
+	}{
+		{name: "without statement", text: minimal},
+		{name: "without statement, with both blank lines", text: strings.Replace(minimal, "\n\n", "\n\n\n", 1)},
+		{name: "not a SIWE message", text: "Hello World", wantErr: true},
+		{name: "no domain", text: strings.TrimPrefix(minimal, "login.example.com"), wantErr: true},
+		{name: "no blank line after the address", text: strings.Replace(minimal, "\n\n", "\n", 1), wantErr: true},
+		{name: "missing nonce", text: strings.Replace(minimal, "Nonce: 32891756\n", "", 1), wantErr: true},
+		{name: "malformed chain ID", text: strings.Replace(minimal, "Chain ID: 1", "Chain ID: one", 1), wantErr: true},
+		{name: "zero chain ID", text: strings.Replace(minimal, "Chain ID: 1", "Chain ID: 0", 1), wantErr: true},
+		{name: "malformed timestamp", text: strings.Replace(minimal, "2026-01-01T00:00:00Z", "yesterday", 1), wantErr: true},
+		{name: "fields out of order", text: strings.Replace(minimal, "Version: 1\nChain ID: 1", "Chain ID: 1\nVersion: 1", 1), wantErr: true},
+		{name: "trailing line", text: minimal + "\nExtra: field", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ParseSIWEMessage(tt.text); (err != nil) != tt.wantErr {
+				t.Errorf("ParseSIWEMessage error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPersonalMessageHash(t *testing.T) {
+	tests := []struct {
+		message string
+		want    string
+	}{
+		{"Hello World", "a1de988600a42c4b4ab089b619297c17d53cffae5d5120d82d8a92d0bb3b78f2"},
+		{"Some data", "1da44b586eb0729ff70a73c326926f6ed5a25f5b056e7f47fbc6e58d86871655"},
+	}
+	for _, tt := range tests {
+		if got := hex.EncodeToString(personalMessageHash([]byte(tt.message))); got != tt.want {
+			t.Errorf("personalMessageHash(%q) = %s, want %s", tt.message, got, tt.want)
+		}
+	}
+}
+
+func TestChecksumAddress(t *testing.T) {
+	// Test vectors from EIP-55.
+	for _, want := range []string{
+		"0x5aAeb6053F3E94C9b9A09f33669435E7Ef1BeAed",
+		"0xfB6916095ca1df60bB79Ce92cE3Ea74c37c5d359",
+		"0xdbF03B407c01E7cD3CBea99509d93f8DDDC8C6FB",
+		"0xD1220A0cf47c7B9Be7A2E6BA89F429762e7b9aDb",
+		"0x52908400098527886E0F7030069857D2E4169EE7",
+		"0xde709f2102306220921060314715629080e2fb77",
+	} {
+		if got := checksumAddress(strings.ToLower(want)); got != want {
+			t.Errorf("checksumAddress = %s, want %s", got, want)
+		}
+		if !isAddress(want) {
+			t.Errorf("isAddress(%s) = false", want)
+		}
+	}
+	for _, s := range []string{"", "5aAeb6053F3E94C9b9A09f33669435E7Ef1BeAed", "0x5aAeb6053F3E94C9b9A09f33669435E7Ef1BeAe", "0xZaAeb6053F3E94C9b9A09f33669435E7Ef1BeAed"} {
+		if isAddress(s) {
+			t.Errorf("isAddress(%q) = true", s)
+		}
+	}
+}
+
+func TestRecoverAddress(t *testing.T) {
+	lowV := testWalletSignature[:len(testWalletSignature)-2] + "01"
+	tests := []struct {
+		name      string
+		message   string
+		signature string
+		want      string // Empty if recovery must fail
+	}{
+		{name: "known signature", message: "Some data", signature: testWalletSignature, want: testWalletAddress},
+		{name: "recovery id 0 or 1", message: "Some data", signature: lowV, want: testWalletAddress},
+		{name: "without 0x", message: "Some data", signature: strings.TrimPrefix(testWalletSignature, "0x"), want: testWalletAddress},
+		{name: "own signature", message: "Hello World", signature: signPersonal(t, "Hello World"), want: testWalletAddress},
+		{name: "short", message: "Some data", signature: testWalletSignature[:len(testWalletSignature)-2]},
+		{name: "not hex", message: "Some data", signature: "0x" + strings.Repeat("zz", 65)},
+		{name: "bad recovery id", message: "Some data", signature: testWalletSignature[:len(testWalletSignature)-2] + "1d"},
+		{name: "high s", message: "Some data", signature: highS(t, testWalletSignature)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := recoverAddress([]byte(tt.message), tt.signature)
+			if tt.want == "" {
+				if err == nil {
+					t.Errorf("recoverAddress = %s, want error", got)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("recoverAddress = %s, %v, want %s", got, err, tt.want)
+			}
+		})
+	}
+
+	// A different message recovers some other key, never the signer.
+	if got, err := recoverAddress([]byte("Some data!"), testWalletSignature); err == nil && got == testWalletAddress {
+		t.Error("signature over another message recovered the signer")
+	}
+}
+
+// highS returns the malleable twin of signature, with s replaced by n - s and
+// the recovery id flipped.
+func highS(t *testing.T, signature string) string {
+	t.Helper()
+	sig, err := hex.DecodeString(strings.TrimPrefix(signature, "0x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var s secp256k1.ModNScalar
+	s.SetByteSlice(sig[32:64])
+	s.Negate()
+	b := s.Bytes()
+	copy(sig[32:64], b[:])
+	sig[64] = 27 + ((sig[64] - 27) ^ 1)
+	return "0x" + hex.EncodeToString(sig)
+}
+
+func TestVerifySIWE(t *testing.T) {
+	t.Setenv("SIWE_DOMAIN", "login.example.com")
+	t.Setenv("SIWE_CHAIN_IDS", "1,10")
+	siwe, err := newSIWEConfig()
+	if err != nil {
+		t.Fatalf("newSIWEConfig: %v", err)
+	}
+	im := &IdentityManager{siwe: siwe}
+
+	message := func(edit func(m *SIWEMessage)) string {
+		t.Helper()
+		nonce, _, err := im.SIWENonce()
+		if err != nil {
+			t.Fatalf("SIWENonce: %v", err)
+		}
+		m := SIWEMessage{
+			Domain:         "login.example.com",
+			Address:        testWalletAddress,
+			URI:            "https://login.example.com",
+			Version:        "1",
+			ChainID:        1,
+			Nonce:          nonce,
+			IssuedAt:       time.Now().Add(-time.Minute),
+			ExpirationTime: time.Now().Add(time.Minute),
+		}
+		if edit != nil {
+			edit(&m)
+		}
+		return m.String()
+	}
+	signed := func(edit func(m *SIWEMessage)) (string, string) {
+		t.Helper()
+		text := message(edit)
+		return text, signPersonal(t, text)
+	}
+
+	text, sig := signed(nil)
+	if got, err := im.VerifySIWE(text, sig); err != nil || got != testWalletAddress {
+		t.Fatalf("VerifySIWE = %s, %v, want %s", got, err, testWalletAddress)
+	}
+	if _, err := im.VerifySIWE(text, sig); err == nil {
+		t.Error("VerifySIWE accepted a reused nonce")
+	}
+
+	tests := []struct {
+		name   string
+		edit   func(m *SIWEMessage) // Applied before signing
+		tamper func(text string) string
+	}{
+		{name: "unknown nonce", edit: func(m *SIWEMessage) { m.Nonce = "0123456789abcdef" }},
+		{name: "wrong domain", edit: func(m *SIWEMessage) { m.Domain = "evil.example.com" }},
+		{name: "wrong chain", edit: func(m *SIWEMessage) { m.ChainID = 5 }},
+		{name: "expired", edit: func(m *SIWEMessage) { m.ExpirationTime = time.Now().Add(-time.Second) }},
+		{name: "not valid yet", edit: func(m *SIWEMessage) { m.NotBefore = time.Now().Add(time.Minute) }},
+		{name: "unsupported version", edit: func(m *SIWEMessage) { m.Version = "2" }},
+		{name: "address not checksummed", edit: func(m *SIWEMessage) { m.Address = strings.ToLower(m.Address) }},
+		{name: "signed by another key", edit: func(m *SIWEMessage) { m.Address = "0x5aAeb6053F3E94C9b9A09f33669435E7Ef1BeAed" }},
+		{name: "tampered message", tamper: func(text string) string {
+			return strings.Replace(text, "URI: https://login.example.com", "URI: https://evil.example.com", 1)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			text, sig := signed(tt.edit)
+			if tt.tamper != nil {
+				text = tt.tamper(text)
+			}
+			if got, err := im.VerifySIWE(text, sig); err == nil {
+				t.Errorf("VerifySIWE = %s, want error", got)
+			}
+		})
+	}
+
+	// A rejected signature does not consume the nonce of the message.
+	text, sig = signed(nil)
+	if _, err := im.VerifySIWE(text, signPersonal(t, text+"\n")); err == nil {
+		t.Fatal("VerifySIWE accepted a signature over another message")
+	}
+	if _, err := im.VerifySIWE(text, sig); err != nil {
+		t.Errorf("VerifySIWE after a rejected signature: %v", err)
+	}
+}
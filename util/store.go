@@ -0,0 +1,18 @@
+package util
+
+import (
+	"context"
+	"io"
+)
+
+// Store is the content-addressed storage the IdentityManager keeps its state
+// in. A Cluster of IPFS HTTP API endpoints is the default implementation.
+// Every call must give up once ctx is done.
+type Store interface {
+	// Cat returns the content stored under cid.
+	Cat(ctx context.Context, cid string) (io.ReadCloser, error)
+	// Add stores the content of r and returns its CID.
+	Add(ctx context.Context, r io.Reader) (string, error)
+	// IsUp reports whether the store currently accepts writes.
+	IsUp(ctx context.Context) bool
+}
@@ -0,0 +1,276 @@
+package util
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// TokenPair is the response to a successful login or refresh.
+type TokenPair struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"` // Access token lifetime in seconds
+	RefreshToken string `json:"refresh_token"`
+}
+
+// tokenConfig holds the settings for issuing tokens.
+type tokenConfig struct {
+	issuer     string
+	audience   string
+	accessTTL  time.Duration
+	refreshTTL time.Duration
+}
+
+// refreshFamily is the chain of refresh tokens descending from one login.
+// Only the newest token is valid; presenting an older one means a token was
+// copied, so the whole family is revoked. Families started for an OIDC client
+// record the client and the granted scope and can only be used by it.
+type refreshFamily struct {
+	ID        string    `json:"id"`
+	UserID    string    `json:"user_id"`
+	ClientID  string    `json:"client_id,omitempty"`
+	Scope     string    `json:"scope,omitempty"`
+	AMR       []string  `json:"amr,omitempty"`     // Authentication methods of the login
+	Current   string    `json:"current"`           // Hash of the valid token
+	Rotated   []string  `json:"rotated,omitempty"` // Hashes of tokens already exchanged
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"` // Expiry of the current token
+	Revoked   bool      `json:"revoked,omitempty"`
+}
+
+// refreshStore keeps refresh-token families in a local JSON file. Tokens are
+// stored only as hashes.
+type refreshStore struct {
+	mu       sync.Mutex
+	path     string
+	families map[string]*refreshFamily
+}
+
+func openRefreshStore(path string) (*refreshStore, error) {
+	s := &refreshStore{path: path, families: make(map[string]*refreshFamily)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read refresh tokens: %w", err)
+	}
+	if err := json.Unmarshal(data, &s.families); err != nil {
+		return nil, fmt.Errorf("failed to parse refresh tokens: %w", err)
+	}
+	return s, nil
+}
+
+// save writes the store to disk, dropping expired families. Callers must hold
+// s.mu.
+func (s *refreshStore) save() error {
+	now := time.Now()
+	for id, family := range s.families {
+		if now.After(family.ExpiresAt) {
+			delete(s.families, id)
+		}
+	}
+	data, err := json.Marshal(s.families)
+	if err != nil {
+		return fmt.Errorf("failed to marshal refresh tokens: %w", err)
+	}
+	if err := writeFileAtomic(s.path, data); err != nil {
+		return fmt.Errorf("failed to save refresh tokens: %w", err)
+	}
+	return nil
+}
+
+// newRefreshToken returns an opaque token in family and its hash.
+func newRefreshToken(family string) (string, string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", "", fmt.Errorf("failed to generate refresh token: %w", err)
+	}
+	token := family + "." + base64.RawURLEncoding.EncodeToString(secret)
+	return token, hashToken(token), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// start creates a family from session, which holds the user ID and, for OIDC
+// clients, the client and scope, and returns its first token.
+func (s *refreshStore) start(session refreshFamily, ttl time.Duration) (string, error) {
+	id := uuid.New().String()
+	token, hash, err := newRefreshToken(id)
+	if err != nil {
+		return "", err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	session.ID = id
+	session.Current = hash
+	session.CreatedAt = now
+	session.ExpiresAt = now.Add(ttl)
+	s.families[id] = &session
+	return token, s.save()
+}
+
+// rotate exchanges token, which must have been issued to clientID (empty for
+// first-party sessions), for a new one in the same family and returns the
+// family and the new token. Reuse of a rotated token revokes the family; the
+// returned bool reports whether that happened.
+func (s *refreshStore) rotate(token, clientID string, ttl time.Duration) (refreshFamily, string, bool, error) {
+	id, _, ok := strings.Cut(token, ".")
+	if !ok {
+		return refreshFamily{}, "", false, ErrInvalidToken
+	}
+	hash := hashToken(token)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	family, exists := s.families[id]
+	if !exists || family.Revoked || family.ClientID != clientID || time.Now().After(family.ExpiresAt) {
+		return refreshFamily{}, "", false, ErrInvalidToken
+	}
+	if hash != family.Current {
+		for _, rotated := range family.Rotated {
+			if hash == rotated {
+				family.Revoked = true
+				if err := s.save(); err != nil {
+					return *family, "", true, err
+				}
+				return *family, "", true, ErrInvalidToken
+			}
+		}
+		return refreshFamily{}, "", false, ErrInvalidToken
+	}
+
+	next, nextHash, err := newRefreshToken(id)
+	if err != nil {
+		return refreshFamily{}, "", false, err
+	}
+	family.Rotated = append(family.Rotated, family.Current)
+	family.Current = nextHash
+	family.ExpiresAt = time.Now().Add(ttl)
+	if err := s.save(); err != nil {
+		return refreshFamily{}, "", false, err
+	}
+	return *family, next, false, nil
+}
+
+// revoke revokes the family token belongs to.
+func (s *refreshStore) revoke(token string) error {
+	id, _, _ := strings.Cut(token, ".")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if family, exists := s.families[id]; exists {
+		family.Revoked = true
+		return s.save()
+	}
+	return nil
+}
+
+// revokeUser revokes every family of userID, ending all of its sessions.
+func (s *refreshStore) revokeUser(userID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, family := range s.families {
+		if family.UserID == userID {
+			family.Revoked = true
+		}
+	}
+	return s.save()
+}
+
+// accessToken signs a new access token for userID, who authenticated with
+// the methods in amr.
+func (im *IdentityManager) accessToken(userID string, amr []string) (string, error) {
+	now := time.Now()
+	return im.signer.Sign(Claims{
+		Issuer:    im.tokens.issuer,
+		Subject:   userID,
+		Audience:  im.tokens.audience,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(im.tokens.accessTTL).Unix(),
+		ID:        uuid.New().String(),
+		AMR:       amr,
+	})
+}
+
+func (im *IdentityManager) tokenPair(userID string, amr []string, refresh string) (TokenPair, error) {
+	access, err := im.accessToken(userID, amr)
+	if err != nil {
+		return TokenPair{}, err
+	}
+	return TokenPair{
+		AccessToken:  access,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(im.tokens.accessTTL.Seconds()),
+		RefreshToken: refresh,
+	}, nil
+}
+
+// IssueTokens starts a new session for userID, who has just authenticated
+// with the methods in amr, and returns its first access and refresh tokens.
+func (im *IdentityManager) IssueTokens(userID string, amr []string) (TokenPair, error) {
+	refresh, err := im.refresh.start(refreshFamily{UserID: userID, AMR: amr}, im.tokens.refreshTTL)
+	if err != nil {
+		return TokenPair{}, err
+	}
+	return im.tokenPair(userID, amr, refresh)
+}
+
+// RefreshTokens exchanges a refresh token for a new token pair. The presented
+// token cannot be used again.
+func (im *IdentityManager) RefreshTokens(ctx context.Context, refreshToken string) (TokenPair, error) {
+	if err := im.mode.checkRead(); err != nil {
+		return TokenPair{}, err
+	}
+
+	family, next, reused, err := im.refresh.rotate(refreshToken, "", im.tokens.refreshTTL)
+	if reused {
+		im.log.Warn(fmt.Sprintf("Refresh token reuse detected, revoked session of user %s", family.UserID))
+	}
+	if err != nil {
+		return TokenPair{}, err
+	}
+	userID := family.UserID
+
+	// The account may have been deleted or deactivated since the last refresh.
+	db, err := im.loadDatabase(ctx)
+	if err != nil {
+		return TokenPair{}, err
+	}
+	if user, exists := db.Users[userID]; !exists || user.Status != StatusActive {
+		if err := im.refresh.revoke(next); err != nil {
+			im.log.Error(fmt.Sprintf("Failed to revoke refresh tokens: %v", err))
+		}
+		return TokenPair{}, ErrInvalidToken
+	}
+	return im.tokenPair(userID, family.AMR, next)
+}
+
+// VerifyAccessToken checks the signature, expiry and audience of an access
+// token and returns its claims.
+func (im *IdentityManager) VerifyAccessToken(token string) (Claims, error) {
+	var claims Claims
+	if err := im.signer.Parse(token, &claims); err != nil {
+		return claims, err
+	}
+	if err := claims.valid(im.tokens.audience, time.Now()); err != nil {
+		return claims, err
+	}
+	return claims, nil
+}
@@ -0,0 +1,100 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestRefreshTokens(t *testing.T) {
+	t.Setenv("JWT_ISSUER", "https://id.example.com")
+	ctx := context.Background()
+	im := newTestManager(t, newTestNode(t))
+
+	id, err := im.BootstrapAdmin(ctx, "ada", "ada-password")
+	if err != nil {
+		t.Fatalf("BootstrapAdmin: %v", err)
+	}
+	login := func() TokenPair {
+		t.Helper()
+		tokens, err := im.IssueTokens(id, []string{AMRPassword})
+		if err != nil {
+			t.Fatalf("IssueTokens: %v", err)
+		}
+		return tokens
+	}
+
+	t.Run("rotation", func(t *testing.T) {
+		first := login()
+		second, err := im.RefreshTokens(ctx, first.RefreshToken)
+		if err != nil {
+			t.Fatalf("RefreshTokens: %v", err)
+		}
+		if second.RefreshToken == first.RefreshToken {
+			t.Fatal("refresh token was not rotated")
+		}
+		claims, err := im.VerifyAccessToken(second.AccessToken)
+		if err != nil {
+			t.Fatalf("VerifyAccessToken: %v", err)
+		}
+		if claims.Subject != id || len(claims.AMR) != 1 || claims.AMR[0] != AMRPassword {
+			t.Errorf("refreshed claims: subject %q amr %v, want %q [%s]", claims.Subject, claims.AMR, id, AMRPassword)
+		}
+		if _, err := im.RefreshTokens(ctx, second.RefreshToken); err != nil {
+			t.Errorf("RefreshTokens with the rotated token: %v", err)
+		}
+	})
+
+	t.Run("reuse revokes the family", func(t *testing.T) {
+		first := login()
+		other := login()
+		second, err := im.RefreshTokens(ctx, first.RefreshToken)
+		if err != nil {
+			t.Fatalf("RefreshTokens: %v", err)
+		}
+		if _, err := im.RefreshTokens(ctx, first.RefreshToken); !errors.Is(err, ErrInvalidToken) {
+			t.Fatalf("reused RefreshTokens = %v, want ErrInvalidToken", err)
+		}
+		if _, err := im.RefreshTokens(ctx, second.RefreshToken); !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("RefreshTokens with the newest token of a revoked family = %v, want ErrInvalidToken", err)
+		}
+		if _, err := im.RefreshTokens(ctx, other.RefreshToken); err != nil {
+			t.Errorf("RefreshTokens of another login: %v", err)
+		}
+	})
+
+	t.Run("unknown token", func(t *testing.T) {
+		if _, err := im.RefreshTokens(ctx, "not-a-token"); !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("RefreshTokens = %v, want ErrInvalidToken", err)
+		}
+	})
+}
+
+func TestEditUserRevokesSessions(t *testing.T) {
+	t.Setenv("JWT_ISSUER", "https://id.example.com")
+	ctx := context.Background()
+	im := newTestManager(t, newTestNode(t))
+
+	id, err := im.BootstrapAdmin(ctx, "ada", "ada-password")
+	if err != nil {
+		t.Fatalf("BootstrapAdmin: %v", err)
+	}
+	tokens, err := im.IssueTokens(id, []string{AMRPassword})
+	if err != nil {
+		t.Fatalf("IssueTokens: %v", err)
+	}
+
+	if err := im.EditUser(ctx, id, "ada.lovelace", ""); err != nil {
+		t.Fatalf("EditUser username: %v", err)
+	}
+	if tokens, err = im.RefreshTokens(ctx, tokens.RefreshToken); err != nil {
+		t.Fatalf("RefreshTokens after a username change: %v", err)
+	}
+
+	if err := im.EditUser(ctx, id, "", "new-password"); err != nil {
+		t.Fatalf("EditUser password: %v", err)
+	}
+	if _, err := im.RefreshTokens(ctx, tokens.RefreshToken); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("RefreshTokens after a password change = %v, want ErrInvalidToken", err)
+	}
+}
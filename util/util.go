@@ -1,20 +1,21 @@
 package util
 
 import (
-	"encoding/json"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
 	"errors"
 	"fmt"
-	"io"
 	"os"
-	"strings"
+	"path/filepath"
 	"sync"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/joho/godotenv"
-	ipfsapi "github.com/ipfs/go-ipfs-api"
 	"golang.org/x/crypto/bcrypt"
 
+	"ipfs-identity/did"
 	"ipfs-identity/logger"
 )
 
@@ -25,15 +26,135 @@ type User struct {
 	Password  string    `json:"password"` // Hashed password
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
+	Status    string    `json:"status"`
+	Roles     []string  `json:"roles,omitempty"` // Names of assigned roles, sorted
+	TOTP      *TOTP     `json:"totp,omitempty"`  // Authenticator enrollment, if any
+
+	Credentials []WebAuthnCredential `json:"webauthn_credentials,omitempty"` // Registered passkeys and security keys
+	Wallets     []string             `json:"wallets,omitempty"`              // Linked Ethereum addresses, EIP-55 checksummed
+	DID         *UserDID             `json:"did,omitempty"`                  // Decentralized identifier and key history
+	Attributes  map[string]string    `json:"attributes,omitempty"`           // Claims vouched for by an administrator, e.g. birthdate
+	LinkedDIDs  []string             `json:"linked_dids,omitempty"`          // Further DIDs the user can log in with
+
+	UpdateKey      string `json:"update_key,omitempty"`      // Multikey profile updates must be signed with, if registered
+	UpdateSequence int    `json:"update_sequence,omitempty"` // Sequence number of the last signed update
+
+	Email         string `json:"email,omitempty"`          // Normalized address, unique across users
+	EmailVerified bool   `json:"email_verified,omitempty"` // Whether Email was confirmed through a verification link
+	PendingEmail  string `json:"pending_email,omitempty"`  // New address awaiting verification before it replaces Email
+}
+
+// StatusActive is the status of an account that may log in.
+const StatusActive = "active"
+
+// canonical returns u with every timestamp in UTC, as it is stored.
+func (u User) canonical() User {
+	u.CreatedAt = u.CreatedAt.UTC()
+	if u.TOTP != nil {
+		totp := *u.TOTP
+		totp.EnrolledAt = totp.EnrolledAt.UTC()
+		u.TOTP = &totp
+	}
+	if u.Credentials != nil {
+		creds := make([]WebAuthnCredential, len(u.Credentials))
+		for i, c := range u.Credentials {
+			creds[i] = c.canonical()
+		}
+		u.Credentials = creds
+	}
+	if u.DID != nil {
+		d := u.DID.canonical()
+		u.DID = &d
+	}
+	u.UpdatedAt = u.UpdatedAt.UTC()
+	return u
+}
+
+// database is the whole state stored under a root CID.
+type database struct {
+	Users    map[string]User
+	Roles    map[string]Role // Custom roles; built-in roles are not stored
+	Policies map[string]Policy
+	Clients  map[string]Client // Registered OIDC clients
+
+	Credentials map[string]IssuedCredential // Verifiable credentials issued, by ID
+	StatusList  *StatusList                 // Latest published revocation list
+}
+
+func newDatabase() *database {
+	return &database{
+		Users:    make(map[string]User),
+		Roles:    make(map[string]Role),
+		Policies: make(map[string]Policy),
+		Clients:  make(map[string]Client),
+
+		Credentials: make(map[string]IssuedCredential),
+	}
+}
+
+// clone returns a copy of db whose maps can be modified independently.
+func (db *database) clone() *database {
+	c := &database{
+		Users:    cloneUsers(db.Users),
+		Roles:    make(map[string]Role, len(db.Roles)),
+		Policies: make(map[string]Policy, len(db.Policies)),
+		Clients:  make(map[string]Client, len(db.Clients)),
+
+		Credentials: make(map[string]IssuedCredential, len(db.Credentials)),
+		StatusList:  db.StatusList,
+	}
+	for name, role := range db.Roles {
+		c.Roles[name] = role
+	}
+	for id, policy := range db.Policies {
+		c.Policies[id] = policy
+	}
+	for id, client := range db.Clients {
+		c.Clients[id] = client
+	}
+	for id, credential := range db.Credentials {
+		c.Credentials[id] = credential
+	}
+	return c
 }
 
 // IdentityManager handles identity operations.
 // It includes a mutex for protecting concurrent access to the user data and CID.
 type IdentityManager struct {
-	ipfs *ipfsapi.Shell
-	cid  string // Content ID of the user database
-	mu   sync.RWMutex
-	log  logger.Logger
+	ipfs    Store  // The backend wrapped with deadlines, retries and a circuit breaker
+	backend Store  // The unwrapped store, for backend-specific features
+	cid     string // Content ID of the user database
+	mu      sync.RWMutex
+	log     logger.Logger
+
+	cache *database      // Decoded state at cid, nil until first read
+	batch *writeBatcher  // Coalesces concurrent writes into one upload
+	wal   *writeAheadLog // Writes waiting for IPFS to become reachable
+	mfs   *MFSMirror     // Optional browsable copy of the state, nil if disabled
+	mode  *modeSwitch    // Normal, read-only or maintenance
+
+	signer  *Signer       // Signs access tokens
+	tokens  tokenConfig   // Token lifetimes and audience
+	refresh *refreshStore // Refresh-token families
+	apiKeys []apiKey      // Static credentials from API_KEYS
+	codes   *codeStore    // Unredeemed OIDC authorization codes
+	mfa     *mfaConfig    // TOTP encryption key, skew and challenge state
+
+	webauthn *webauthnConfig // Relying party settings and pending ceremonies
+	siwe     *siweConfig     // Sign-In with Ethereum settings and issued nonces
+
+	didDomain string  // Domain of did:web identifiers
+	vcSigner  *Signer // Ed25519 key verifiable credentials are signed with
+
+	didAuth  *didAuthConfig // Nonces issued for DID logins
+	resolver did.Resolver   // Resolves DIDs the service does not answer itself
+
+	notifier Notifier     // Delivers messages such as password reset links
+	resets   *resetStore  // Unredeemed password reset tokens
+	email    *emailConfig // Email verification links and policy
+
+	compress   bool   // Gzip stored states
+	historyKey []byte // Authenticates history cursors; random, so they last until a restart
 }
 
 // NewIdentityManager initializes the IdentityManager.
@@ -58,118 +179,391 @@ func NewIdentityManager() *IdentityManager {
 		os.Exit(1)
 	}
 
-	shell := ipfsapi.NewShell(ipfsNode)
-	return &IdentityManager{
-		ipfs: shell,
-		log:  log,
+	// Tokens, OIDC discovery and links in messages name the issuer, which
+	// must not be taken from requests.
+	if os.Getenv("JWT_ISSUER") == "" {
+		log.Error("JWT_ISSUER environment variable not set")
+		os.Exit(1)
 	}
-}
 
-// loadUsers retrieves users from IPFS.
-func (im *IdentityManager) loadUsers() (map[string]User, error) {
-	im.mu.RLock()
-	defer im.mu.RUnlock()
+	var store Store
+	if ipfsNode == "embedded" {
+		node, err := NewEmbeddedNode(context.Background(), NewEmbeddedConfigFromEnv())
+		if err != nil {
+			log.Error(fmt.Sprintf("Failed to start embedded IPFS node: %v", err))
+			os.Exit(1)
+		}
+		log.Info(fmt.Sprintf("Embedded IPFS node started with peer ID %q", node.ID()))
+		store = node
+	} else {
+		// IPFS_NODE may list several endpoints; see NewCluster.
+		cluster, err := NewCluster(ipfsNode,
+			intFromEnv("IPFS_WRITE_QUORUM", 0),
+			durationFromEnv("IPFS_PIN_TIMEOUT", 10*time.Second),
+			log,
+		)
+		if err != nil {
+			log.Error(fmt.Sprintf("Invalid IPFS_NODE: %v", err))
+			os.Exit(1)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		err = cluster.ConfigureNetwork(ctx, NewNetworkConfigFromEnv())
+		cancel()
+		if err != nil {
+			log.Error(fmt.Sprintf("Failed to configure private IPFS network: %v", err))
+			os.Exit(1)
+		}
+		cluster.StartHealthChecks(context.Background(), durationFromEnv("IPFS_HEALTH_INTERVAL", 10*time.Second))
+		store = cluster
+	}
 
-	// If no CID is set, return an empty map.
-	if im.cid == "" {
-		return make(map[string]User), nil
+	walDir := os.Getenv("WAL_DIR")
+	if walDir == "" {
+		walDir = "data"
 	}
+	im, err := NewIdentityManagerWithStore(store, walDir, log)
+	if err != nil {
+		log.Error(err.Error())
+		os.Exit(1)
+	}
+
+	// Mirror the state into the primary node's MFS if IPFS_MFS_ROOT is set.
+	if root := os.Getenv("IPFS_MFS_ROOT"); root != "" {
+		cluster, ok := store.(*Cluster)
+		if !ok {
+			log.Error("IPFS_MFS_ROOT requires an external IPFS node")
+			os.Exit(1)
+		}
+		im.mfs = NewMFSMirror(cluster.primary.shell, root, log)
+	}
+
+	im.StartModeChecks(context.Background(), durationFromEnv("MODE_CHECK_INTERVAL", 5*time.Second))
+	return im
+}
 
-	reader, err := im.ipfs.Cat(im.cid)
+// NewIdentityManagerWithStore creates an IdentityManager on top of store,
+// keeping its write-ahead log in walDir. Unlike NewIdentityManager it needs no
+// .env file or IPFS_NODE, so it can be used with an embedded node in tests.
+func NewIdentityManagerWithStore(store Store, walDir string, log logger.Logger) (*IdentityManager, error) {
+	wal, head, err := openWAL(walDir)
 	if err != nil {
-		return nil, fmt.Errorf("failed to fetch data from IPFS: %w", err)
+		return nil, fmt.Errorf("failed to open write-ahead log: %w", err)
 	}
-	defer reader.Close()
 
-	data, err := io.ReadAll(reader)
+	alg := os.Getenv("JWT_ALG")
+	if alg == "" {
+		alg = AlgEdDSA
+	}
+	keyFile := os.Getenv("JWT_KEY_FILE")
+	if keyFile == "" {
+		keyFile = filepath.Join(walDir, "jwt.key")
+	}
+	signer, err := loadOrCreateSigner(keyFile, alg)
+	if err != nil {
+		return nil, err
+	}
+	vcKeyFile := os.Getenv("VC_KEY_FILE")
+	if vcKeyFile == "" {
+		vcKeyFile = filepath.Join(walDir, "vc.key")
+	}
+	vcSigner, err := loadOrCreateSigner(vcKeyFile, AlgEdDSA)
+	if err != nil {
+		return nil, err
+	}
+	mfaKeyFile := os.Getenv("MFA_KEY_FILE")
+	if mfaKeyFile == "" {
+		mfaKeyFile = filepath.Join(walDir, "mfa.key")
+	}
+	mfaKey, err := loadOrCreateMFAKey(mfaKeyFile)
 	if err != nil {
-		return nil, fmt.Errorf("failed reading data: %w", err)
+		return nil, err
+	}
+	refresh, err := openRefreshStore(filepath.Join(walDir, "refresh_tokens.json"))
+	if err != nil {
+		return nil, err
+	}
+	resets, err := openResetStore(filepath.Join(walDir, "reset_tokens.json"), durationFromEnv("PASSWORD_RESET_TTL", 30*time.Minute))
+	if err != nil {
+		return nil, err
+	}
+	apiKeys, err := parseAPIKeys(os.Getenv("API_KEYS"))
+	if err != nil {
+		return nil, err
+	}
+	siwe, err := newSIWEConfig()
+	if err != nil {
+		return nil, err
+	}
+	email, err := newEmailConfig()
+	if err != nil {
+		return nil, err
+	}
+	historyKey := make([]byte, 32)
+	if _, err := rand.Read(historyKey); err != nil {
+		return nil, fmt.Errorf("failed to generate history cursor key: %w", err)
+	}
+	audience := os.Getenv("JWT_AUDIENCE")
+	if audience == "" {
+		audience = "ipfs-identity"
 	}
 
-	var users map[string]User
-	if err := json.Unmarshal(data, &users); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal user data: %w", err)
+	im := &IdentityManager{
+		ipfs:     newResilientStoreFromEnv(store),
+		backend:  store,
+		cid:      head.CID,
+		log:      log,
+		wal:      wal,
+		compress: os.Getenv("STORAGE_COMPRESSION") == "gzip",
+		mode: newModeSwitch(
+			durationFromEnv("MODE_RETRY_AFTER", 30*time.Second),
+			optionalDurationFromEnv("MODE_READ_ONLY_AFTER", 30*time.Second),
+			log,
+		),
+		signer: signer,
+		tokens: tokenConfig{
+			issuer:     os.Getenv("JWT_ISSUER"),
+			audience:   audience,
+			accessTTL:  durationFromEnv("ACCESS_TOKEN_TTL", 15*time.Minute),
+			refreshTTL: durationFromEnv("REFRESH_TOKEN_TTL", 30*24*time.Hour),
+		},
+		refresh: refresh,
+		apiKeys: apiKeys,
+		codes:   newCodeStore(),
+		mfa:     newMFAConfig(mfaKey),
+
+		webauthn: newWebAuthnConfig(),
+		siwe:     siwe,
+
+		didDomain: didDomain(),
+		vcSigner:  vcSigner,
+
+		didAuth:  newDIDAuthConfig(),
+		resolver: newDIDResolver(),
+
+		notifier: newNotifier(walDir),
+		resets:   resets,
+		email:    email,
+
+		historyKey: historyKey,
+	}
+	if head.CID != "" {
+		snapshot, err := wal.loadSnapshot(head.CID)
+		if err != nil {
+			log.Warn(fmt.Sprintf("Ignoring state snapshot, reading %s from IPFS: %v", head.CID, err))
+		}
+		im.cache = snapshot
 	}
-	return users, nil
+	im.batch = newWriteBatcher(im,
+		optionalDurationFromEnv("WRITE_BATCH_WINDOW", 5*time.Millisecond),
+		intFromEnv("WRITE_BATCH_SIZE", 64),
+		durationFromEnv("WAL_SYNC_INTERVAL", 5*time.Second),
+	)
+	return im, nil
 }
 
-// saveUsers saves users to IPFS.
-func (im *IdentityManager) saveUsers(users map[string]User) error {
-	// First marshal the data to JSON.
-	data, err := json.Marshal(users)
+// loadState retrieves the state stored at the current CID. Stored blobs never
+// change, so the decoded state is cached and IPFS is only read when the cache
+// does not hold the current CID yet. The cache starts from the snapshot kept
+// next to the WAL, so logins keep working while IPFS is unreachable, even
+// across restarts.
+func (im *IdentityManager) loadState(ctx context.Context) (*database, error) {
+	im.mu.RLock()
+	cid, cache := im.cid, im.cache
+	im.mu.RUnlock()
+
+	// If no CID is set, return an empty database.
+	if cid == "" {
+		return newDatabase(), nil
+	}
+	if cache != nil {
+		return cache.clone(), nil
+	}
+
+	db, _, err := im.fetchRoot(ctx, cid)
 	if err != nil {
-		return fmt.Errorf("failed to marshal users: %w", err)
+		return nil, err
+	}
+	im.mu.Lock()
+	if im.cid == cid {
+		im.cache = db.clone()
 	}
+	im.mu.Unlock()
+	return db, nil
+}
 
-	// Save the JSON data to IPFS.
-	cid, err := im.ipfs.Add(strings.NewReader(string(data)))
+// loadDatabase returns the current state: the stored state with any writes
+// still pending in the WAL applied on top.
+func (im *IdentityManager) loadDatabase(ctx context.Context) (*database, error) {
+	db, err := im.loadState(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to add data to IPFS: %w", err)
+		return nil, err
+	}
+	for _, e := range im.wal.pending() {
+		if err := e.Mutation.apply(db); err != nil {
+			im.log.Warn(fmt.Sprintf("Skipping WAL entry %d: %v", e.Seq, err))
+		}
+	}
+	return db, nil
+}
+
+// cloneUsers returns a shallow copy of users.
+func cloneUsers(users map[string]User) map[string]User {
+	clone := make(map[string]User, len(users))
+	for id, user := range users {
+		clone[id] = user
+	}
+	return clone
+}
+
+// saveState saves db to IPFS as a new ledger entry and checkpoints its CID
+// together with the sequence number of the last WAL entry included in db. A
+// copy of db is kept next to the checkpoint for restarts without IPFS.
+func (im *IdentityManager) saveState(ctx context.Context, db *database, entry ledgerEntry, seq uint64) error {
+	cid, err := im.storeTransition(ctx, db, entry)
+	if err != nil {
+		return err
 	}
 
 	// Lock for writing the new CID.
 	im.mu.Lock()
 	im.cid = cid
+	im.cache = db.clone()
 	im.mu.Unlock()
 
+	if data, err := encodeState(db, im.compress); err != nil {
+		im.log.Error(fmt.Sprintf("Failed to encode snapshot of CID %s: %v", cid, err))
+	} else if err := im.wal.saveSnapshot(cid, data); err != nil {
+		im.log.Error(fmt.Sprintf("Failed to save snapshot of CID %s: %v", cid, err))
+	}
+	if err := im.wal.checkpoint(checkpoint{CID: cid, Seq: seq}); err != nil {
+		im.log.Error(fmt.Sprintf("Failed to checkpoint CID %s: %v", cid, err))
+	}
+	if im.mfs != nil {
+		im.mfs.Publish(cid, db.Users)
+	}
 	return nil
 }
 
-// AddUser creates a new user.
-func (im *IdentityManager) AddUser(username, password string) (string, error) {
-	// Load the current users.
-	users, err := im.loadUsers()
+// Health describes the state of the storage backend.
+type Health struct {
+	IPFSUp             bool       `json:"ipfs_up"`
+	CID                string     `json:"cid"`
+	WALDepth           int        `json:"wal_depth"`
+	WALOldestAgeSecond float64    `json:"wal_oldest_age_seconds"`
+	WALError           string     `json:"wal_error,omitempty"` // Why replay is stuck on the oldest queued write
+	Mode               ModeStatus `json:"mode"`
+
+	Endpoints []EndpointStatus `json:"endpoints,omitempty"`
+}
+
+// Health reports IPFS reachability and the offline write queue.
+func (im *IdentityManager) Health(ctx context.Context) Health {
+	im.mu.RLock()
+	cid := im.cid
+	im.mu.RUnlock()
+
+	depth, age := im.wal.stats()
+	health := Health{
+		IPFSUp:             im.ipfs.IsUp(ctx),
+		CID:                cid,
+		WALDepth:           depth,
+		WALOldestAgeSecond: age.Seconds(),
+		Mode:               im.mode.current(),
+	}
+	if err := im.wal.failure(); err != nil {
+		health.WALError = err.Error()
+	}
+	if cluster, ok := im.backend.(*Cluster); ok {
+		health.Endpoints = cluster.Endpoints()
+	}
+	return health
+}
+
+// CheckMirror compares the MFS mirror with the state at the current root CID
+// and returns every inconsistency found.
+func (im *IdentityManager) CheckMirror(ctx context.Context) (string, []string, error) {
+	if im.mfs == nil {
+		return "", nil, errors.New("MFS mirror is not enabled")
+	}
+	im.mu.RLock()
+	cid := im.cid
+	im.mu.RUnlock()
+
+	db, err := im.loadState(ctx)
 	if err != nil {
-		return "", err
+		return cid, nil, err
+	}
+	problems, err := im.mfs.Check(ctx, cid, db.Users)
+	return cid, problems, err
+}
+
+// Network reports the swarm peers and bandwidth of the connected IPFS nodes.
+func (im *IdentityManager) Network(ctx context.Context) ([]EndpointNetwork, error) {
+	cluster, ok := im.backend.(*Cluster)
+	if !ok {
+		return nil, errors.New("network status is only available for external IPFS nodes")
 	}
+	return cluster.Network(ctx), nil
+}
 
-	// Check if the username already exists.
-	for _, user := range users {
-		if user.Username == username {
-			return "", errors.New("username already exists")
+// AddUser creates a new user with a DID and, unless email is empty, an
+// unverified email address. It returns the user's ID and the private key of
+// the DID, which is not stored and must be handed to the user.
+func (im *IdentityManager) AddUser(ctx context.Context, username, password, email string) (string, ed25519.PrivateKey, error) {
+	if err := im.mode.checkWrite(); err != nil {
+		return "", nil, err
+	}
+	if email != "" {
+		var err error
+		if email, err = normalizeEmail(email); err != nil {
+			return "", nil, err
 		}
 	}
 
 	// Generate a hashed password.
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	if err != nil {
-		return "", fmt.Errorf("failed to hash password: %w", err)
+		return "", nil, fmt.Errorf("failed to hash password: %w", err)
 	}
 
-	// Create a new user.
+	// Generate the DID key. Its document is published with the new user.
 	id := uuid.New().String()
-	newUser := User{
-		ID:        id,
-		Username:  username,
-		Password:  string(hashedPassword),
-		CreatedAt: time.Now(),
-		UpdatedAt: time.Now(),
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to generate DID key: %w", err)
 	}
 
-	// Update the users map.
-	users[id] = newUser
-	if err := im.saveUsers(users); err != nil {
-		return "", err
+	// Create a new user. The batcher rejects the write if the username or
+	// email address is taken.
+	err = im.batch.submit(ctx, mutation{
+		Op:       opAddUser,
+		ID:       id,
+		Username: username,
+		Password: string(hashedPassword),
+		Email:    email,
+		DID:      nextDID(im.didDomain, id, nil, pub),
+		At:       time.Now(),
+	})
+	if err != nil {
+		return "", nil, err
 	}
 
 	im.log.Info("User added successfully with ID: %s", id)
-	return id, nil
+	return id, priv, nil
 }
 
-// EditUser updates an existing user.
-func (im *IdentityManager) EditUser(id, newUsername, newPassword string) error {
-	users, err := im.loadUsers()
-	if err != nil {
+// EditUser updates an existing user. Changing the password ends every
+// session of the user, as a reset does.
+func (im *IdentityManager) EditUser(ctx context.Context, id, newUsername, newPassword string) error {
+	if err := im.mode.checkWrite(); err != nil {
 		return err
 	}
 
-	user, exists := users[id]
-	if !exists {
-		return errors.New("user not found")
-	}
-
-	if newUsername != "" {
-		user.Username = newUsername
+	m := mutation{
+		Op:       opEditUser,
+		ID:       id,
+		Username: newUsername,
+		At:       time.Now(),
 	}
 
 	if newPassword != "" {
@@ -177,33 +571,29 @@ func (im *IdentityManager) EditUser(id, newUsername, newPassword string) error {
 		if err != nil {
 			return fmt.Errorf("failed to hash new password: %w", err)
 		}
-		user.Password = string(hashedPassword)
+		m.Password = string(hashedPassword)
 	}
 
-	user.UpdatedAt = time.Now()
-	users[id] = user
-
-	if err := im.saveUsers(users); err != nil {
+	if err := im.batch.submit(ctx, m); err != nil {
 		return err
 	}
+	if m.Password != "" {
+		if err := im.refresh.revokeUser(id); err != nil {
+			return err
+		}
+	}
 
 	im.log.Info("User with ID %s updated successfully", id)
 	return nil
 }
 
 // DeleteUser removes a user.
-func (im *IdentityManager) DeleteUser(id string) error {
-	users, err := im.loadUsers()
-	if err != nil {
+func (im *IdentityManager) DeleteUser(ctx context.Context, id string) error {
+	if err := im.mode.checkWrite(); err != nil {
 		return err
 	}
 
-	if _, exists := users[id]; !exists {
-		return errors.New("user not found")
-	}
-
-	delete(users, id)
-	if err := im.saveUsers(users); err != nil {
+	if err := im.batch.submit(ctx, mutation{Op: opDeleteUser, ID: id, At: time.Now()}); err != nil {
 		return err
 	}
 
@@ -212,21 +602,30 @@ func (im *IdentityManager) DeleteUser(id string) error {
 }
 
 // Login authenticates a user.
-func (im *IdentityManager) Login(username, password string) (string, error) {
-	users, err := im.loadUsers()
+func (im *IdentityManager) Login(ctx context.Context, username, password string) (string, error) {
+	if err := im.mode.checkRead(); err != nil {
+		return "", err
+	}
+
+	db, err := im.loadDatabase(ctx)
 	if err != nil {
 		return "", err
 	}
 
-	for id, user := range users {
-		if user.Username == username {
-			if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)); err == nil {
-				im.log.Info("User %s authenticated successfully", username)
-				return id, nil
-			}
-			return "", errors.New("invalid password")
-		}
+	// username may also be a verified email address.
+	user, found := findLogin(db, username)
+	if !found {
+		return "", errors.New("user not found")
+	}
+	if user.Status != StatusActive {
+		return "", errors.New("account is not active")
 	}
-	return "", errors.New("user not found")
+	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)); err != nil {
+		return "", errors.New("invalid password")
+	}
+	if im.email.blocked(user, time.Now()) {
+		return "", ErrEmailUnverified
+	}
+	im.log.Info("User %s authenticated successfully", username)
+	return user.ID, nil
 }
-
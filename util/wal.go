@@ -0,0 +1,353 @@
+package util
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// walEntry is one durably logged mutation that has not yet reached IPFS.
+type walEntry struct {
+	Seq      uint64    `json:"seq"`
+	LoggedAt time.Time `json:"logged_at"`
+	Mutation mutation  `json:"mutation"`
+}
+
+// checkpoint records the latest root CID on IPFS and the sequence number of
+// the last WAL entry it includes.
+type checkpoint struct {
+	CID string `json:"cid"`
+	Seq uint64 `json:"seq"`
+}
+
+// writeAheadLog is an append-only local log of mutations that could not be
+// uploaded to IPFS. Entries are replayed in order once the node is reachable.
+type writeAheadLog struct {
+	mu      sync.Mutex
+	dir     string
+	file    *os.File
+	entries []walEntry // Pending entries, oldest first
+	seq     uint64     // Last assigned sequence number
+	failed  error      // Why the oldest pending entry could not be replayed, if it could not
+}
+
+// openWAL opens (or creates) the log in dir and returns it together with the
+// last recorded checkpoint. Entries already covered by the checkpoint are
+// dropped, and a torn final line from a crash mid-append is cut off so that
+// later appends start on a line of their own. A damaged line anywhere else
+// is an error rather than a reason to drop the entries after it.
+func openWAL(dir string) (*writeAheadLog, checkpoint, error) {
+	var head checkpoint
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, head, fmt.Errorf("failed to create WAL directory: %w", err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "HEAD"))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, head, fmt.Errorf("failed to read checkpoint: %w", err)
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &head); err != nil {
+			return nil, head, fmt.Errorf("failed to parse checkpoint: %w", err)
+		}
+	}
+
+	file, err := os.OpenFile(filepath.Join(dir, "wal.log"), os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, head, fmt.Errorf("failed to open WAL: %w", err)
+	}
+
+	data, err = io.ReadAll(file)
+	if err != nil {
+		file.Close()
+		return nil, head, fmt.Errorf("failed to read WAL: %w", err)
+	}
+	w := &writeAheadLog{dir: dir, file: file, seq: head.Seq}
+	valid := 0
+	for line := 1; valid < len(data); line++ {
+		end := bytes.IndexByte(data[valid:], '\n')
+		if end < 0 {
+			break // Torn: the crash came before the newline
+		}
+		var e walEntry
+		if err := json.Unmarshal(data[valid:valid+end], &e); err != nil {
+			if valid+end+1 == len(data) {
+				break
+			}
+			file.Close()
+			return nil, head, fmt.Errorf("WAL line %d is damaged: %w", line, err)
+		}
+		if e.Seq > w.seq {
+			w.seq = e.Seq
+		}
+		if e.Seq > head.Seq {
+			w.entries = append(w.entries, e)
+		}
+		valid += end + 1
+	}
+	if valid < len(data) {
+		if err := w.truncate(int64(valid)); err != nil {
+			file.Close()
+			return nil, head, fmt.Errorf("failed to cut torn WAL entry: %w", err)
+		}
+	}
+	return w, head, nil
+}
+
+// truncate cuts the log file to size bytes and syncs it.
+func (w *writeAheadLog) truncate(size int64) error {
+	if err := w.file.Truncate(size); err != nil {
+		return err
+	}
+	return w.file.Sync()
+}
+
+// append durably logs ms and returns once they are synced to disk.
+func (w *writeAheadLog) append(ms []mutation) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	var buf []byte
+	entries := make([]walEntry, 0, len(ms))
+	seq := w.seq
+	for _, m := range ms {
+		seq++
+		e := walEntry{Seq: seq, LoggedAt: time.Now(), Mutation: m}
+		line, err := json.Marshal(e)
+		if err != nil {
+			return fmt.Errorf("failed to marshal WAL entry: %w", err)
+		}
+		buf = append(append(buf, line...), '\n')
+		entries = append(entries, e)
+	}
+
+	info, err := w.file.Stat()
+	if err != nil {
+		return err
+	}
+	// On failure, cut off whatever part of buf was written, so that the next
+	// append does not continue a torn line.
+	if _, err := w.file.Write(buf); err != nil {
+		w.truncate(info.Size())
+		return err
+	}
+	if err := w.file.Sync(); err != nil {
+		w.truncate(info.Size())
+		return err
+	}
+	w.seq = seq
+	w.entries = append(w.entries, entries...)
+	return nil
+}
+
+// pending returns a copy of the entries not yet uploaded to IPFS.
+func (w *writeAheadLog) pending() []walEntry {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]walEntry(nil), w.entries...)
+}
+
+// stats reports the queue depth and the age of the oldest pending entry.
+func (w *writeAheadLog) stats() (int, time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.entries) == 0 {
+		return 0, 0
+	}
+	return len(w.entries), time.Since(w.entries[0].LoggedAt)
+}
+
+// lastSeq returns the sequence number of the newest entry ever logged.
+func (w *writeAheadLog) lastSeq() uint64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.seq
+}
+
+// setFailed records why replaying the oldest pending entry failed, or clears
+// it when err is nil.
+func (w *writeAheadLog) setFailed(err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.failed = err
+}
+
+// failure returns the error recorded by setFailed.
+func (w *writeAheadLog) failure() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.failed
+}
+
+// probe reports whether the log directory still accepts synced writes, such
+// as when the disk is full or read-only it does not.
+func (w *writeAheadLog) probe() error {
+	f, err := os.CreateTemp(w.dir, "probe.tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if _, err := f.Write([]byte("ok\n")); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// checkpoint persists head and drops every entry it covers from the log.
+func (w *writeAheadLog) checkpoint(head checkpoint) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	data, err := json.Marshal(head)
+	if err != nil {
+		return fmt.Errorf("failed to marshal checkpoint: %w", err)
+	}
+	if err := writeFileAtomic(filepath.Join(w.dir, "HEAD"), data); err != nil {
+		return fmt.Errorf("failed to write checkpoint: %w", err)
+	}
+
+	remaining := w.entries[:0]
+	for _, e := range w.entries {
+		if e.Seq > head.Seq {
+			remaining = append(remaining, e)
+		}
+	}
+	if len(remaining) == len(w.entries) {
+		return nil
+	}
+	w.entries = remaining
+
+	// Rewrite the log with only the entries still pending.
+	var buf []byte
+	for _, e := range w.entries {
+		line, err := json.Marshal(e)
+		if err != nil {
+			return fmt.Errorf("failed to marshal WAL entry: %w", err)
+		}
+		buf = append(append(buf, line...), '\n')
+	}
+	path := filepath.Join(w.dir, "wal.log")
+	if err := writeFileAtomic(path, buf); err != nil {
+		return fmt.Errorf("failed to compact WAL: %w", err)
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to reopen WAL: %w", err)
+	}
+	w.file.Close()
+	w.file = file
+	return nil
+}
+
+// saveSnapshot stores data, the encoded state at cid, next to HEAD, so that
+// the state can be read after a restart while IPFS is unreachable.
+func (w *writeAheadLog) saveSnapshot(cid string, data []byte) error {
+	buf := make([]byte, 0, len(cid)+1+len(data))
+	buf = append(append(append(buf, cid...), '\n'), data...)
+	return writeFileAtomic(filepath.Join(w.dir, "STATE"), buf)
+}
+
+// loadSnapshot returns the state saved by saveSnapshot if it is the state at
+// cid, and nil if there is none or it belongs to another CID.
+func (w *writeAheadLog) loadSnapshot(cid string) (*database, error) {
+	data, err := os.ReadFile(filepath.Join(w.dir, "STATE"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	saved, state, ok := bytes.Cut(data, []byte("\n"))
+	if !ok || string(saved) != cid {
+		return nil, nil
+	}
+	db, _, err := decodeState(state)
+	return db, err
+}
+
+// writeFileAtomic replaces path with data so that readers see either the old
+// or the new contents, never a partial write.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// commit stores db, the state after applying ms. While IPFS is unreachable,
+// or while earlier writes are still queued, ms are appended to the WAL instead
+// so that they reach IPFS in order.
+func (im *IdentityManager) commit(ctx context.Context, ms []mutation, db *database) error {
+	if depth, _ := im.wal.stats(); depth == 0 {
+		err := im.saveState(ctx, db, ledgerEntry{Kind: transitionWrite, Mutations: ms}, im.wal.lastSeq())
+		if err == nil {
+			return nil
+		}
+		im.log.Warn(fmt.Sprintf("IPFS write failed, queueing in WAL: %v", err))
+	}
+
+	if err := im.wal.append(ms); err != nil {
+		return fmt.Errorf("failed to append to write-ahead log: %w", err)
+	}
+	return nil
+}
+
+// syncWAL replays pending WAL entries onto the last stored state and uploads
+// the result once IPFS is reachable again. Replay stops at an entry that no
+// longer applies: it was acknowledged, so it stays queued, with the entries
+// after it, and the failure is reported by Health until it is resolved.
+func (im *IdentityManager) syncWAL(ctx context.Context) {
+	entries := im.wal.pending()
+	if len(entries) == 0 || !im.ipfs.IsUp(ctx) {
+		return
+	}
+
+	db, err := im.loadState(ctx)
+	if err != nil {
+		im.log.Warn(fmt.Sprintf("WAL replay deferred: %v", err))
+		return
+	}
+	entry := ledgerEntry{Kind: transitionWrite}
+	var failed error
+	for _, e := range entries {
+		if err := e.Mutation.apply(db); err != nil {
+			failed = fmt.Errorf("WAL entry %d no longer applies: %w", e.Seq, err)
+			im.log.Error(fmt.Sprintf("WAL replay stopped: %v", failed))
+			break
+		}
+		entry.Mutations = append(entry.Mutations, e.Mutation)
+	}
+	im.wal.setFailed(failed)
+	replayed := len(entry.Mutations)
+	if replayed == 0 {
+		return
+	}
+
+	if err := im.saveState(ctx, db, entry, entries[replayed-1].Seq); err != nil {
+		im.log.Warn(fmt.Sprintf("WAL replay failed: %v", err))
+		return
+	}
+	im.log.Info(fmt.Sprintf("Replayed %d WAL entries to IPFS", replayed))
+}
@@ -0,0 +1,218 @@
+package util
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// appendTestEntries logs one user registration per name.
+func appendTestEntries(t *testing.T, w *writeAheadLog, names ...string) {
+	t.Helper()
+	var ms []mutation
+	for _, name := range names {
+		ms = append(ms, mutation{Op: opAddUser, ID: name, Username: name})
+	}
+	if err := w.append(ms); err != nil {
+		t.Fatalf("append: %v", err)
+	}
+}
+
+// pendingNames returns the usernames of the pending entries, checking that
+// their sequence numbers follow each other.
+func pendingNames(t *testing.T, w *writeAheadLog) []string {
+	t.Helper()
+	var names []string
+	entries := w.pending()
+	for i, e := range entries {
+		if i > 0 && e.Seq != entries[i-1].Seq+1 {
+			t.Errorf("entry %d has seq %d after %d", i, e.Seq, entries[i-1].Seq)
+		}
+		names = append(names, e.Mutation.Username)
+	}
+	return names
+}
+
+func reopenWAL(t *testing.T, dir string) (*writeAheadLog, checkpoint) {
+	t.Helper()
+	w, head, err := openWAL(dir)
+	if err != nil {
+		t.Fatalf("openWAL: %v", err)
+	}
+	t.Cleanup(func() { w.file.Close() })
+	return w, head
+}
+
+func TestWALTornTail(t *testing.T) {
+	dir := t.TempDir()
+	w, _ := reopenWAL(t, dir)
+	appendTestEntries(t, w, "alice", "bob")
+
+	// A crash in the middle of an append leaves part of a line.
+	path := filepath.Join(dir, "wal.log")
+	whole, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.file.Write([]byte(`{"seq":3,"mutation":{"op":"add_`)); err != nil {
+		t.Fatal(err)
+	}
+
+	w, _ = reopenWAL(t, dir)
+	if got := pendingNames(t, w); len(got) != 2 || w.lastSeq() != 2 {
+		t.Fatalf("after a torn append: pending %v, last seq %d", got, w.lastSeq())
+	}
+	if data, _ := os.ReadFile(path); !bytes.Equal(data, whole) {
+		t.Errorf("torn line was not cut off:\n%s", data)
+	}
+
+	// The next entry starts on its own line and survives another restart.
+	appendTestEntries(t, w, "carol")
+	w, _ = reopenWAL(t, dir)
+	if got := pendingNames(t, w); len(got) != 3 || got[2] != "carol" || w.lastSeq() != 3 {
+		t.Errorf("after appending again: pending %v, last seq %d", got, w.lastSeq())
+	}
+
+	// Damage before the last line is not a torn append, and dropping the
+	// entries after it would lose acknowledged writes.
+	data, _ := os.ReadFile(path)
+	data[5] = '#'
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := openWAL(dir); err == nil {
+		t.Error("openWAL accepted a damaged entry in the middle of the log")
+	}
+}
+
+func TestWALCheckpointCompaction(t *testing.T) {
+	dir := t.TempDir()
+	w, _ := reopenWAL(t, dir)
+	appendTestEntries(t, w, "alice", "bob", "carol")
+
+	if err := w.checkpoint(checkpoint{CID: "root-2", Seq: 2}); err != nil {
+		t.Fatalf("checkpoint: %v", err)
+	}
+	if got := pendingNames(t, w); len(got) != 1 || got[0] != "carol" {
+		t.Errorf("pending after checkpoint = %v, want [carol]", got)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "wal.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := bytes.Count(data, []byte("\n")); lines != 1 {
+		t.Errorf("compacted log has %d lines, want 1", lines)
+	}
+
+	// Appends after compaction go to the new file.
+	appendTestEntries(t, w, "dave")
+	w, head := reopenWAL(t, dir)
+	if head != (checkpoint{CID: "root-2", Seq: 2}) {
+		t.Errorf("HEAD = %+v", head)
+	}
+	if got := pendingNames(t, w); len(got) != 2 || got[0] != "carol" || got[1] != "dave" {
+		t.Errorf("pending after restart = %v, want [carol dave]", got)
+	}
+
+	// Once everything is checkpointed the log is empty, and numbering
+	// continues from HEAD.
+	if err := w.checkpoint(checkpoint{CID: "root-4", Seq: 4}); err != nil {
+		t.Fatalf("checkpoint: %v", err)
+	}
+	w, _ = reopenWAL(t, dir)
+	if depth, _ := w.stats(); depth != 0 || w.lastSeq() != 4 {
+		t.Errorf("after full checkpoint: depth %d, last seq %d", depth, w.lastSeq())
+	}
+	appendTestEntries(t, w, "erin")
+	if e := w.pending(); len(e) != 1 || e[0].Seq != 5 {
+		t.Errorf("next entry = %+v, want seq 5", e)
+	}
+}
+
+func TestWALReplayAfterRestart(t *testing.T) {
+	t.Setenv("WAL_SYNC_INTERVAL", "1h") // Replay only when the test asks
+	ctx := context.Background()
+	store := &flakyStore{Store: newTestNode(t)}
+	dir := t.TempDir()
+	im := openTestManager(t, store, dir)
+
+	if _, _, err := im.AddUser(ctx, "alice", "alice-password", ""); err != nil {
+		t.Fatalf("AddUser alice: %v", err)
+	}
+	store.down.Store(true)
+	if _, _, err := im.AddUser(ctx, "bob", "bob-password", ""); err != nil {
+		t.Fatalf("AddUser bob while IPFS is down: %v", err)
+	}
+	if depth, _ := im.wal.stats(); depth != 1 {
+		t.Fatalf("WAL depth = %d, want 1", depth)
+	}
+
+	// After a restart with IPFS still down, the stored state comes from
+	// the snapshot and the queued write from the WAL.
+	im = openTestManager(t, store, dir)
+	for _, name := range []string{"alice", "bob"} {
+		if _, err := im.Login(ctx, name, name+"-password"); err != nil {
+			t.Errorf("Login %s after restart without IPFS: %v", name, err)
+		}
+	}
+	if _, _, err := im.AddUser(ctx, "carol", "carol-password", ""); err != nil {
+		t.Fatalf("AddUser carol after restart: %v", err)
+	}
+
+	store.down.Store(false)
+	im.syncWAL(ctx)
+	health := im.Health(ctx)
+	if health.WALDepth != 0 || health.WALError != "" {
+		t.Fatalf("after replay: depth %d, error %q", health.WALDepth, health.WALError)
+	}
+
+	// The replayed state is on IPFS, not only in the snapshot.
+	os.Remove(filepath.Join(dir, "STATE"))
+	im = openTestManager(t, store, dir)
+	if im.Health(ctx).CID != health.CID {
+		t.Errorf("CID after restart = %s, want %s", im.Health(ctx).CID, health.CID)
+	}
+	for _, name := range []string{"alice", "bob", "carol"} {
+		if _, err := im.Login(ctx, name, name+"-password"); err != nil {
+			t.Errorf("Login %s after replay: %v", name, err)
+		}
+	}
+}
+
+func TestWALReplayKeepsFailedEntries(t *testing.T) {
+	t.Setenv("WAL_SYNC_INTERVAL", "1h")
+	ctx := context.Background()
+	im := newTestManager(t, newTestNode(t))
+
+	// Queue a write that cannot apply between two that can, as if the WAL
+	// had been written against another state.
+	appendTestEntries(t, im.wal, "alice")
+	if err := im.wal.append([]mutation{{Op: opEditUser, ID: "ghost", Username: "ghost"}}); err != nil {
+		t.Fatal(err)
+	}
+	appendTestEntries(t, im.wal, "bob")
+
+	im.syncWAL(ctx)
+	health := im.Health(ctx)
+	if health.WALDepth != 2 || health.WALError == "" {
+		t.Fatalf("after replay: depth %d, error %q; want the failed entry and the one after it kept and reported", health.WALDepth, health.WALError)
+	}
+	if e := im.wal.pending(); e[0].Seq != 2 || e[1].Mutation.Username != "bob" {
+		t.Errorf("pending = %+v", e)
+	}
+	db, err := im.loadState(ctx)
+	if err != nil {
+		t.Fatalf("loadState: %v", err)
+	}
+	if _, ok := db.Users["alice"]; !ok || len(db.Users) != 1 {
+		t.Errorf("stored users = %v, want only the entry before the failure", db.Users)
+	}
+
+	// Retrying keeps the entries and the report.
+	im.syncWAL(ctx)
+	if health := im.Health(ctx); health.WALDepth != 2 || health.WALError == "" {
+		t.Errorf("after retry: depth %d, error %q", health.WALDepth, health.WALError)
+	}
+}
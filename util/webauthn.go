@@ -0,0 +1,733 @@
+package util
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"sync"
+	"time"
+)
+
+// COSE algorithm identifiers supported for credentials.
+const (
+	coseES256 = -7
+	coseEdDSA = -8
+	coseRS256 = -257
+)
+
+// Authenticator data flags.
+const (
+	flagUserPresent    = 0x01
+	flagUserVerified   = 0x04
+	flagBackupEligible = 0x08
+	flagBackupState    = 0x10
+	flagAttestedData   = 0x40
+)
+
+// AMRHardwareKey is the amr value of sessions started with a WebAuthn
+// credential.
+const AMRHardwareKey = "hwk"
+
+// WebAuthnCredential is a public key credential registered by a user. A user
+// can have several, one per authenticator.
+type WebAuthnCredential struct {
+	ID             string    `json:"id"`         // Credential ID, base64url
+	PublicKey      []byte    `json:"public_key"` // COSE_Key
+	Algorithm      int       `json:"alg"`
+	SignCount      uint32    `json:"sign_count"`
+	AAGUID         string    `json:"aaguid,omitempty"`
+	Attestation    string    `json:"attestation"` // Attestation statement format
+	Transports     []string  `json:"transports,omitempty"`
+	BackupEligible bool      `json:"backup_eligible,omitempty"` // A synced passkey
+	Name           string    `json:"name,omitempty"`
+	CreatedAt      time.Time `json:"created_at"`
+	LastUsedAt     time.Time `json:"last_used_at"`
+}
+
+func (c WebAuthnCredential) canonical() WebAuthnCredential {
+	c.CreatedAt = c.CreatedAt.UTC()
+	c.LastUsedAt = c.LastUsedAt.UTC()
+	return c
+}
+
+// RelyingParty identifies this service to authenticators.
+type RelyingParty struct {
+	ID      string   `json:"id"` // Registrable domain credentials are scoped to
+	Name    string   `json:"name"`
+	Origins []string `json:"-"` // Origins the browser may report
+}
+
+// webauthnConfig holds the WebAuthn settings and pending ceremonies.
+type webauthnConfig struct {
+	rpID             string
+	rpName           string
+	origins          []string
+	attestation      string // none, indirect or direct
+	userVerification string // required, preferred or discouraged
+	timeout          time.Duration
+
+	mu         sync.Mutex
+	ceremonies map[string]ceremony // Keyed by challenge
+}
+
+// ceremony is a registration or login waiting for the authenticator's
+// response.
+type ceremony struct {
+	login   bool
+	userID  string // Empty for logins without a username
+	rp      RelyingParty
+	expires time.Time
+}
+
+func newWebAuthnConfig() *webauthnConfig {
+	c := &webauthnConfig{
+		rpID:             os.Getenv("WEBAUTHN_RP_ID"),
+		rpName:           os.Getenv("WEBAUTHN_RP_NAME"),
+		origins:          splitList(os.Getenv("WEBAUTHN_ORIGINS")),
+		attestation:      os.Getenv("WEBAUTHN_ATTESTATION"),
+		userVerification: os.Getenv("WEBAUTHN_USER_VERIFICATION"),
+		timeout:          durationFromEnv("WEBAUTHN_TIMEOUT", 5*time.Minute),
+		ceremonies:       make(map[string]ceremony),
+	}
+	if c.rpName == "" {
+		c.rpName = "ipfs-identity"
+	}
+	if c.attestation == "" {
+		c.attestation = "none"
+	}
+	if c.userVerification == "" {
+		c.userVerification = "preferred"
+	}
+	return c
+}
+
+// RelyingParty returns the configured relying party. Passkeys are bound to
+// its ID, so it is never taken from the request's Host header, which the
+// client controls: without WEBAUTHN_RP_ID and WEBAUTHN_ORIGINS, WebAuthn is
+// refused.
+func (im *IdentityManager) RelyingParty() (RelyingParty, error) {
+	if im.webauthn.rpID == "" || len(im.webauthn.origins) == 0 {
+		return RelyingParty{}, errors.New("WebAuthn needs WEBAUTHN_RP_ID and WEBAUTHN_ORIGINS to be set")
+	}
+	return RelyingParty{ID: im.webauthn.rpID, Name: im.webauthn.rpName, Origins: im.webauthn.origins}, nil
+}
+
+// newCeremony stores c under a new random challenge and returns the challenge.
+func (w *webauthnConfig) newCeremony(c ceremony) (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", fmt.Errorf("failed to generate challenge: %w", err)
+	}
+	challenge := base64.RawURLEncoding.EncodeToString(raw)
+	c.expires = time.Now().Add(w.timeout)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	now := time.Now()
+	for key, existing := range w.ceremonies {
+		if now.After(existing.expires) {
+			delete(w.ceremonies, key)
+		}
+	}
+	w.ceremonies[challenge] = c
+	return challenge, nil
+}
+
+// takeCeremony removes and returns the ceremony for challenge. A challenge
+// can be answered once.
+func (w *webauthnConfig) takeCeremony(challenge string, login bool) (ceremony, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	c, ok := w.ceremonies[challenge]
+	delete(w.ceremonies, challenge)
+	if !ok || c.login != login || time.Now().After(c.expires) {
+		return ceremony{}, errors.New("unknown or expired challenge")
+	}
+	return c, nil
+}
+
+// CredentialParameter is an entry of pubKeyCredParams.
+type CredentialParameter struct {
+	Type string `json:"type"`
+	Alg  int    `json:"alg"`
+}
+
+// CredentialDescriptor identifies a credential in allow and exclude lists.
+type CredentialDescriptor struct {
+	Type       string   `json:"type"`
+	ID         string   `json:"id"`
+	Transports []string `json:"transports,omitempty"`
+}
+
+// CredentialCreationOptions are the options for navigator.credentials.create,
+// in the JSON form accepted by PublicKeyCredential.parseCreationOptionsFromJSON.
+type CredentialCreationOptions struct {
+	Challenge string       `json:"challenge"`
+	RP        RelyingParty `json:"rp"`
+	User      struct {
+		ID          string `json:"id"`
+		Name        string `json:"name"`
+		DisplayName string `json:"displayName"`
+	} `json:"user"`
+	PubKeyCredParams       []CredentialParameter  `json:"pubKeyCredParams"`
+	Timeout                int64                  `json:"timeout"`
+	ExcludeCredentials     []CredentialDescriptor `json:"excludeCredentials"`
+	AuthenticatorSelection map[string]string      `json:"authenticatorSelection"`
+	Attestation            string                 `json:"attestation"`
+}
+
+// CredentialRequestOptions are the options for navigator.credentials.get, in
+// the JSON form accepted by PublicKeyCredential.parseRequestOptionsFromJSON.
+type CredentialRequestOptions struct {
+	Challenge        string                 `json:"challenge"`
+	RPID             string                 `json:"rpId"`
+	Timeout          int64                  `json:"timeout"`
+	AllowCredentials []CredentialDescriptor `json:"allowCredentials"`
+	UserVerification string                 `json:"userVerification"`
+}
+
+// CredentialResponse is a PublicKeyCredential serialized with toJSON(). All
+// binary fields are base64url.
+type CredentialResponse struct {
+	ID       string `json:"id"`
+	RawID    string `json:"rawId"`
+	Type     string `json:"type"`
+	Response struct {
+		ClientDataJSON    string   `json:"clientDataJSON"`
+		AttestationObject string   `json:"attestationObject"` // Registration only
+		Transports        []string `json:"transports"`        // Registration only
+		AuthenticatorData string   `json:"authenticatorData"` // Login only
+		Signature         string   `json:"signature"`         // Login only
+		UserHandle        string   `json:"userHandle"`        // Login only
+	} `json:"response"`
+}
+
+// BeginWebAuthnRegistration returns the options for registering a new
+// credential for the user with ID id.
+func (im *IdentityManager) BeginWebAuthnRegistration(ctx context.Context, id string) (CredentialCreationOptions, error) {
+	if err := im.mode.checkWrite(); err != nil {
+		return CredentialCreationOptions{}, err
+	}
+	rp, err := im.RelyingParty()
+	if err != nil {
+		return CredentialCreationOptions{}, err
+	}
+	db, err := im.loadDatabase(ctx)
+	if err != nil {
+		return CredentialCreationOptions{}, err
+	}
+	user, exists := db.Users[id]
+	if !exists {
+		return CredentialCreationOptions{}, errors.New("user not found")
+	}
+	challenge, err := im.webauthn.newCeremony(ceremony{userID: id, rp: rp})
+	if err != nil {
+		return CredentialCreationOptions{}, err
+	}
+
+	opts := CredentialCreationOptions{
+		Challenge: challenge,
+		RP:        rp,
+		PubKeyCredParams: []CredentialParameter{
+			{Type: "public-key", Alg: coseES256},
+			{Type: "public-key", Alg: coseEdDSA},
+			{Type: "public-key", Alg: coseRS256},
+		},
+		Timeout:            im.webauthn.timeout.Milliseconds(),
+		ExcludeCredentials: descriptors(user.Credentials),
+		AuthenticatorSelection: map[string]string{
+			"residentKey":      "preferred",
+			"userVerification": im.webauthn.userVerification,
+		},
+		Attestation: im.webauthn.attestation,
+	}
+	opts.User.ID = base64.RawURLEncoding.EncodeToString([]byte(user.ID))
+	opts.User.Name = user.Username
+	opts.User.DisplayName = user.Username
+	return opts, nil
+}
+
+func descriptors(creds []WebAuthnCredential) []CredentialDescriptor {
+	list := make([]CredentialDescriptor, 0, len(creds))
+	for _, c := range creds {
+		list = append(list, CredentialDescriptor{Type: "public-key", ID: c.ID, Transports: c.Transports})
+	}
+	return list
+}
+
+// FinishWebAuthnRegistration verifies the authenticator's response to
+// BeginWebAuthnRegistration and stores the new credential under name.
+func (im *IdentityManager) FinishWebAuthnRegistration(ctx context.Context, id, name string, resp CredentialResponse) (WebAuthnCredential, error) {
+	if err := im.mode.checkWrite(); err != nil {
+		return WebAuthnCredential{}, err
+	}
+	clientDataJSON, err := base64.RawURLEncoding.DecodeString(resp.Response.ClientDataJSON)
+	if err != nil {
+		return WebAuthnCredential{}, errors.New("malformed clientDataJSON")
+	}
+	c, err := im.webauthn.checkClientData(clientDataJSON, "webauthn.create")
+	if err != nil {
+		return WebAuthnCredential{}, err
+	}
+	if c.userID != id {
+		return WebAuthnCredential{}, errors.New("challenge was issued for another user")
+	}
+
+	rawAttestation, err := base64.RawURLEncoding.DecodeString(resp.Response.AttestationObject)
+	if err != nil {
+		return WebAuthnCredential{}, errors.New("malformed attestationObject")
+	}
+	item, _, err := cborDecode(rawAttestation)
+	if err != nil {
+		return WebAuthnCredential{}, fmt.Errorf("malformed attestationObject: %w", err)
+	}
+	attestation, _ := item.(map[interface{}]interface{})
+	format, _ := attestation["fmt"].(string)
+	statement, _ := attestation["attStmt"].(map[interface{}]interface{})
+	rawAuthData, _ := attestation["authData"].([]byte)
+	if format == "" || statement == nil || rawAuthData == nil {
+		return WebAuthnCredential{}, errors.New("malformed attestationObject")
+	}
+
+	authData, err := parseAuthenticatorData(rawAuthData)
+	if err != nil {
+		return WebAuthnCredential{}, err
+	}
+	if err := im.webauthn.checkAuthenticatorData(authData, c.rp); err != nil {
+		return WebAuthnCredential{}, err
+	}
+	if authData.flags&flagAttestedData == 0 {
+		return WebAuthnCredential{}, errors.New("authenticator data has no credential")
+	}
+	key, alg, err := parseCOSEKey(authData.publicKey)
+	if err != nil {
+		return WebAuthnCredential{}, err
+	}
+
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	signed := append(append([]byte{}, rawAuthData...), clientDataHash[:]...)
+	if err := verifyAttestation(format, statement, signed, authData, key, alg); err != nil {
+		return WebAuthnCredential{}, err
+	}
+
+	now := time.Now()
+	cred := WebAuthnCredential{
+		ID:             base64.RawURLEncoding.EncodeToString(authData.credentialID),
+		PublicKey:      authData.publicKey,
+		Algorithm:      alg,
+		SignCount:      authData.signCount,
+		AAGUID:         formatAAGUID(authData.aaguid),
+		Attestation:    format,
+		Transports:     resp.Response.Transports,
+		BackupEligible: authData.flags&flagBackupEligible != 0,
+		Name:           name,
+		CreatedAt:      now,
+		LastUsedAt:     now,
+	}
+	err = im.batch.submit(ctx, mutation{Op: opAddCredential, ID: id, Credential: &cred, At: now})
+	if err != nil {
+		return WebAuthnCredential{}, err
+	}
+	im.log.Info(fmt.Sprintf("WebAuthn credential %s (%s attestation) registered for user %s", cred.ID, format, id))
+	return cred, nil
+}
+
+// BeginWebAuthnLogin returns the options for logging in with a credential.
+// With a username, the user's credentials are listed; without one, the
+// authenticator offers its discoverable credentials (passkeys).
+func (im *IdentityManager) BeginWebAuthnLogin(ctx context.Context, username string) (CredentialRequestOptions, error) {
+	if err := im.mode.checkRead(); err != nil {
+		return CredentialRequestOptions{}, err
+	}
+	rp, err := im.RelyingParty()
+	if err != nil {
+		return CredentialRequestOptions{}, err
+	}
+	c := ceremony{login: true, rp: rp}
+	allow := []CredentialDescriptor{}
+	if username != "" {
+		db, err := im.loadDatabase(ctx)
+		if err != nil {
+			return CredentialRequestOptions{}, err
+		}
+		// Unknown users get an empty list rather than an error, so the
+		// endpoint does not reveal which usernames exist.
+		for _, user := range db.Users {
+			if user.Username == username {
+				c.userID = user.ID
+				allow = descriptors(user.Credentials)
+			}
+		}
+	}
+	challenge, err := im.webauthn.newCeremony(c)
+	if err != nil {
+		return CredentialRequestOptions{}, err
+	}
+	return CredentialRequestOptions{
+		Challenge:        challenge,
+		RPID:             rp.ID,
+		Timeout:          im.webauthn.timeout.Milliseconds(),
+		AllowCredentials: allow,
+		UserVerification: im.webauthn.userVerification,
+	}, nil
+}
+
+// FinishWebAuthnLogin verifies an assertion and returns the ID of the user it
+// authenticates and the authentication methods it proves.
+func (im *IdentityManager) FinishWebAuthnLogin(ctx context.Context, resp CredentialResponse) (string, []string, error) {
+	if err := im.mode.checkRead(); err != nil {
+		return "", nil, err
+	}
+	clientDataJSON, err := base64.RawURLEncoding.DecodeString(resp.Response.ClientDataJSON)
+	if err != nil {
+		return "", nil, errors.New("malformed clientDataJSON")
+	}
+	c, err := im.webauthn.checkClientData(clientDataJSON, "webauthn.get")
+	if err != nil {
+		return "", nil, err
+	}
+
+	db, err := im.loadDatabase(ctx)
+	if err != nil {
+		return "", nil, err
+	}
+	user, cred, found := findCredential(db, resp.ID)
+	if !found || user.Status != StatusActive {
+		return "", nil, errors.New("unknown credential")
+	}
+	if c.userID != "" && c.userID != user.ID {
+		return "", nil, errors.New("credential belongs to another user")
+	}
+	if resp.Response.UserHandle != "" {
+		handle, err := base64.RawURLEncoding.DecodeString(resp.Response.UserHandle)
+		if err != nil || string(handle) != user.ID {
+			return "", nil, errors.New("user handle does not match the credential")
+		}
+	}
+
+	rawAuthData, err := base64.RawURLEncoding.DecodeString(resp.Response.AuthenticatorData)
+	if err != nil {
+		return "", nil, errors.New("malformed authenticatorData")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(resp.Response.Signature)
+	if err != nil {
+		return "", nil, errors.New("malformed signature")
+	}
+	authData, err := parseAuthenticatorData(rawAuthData)
+	if err != nil {
+		return "", nil, err
+	}
+	if err := im.webauthn.checkAuthenticatorData(authData, c.rp); err != nil {
+		return "", nil, err
+	}
+	key, _, err := parseCOSEKey(cred.PublicKey)
+	if err != nil {
+		return "", nil, err
+	}
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	if err := verifySignature(key, cred.Algorithm, append(rawAuthData, clientDataHash[:]...), signature); err != nil {
+		return "", nil, err
+	}
+
+	// A counter that does not increase means the credential may have been
+	// cloned. Authenticators that do not count always report zero.
+	if (authData.signCount != 0 || cred.SignCount != 0) && authData.signCount <= cred.SignCount {
+		im.log.Warn(fmt.Sprintf("WebAuthn credential %s of user %s reported sign count %d after %d; possible clone", cred.ID, user.ID, authData.signCount, cred.SignCount))
+		return "", nil, errors.New("signature counter did not increase")
+	}
+	err = im.mode.checkWrite()
+	if err == nil {
+		err = im.batch.submit(ctx, mutation{Op: opUseCredential, ID: user.ID, CredentialID: cred.ID, SignCount: authData.signCount, At: time.Now()})
+	}
+	var modeErr *ModeError
+	if err != nil && !errors.As(err, &modeErr) {
+		return "", nil, err
+	}
+
+	amr := []string{AMRHardwareKey}
+	if authData.flags&flagUserVerified != 0 {
+		// Possession of the key plus a PIN or biometric is two factors.
+		amr = append(amr, AMRMFA)
+	}
+	im.log.Info(fmt.Sprintf("User %s logged in with WebAuthn credential %s", user.ID, cred.ID))
+	return user.ID, amr, nil
+}
+
+func findCredential(db *database, id string) (User, WebAuthnCredential, bool) {
+	for _, user := range db.Users {
+		for _, cred := range user.Credentials {
+			if cred.ID == id {
+				return user, cred, true
+			}
+		}
+	}
+	return User{}, WebAuthnCredential{}, false
+}
+
+// WebAuthnCredentials lists the credentials of the user with ID id.
+func (im *IdentityManager) WebAuthnCredentials(ctx context.Context, id string) ([]WebAuthnCredential, error) {
+	db, err := im.loadDatabase(ctx)
+	if err != nil {
+		return nil, err
+	}
+	user, exists := db.Users[id]
+	if !exists {
+		return nil, errors.New("user not found")
+	}
+	return append([]WebAuthnCredential{}, user.Credentials...), nil
+}
+
+// RemoveWebAuthnCredential deletes one of the user's credentials.
+func (im *IdentityManager) RemoveWebAuthnCredential(ctx context.Context, actor Principal, id, credentialID string) error {
+	if err := im.mode.checkWrite(); err != nil {
+		return err
+	}
+	err := im.batch.submit(ctx, mutation{Op: opRemoveCredential, ID: id, CredentialID: credentialID, Actor: actor.String(), At: time.Now()})
+	if err != nil {
+		return err
+	}
+	im.log.Info(fmt.Sprintf("WebAuthn credential %s of user %s removed by %s", credentialID, id, actor))
+	return nil
+}
+
+// checkClientData verifies the type, challenge and origin of clientDataJSON
+// and returns the ceremony it answers.
+func (w *webauthnConfig) checkClientData(raw []byte, typ string) (ceremony, error) {
+	var clientData struct {
+		Type        string `json:"type"`
+		Challenge   string `json:"challenge"`
+		Origin      string `json:"origin"`
+		CrossOrigin bool   `json:"crossOrigin"`
+	}
+	if err := json.Unmarshal(raw, &clientData); err != nil {
+		return ceremony{}, errors.New("malformed clientDataJSON")
+	}
+	if clientData.Type != typ {
+		return ceremony{}, fmt.Errorf("client data type is %q, want %q", clientData.Type, typ)
+	}
+	c, err := w.takeCeremony(clientData.Challenge, typ == "webauthn.get")
+	if err != nil {
+		return ceremony{}, err
+	}
+	if clientData.CrossOrigin {
+		return ceremony{}, errors.New("cross-origin requests are not allowed")
+	}
+	for _, origin := range c.rp.Origins {
+		if clientData.Origin == origin {
+			return c, nil
+		}
+	}
+	return ceremony{}, fmt.Errorf("origin %q is not allowed", clientData.Origin)
+}
+
+// authenticatorData is the parsed authData of a registration or assertion.
+type authenticatorData struct {
+	rpIDHash  []byte
+	flags     byte
+	signCount uint32
+
+	// Attested credential data, registration only.
+	aaguid       []byte
+	credentialID []byte
+	publicKey    []byte // COSE_Key
+}
+
+func parseAuthenticatorData(data []byte) (authenticatorData, error) {
+	if len(data) < 37 {
+		return authenticatorData{}, errors.New("authenticator data too short")
+	}
+	ad := authenticatorData{
+		rpIDHash:  data[:32],
+		flags:     data[32],
+		signCount: binary.BigEndian.Uint32(data[33:37]),
+	}
+	if ad.flags&flagAttestedData == 0 {
+		return ad, nil
+	}
+	rest := data[37:]
+	if len(rest) < 18 {
+		return authenticatorData{}, errors.New("attested credential data too short")
+	}
+	ad.aaguid = rest[:16]
+	n := int(binary.BigEndian.Uint16(rest[16:18]))
+	rest = rest[18:]
+	if n > 1023 || len(rest) < n {
+		return authenticatorData{}, errors.New("malformed credential ID")
+	}
+	ad.credentialID = rest[:n]
+	_, size, err := cborDecode(rest[n:])
+	if err != nil {
+		return authenticatorData{}, fmt.Errorf("malformed credential public key: %w", err)
+	}
+	ad.publicKey = rest[n : n+size]
+	return ad, nil
+}
+
+// checkAuthenticatorData verifies the RP ID hash and the presence and
+// verification flags.
+func (w *webauthnConfig) checkAuthenticatorData(ad authenticatorData, rp RelyingParty) error {
+	want := sha256.Sum256([]byte(rp.ID))
+	if !bytes.Equal(ad.rpIDHash, want[:]) {
+		return errors.New("credential is scoped to another relying party")
+	}
+	if ad.flags&flagUserPresent == 0 {
+		return errors.New("user was not present")
+	}
+	if w.userVerification == "required" && ad.flags&flagUserVerified == 0 {
+		return errors.New("user was not verified")
+	}
+	if ad.flags&flagBackupState != 0 && ad.flags&flagBackupEligible == 0 {
+		return errors.New("invalid backup flags")
+	}
+	return nil
+}
+
+// parseCOSEKey decodes a COSE_Key into a public key and its algorithm.
+func parseCOSEKey(raw []byte) (crypto.PublicKey, int, error) {
+	item, _, err := cborDecode(raw)
+	if err != nil {
+		return nil, 0, fmt.Errorf("malformed public key: %w", err)
+	}
+	m, _ := item.(map[interface{}]interface{})
+	kty, _ := m[int64(1)].(int64)
+	alg, _ := m[int64(3)].(int64)
+	switch {
+	case kty == 2 && alg == coseES256:
+		crv, _ := m[int64(-1)].(int64)
+		x, _ := m[int64(-2)].([]byte)
+		y, _ := m[int64(-3)].([]byte)
+		if crv != 1 || len(x) != 32 || len(y) != 32 {
+			return nil, 0, errors.New("unsupported EC2 key")
+		}
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return nil, 0, errors.New("EC2 key is not on the curve")
+		}
+		return key, coseES256, nil
+	case kty == 1 && alg == coseEdDSA:
+		crv, _ := m[int64(-1)].(int64)
+		x, _ := m[int64(-2)].([]byte)
+		if crv != 6 || len(x) != ed25519.PublicKeySize {
+			return nil, 0, errors.New("unsupported OKP key")
+		}
+		return ed25519.PublicKey(x), coseEdDSA, nil
+	case kty == 3 && alg == coseRS256:
+		n, _ := m[int64(-1)].([]byte)
+		e, _ := m[int64(-2)].([]byte)
+		if len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			return nil, 0, errors.New("unsupported RSA key")
+		}
+		exponent := 0
+		for _, b := range e {
+			exponent = exponent<<8 | int(b)
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: exponent}, coseRS256, nil
+	}
+	return nil, 0, fmt.Errorf("unsupported key type %d with algorithm %d", kty, alg)
+}
+
+// verifySignature checks a WebAuthn signature made with alg.
+func verifySignature(key crypto.PublicKey, alg int, data, sig []byte) error {
+	digest := sha256.Sum256(data)
+	ok := false
+	switch k := key.(type) {
+	case *ecdsa.PublicKey:
+		ok = alg == coseES256 && ecdsa.VerifyASN1(k, digest[:], sig)
+	case ed25519.PublicKey:
+		ok = alg == coseEdDSA && ed25519.Verify(k, data, sig)
+	case *rsa.PublicKey:
+		ok = alg == coseRS256 && rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], sig) == nil
+	}
+	if !ok {
+		return errors.New("invalid signature")
+	}
+	return nil
+}
+
+// idFIDOGenCeAAGUID is the certificate extension holding an authenticator's
+// AAGUID.
+var idFIDOGenCeAAGUID = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 45724, 1, 1, 4}
+
+// verifyAttestation checks an attestation statement over signed, the
+// authenticator data followed by the client data hash. The "packed" format
+// is verified with its certificate (basic attestation) or the credential key
+// itself (self attestation). Certificates are checked for the structure the
+// format requires but not chained to a vendor root, so attestation proves
+// the statement is well-formed rather than which authenticator made it.
+func verifyAttestation(format string, statement map[interface{}]interface{}, signed []byte, ad authenticatorData, credKey crypto.PublicKey, credAlg int) error {
+	switch format {
+	case "none":
+		if len(statement) != 0 {
+			return errors.New("none attestation must have an empty statement")
+		}
+		return nil
+	case "packed":
+	default:
+		return fmt.Errorf("unsupported attestation format %q", format)
+	}
+
+	alg, _ := statement["alg"].(int64)
+	sig, _ := statement["sig"].([]byte)
+	if sig == nil {
+		return errors.New("packed attestation has no signature")
+	}
+	chain, hasCerts := statement["x5c"].([]interface{})
+	if !hasCerts {
+		if int(alg) != credAlg {
+			return errors.New("self attestation algorithm does not match the credential")
+		}
+		return verifySignature(credKey, credAlg, signed, sig)
+	}
+
+	if len(chain) == 0 {
+		return errors.New("packed attestation has an empty certificate chain")
+	}
+	der, _ := chain[0].([]byte)
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return fmt.Errorf("malformed attestation certificate: %w", err)
+	}
+	if cert.Version != 3 || cert.IsCA || len(cert.Subject.OrganizationalUnit) != 1 ||
+		cert.Subject.OrganizationalUnit[0] != "Authenticator Attestation" ||
+		len(cert.Subject.Country) == 0 || len(cert.Subject.Organization) == 0 || cert.Subject.CommonName == "" {
+		return errors.New("attestation certificate does not meet the packed format requirements")
+	}
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(idFIDOGenCeAAGUID) {
+			continue
+		}
+		var aaguid []byte
+		if _, err := asn1.Unmarshal(ext.Value, &aaguid); err != nil || !bytes.Equal(aaguid, ad.aaguid) {
+			return errors.New("attestation certificate AAGUID does not match")
+		}
+	}
+	now := time.Now()
+	if now.Before(cert.NotBefore) || now.After(cert.NotAfter) {
+		return errors.New("attestation certificate is not valid now")
+	}
+	return verifySignature(cert.PublicKey, int(alg), signed, sig)
+}
+
+func formatAAGUID(b []byte) string {
+	if len(b) != 16 {
+		return ""
+	}
+	h := hex.EncodeToString(b)
+	return h[:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:]
+}
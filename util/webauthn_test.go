@@ -0,0 +1,438 @@
+package util
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+// cborPair is an entry of a cborMap.
+type cborPair struct {
+	key, value interface{}
+}
+
+// cborMap is a CBOR map whose entries are encoded in the order given.
+type cborMap []cborPair
+
+// cborEncode encodes the subset of CBOR authenticators produce.
+func cborEncode(v interface{}) []byte {
+	head := func(major byte, n uint64) []byte {
+		switch {
+		case n < 24:
+			return []byte{major<<5 | byte(n)}
+		case n <= 0xff:
+			return []byte{major<<5 | 24, byte(n)}
+		case n <= 0xffff:
+			return binary.BigEndian.AppendUint16([]byte{major<<5 | 25}, uint16(n))
+		case n <= 0xffffffff:
+			return binary.BigEndian.AppendUint32([]byte{major<<5 | 26}, uint32(n))
+		}
+		return binary.BigEndian.AppendUint64([]byte{major<<5 | 27}, n)
+	}
+	switch v := v.(type) {
+	case int:
+		if v < 0 {
+			return head(1, uint64(-1-v))
+		}
+		return head(0, uint64(v))
+	case []byte:
+		return append(head(2, uint64(len(v))), v...)
+	case string:
+		return append(head(3, uint64(len(v))), v...)
+	case []interface{}:
+		out := head(4, uint64(len(v)))
+		for _, item := range v {
+			out = append(out, cborEncode(item)...)
+		}
+		return out
+	case cborMap:
+		out := head(5, uint64(len(v)))
+		for _, p := range v {
+			out = append(append(out, cborEncode(p.key)...), cborEncode(p.value)...)
+		}
+		return out
+	}
+	panic("cborEncode: unsupported type")
+}
+
+// softAuthenticator is a WebAuthn authenticator in software, holding one
+// credential.
+type softAuthenticator struct {
+	aaguid []byte
+	id     []byte
+	key    crypto.Signer
+	alg    int
+	count  uint32
+	origin string
+	flags  byte // Reported in every response, besides user presence
+
+	// For packed attestation with a certificate.
+	attestationKey  *ecdsa.PrivateKey
+	attestationCert []byte
+}
+
+func newSoftAuthenticator(t *testing.T, alg int) *softAuthenticator {
+	a := &softAuthenticator{aaguid: make([]byte, 16), id: make([]byte, 32), alg: alg, origin: "https://example.com", flags: flagUserVerified}
+	rand.Read(a.aaguid)
+	rand.Read(a.id)
+	var err error
+	switch alg {
+	case coseES256:
+		a.key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case coseEdDSA:
+		_, a.key, err = ed25519.GenerateKey(rand.Reader)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+// coseKey returns the credential public key as a COSE_Key.
+func (a *softAuthenticator) coseKey() []byte {
+	switch pub := a.key.Public().(type) {
+	case *ecdsa.PublicKey:
+		x, y := make([]byte, 32), make([]byte, 32)
+		pub.X.FillBytes(x)
+		pub.Y.FillBytes(y)
+		return cborEncode(cborMap{{1, 2}, {3, coseES256}, {-1, 1}, {-2, x}, {-3, y}})
+	case ed25519.PublicKey:
+		return cborEncode(cborMap{{1, 1}, {3, coseEdDSA}, {-1, 6}, {-2, []byte(pub)}})
+	}
+	return nil
+}
+
+func sign(t *testing.T, key crypto.Signer, data []byte) []byte {
+	t.Helper()
+	var (
+		sig []byte
+		err error
+	)
+	if _, ok := key.(ed25519.PrivateKey); ok {
+		sig, err = key.Sign(rand.Reader, data, crypto.Hash(0))
+	} else {
+		digest := sha256.Sum256(data)
+		sig, err = key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sig
+}
+
+func (a *softAuthenticator) clientData(typ, challenge string) []byte {
+	data, _ := json.Marshal(map[string]interface{}{"type": typ, "challenge": challenge, "origin": a.origin, "crossOrigin": false})
+	return data
+}
+
+// authData returns authenticator data for rpID, with the credential if
+// attested.
+func (a *softAuthenticator) authData(rpID string, attested bool) []byte {
+	hash := sha256.Sum256([]byte(rpID))
+	data := append(hash[:], a.flags|flagUserPresent)
+	if attested {
+		data[32] |= flagAttestedData
+	}
+	data = binary.BigEndian.AppendUint32(data, a.count)
+	if attested {
+		data = append(data, a.aaguid...)
+		data = binary.BigEndian.AppendUint16(data, uint16(len(a.id)))
+		data = append(append(data, a.id...), a.coseKey()...)
+	}
+	return data
+}
+
+// register answers opts with an attestation in format: "none", "packed" with
+// self attestation, or "packed-x5c" with the attestation certificate.
+func (a *softAuthenticator) register(t *testing.T, opts CredentialCreationOptions, format string) CredentialResponse {
+	clientData := a.clientData("webauthn.create", opts.Challenge)
+	authData := a.authData(opts.RP.ID, true)
+	hash := sha256.Sum256(clientData)
+	signed := append(append([]byte{}, authData...), hash[:]...)
+
+	statement := cborMap{}
+	switch format {
+	case "packed":
+		statement = cborMap{{"alg", a.alg}, {"sig", sign(t, a.key, signed)}}
+	case "packed-x5c":
+		format = "packed"
+		statement = cborMap{{"alg", coseES256}, {"sig", sign(t, a.attestationKey, signed)}, {"x5c", []interface{}{a.attestationCert}}}
+	}
+	object := cborEncode(cborMap{{"fmt", format}, {"attStmt", statement}, {"authData", authData}})
+
+	var resp CredentialResponse
+	resp.ID = base64.RawURLEncoding.EncodeToString(a.id)
+	resp.RawID = resp.ID
+	resp.Type = "public-key"
+	resp.Response.ClientDataJSON = base64.RawURLEncoding.EncodeToString(clientData)
+	resp.Response.AttestationObject = base64.RawURLEncoding.EncodeToString(object)
+	resp.Response.Transports = []string{"usb"}
+	return resp
+}
+
+// assert answers opts, counting the signature first.
+func (a *softAuthenticator) assert(t *testing.T, opts CredentialRequestOptions, userID string) CredentialResponse {
+	a.count++
+	clientData := a.clientData("webauthn.get", opts.Challenge)
+	authData := a.authData(opts.RPID, false)
+	hash := sha256.Sum256(clientData)
+
+	var resp CredentialResponse
+	resp.ID = base64.RawURLEncoding.EncodeToString(a.id)
+	resp.RawID = resp.ID
+	resp.Type = "public-key"
+	resp.Response.ClientDataJSON = base64.RawURLEncoding.EncodeToString(clientData)
+	resp.Response.AuthenticatorData = base64.RawURLEncoding.EncodeToString(authData)
+	resp.Response.Signature = base64.RawURLEncoding.EncodeToString(sign(t, a.key, append(authData, hash[:]...)))
+	resp.Response.UserHandle = base64.RawURLEncoding.EncodeToString([]byte(userID))
+	return resp
+}
+
+// issueAttestationCert gives a a certificate for a new attestation key that
+// meets the packed format requirements, stating aaguid.
+func (a *softAuthenticator) issueAttestationCert(t *testing.T, aaguid []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ext, _ := asn1.Marshal(aaguid)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject: pkix.Name{
+			Country:            []string{"SE"},
+			Organization:       []string{"Soft Authenticators"},
+			OrganizationalUnit: []string{"Authenticator Attestation"},
+			CommonName:         "Soft Authenticator",
+		},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		BasicConstraintsValid: true,
+		ExtraExtensions:       []pkix.Extension{{Id: idFIDOGenCeAAGUID, Value: ext}},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.attestationKey, a.attestationCert = key, der
+}
+
+var testRP = RelyingParty{ID: "example.com", Name: "Example", Origins: []string{"https://example.com"}}
+
+// newWebAuthnTestManager returns a test manager configured as testRP.
+func newWebAuthnTestManager(t *testing.T) *IdentityManager {
+	t.Helper()
+	t.Setenv("WEBAUTHN_RP_ID", testRP.ID)
+	t.Setenv("WEBAUTHN_RP_NAME", testRP.Name)
+	t.Setenv("WEBAUTHN_ORIGINS", strings.Join(testRP.Origins, ","))
+	return newTestManager(t, newTestNode(t))
+}
+
+// TestWebAuthnNeedsRelyingParty checks that ceremonies are refused rather
+// than bound to a relying party taken from the request.
+func TestWebAuthnNeedsRelyingParty(t *testing.T) {
+	for _, env := range []map[string]string{
+		{},
+		{"WEBAUTHN_RP_ID": "example.com"},
+		{"WEBAUTHN_ORIGINS": "https://example.com"},
+	} {
+		t.Setenv("WEBAUTHN_RP_ID", env["WEBAUTHN_RP_ID"])
+		t.Setenv("WEBAUTHN_ORIGINS", env["WEBAUTHN_ORIGINS"])
+		im := newTestManager(t, newTestNode(t))
+		ctx := context.Background()
+		id, _, err := im.AddUser(ctx, "alice", "secret", "")
+		if err != nil {
+			t.Fatalf("AddUser: %v", err)
+		}
+		if _, err := im.BeginWebAuthnRegistration(ctx, id); err == nil {
+			t.Errorf("registration allowed with %v", env)
+		}
+		if _, err := im.BeginWebAuthnLogin(ctx, ""); err == nil {
+			t.Errorf("login allowed with %v", env)
+		}
+	}
+}
+
+func TestWebAuthnRegistration(t *testing.T) {
+	im := newWebAuthnTestManager(t)
+	ctx := context.Background()
+	id, _, err := im.AddUser(ctx, "alice", "secret", "")
+	if err != nil {
+		t.Fatalf("AddUser: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		alg    int
+		format string
+		setup  func(t *testing.T, a *softAuthenticator)
+		want   string // Substring of the error; empty for success
+	}{
+		{name: "none", alg: coseES256, format: "none"},
+		{name: "packed self ES256", alg: coseES256, format: "packed"},
+		{name: "packed self EdDSA", alg: coseEdDSA, format: "packed"},
+		{name: "packed certificate", alg: coseEdDSA, format: "packed-x5c", setup: func(t *testing.T, a *softAuthenticator) {
+			a.issueAttestationCert(t, a.aaguid)
+		}},
+		{name: "certificate for another AAGUID", alg: coseES256, format: "packed-x5c", want: "AAGUID does not match", setup: func(t *testing.T, a *softAuthenticator) {
+			a.issueAttestationCert(t, make([]byte, 16))
+		}},
+		{name: "other origin", alg: coseES256, format: "none", want: "origin", setup: func(t *testing.T, a *softAuthenticator) {
+			a.origin = "https://evil.example"
+		}},
+		{name: "backup state without eligibility", alg: coseES256, format: "none", want: "backup flags", setup: func(t *testing.T, a *softAuthenticator) {
+			a.flags |= flagBackupState
+		}},
+	}
+	registered := 0
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newSoftAuthenticator(t, tt.alg)
+			if tt.setup != nil {
+				tt.setup(t, a)
+			}
+			opts, err := im.BeginWebAuthnRegistration(ctx, id)
+			if err != nil {
+				t.Fatalf("BeginWebAuthnRegistration: %v", err)
+			}
+			if len(opts.ExcludeCredentials) != registered {
+				t.Errorf("%d credentials excluded, want %d", len(opts.ExcludeCredentials), registered)
+			}
+			cred, err := im.FinishWebAuthnRegistration(ctx, id, tt.name, a.register(t, opts, tt.format))
+			if tt.want != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.want) {
+					t.Fatalf("FinishWebAuthnRegistration error = %v, want one containing %q", err, tt.want)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("FinishWebAuthnRegistration: %v", err)
+			}
+			registered++
+			if cred.ID != base64.RawURLEncoding.EncodeToString(a.id) || cred.Algorithm != tt.alg || cred.AAGUID != formatAAGUID(a.aaguid) {
+				t.Errorf("stored credential %+v does not match the authenticator", cred)
+			}
+			if !bytes.Equal(cred.PublicKey, a.coseKey()) {
+				t.Error("stored public key differs from the authenticator's")
+			}
+		})
+	}
+
+	// A challenge is answered once.
+	a := newSoftAuthenticator(t, coseES256)
+	opts, err := im.BeginWebAuthnRegistration(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := a.register(t, opts, "none")
+	if _, err := im.FinishWebAuthnRegistration(ctx, id, "first", resp); err != nil {
+		t.Fatalf("FinishWebAuthnRegistration: %v", err)
+	}
+	if _, err := im.FinishWebAuthnRegistration(ctx, id, "again", resp); err == nil {
+		t.Error("a replayed registration was accepted")
+	}
+}
+
+func TestWebAuthnLogin(t *testing.T) {
+	im := newWebAuthnTestManager(t)
+	ctx := context.Background()
+	id, _, err := im.AddUser(ctx, "alice", "secret", "")
+	if err != nil {
+		t.Fatalf("AddUser: %v", err)
+	}
+	a := newSoftAuthenticator(t, coseES256)
+	opts, err := im.BeginWebAuthnRegistration(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := im.FinishWebAuthnRegistration(ctx, id, "key", a.register(t, opts, "packed")); err != nil {
+		t.Fatalf("FinishWebAuthnRegistration: %v", err)
+	}
+
+	login := func(username string) (string, []string, error) {
+		opts, err := im.BeginWebAuthnLogin(ctx, username)
+		if err != nil {
+			t.Fatalf("BeginWebAuthnLogin: %v", err)
+		}
+		return im.FinishWebAuthnLogin(ctx, a.assert(t, opts, id))
+	}
+
+	// With a username and as a passkey without one.
+	for _, username := range []string{"alice", ""} {
+		got, amr, err := login(username)
+		if err != nil {
+			t.Fatalf("login as %q: %v", username, err)
+		}
+		if got != id || strings.Join(amr, " ") != AMRHardwareKey+" "+AMRMFA {
+			t.Errorf("login as %q = %s %v, want %s [hwk mfa]", username, got, amr, id)
+		}
+	}
+	creds, err := im.WebAuthnCredentials(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(creds) != 1 || creds[0].SignCount != a.count {
+		t.Errorf("stored sign count %v, want %d", creds, a.count)
+	}
+
+	// Without user verification the key is a single factor.
+	a.flags = 0
+	if _, amr, err := login("alice"); err != nil || strings.Join(amr, " ") != AMRHardwareKey {
+		t.Errorf("login without user verification = %v, %v, want [hwk]", amr, err)
+	}
+
+	// A clone of the authenticator falls behind the counter.
+	a.count--
+	if _, _, err := login("alice"); err == nil || !strings.Contains(err.Error(), "counter") {
+		t.Errorf("login with a repeated sign count: %v, want a counter error", err)
+	}
+
+	// The credential is scoped to the relying party it was created for.
+	opts2, err := im.BeginWebAuthnLogin(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts2.RPID = "evil.example"
+	a.count += 10
+	if _, _, err := im.FinishWebAuthnLogin(ctx, a.assert(t, opts2, id)); err == nil || !strings.Contains(err.Error(), "another relying party") {
+		t.Errorf("assertion for another RP ID: %v", err)
+	}
+
+	// A signature over other data, and a credential of another user.
+	opts3, err := im.BeginWebAuthnLogin(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := a.assert(t, opts3, id)
+	resp.Response.Signature = a.assert(t, CredentialRequestOptions{Challenge: "other", RPID: testRP.ID}, id).Response.Signature
+	if _, _, err := im.FinishWebAuthnLogin(ctx, resp); err == nil || !strings.Contains(err.Error(), "invalid signature") {
+		t.Errorf("assertion with a signature over other data: %v", err)
+	}
+	if _, _, err := im.AddUser(ctx, "bob", "secret", ""); err != nil {
+		t.Fatal(err)
+	}
+	opts4, err := im.BeginWebAuthnLogin(ctx, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(opts4.AllowCredentials) != 0 {
+		t.Errorf("bob is offered alice's credentials")
+	}
+	if _, _, err := im.FinishWebAuthnLogin(ctx, a.assert(t, opts4, id)); err == nil || !strings.Contains(err.Error(), "another user") {
+		t.Errorf("alice's credential in bob's login: %v", err)
+	}
+}